@@ -0,0 +1,128 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"sync"
+)
+
+// treeVersion is one tree an AtomicTree has served, with the uses of it
+// still in flight.
+type treeVersion struct {
+	tree  *Tree
+	inUse sync.WaitGroup
+}
+
+// AtomicTree serves queries from a tree that can be replaced while queries
+// are running, such as with a rebuilt copy, without stopping to wait for
+// them. Queries that start before a Swap finish on the old tree, which is
+// closed once the last of them does, and queries that start after it use
+// the new one.
+type AtomicTree struct {
+	mu      sync.RWMutex
+	current *treeVersion // nil once closed
+}
+
+var _ Searcher = (*AtomicTree)(nil)
+
+// NewAtomicTree returns an AtomicTree serving t, which it takes ownership
+// of.
+func NewAtomicTree(t *Tree) *AtomicTree {
+	return &AtomicTree{current: &treeVersion{tree: t}}
+}
+
+// acquire returns the current tree version, marking a use of it in flight.
+func (a *AtomicTree) acquire() (*treeVersion, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.current == nil {
+		return nil, errClass.New("atomic tree closed")
+	}
+	a.current.inUse.Add(1)
+	return a.current, nil
+}
+
+// Do calls fn with the current tree, which won't be closed before fn
+// returns, even if it is swapped out meanwhile, and returns fn's error. fn
+// must not keep the tree or anything read from it that aliases its memory,
+// such as Data from a memory-mapped tree, past returning.
+func (a *AtomicTree) Do(fn func(t *Tree) error) error {
+	v, err := a.acquire()
+	if err != nil {
+		return err
+	}
+	defer v.inUse.Done()
+	return fn(v.tree)
+}
+
+// Nearest is Tree.Nearest on the current tree.
+func (a *AtomicTree) Nearest(p Point, n int) (rv []PointDistance, err error) {
+	err = a.Do(func(t *Tree) error {
+		rv, err = t.Nearest(p, n)
+		return err
+	})
+	return rv, err
+}
+
+// Dims returns the dimensions of the current tree, or 0 once closed.
+func (a *AtomicTree) Dims() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.current == nil {
+		return 0
+	}
+	return a.current.tree.Dims()
+}
+
+// Swap makes t, which the AtomicTree takes ownership of, the current tree.
+// It then waits for the queries still using the old tree to finish, closes
+// it and returns any error closing it. t must have the same dimensions as
+// the old tree; if it is refused, it stays the caller's to close.
+func (a *AtomicTree) Swap(t *Tree) error {
+	a.mu.Lock()
+	old := a.current
+	if old == nil {
+		a.mu.Unlock()
+		return errClass.New("atomic tree closed")
+	}
+	if t.Dims() != old.tree.Dims() {
+		a.mu.Unlock()
+		return ErrDimensionMismatch.New(
+			"replacement tree has %d dimensions, expected %d", t.Dims(),
+			old.tree.Dims())
+	}
+	a.current = &treeVersion{tree: t}
+	a.mu.Unlock()
+	return old.retire()
+}
+
+// Close waits for queries in flight to finish and closes the current tree.
+// Later queries fail.
+func (a *AtomicTree) Close() error {
+	a.mu.Lock()
+	old := a.current
+	a.current = nil
+	a.mu.Unlock()
+	if old == nil {
+		return nil
+	}
+	return old.retire()
+}
+
+// retire waits for v to be out of use and closes its tree.
+func (v *treeVersion) retire() error {
+	v.inUse.Wait()
+	return v.tree.Close()
+}
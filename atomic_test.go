@@ -0,0 +1,105 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAtomicTree(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	first := createTestTree(t, fs, 3, 10, points[:100], BuildOptions{})
+	second := createTestTree(t, fs, 3, 10, points[100:], BuildOptions{})
+	a := NewAtomicTree(first)
+
+	nearest, err := a.Nearest(points[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertPointsEqual(nearest[0].Point, points[0])
+
+	// a query in flight on the first tree holds it open across the swap
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	queried := make(chan error)
+	go func() {
+		queried <- a.Do(func(tree *Tree) error {
+			close(started)
+			<-finish
+			_, err := tree.Nearest(points[0], 1)
+			return err
+		})
+	}()
+	<-started
+	swapped := make(chan error)
+	go func() { swapped <- a.Swap(second) }()
+
+	// queries that start after the swap see the second tree
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		nearest, err = a.Nearest(points[150], 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nearest[0].Point.equal(&points[150]) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("swap never took effect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err = <-swapped:
+		t.Fatalf("swap finished with a query in flight: %v", err)
+	default:
+	}
+	close(finish)
+	err = <-queried
+	if err != nil {
+		t.Fatalf("query in flight failed: %v", err)
+	}
+	err = <-swapped
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = first.Nearest(points[0], 1)
+	if err == nil {
+		t.Fatal("expected the old tree to be closed")
+	}
+
+	other := createTestTree(t, fs, 2, 10, newTestPoints(10, 2, 10),
+		BuildOptions{})
+	defer other.Close()
+	if !ErrDimensionMismatch.Contains(a.Swap(other)) {
+		t.Fatal("expected a tree of other dimensions to be refused")
+	}
+
+	err = a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Nearest(points[150], 1)
+	if err == nil {
+		t.Fatal("expected queries to fail once closed")
+	}
+	if a.Swap(first) == nil {
+		t.Fatal("expected swaps to fail once closed")
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// BackendReader is a stored tree file opened for reading.
+type BackendReader interface {
+	io.ReaderAt
+	io.Closer
+	// Size returns the length of the file.
+	Size() int64
+}
+
+// Backend is a store of tree files, such as a directory or an object store
+// bucket. Trees are built locally and then saved to a Backend with SaveTo,
+// and queried straight out of it with OpenTreeBackend, so a Backend needs
+// random reads but no in-place writes.
+type Backend interface {
+	Open(name string) (BackendReader, error)
+	Create(name string) (io.WriteCloser, error)
+	Remove(name string) error
+}
+
+// OpenTreeBackend opens the tree stored as name in b for reading. Every node
+// visited is a ReadAt on b, so for remote stores a node cache (see
+// OpenOptions.CacheBytes) is worthwhile. OpenOptions.Mmap is ignored.
+func OpenTreeBackend(b Backend, name string, opts OpenOptions) (*Tree,
+	error) {
+	r, err := b.Open(name)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	t, err := openReaderAt(r, r.Size(), opts)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	t.closer = r
+	return t, nil
+}
+
+// SaveTo writes a complete copy of the tree to b as name. Pending inserted
+// points aren't included. If the copy fails, the partial copy is removed.
+func (t *Tree) SaveTo(b Backend, name string) error {
+	return t.save(b, name, nil)
+}
+
+// save is SaveTo, but also writes the copy to h, if set.
+func (t *Tree) save(b Backend, name string, h hash.Hash) error {
+	w, err := b.Create(name)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	var dst io.Writer = w
+	if h != nil {
+		dst = io.MultiWriter(w, h)
+	}
+	_, err = t.WriteTo(dst)
+	if cerr := w.Close(); err == nil {
+		err = errClass.Wrap(cerr)
+	}
+	if err != nil {
+		b.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// CopyTo is SaveTo, but then reads the copy back to confirm that it matches
+// the tree byte for byte, by SHA-256, and that it opens as a tree with the
+// same dimensions and max data length. A copy that doesn't is removed and
+// reported with ErrChecksum, or the error opening it. Use DirBackend to
+// copy to a local path.
+func (t *Tree) CopyTo(b Backend, name string) error {
+	h := sha256.New()
+	err := t.save(b, name, h)
+	if err != nil {
+		return err
+	}
+	err = checkCopy(b, name, h.Sum(nil), t.footer.dims, t.footer.maxDataLen)
+	if err != nil {
+		b.Remove(name)
+	}
+	return err
+}
+
+// SumBackend is a Backend that can report the SHA-256 of a stored file
+// without it being read back, as object stores often can. Copies written
+// to one are checked that way rather than by reading them back.
+type SumBackend interface {
+	Backend
+	SHA256(name string) ([]byte, error)
+}
+
+// checkCopy checks the copy of a tree of dims dimensions and maxDataLen
+// max data length saved to b as name, whose SHA-256 should be sum.
+func checkCopy(b Backend, name string, sum []byte, dims,
+	maxDataLen int) error {
+	r, err := b.Open(name)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer r.Close()
+	var got []byte
+	if sb, ok := b.(SumBackend); ok {
+		got, err = sb.SHA256(name)
+	} else {
+		h := sha256.New()
+		_, err = io.Copy(h, io.NewSectionReader(r, 0, r.Size()))
+		got = h.Sum(nil)
+	}
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	if !bytes.Equal(got, sum) {
+		return ErrChecksum.New("copy saved as %s doesn't match the tree", name)
+	}
+	_, err = openReaderAt(r, r.Size(), OpenOptions{Dims: dims,
+		MaxDataLen: maxDataLen})
+	return err
+}
+
+// Mirror is a copy of a tree that a build also writes, to name in Backend.
+// See BuildOptions.Mirrors.
+type Mirror struct {
+	Backend Backend
+	Name    string
+}
+
+// writeMirrors copies the finished tree file at path, of a tree of dims
+// dimensions and maxDataLen max data length, to every mirror in a single
+// read of it, then checks each copy as CopyTo does. If any copy fails, they
+// are all removed.
+func writeMirrors(path string, mirrors []Mirror, dims,
+	maxDataLen int) (err error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer fh.Close()
+
+	var created []Mirror
+	defer func() {
+		if err != nil {
+			for _, m := range created {
+				m.Backend.Remove(m.Name)
+			}
+		}
+	}()
+	// ws holds the writers still to be closed
+	var ws []io.WriteCloser
+	defer func() {
+		for _, w := range ws {
+			if w != nil {
+				w.Close()
+			}
+		}
+	}()
+	h := sha256.New()
+	dsts := []io.Writer{h}
+	for _, m := range mirrors {
+		w, err := m.Backend.Create(m.Name)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+		created = append(created, m)
+		ws = append(ws, w)
+		dsts = append(dsts, w)
+	}
+	_, err = io.Copy(io.MultiWriter(dsts...), fh)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	for i, w := range ws {
+		ws[i] = nil
+		err = w.Close()
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+
+	sum := h.Sum(nil)
+	for _, m := range mirrors {
+		err = checkCopy(m.Backend, m.Name, sum, dims, maxDataLen)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DirBackend returns a Backend that stores tree files in the directory dir.
+func DirBackend(dir string) Backend { return dirBackend(dir) }
+
+type dirBackend string
+
+func (d dirBackend) Open(name string) (BackendReader, error) {
+	fh, err := os.Open(filepath.Join(string(d), name))
+	if err != nil {
+		return nil, err
+	}
+	info, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return &dirFile{File: fh, size: info.Size()}, nil
+}
+
+func (d dirBackend) Create(name string) (io.WriteCloser, error) {
+	return os.Create(filepath.Join(string(d), name))
+}
+
+func (d dirBackend) Remove(name string) error {
+	return os.Remove(filepath.Join(string(d), name))
+}
+
+type dirFile struct {
+	*os.File
+	size int64
+}
+
+func (f *dirFile) Size() int64 { return f.size }
+
+// OpenTreeFS opens the tree stored at path in fsys for reading, e.g. one
+// embedded in the binary with embed.FS. Files that don't support ReadAt, such
+// as compressed zip entries, are read into memory.
+func OpenTreeFS(fsys fs.FS, path string) (*Tree, error) {
+	return OpenTreeBackend(FSBackend(fsys), path, OpenOptions{})
+}
+
+// FSBackend returns a read-only Backend over fsys.
+func FSBackend(fsys fs.FS) Backend { return fsBackend{fsys: fsys} }
+
+type fsBackend struct {
+	fsys fs.FS
+}
+
+func (b fsBackend) Open(name string) (BackendReader, error) {
+	fh, err := b.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if r, ok := fh.(io.ReaderAt); ok {
+		return &fsFile{ReaderAt: r, Closer: fh, size: info.Size()}, nil
+	}
+	data, err := io.ReadAll(fh)
+	fh.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &fsFile{ReaderAt: bytes.NewReader(data), Closer: io.NopCloser(nil),
+		size: int64(len(data))}, nil
+}
+
+func (b fsBackend) Create(name string) (io.WriteCloser, error) {
+	return nil, errClass.New("%s: file system is read-only", name)
+}
+
+func (b fsBackend) Remove(name string) error {
+	return errClass.New("%s: file system is read-only", name)
+}
+
+type fsFile struct {
+	io.ReaderAt
+	io.Closer
+	size int64
+}
+
+func (f *fsFile) Size() int64 { return f.size }
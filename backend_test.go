@@ -0,0 +1,303 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+// memBackend keeps tree files in memory, standing in for an object store.
+type memBackend map[string]*bytes.Buffer
+
+type memWriter struct {
+	bytes.Buffer
+	b    memBackend
+	name string
+}
+
+func (w *memWriter) Close() error {
+	w.b[w.name] = &w.Buffer
+	return nil
+}
+
+type memReader struct{ *bytes.Reader }
+
+func (r memReader) Close() error { return nil }
+
+func (b memBackend) Open(name string) (BackendReader, error) {
+	buf, ok := b[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return memReader{bytes.NewReader(buf.Bytes())}, nil
+}
+
+func (b memBackend) Create(name string) (io.WriteCloser, error) {
+	return &memWriter{b: b, name: name}, nil
+}
+
+func (b memBackend) Remove(name string) error {
+	delete(b, name)
+	return nil
+}
+
+func TestBackend(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	for _, b := range []Backend{memBackend{}, DirBackend(fs.Path())} {
+		err := tree.SaveTo(b, "saved")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := OpenTreeBackend(b, "saved",
+			OpenOptions{CacheBytes: 1 << 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Count() != tree.Count() {
+			t.Fatalf("stored tree has %d points, expected %d",
+				stored.Count(), tree.Count())
+		}
+		for _, p := range points[:50] {
+			nearest, err := stored.Nearest(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			AssertPointsEqual(nearest[0].Point, p)
+		}
+		if stored.Delete(points[0]) == nil {
+			t.Fatal("expected a stored tree to refuse deletes")
+		}
+		err = stored.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Remove("saved")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = OpenTreeBackend(b, "saved", OpenOptions{})
+		if err == nil {
+			t.Fatal("expected an error opening a removed tree")
+		}
+	}
+}
+
+func TestOpenTreeFS(t *testing.T) {
+	tmp := newTestFS(t)
+	defer tmp.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	tree := createTestTree(t, tmp, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+	err := tree.SaveTo(DirBackend(tmp.Path()), "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// compressed zip entries can't be read at arbitrary offsets
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	w, err := zw.Create("trees/tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tree.WriteTo(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()),
+		int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		fsys fs.FS
+		path string
+	}{
+		{os.DirFS(tmp.Path()), "tree"},
+		{zr, "trees/tree"}} {
+		opened, err := OpenTreeFS(c.fsys, c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range points[:50] {
+			nearest, err := opened.Nearest(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			AssertPointsEqual(nearest[0].Point, p)
+		}
+		err = opened.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// corruptingBackend is a memBackend that flips a bit in every file it
+// stores.
+type corruptingBackend struct{ memBackend }
+
+type corruptingWriter struct{ *memWriter }
+
+func (w corruptingWriter) Close() error {
+	w.Bytes()[w.Len()/2] ^= 1
+	return w.memWriter.Close()
+}
+
+func (b corruptingBackend) Create(name string) (io.WriteCloser, error) {
+	return corruptingWriter{&memWriter{b: b.memBackend, name: name}}, nil
+}
+
+func TestCopyTo(t *testing.T) {
+	tmp := newTestFS(t)
+	defer tmp.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	tree := createTestTree(t, tmp, 3, 10, points, BuildOptions{Checksums: true})
+	defer tree.Close()
+
+	err := os.Mkdir(tmp.Path("published"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := DirBackend(tmp.Path("published"))
+	err = tree.CopyTo(published, "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := OpenTreeBackend(published, "tree", OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	err = copied.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points[:50] {
+		nearest, err := copied.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+	}
+
+	b := corruptingBackend{memBackend{}}
+	err = tree.CopyTo(b, "tree")
+	if !ErrChecksum.Contains(err) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if _, ok := b.memBackend["tree"]; ok {
+		t.Fatal("expected the corrupt copy to be removed")
+	}
+}
+
+// summingBackend is a SumBackend that counts the sums it reports.
+type summingBackend struct {
+	memBackend
+	sums *int
+}
+
+func (b summingBackend) SHA256(name string) ([]byte, error) {
+	*b.sums++
+	sum := sha256.Sum256(b.memBackend[name].Bytes())
+	return sum[:], nil
+}
+
+func TestMirrors(t *testing.T) {
+	tmp := newTestFS(t)
+	defer tmp.Delete()
+
+	err := os.Mkdir(tmp.Path("published"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := DirBackend(tmp.Path("published"))
+	sums := 0
+	remote := summingBackend{memBackend{}, &sums}
+
+	points := newTestPoints(300, 3, 10)
+	tree := createTestTree(t, tmp, 3, 10, points, BuildOptions{
+		Checksums: true,
+		Mirrors: []Mirror{{Backend: published, Name: "local"},
+			{Backend: remote, Name: "remote"}}})
+	defer tree.Close()
+	if sums != 1 {
+		t.Fatalf("expected the remote copy to be summed once, got %d", sums)
+	}
+	for _, m := range []Mirror{{published, "local"}, {remote, "remote"}} {
+		copied, err := OpenTreeBackend(m.Backend, m.Name, OpenOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = copied.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nearest, err := copied.Nearest(points[0], 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, points[0])
+		copied.Close()
+	}
+
+	// a bad copy fails the build and removes every copy
+	set, err := NewPointSet(tmp.Temp(), 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points {
+		err = set.Add(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := tmp.Path("failed")
+	bad := corruptingBackend{memBackend{}}
+	_, err = CreateTreeWithOptions(path, tmp.Temp(), set, BuildOptions{
+		Mirrors: []Mirror{{Backend: published, Name: "again"},
+			{Backend: bad, Name: "bad"}}})
+	if !ErrChecksum.Contains(err) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("expected no tree after a failed mirror")
+	}
+	if _, err := os.Stat(tmp.Path("published/again")); !os.IsNotExist(err) {
+		t.Fatal("expected the good copy to be removed")
+	}
+	if _, ok := bad.memBackend["bad"]; ok {
+		t.Fatal("expected the bad copy to be removed")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"time"
+)
+
+// NearestBatch finds the n nearest points to each of queries, as Nearest
+// would, in a single traversal of the tree. Each node is read once for all
+// of the queries that need it rather than once per query, so a batch of
+// queries against a cold tree reads far less from disk, especially when the
+// queries are near each other.
+func (t *Tree) NearestBatch(queries []Point, n int) ([][]PointDistance,
+	error) {
+	rv := make([][]PointDistance, len(queries))
+	if n <= 0 || len(queries) == 0 {
+		return rv, nil
+	}
+	// the results of every query are held until the batch is done
+	err := t.checkResults(int64(len(queries)) * int64(n))
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	qs := make([]*nearestQuery, 0, len(queries))
+	for _, p := range queries {
+		err := t.checkDims(p)
+		if err != nil {
+			return nil, err
+		}
+		qs = append(qs, &nearestQuery{p: p, h: make(maxHeap, 0, n),
+			exclude: -1})
+	}
+	err = t.searchBatch(t.root, qs)
+	if err != nil {
+		return nil, err
+	}
+	for i, q := range qs {
+		t.searchPending(q)
+		t.recordQuery(q.stats, start)
+		rv[i] = q.h.Points()
+	}
+	return rv, nil
+}
+
+// searchBatch is search for many queries at once. The node at offset is read
+// once, and each child is then searched once with every query that can't
+// rule it out yet. The child that is the near side for most of the queries
+// goes first, so the rest search their far side first, which can visit more
+// nodes than searching them one at a time but never reads a node twice.
+func (t *Tree) searchBatch(offset int64, qs []*nearestQuery) error {
+	if offset == -1 || len(qs) == 0 {
+		return nil
+	}
+
+	n, err := t.Node(offset)
+	if err != nil {
+		return err
+	}
+	nearLeft := 0
+	for _, q := range qs {
+		err = q.visit(t.nodelen)
+		if err != nil {
+			return err
+		}
+		if !n.Deleted && offset != q.exclude {
+			q.add(neighbor{
+				PointDistance: PointDistance{Point: n.Point,
+					Distance: q.distance(&n.Point), ID: t.pointID(offset)},
+				offset: offset})
+		}
+		if q.p.Pos[n.Dim] <= n.Point.Pos[n.Dim] {
+			nearLeft++
+		}
+	}
+
+	// explorers returns the queries for the left or right child.
+	explorers := func(left bool) []*nearestQuery {
+		var rv []*nearestQuery
+		for _, q := range qs {
+			c := q.p.Pos[n.Dim] - n.Point.Pos[n.Dim]
+			if (c <= 0) == left || q.explore(n.Dim, c) {
+				rv = append(rv, q)
+			} else if left {
+				q.prune(n.Left)
+			} else {
+				q.prune(n.Right)
+			}
+		}
+		return rv
+	}
+
+	leftFirst := 2*nearLeft >= len(qs)
+	first, second := n.Left, n.Right
+	if !leftFirst {
+		first, second = second, first
+	}
+	t.prefetch.fetch(second)
+	err = t.searchBatch(first, explorers(leftFirst))
+	if err != nil {
+		return err
+	}
+	return t.searchBatch(second, explorers(!leftFirst))
+}
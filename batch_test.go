@@ -0,0 +1,61 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"testing"
+)
+
+func TestNearestBatch(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	queries := newTestPoints(200, 3, 10)
+	queries = append(queries, points[:50]...)
+	for _, k := range []int{1, 7, 2000} {
+		batch, err := tree.NearestBatch(queries, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) != len(queries) {
+			t.Fatalf("got %d results, expected %d", len(batch), len(queries))
+		}
+		for i, q := range queries {
+			expected, err := tree.NearestExhaustive(q, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(batch[i]) != len(expected) {
+				t.Fatalf("got %d points, expected %d", len(batch[i]),
+					len(expected))
+			}
+			for j := range expected {
+				if batch[i][j].Distance != expected[j].Distance {
+					t.Fatalf("query %d result %d: got distance %v, expected %v",
+						i, j, batch[i][j].Distance, expected[j].Distance)
+				}
+			}
+		}
+	}
+
+	_, err := tree.NearestBatch([]Point{NewPoint(2, 10)}, 1)
+	if err == nil {
+		t.Fatal("expected a dimension mismatch error")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+)
+
+// boxEntrySize is the size of each node's entry in the box table of a tree
+// with dims dimensions: the min and then max corner of its subtree's
+// bounding box.
+func boxEntrySize(dims int) int64 { return 2 * int64(dims) * uint64Size }
+
+// boxesLen is the size of the box table, if there is one.
+func (f *footer) boxesLen() int64 {
+	if !f.boxes {
+		return 0
+	}
+	return f.count * boxEntrySize(f.dims)
+}
+
+// boxesOffset is where the box table starts, after the checksum table.
+func (t *Tree) boxesOffset() int64 {
+	return t.checksumsOffset() + t.footer.checksumsLen()
+}
+
+// addBoxes appends a box table to the tree file at path, which f describes,
+// and updates f to record it. There is an entry for each node, in file
+// order, holding the bounding box of every point in its subtree, including
+// deleted points.
+func addBoxes(path string, f *footer, fsync *syncer) error {
+	fh, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer fh.Close()
+	t := &Tree{r: fh, root: f.root, count: f.count, nodelen: f.nodeSize(),
+		footer: *f}
+	base := t.boxesOffset()
+	size := boxEntrySize(f.dims)
+	out := fsync.writer(fh)
+
+	var add func(offset int64) (b box, err error)
+	add = func(offset int64) (b box, err error) {
+		n, _, err := t.nodeShape(offset, true)
+		if err != nil {
+			return b, err
+		}
+		b = box{min: append([]float64(nil), n.Point.Pos...),
+			max: append([]float64(nil), n.Point.Pos...)}
+		for _, child := range []int64{n.Left, n.Right} {
+			if child == -1 {
+				continue
+			}
+			cb, err := add(child)
+			if err != nil {
+				return b, err
+			}
+			for i := range b.min {
+				b.min[i] = math.Min(b.min[i], cb.min[i])
+				b.max[i] = math.Max(b.max[i], cb.max[i])
+			}
+		}
+		entry := make([]byte, 0, size)
+		for _, v := range append(b.min, b.max...) {
+			entry = binary.LittleEndian.AppendUint64(entry, math.Float64bits(v))
+		}
+		_, err = out.WriteAt(entry, base+offset/t.nodelen*size)
+		return b, errClass.Wrap(err)
+	}
+	if f.root != -1 {
+		_, err = add(f.root)
+		if err != nil {
+			return err
+		}
+	}
+	f.boxes = true
+	return errClass.Wrap(fh.Close())
+}
+
+// nodeBox reads the bounding box of the subtree at offset.
+func (t *Tree) nodeBox(offset int64) (box, error) {
+	size := boxEntrySize(t.footer.dims)
+	entry := make([]byte, size)
+	_, err := t.r.ReadAt(entry, t.boxesOffset()+offset/t.nodelen*size)
+	if err != nil {
+		return box{}, errClass.Wrap(err)
+	}
+	b := box{min: make([]float64, t.footer.dims),
+		max: make([]float64, t.footer.dims)}
+	for i := range b.min {
+		b.min[i] = math.Float64frombits(binary.LittleEndian.Uint64(
+			entry[i*uint64Size:]))
+		b.max[i] = math.Float64frombits(binary.LittleEndian.Uint64(
+			entry[(t.footer.dims+i)*uint64Size:]))
+	}
+	return b, nil
+}
+
+// tightenBox narrows b, a bound on the subtree at offset, to the subtree's
+// stored bounding box, if the tree has them. restore puts b back.
+func (t *Tree) tightenBox(offset int64, b *box) (restore func(), err error) {
+	if !t.footer.boxes {
+		return func() {}, nil
+	}
+	stored, err := t.nodeBox(offset)
+	if err != nil {
+		return nil, err
+	}
+	oldMin := append([]float64(nil), b.min...)
+	oldMax := append([]float64(nil), b.max...)
+	for i := range b.min {
+		b.min[i] = math.Max(b.min[i], stored.min[i])
+		b.max[i] = math.Min(b.max[i], stored.max[i])
+	}
+	return func() {
+		copy(b.min, oldMin)
+		copy(b.max, oldMax)
+	}, nil
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestBoxes(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	// tight clusters scattered through a large space
+	var points []Point
+	for c := 0; c < 20; c++ {
+		center := []float64{rand.Float64() * 1000, rand.Float64() * 1000}
+		for i := 0; i < 50; i++ {
+			p := NewPoint(2, 10)
+			p.Pos[0] = center[0] + rand.Float64()
+			p.Pos[1] = center[1] + rand.Float64()
+			points = append(points, p)
+		}
+	}
+	plain := createTestTree(t, fs, 2, 10, points, BuildOptions{})
+	defer plain.Close()
+	boxed := createTestTree(t, fs, 2, 10, points, BuildOptions{Boxes: true})
+	defer boxed.Close()
+	if !boxed.footer.boxes || boxed.Info().Version != footerVersionBoxes {
+		t.Fatal("boxes not recorded in the footer")
+	}
+
+	var plainVisited, boxedVisited int64
+	for i := 0; i < 100; i++ {
+		q := Point{Pos: []float64{rand.Float64() * 1000, rand.Float64() * 1000}}
+		expected, stats, err := plain.NearestWithStats(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plainVisited += stats.NodesVisited
+		actual, stats, err := boxed.NearestWithStats(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		boxedVisited += stats.NodesVisited
+		for j := range expected {
+			if actual[j].Distance != expected[j].Distance {
+				t.Fatalf("got distance %v, expected %v", actual[j].Distance,
+					expected[j].Distance)
+			}
+		}
+
+		radius := rand.Float64() * 50
+		expectedCount, err := plain.CountWithin(q, radius)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := boxed.CountWithin(q, radius)
+		if err != nil {
+			t.Fatal(err)
+		}
+		within, err := boxed.Within(q, radius)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ranged int64
+		err = boxed.Range(
+			[]float64{q.Pos[0] - radius, q.Pos[1] - radius},
+			[]float64{q.Pos[0] + radius, q.Pos[1] + radius},
+			func(p Point) error {
+				ranged++
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expectedRanged int64
+		for _, p := range points {
+			if p.Pos[0] >= q.Pos[0]-radius && p.Pos[0] <= q.Pos[0]+radius &&
+				p.Pos[1] >= q.Pos[1]-radius && p.Pos[1] <= q.Pos[1]+radius {
+				expectedRanged++
+			}
+		}
+		if count != expectedCount || int64(len(within)) != expectedCount ||
+			ranged != expectedRanged {
+			t.Fatalf("counted %d, %d within and %d in range, expected %d and %d",
+				count, len(within), ranged, expectedCount, expectedRanged)
+		}
+	}
+	if boxedVisited >= plainVisited {
+		t.Fatalf("visited %d nodes with boxes, %d without", boxedVisited,
+			plainVisited)
+	}
+
+	var buf bytes.Buffer
+	_, err := Shrink(&buf, boxed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shrunk, err := openReaderAt(bytes.NewReader(buf.Bytes()),
+		int64(buf.Len()), OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = shrunk.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points[:50] {
+		nearest, err := shrunk.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+// bucket holds a run of nodes read at once. See BuildOptions.LeafSize.
+type bucket struct {
+	start int64
+	data  []byte
+}
+
+// holds reports whether the bucket, which may be nil, holds the node at
+// offset.
+func (b *bucket) holds(offset, nodelen int64) bool {
+	return b != nil && offset >= b.start &&
+		offset+nodelen <= b.start+int64(len(b.data))
+}
+
+// readBucket reads the nodes of the subtree of count points rooted at
+// offset, past the root itself, into a bucket for q. In the preorder layout
+// they follow the root. If points of the subtree have been deleted, it
+// holds more nodes than count, and searches read the rest as usual.
+func (t *Tree) readBucket(offset, count int64, q *nearestQuery) error {
+	start := offset + t.nodelen
+	end := offset + count*t.nodelen
+	if nodesEnd := t.count * t.nodelen; end > nodesEnd {
+		end = nodesEnd
+	}
+	if end <= start {
+		return nil
+	}
+	b := &bucket{start: start, data: make([]byte, end-start)}
+	_, err := t.r.ReadAt(b.data, start)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	q.stats.BytesRead += end - start
+	q.bucket = b
+	return nil
+}
+
+// searchNode returns the node at offset for q, from its bucket if it has
+// one that holds the node, and otherwise as nodeShape does.
+func (t *Tree) searchNode(offset int64, q *nearestQuery) (n Node, ref bool,
+	err error) {
+	b := q.bucket
+	if !b.holds(offset, t.nodelen) {
+		return t.nodeShape(offset, q.lazyData)
+	}
+	n, ref, err = t.parseNodeShape(offset,
+		b.data[offset-b.start:][:t.nodelen])
+	if err == nil && ref && !q.lazyData {
+		n.Point.Data, err = t.readData(offset, n.Point.Data)
+		ref = false
+	}
+	return n, ref, err
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"io"
+	"testing"
+)
+
+// readCounter counts reads of a tree file.
+type readCounter struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *readCounter) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+func TestLeafSize(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(2000, 3, 10)
+	plain := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer plain.Close()
+	bucketed := createTestTree(t, fs, 3, 10, points,
+		BuildOptions{LeafSize: 32})
+	bucketed.Close()
+	if bucketed.Info().Options.LeafSize != 32 {
+		t.Fatal("leaf size not recorded")
+	}
+
+	tree, err := OpenRW(bucketed.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	check := func() (plainReads, bucketReads int) {
+		plainCounter := &readCounter{r: plain.r}
+		plain.r = plainCounter
+		bucketCounter := &readCounter{r: tree.r}
+		tree.r = bucketCounter
+		defer func() { plain.r, tree.r = plainCounter.r, bucketCounter.r }()
+		for i := 0; i < 50; i++ {
+			q := NewPoint(3, 10)
+			expected, err := plain.Nearest(q, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := tree.Nearest(q, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(actual) != len(expected) {
+				t.Fatalf("got %d results, expected %d", len(actual),
+					len(expected))
+			}
+			for j := range expected {
+				if actual[j].Distance != expected[j].Distance {
+					t.Fatalf("result %d differs from the plain tree", j)
+				}
+			}
+		}
+		return plainCounter.reads, bucketCounter.reads
+	}
+
+	plainReads, bucketReads := check()
+	if bucketReads*2 > plainReads {
+		t.Fatalf("bucketed tree took %d reads, plain tree %d", bucketReads,
+			plainReads)
+	}
+
+	// deleted points leave subtrees with more nodes than their counts
+	plainRW, err := OpenRW(plain.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plainRW.Close()
+	for _, p := range points[:500] {
+		err = tree.Delete(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = plainRW.Delete(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check()
+
+	set, err := NewPointSet(fs.Temp(), 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	_, err = CreateTreeWithOptions(fs.Path(tempName("")), fs.Temp(), set,
+		BuildOptions{LeafSize: 8, Layout: CacheObliviousLayout})
+	if err == nil {
+		t.Fatal("expected LeafSize to require the preorder layout")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// CacheStats describes the use of a tree's node cache.
+type CacheStats struct {
+	Hits, Misses int64
+	// Nodes and Bytes are how many nodes the cache holds and how many bytes
+	// of the cache budget they use.
+	Nodes, Bytes int64
+}
+
+// nodeCache is an LRU cache of parsed nodes by offset, bounded by the
+// serialized size of the nodes it holds.
+type nodeCache struct {
+	mu           sync.Mutex
+	budget, size int64
+	lru          *list.List // of *cacheEntry, most recently used first
+	entries      map[int64]*list.Element
+	hits, misses int64
+	// logger, if set, is told about evictions.
+	logger *slog.Logger
+}
+
+type cacheEntry struct {
+	offset int64
+	n      Node
+}
+
+func newNodeCache(budget int64) *nodeCache {
+	return &nodeCache{
+		budget:  budget,
+		lru:     list.New(),
+		entries: map[int64]*list.Element{}}
+}
+
+func (c *nodeCache) get(offset int64) (n Node, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[offset]
+	if !ok {
+		c.misses++
+		return Node{}, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).n, true
+}
+
+// add caches n, which takes nodelen bytes of the budget, evicting the least
+// recently used nodes to make room.
+func (c *nodeCache) add(offset int64, n Node, nodelen int64) {
+	if nodelen > c.budget {
+		return
+	}
+	c.mu.Lock()
+	if e, ok := c.entries[offset]; ok {
+		e.Value.(*cacheEntry).n = n
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return
+	}
+	evicted := 0
+	for c.size+nodelen > c.budget {
+		last := c.lru.Back()
+		delete(c.entries, last.Value.(*cacheEntry).offset)
+		c.lru.Remove(last)
+		c.size -= nodelen
+		evicted++
+	}
+	c.entries[offset] = c.lru.PushFront(&cacheEntry{offset: offset, n: n})
+	c.size += nodelen
+	cached, size := c.lru.Len(), c.size
+	c.mu.Unlock()
+	// logged outside the lock, as the handler may be slow
+	if evicted > 0 && c.logger != nil {
+		c.logger.Debug("dkdtree: cache evicted nodes", "nodes", evicted,
+			"cached", cached, "bytes", size)
+	}
+}
+
+// remove drops the node at offset, which has changed on disk.
+func (c *nodeCache) remove(offset int64, nodelen int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[offset]; ok {
+		delete(c.entries, offset)
+		c.lru.Remove(e)
+		c.size -= nodelen
+	}
+}
+
+// offsets returns the offsets of the cached nodes, most recently used first.
+func (c *nodeCache) offsets() []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rv := make([]int64, 0, c.lru.Len())
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		rv = append(rv, e.Value.(*cacheEntry).offset)
+	}
+	return rv
+}
+
+// CacheStats returns the hit and miss counts and current size of the node
+// cache configured by OpenOptions.CacheBytes.
+func (t *Tree) CacheStats() CacheStats {
+	c := t.cache
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Nodes:  int64(c.lru.Len()),
+		Bytes:  c.size}
+}
+
+// DumpCache writes the offsets of the nodes in the node cache to w, so that
+// LoadCache can warm the cache of a later Tree over the same file.
+func (t *Tree) DumpCache(w io.Writer) error {
+	if t.cache == nil {
+		return errClass.New("tree has no node cache")
+	}
+	bw := bufio.NewWriter(w)
+	var buf [uint64Size]byte
+	for _, offset := range t.cache.offsets() {
+		binary.LittleEndian.PutUint64(buf[:], uint64(offset))
+		_, err := bw.Write(buf[:])
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	return errClass.Wrap(bw.Flush())
+}
+
+// LoadCache reads node offsets written by DumpCache from r and reads those
+// nodes into the node cache, keeping their order of use. Offsets that aren't
+// nodes of this tree are reported as an error.
+func (t *Tree) LoadCache(r io.Reader) error {
+	if t.cache == nil {
+		return errClass.New("tree has no node cache")
+	}
+	var offsets []int64
+	br := bufio.NewReader(r)
+	var buf [uint64Size]byte
+	for {
+		_, err := io.ReadFull(br, buf[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+		offset := int64(binary.LittleEndian.Uint64(buf[:]))
+		if offset < 0 || offset%t.nodelen != 0 ||
+			offset >= t.count*t.nodelen {
+			return errClass.New("cached offset %d is not a node", offset)
+		}
+		offsets = append(offsets, offset)
+	}
+	// add the least recently used first, so it is evicted first
+	for i := len(offsets) - 1; i >= 0; i-- {
+		n, err := t.readNode(offsets[i])
+		if err != nil {
+			return err
+		}
+		t.cache.add(offsets[i], n, t.nodelen)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestNodeCache(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	budget := 100 * tree.nodelen
+	cached, err := OpenTreeWithOptions(tree.path,
+		OpenOptions{CacheBytes: budget})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cached.Close()
+
+	for i := 0; i < 2; i++ {
+		for _, p := range points[:100] {
+			expected, err := tree.Nearest(p, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := cached.Nearest(p, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := range expected {
+				AssertPointsEqual(actual[j].Point, expected[j].Point)
+			}
+		}
+	}
+	stats := cached.CacheStats()
+	if stats.Hits == 0 || stats.Misses == 0 {
+		t.Fatalf("expected hits and misses, got %+v", stats)
+	}
+	if stats.Nodes != 100 || stats.Bytes != budget {
+		t.Fatalf("expected a full cache, got %+v", stats)
+	}
+	if tree.CacheStats() != (CacheStats{}) {
+		t.Fatal("uncached tree has cache stats")
+	}
+
+	var dump bytes.Buffer
+	err = cached.DumpCache(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.DumpCache(&dump)
+	if err == nil {
+		t.Fatal("expected an error dumping a missing cache")
+	}
+
+	warmed, err := OpenTreeWithOptions(tree.path,
+		OpenOptions{CacheBytes: budget})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer warmed.Close()
+	err = warmed.LoadCache(bytes.NewReader(dump.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warmed.cache.offsets()[0] != cached.cache.offsets()[0] {
+		t.Fatal("cache order not restored")
+	}
+	_, err = warmed.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = warmed.CacheStats()
+	if stats.Nodes != 100 || stats.Hits != 1 || stats.Misses != 0 {
+		t.Fatalf("expected a warm cache, got %+v", stats)
+	}
+
+	err = warmed.LoadCache(bytes.NewReader([]byte{1, 0, 0, 0, 0, 0, 0, 0}))
+	if err == nil {
+		t.Fatal("expected an error loading a bad offset")
+	}
+}
+
+func TestWarm(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	cached, err := OpenTreeWithOptions(tree.path,
+		OpenOptions{CacheBytes: 1000 * tree.nodelen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cached.Close()
+	err = cached.Warm(context.Background(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := cached.CacheStats(); stats.Nodes != 15 || stats.Hits != 0 {
+		t.Fatalf("expected the top 4 levels cached, got %+v", stats)
+	}
+	root, err := cached.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cached.Node(root.Left)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := cached.CacheStats(); stats.Hits != 2 || stats.Nodes != 15 {
+		t.Fatalf("expected warmed nodes to hit, got %+v", stats)
+	}
+
+	for _, levels := range []int{-1, 0, 100} {
+		err = tree.Warm(context.Background(), levels)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, levels := range []int{-1, 4} {
+		err = tree.Warm(ctx, levels)
+		if err != context.Canceled {
+			t.Fatalf("expected the canceled context's error, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,528 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+// CappedOptions configures a CappedTree.
+type CappedOptions struct {
+	// MaxPoints is the most points the CappedTree holds. It must be at
+	// least Generations.
+	MaxPoints int64
+	// Generations is how many generations MaxPoints is split into, which
+	// sets how many points are evicted at a time. Defaults to 8, and must be
+	// at least 2.
+	Generations int
+	// Priority, if set, ranks points for eviction, lowest first. It must
+	// always give a point the same priority. Otherwise the points inserted
+	// first are evicted first.
+	Priority func(Point) float64
+	// TmpDir is where builds keep their temporary files. Defaults to the
+	// CappedTree's directory.
+	TmpDir string
+	// Build configures the build of each generation.
+	Build BuildOptions
+	// Open configures how each generation is opened. If SyncWrites is set,
+	// Insert syncs each inserted point to stable storage before returning.
+	Open OpenOptions
+}
+
+// CappedTree is a spatial index that holds at most a fixed number of points,
+// evicting the oldest, or those of lowest priority, to make room for new
+// ones, so that a rolling window of points needs no lifecycle management
+// from the caller.
+//
+// Its points are kept in generations, each a tree of its own, in a
+// directory. Inserted points are logged as with Tree.Insert until a
+// generation's worth, MaxPoints / Generations, has built up, and are then
+// built into a new generation. Whenever that leaves less than a
+// generation's worth of room, points are evicted: by insertion order, whole
+// generations are dropped, oldest first; by priority, every generation is
+// merged into one holding only the highest-priority points. Once full, a
+// CappedTree so holds within two generations of MaxPoints, and never more.
+//
+// A CappedTree is safe for concurrent use. Inserts that fill a generation
+// build it before returning, holding off queries until then.
+type CappedTree struct {
+	dir              string
+	dims, maxDataLen int
+	opts             CappedOptions
+	genSize          int64
+
+	mu   sync.RWMutex
+	gens []*generation
+	// buf logs the points inserted since the last generation was built,
+	// which will make up generation next.
+	buf  *pendingLog
+	next uint64
+}
+
+var _ Searcher = (*CappedTree)(nil)
+
+// generation is a tree of a CappedTree holding the points of generations
+// first through last, as numbered when they were built.
+type generation struct {
+	first, last uint64
+	path        string
+	tree        *Tree
+}
+
+// OpenCappedTree opens the CappedTree kept in dir for points with dims
+// dimensions and Data up to maxDataLen bytes long, creating it if dir has
+// no generations yet.
+func OpenCappedTree(dir string, dims, maxDataLen int, opts CappedOptions) (
+	*CappedTree, error) {
+	if opts.Generations == 0 {
+		opts.Generations = 8
+	}
+	if opts.Generations < 2 {
+		return nil, errClass.New("a capped tree needs at least 2 generations")
+	}
+	if opts.MaxPoints < int64(opts.Generations) {
+		return nil, errClass.New("max points %d is less than %d generations",
+			opts.MaxPoints, opts.Generations)
+	}
+	err := checkNodeSize(int64(dims), int64(maxDataLen))
+	if err != nil {
+		return nil, err
+	}
+	if opts.Build.Normalize {
+		return nil, ErrUnsupported.New("a capped tree's generations can't " +
+			"each be normalized")
+	}
+	if opts.TmpDir == "" {
+		opts.TmpDir = dir
+	}
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	c := &CappedTree{
+		dir:        dir,
+		dims:       dims,
+		maxDataLen: maxDataLen,
+		opts:       opts,
+		genSize: (opts.MaxPoints + int64(opts.Generations) - 1) /
+			int64(opts.Generations),
+		next: 1,
+	}
+	err = c.load()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// load opens the generations and the log of inserted points in c.dir. A
+// crash while building a generation can leave behind generations and logs
+// that a newer generation already holds the points of, which are removed.
+func (c *CappedTree) load() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	var gens []*generation
+	var logs []uint64
+	for _, entry := range entries {
+		var g generation
+		var seq uint64
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, ".dkd"):
+			_, err = fmt.Sscanf(name, "%d-%d.dkd", &g.first, &g.last)
+			if err == nil && g.first <= g.last {
+				g.path = filepath.Join(c.dir, name)
+				gens = append(gens, &g)
+			}
+		case strings.HasSuffix(name, pendingSuffix):
+			_, err = fmt.Sscanf(name, "%d"+pendingSuffix, &seq)
+			if err == nil {
+				logs = append(logs, seq)
+			}
+		}
+	}
+
+	sort.Slice(gens, func(i, j int) bool {
+		if gens[i].first != gens[j].first {
+			return gens[i].first < gens[j].first
+		}
+		return gens[i].last > gens[j].last
+	})
+	for _, g := range gens {
+		if g.last < c.next {
+			err = os.Remove(g.path)
+			if err != nil {
+				return errClass.Wrap(err)
+			}
+			continue
+		}
+		g.tree, err = OpenTreeWithOptions(g.path, c.opts.Open)
+		if err != nil {
+			return err
+		}
+		if g.tree.Dims() != c.dims {
+			g.tree.Close()
+			return ErrDimensionMismatch.New("generation %s has %d dimensions, "+
+				"expected %d", g.path, g.tree.Dims(), c.dims)
+		}
+		c.gens = append(c.gens, g)
+		c.next = g.last + 1
+	}
+
+	sort.Slice(logs, func(i, j int) bool { return logs[i] < logs[j] })
+	for i, seq := range logs {
+		if seq < c.next || i < len(logs)-1 {
+			err = os.Remove(c.logPath(seq))
+			if err != nil {
+				return errClass.Wrap(err)
+			}
+			continue
+		}
+		c.next = seq
+	}
+	c.buf, err = openPendingLog(c.logPath(c.next), c.dims, 0)
+	if err != nil {
+		return err
+	}
+	if c.opts.Priority == nil {
+		return c.dropOldest()
+	}
+	return nil
+}
+
+func (c *CappedTree) genPath(first, last uint64) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%016d-%016d.dkd", first, last))
+}
+
+func (c *CappedTree) logPath(seq uint64) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%016d%s", seq, pendingSuffix))
+}
+
+// Dims returns the number of dimensions of the tree's points.
+func (c *CappedTree) Dims() int { return c.dims }
+
+// Count returns the number of points the tree holds.
+func (c *CappedTree) Count() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.count()
+}
+
+func (c *CappedTree) count() int64 {
+	count := int64(c.buf.len())
+	for _, g := range c.gens {
+		count += g.tree.Count()
+	}
+	return count
+}
+
+// Generations returns the number of generations the tree's points are
+// currently kept in, not counting the points still to be built into one.
+func (c *CappedTree) Generations() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.gens)
+}
+
+// checkPoint checks that p is a valid point for the tree.
+func (c *CappedTree) checkPoint(p Point) error {
+	if len(p.Pos) != c.dims {
+		return ErrDimensionMismatch.New("point has wrong dimension: %d, "+
+			"expected %d", len(p.Pos), c.dims)
+	}
+	return checkFinite(p.Pos)
+}
+
+// Insert adds p to the tree, evicting points if that fills the tree.
+func (c *CappedTree) Insert(p Point) error {
+	err := c.checkPoint(p)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err = c.buf.append(p, c.maxDataLen, maxPoints)
+	if err == nil && c.opts.Open.SyncWrites {
+		err = c.buf.sync()
+	}
+	if err != nil || int64(c.buf.len()) < c.genSize {
+		return err
+	}
+	return c.flush()
+}
+
+// Flush builds the points inserted since the last generation was built into
+// a generation of their own, evicting points if that leaves too little
+// room. Generations are built as they fill up, and inserted points are
+// logged until then, so Flush is only needed to make them faster to query.
+func (c *CappedTree) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
+// room is how many points the generations may hold once a generation is
+// built, leaving room for the next.
+func (c *CappedTree) room() int64 { return c.opts.MaxPoints - c.genSize }
+
+func (c *CappedTree) flush() error {
+	points := c.buf.snapshot()
+	if len(points) == 0 {
+		return nil
+	}
+	var err error
+	if c.opts.Priority != nil && c.count() > c.room() {
+		err = c.merge(points)
+	} else {
+		var g *generation
+		g, err = c.build(c.next, points, nil, nil)
+		if err == nil {
+			c.gens = append(c.gens, g)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// the logged points are in a generation now
+	err = c.buf.close()
+	if err == nil {
+		err = os.Remove(c.buf.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return errClass.Wrap(err)
+	}
+	c.next++
+	c.buf = &pendingLog{path: c.logPath(c.next)}
+	if c.opts.Priority == nil {
+		return c.dropOldest()
+	}
+	return nil
+}
+
+// dropOldest removes generations, oldest first, until the rest fit in
+// c.room().
+func (c *CappedTree) dropOldest() error {
+	for len(c.gens) > 0 && c.count() > c.room() {
+		g := c.gens[0]
+		err := g.tree.Close()
+		if err != nil {
+			return err
+		}
+		c.gens = c.gens[1:]
+		err = os.Remove(g.path)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// merge replaces every generation, along with points, with a single
+// generation of the c.room() points of highest priority.
+func (c *CappedTree) merge(points []Point) error {
+	first := c.next
+	sources := make([]*Tree, 0, len(c.gens))
+	for _, g := range c.gens {
+		first = min(first, g.first)
+		sources = append(sources, g.tree)
+	}
+
+	// the cutoff is the lowest priority kept, of which only ties more may be
+	// kept
+	var priorities []float64
+	for _, p := range points {
+		priorities = append(priorities, c.opts.Priority(p))
+	}
+	for _, t := range sources {
+		err := t.Each(func(p Point) error {
+			priorities = append(priorities, c.opts.Priority(p))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var keep func(Point) bool
+	if int64(len(priorities)) > c.room() {
+		sort.Sort(sort.Reverse(sort.Float64Slice(priorities)))
+		cutoff := priorities[c.room()-1]
+		ties := c.room()
+		for _, priority := range priorities {
+			if priority > cutoff {
+				ties--
+			}
+		}
+		keep = func(p Point) bool {
+			priority := c.opts.Priority(p)
+			if priority == cutoff && ties > 0 {
+				ties--
+				return true
+			}
+			return priority > cutoff
+		}
+	}
+
+	g, err := c.build(first, points, sources, keep)
+	if err != nil {
+		return err
+	}
+	old := c.gens
+	c.gens = []*generation{g}
+	for _, g := range old {
+		err = g.tree.Close()
+		if err != nil {
+			return err
+		}
+		err = os.Remove(g.path)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// build builds generations first through c.next out of points and the
+// points of sources, keeping only those keep selects if it isn't nil.
+func (c *CappedTree) build(first uint64, points []Point, sources []*Tree,
+	keep func(Point) bool) (*generation, error) {
+	fs, err := newBaseFS(tempName(c.opts.TmpDir))
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Delete()
+	set, err := newPointSet(fs.Temp(), c.dims, c.maxDataLen, true)
+	if err != nil {
+		return nil, err
+	}
+	defer set.Close()
+	add := func(p Point) error {
+		if keep != nil && !keep(p) {
+			return nil
+		}
+		return set.Add(p)
+	}
+	for _, p := range points {
+		err = add(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range sources {
+		err = t.Each(add)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g := &generation{first: first, last: c.next,
+		path: c.genPath(first, c.next)}
+	t, err := CreateTreeWithOptions(g.path, c.opts.TmpDir, set, c.opts.Build)
+	if err != nil {
+		return nil, err
+	}
+	err = t.Close()
+	if err == nil {
+		g.tree, err = OpenTreeWithOptions(g.path, c.opts.Open)
+	}
+	if err != nil {
+		os.Remove(g.path)
+		return nil, err
+	}
+	return g, nil
+}
+
+// forest returns a Forest over the generations' trees, for queries of them
+// all. It must be called with mu held.
+func (c *CappedTree) forest() *Forest {
+	trees := make([]*Tree, 0, len(c.gens))
+	for _, g := range c.gens {
+		trees = append(trees, g.tree)
+	}
+	return &Forest{trees: trees}
+}
+
+// Nearest returns the n nearest points to p across every generation and
+// the points not yet built into one. IDs in the results only identify
+// points within their generation, so they can't be passed to Tree.Get.
+func (c *CappedTree) Nearest(p Point, n int) ([]PointDistance, error) {
+	err := c.checkPoint(p)
+	if err != nil || n <= 0 {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	nearest, err := c.forest().Nearest(p, n)
+	if err != nil {
+		return nil, err
+	}
+	var buffered []PointDistance
+	for _, b := range c.buf.snapshot() {
+		buffered = append(buffered,
+			PointDistance{Point: b, Distance: p.distanceSquared(&b)})
+	}
+	return mergeNearest(n, nearest, buffered), nil
+}
+
+// Within returns every point within radius of p across every generation
+// and the points not yet built into one, in no particular order. See
+// Tree.Within.
+func (c *CappedTree) Within(p Point, radius float64) ([]Point, error) {
+	if !(radius >= 0) {
+		return nil, errClass.New("invalid radius %v", radius)
+	}
+	err := c.checkPoint(p)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	rv, err := c.forest().Within(p, radius)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range c.buf.snapshot() {
+		if p.distanceSquared(&b) <= radius*radius {
+			rv = append(rv, b)
+		}
+	}
+	return rv, nil
+}
+
+// Close closes every generation and the log of inserted points, which are
+// loaded again by the next OpenCappedTree.
+func (c *CappedTree) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs errors.ErrorGroup
+	for _, g := range c.gens {
+		errs.Add(g.tree.Close())
+	}
+	c.gens = nil
+	if c.buf != nil {
+		errs.Add(c.buf.close())
+	}
+	return errs.Finalize()
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestCappedTree(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+	dir := fs.Path("capped")
+	opts := CappedOptions{MaxPoints: 100, Generations: 4}
+
+	c, err := OpenCappedTree(dir, 2, 8, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	center := Point{Pos: []float64{0.5, 0.5}}
+	for i := 0; i < 1000; i++ {
+		p := NewPoint(2, 1)
+		p.Data = []byte(strconv.Itoa(i))
+		err = c.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Count() > opts.MaxPoints {
+			t.Fatalf("%d points after %d inserts", c.Count(), i+1)
+		}
+	}
+	if c.Count() < opts.MaxPoints/2 {
+		t.Fatalf("only %d points kept", c.Count())
+	}
+	if c.Generations() > opts.Generations {
+		t.Fatalf("%d generations", c.Generations())
+	}
+	all, err := c.Within(center, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(all)) != c.Count() {
+		t.Fatalf("found %d points, expected %d", len(all), c.Count())
+	}
+	for _, p := range all {
+		i, err := strconv.Atoi(string(p.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 1000-int(opts.MaxPoints) {
+			t.Fatalf("point %d wasn't evicted", i)
+		}
+	}
+	nearest, err := c.Nearest(center, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 10 || nearest[0].Distance > nearest[9].Distance {
+		t.Fatalf("unexpected nearest points %v", nearest)
+	}
+
+	count := c.Count()
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a log the generations already hold is left by a crash mid-build
+	err = os.WriteFile(filepath.Join(dir, "0000000000000001"+pendingSuffix),
+		[]byte("stale"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenCappedTree(dir, 2, 8, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Count() != count {
+		t.Fatalf("%d points after reopening, expected %d", c.Count(), count)
+	}
+	_, err = os.Stat(filepath.Join(dir, "0000000000000001"+pendingSuffix))
+	if !os.IsNotExist(err) {
+		t.Fatalf("stale log wasn't removed: %v", err)
+	}
+	err = c.Insert(NewPoint(3, 1))
+	if !ErrDimensionMismatch.Contains(err) {
+		t.Fatalf("expected a dimension mismatch, got %v", err)
+	}
+}
+
+func TestCappedTreePriority(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+	opts := CappedOptions{MaxPoints: 100, Generations: 4,
+		Priority: func(p Point) float64 { return p.Pos[0] }}
+
+	c, err := OpenCappedTree(fs.Path("capped"), 2, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var priorities []float64
+	for i := 0; i < 1000; i++ {
+		p := NewPoint(2, 1)
+		priorities = append(priorities, p.Pos[0])
+		err = c.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Count() > opts.MaxPoints {
+			t.Fatalf("%d points after %d inserts", c.Count(), i+1)
+		}
+	}
+	all, err := c.Within(Point{Pos: []float64{0.5, 0.5}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := map[float64]bool{}
+	for _, p := range all {
+		kept[p.Pos[0]] = true
+	}
+	// the points ranked highest overall are kept by every merge
+	sort.Sort(sort.Reverse(sort.Float64Slice(priorities)))
+	for _, priority := range priorities[:75] {
+		if !kept[priority] {
+			t.Fatalf("point of priority %v was evicted", priority)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultCheckpointInterval is how often a build checkpoints its progress
+// if BuildOptions.CheckpointInterval isn't set.
+const DefaultCheckpointInterval = time.Minute
+
+// checkpoint is the progress of a build saved in its CheckpointDir. The
+// nodes of finished subtrees are in the node log, which is kept up to
+// Nodes bytes long. The subtree being built when the checkpoint was taken
+// is Set, and Frames are the splits above it, outermost first, whose nodes
+// are yet to be written.
+type checkpoint struct {
+	Dims       int             `json:"dims"`
+	MaxDataLen int             `json:"max_data_len"`
+	Count      int64           `json:"count"`
+	Duplicates Duplicates      `json:"duplicates"`
+	Split      SplitStrategy   `json:"split"`
+	Dimensions DimensionChoice `json:"dimensions"`
+	// Input is a hash of the points being built, so that a checkpoint isn't
+	// resumed by a build of a different set of the same size.
+	Input string `json:"input"`
+
+	Nodes  int64             `json:"nodes"`
+	Set    *checkpointSet    `json:"set,omitempty"`
+	SetDim int               `json:"set_dim"`
+	Frames []checkpointFrame `json:"frames,omitempty"`
+	// Done is set once the node log is complete, with Built nodes.
+	Done  bool  `json:"done,omitempty"`
+	Built int64 `json:"built,omitempty"`
+}
+
+// checkpointSet is a PointSet as saved in a checkpoint: Count points in the
+// split point file Name, from byte Start on.
+type checkpointSet struct {
+	Name  string `json:"name"`
+	Start int64  `json:"start,omitempty"`
+	Count int64  `json:"count"`
+}
+
+func newCheckpointSet(pl *PointSet) *checkpointSet {
+	return &checkpointSet{
+		Name:  filepath.Base(pl.path),
+		Start: pl.start,
+		Count: pl.count}
+}
+
+// checkpointFrame is a buildFrame as saved in a checkpoint. Right is the
+// points of the right subtree while the left is being built, and is nil once
+// the left is done.
+type checkpointFrame struct {
+	Dim        int            `json:"dim"`
+	Median     Point          `json:"median"`
+	Right      *checkpointSet `json:"right,omitempty"`
+	LeftOffset int64          `json:"left_offset"`
+	LeftCount  int64          `json:"left_count"`
+}
+
+// buildFrame is a split whose subtrees are being built, and whose node is
+// written once they are.
+type buildFrame struct {
+	dim    int
+	median Point
+	// right is the right subtree's points while the left subtree is being
+	// built, and nil after, when leftOffset and leftCount are set.
+	right                 *PointSet
+	leftOffset, leftCount int64
+}
+
+// checkpointer saves the progress of a build to its scratch file system.
+type checkpointer struct {
+	fs    *baseFS
+	every time.Duration
+	last  time.Time
+	// header holds the fields identifying the build.
+	header checkpoint
+}
+
+func newCheckpointer(fs *baseFS, points *PointSet, opts BuildOptions,
+	dups Duplicates) (*checkpointer, error) {
+	every := opts.CheckpointInterval
+	if every <= 0 {
+		every = DefaultCheckpointInterval
+	}
+	input, err := points.fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	return &checkpointer{
+		fs:    fs,
+		every: every,
+		last:  time.Now(),
+		header: checkpoint{
+			Dims:       points.dims,
+			MaxDataLen: points.maxDataLen,
+			Count:      points.count,
+			Duplicates: dups,
+			Split:      opts.SplitStrategy,
+			Dimensions: opts.SplitDimension,
+			Input:      input}}, nil
+}
+
+// fingerprint returns a hash of the stored form of the points in pl.
+func (pl *PointSet) fingerprint() (string, error) {
+	err := pl.sync()
+	if err != nil {
+		return "", err
+	}
+	fh, err := openFile(pl.path, pl.direct)
+	if err != nil {
+		return "", errClass.Wrap(err)
+	}
+	defer fh.Close()
+	if pl.start > 0 {
+		_, err = fh.(io.Seeker).Seek(pl.start, io.SeekStart)
+		if err != nil {
+			return "", errClass.Wrap(err)
+		}
+	}
+	h := sha256.New()
+	size := int64(pointSize(pl.dims, pl.maxDataLen))
+	_, err = io.CopyN(h, bufio.NewReader(fh), pl.count*size)
+	if err != nil {
+		return "", ErrCorrupt.New("truncated point file %#v", pl.path)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// nodesPath is where the node log of a build with checkpoints is kept.
+func (c *checkpointer) nodesPath() string { return c.fs.Path("nodes") }
+
+// load returns the checkpoint saved by an earlier attempt at the build, or
+// nil if there isn't one.
+func (c *checkpointer) load() (*checkpoint, error) {
+	data, err := os.ReadFile(c.fs.Path("checkpoint"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	var cp checkpoint
+	err = json.Unmarshal(data, &cp)
+	if err != nil {
+		return nil, ErrCorrupt.New("bad checkpoint: %v", err)
+	}
+	h := c.header
+	if cp.Dims != h.Dims || cp.MaxDataLen != h.MaxDataLen ||
+		cp.Count != h.Count || cp.Duplicates != h.Duplicates ||
+		cp.Split != h.Split || cp.Dimensions != h.Dimensions ||
+		cp.Input != h.Input {
+		return nil, errClass.New("checkpoint in %#v is of a different build",
+			c.fs.base)
+	}
+	return &cp, nil
+}
+
+// save replaces the saved checkpoint with cp atomically, and then removes
+// the split point files not named by it.
+func (c *checkpointer) save(cp *checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	path := c.fs.Path("checkpoint")
+	tmp := path + ".tmp"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	_, err = fh.Write(data)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err != nil {
+		fh.Close()
+		return errClass.Wrap(err)
+	}
+	err = fh.Close()
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	syncDir(filepath.Dir(path))
+	c.last = time.Now()
+
+	live := map[string]bool{}
+	if cp.Set != nil {
+		live[cp.Set.Name] = true
+	}
+	for _, f := range cp.Frames {
+		if f.Right != nil {
+			live[f.Right.Name] = true
+		}
+	}
+	dir := filepath.Join(c.fs.base, "tmp")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	for _, e := range entries {
+		if !live[e.Name()] {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return nil
+}
+
+// checkpoint saves the build's progress if it is due, with log, to be split
+// on dim, as the subtree being built.
+func (nl *nodeLog) checkpoint(log *PointSet, dim int) error {
+	c := nl.checkpoints
+	if c == nil || len(nl.frames) == 0 || time.Since(c.last) < c.every {
+		return nil
+	}
+	err := nl.sync()
+	if err != nil {
+		return err
+	}
+	cp := c.header
+	cp.Nodes = nl.offset
+	cp.Set = newCheckpointSet(log)
+	cp.SetDim = dim
+	// the point files named by the checkpoint must outlive their use, in
+	// case the build has to resume from it.
+	sets := []*PointSet{log}
+	for _, f := range nl.frames {
+		cf := checkpointFrame{
+			Dim:        f.dim,
+			Median:     f.median,
+			LeftOffset: f.leftOffset,
+			LeftCount:  f.leftCount}
+		if f.right != nil {
+			cf.Right = newCheckpointSet(f.right)
+			sets = append(sets, f.right)
+		}
+		cp.Frames = append(cp.Frames, cf)
+	}
+	for _, set := range sets {
+		err = set.sync()
+		if err != nil {
+			return err
+		}
+		if set.owner != nil {
+			set = set.owner
+		}
+		set.deleteOnClose = false
+	}
+	return c.save(&cp)
+}
+
+// finishCheckpoints saves a checkpoint recording that the node log is
+// complete, with count nodes.
+func (nl *nodeLog) finishCheckpoints(count int64) error {
+	c := nl.checkpoints
+	if c == nil {
+		return nil
+	}
+	err := nl.sync()
+	if err != nil {
+		return err
+	}
+	cp := c.header
+	cp.Nodes = nl.offset
+	cp.Done = true
+	cp.Built = count
+	return c.save(&cp)
+}
+
+// sync writes out the node log's buffered nodes and syncs its file.
+func (nl *nodeLog) sync() error {
+	err := nl.buf.Flush()
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	if fh, ok := nl.fh.(*os.File); ok {
+		return errClass.Wrap(fh.Sync())
+	}
+	return nil
+}
+
+// resumeNodeLog opens the node log of the build cp was saved from at path,
+// dropping any nodes written after cp.
+func resumeNodeLog(path string, cp *checkpoint) (*nodeLog, error) {
+	fh, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	err = fh.Truncate(cp.Nodes)
+	if err == nil {
+		_, err = fh.Seek(cp.Nodes, io.SeekStart)
+	}
+	if err != nil {
+		fh.Close()
+		return nil, errClass.Wrap(err)
+	}
+	nl := newNodeLogFile(fh, cp.Dims, cp.MaxDataLen)
+	nl.offset = cp.Nodes
+	return nl, nil
+}
+
+// replayNodes counts the nodes the build cp was saved from had written to
+// the node log at path toward prog and grid, as if they had just been added.
+func replayNodes(path string, cp *checkpoint, grid *Grid,
+	prog *progress) error {
+	n := cp.Nodes / int64(nodeSize(cp.Dims, cp.MaxDataLen))
+	if grid == nil {
+		prog.add(n)
+		return nil
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer fh.Close()
+	r := bufio.NewReader(fh)
+	for i := int64(0); i < n; i++ {
+		node, _, err := parseNodeFromReader(r)
+		if err != nil {
+			return err
+		}
+		grid.add(node.Point.Pos)
+		prog.add(1)
+	}
+	return nil
+}
+
+// resume carries on the build of the tree cp was saved from, returning the
+// offset of its root and how many nodes it has.
+func (nl *nodeLog) resume(fs *baseFS, cp *checkpoint) (node_offset,
+	count int64, err error) {
+	open := func(cs *checkpointSet) (*PointSet, error) {
+		return openPointSet(filepath.Join(fs.base, "tmp", cs.Name), cs.Start,
+			cs.Count, nl.dims, nl.maxDataLen)
+	}
+	set, err := open(cp.Set)
+	if err != nil {
+		return -1, 0, err
+	}
+	for _, cf := range cp.Frames {
+		f := &buildFrame{
+			dim:        cf.Dim,
+			median:     cf.Median,
+			leftOffset: cf.LeftOffset,
+			leftCount:  cf.LeftCount}
+		if cf.Right != nil {
+			f.right, err = open(cf.Right)
+			if err != nil {
+				return -1, 0, err
+			}
+		}
+		nl.frames = append(nl.frames, f)
+	}
+
+	node_offset, count, err = nl.Build(fs, set, cp.SetDim)
+	for err == nil && len(nl.frames) > 0 {
+		f := nl.frames[len(nl.frames)-1]
+		if f.right != nil {
+			right := f.right
+			f.leftOffset, f.leftCount, f.right = node_offset, count, nil
+			node_offset, count, err = nl.Build(fs, right, (f.dim+1)%nl.dims)
+			if err != nil {
+				break
+			}
+		}
+		nl.frames = nl.frames[:len(nl.frames)-1]
+		node_offset, count, err = nl.join(f, node_offset, count)
+	}
+	return node_offset, count, err
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCheckpoints(t *testing.T) {
+	points := newTestPoints(2000, 3, 10)
+	points = append(points, points[:100]...)
+	testCheckpoints(t, points,
+		BuildOptions{GridResolution: 4, Duplicates: DropExactDuplicates})
+
+	// points in order along the first dimension are split in place, which
+	// checkpoints record as ranges of their split point files
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Pos[0] < points[j].Pos[0]
+	})
+	testCheckpoints(t, points, BuildOptions{GridResolution: 4})
+}
+
+// testCheckpoints interrupts builds of points with opts and checkpoints
+// until one finishes, and checks it matches an uninterrupted build.
+func testCheckpoints(t *testing.T, points []Point, opts BuildOptions) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	expected := createTestTree(t, fs, 3, 10, points, opts)
+	defer expected.Close()
+
+	newSet := func(points []Point) *PointSet {
+		set, err := NewPointSet(fs.Temp(), 3, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range points {
+			err = set.Add(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return set
+	}
+
+	opts.CheckpointDir = fs.Path("checkpoints")
+	opts.CheckpointInterval = time.Nanosecond
+	var tree *Tree
+	attempts := 0
+	for stop := int64(300); tree == nil; stop += 300 {
+		// each attempt is interrupted after about 300 more nodes
+		ctx, cancel := context.WithCancel(context.Background())
+		opts.Progress = func(done, total int64) {
+			if done >= stop {
+				cancel()
+			}
+		}
+		var err error
+		tree, err = CreateTreeContext(ctx, fs.Path("tree"), fs.Temp(),
+			newSet(points), opts)
+		cancel()
+		attempts++
+		if err == nil {
+			break
+		}
+		if err != context.Canceled {
+			t.Fatal(err)
+		}
+		if attempts == 1 {
+			// a build of other points can't resume from the checkpoint
+			_, err = CreateTreeWithOptions(fs.Path("other"), fs.Temp(),
+				newSet(points[:1000]), opts)
+			if err == nil {
+				t.Fatal("expected a build of other points to fail")
+			}
+			// even if there are as many of them
+			same := append([]Point(nil), points...)
+			same[len(same)/2] = NewPoint(3, 10)
+			_, err = CreateTreeWithOptions(fs.Path("other"), fs.Temp(),
+				newSet(same), opts)
+			if err == nil {
+				t.Fatal("expected a build of other points to fail")
+			}
+		}
+	}
+	defer tree.Close()
+	if attempts < 3 {
+		t.Fatalf("build finished after %d attempts", attempts)
+	}
+
+	if tree.Count() != expected.Count() {
+		t.Fatalf("got %d points, expected %d", tree.Count(), expected.Count())
+	}
+	sum, err := tree.ContentHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSum, err := expected.ContentHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != expectedSum {
+		t.Fatal("resumed build holds different points")
+	}
+	grid, err := tree.GridCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedGrid, err := expected.GridCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(grid, expectedGrid) {
+		t.Fatal("resumed build has different grid counts")
+	}
+	err = tree.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(opts.CheckpointDir)
+	if !os.IsNotExist(err) {
+		t.Fatalf("checkpoint dir left behind: %v", err)
+	}
+}
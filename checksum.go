@@ -0,0 +1,127 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumSize is the size of a CRC-32C.
+const checksumSize = uint32Size
+
+// nodeChecksum returns the checksum of the serialized node data. The subtree
+// count and the byte holding the tombstone flag are left out, as they are
+// rewritten in place by Delete.
+func nodeChecksum(data []byte) uint32 {
+	nodelen := len(data)
+	crc := crc32.Update(0, crcTable, data[:nodelen-uint32Size-uint64Size])
+	return crc32.Update(crc, crcTable, data[nodelen-uint32Size:nodelen-1])
+}
+
+// addChecksums appends a checksum table to the tree file at path, whose nodes
+// and data region f describes, and updates f to record it. There is an entry
+// for each node, in file order, holding the checksum of the node and, if the
+// tree has variable-length data, the checksum of its stored Data.
+func addChecksums(path string, f *footer, fsync *syncer) error {
+	fh, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer fh.Close()
+	t := &Tree{r: fh, root: f.root, count: f.count, nodelen: f.nodeSize(),
+		footer: *f}
+
+	_, err = fh.Seek(t.checksumsOffset(), 0)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	w := bufio.NewWriter(fsync.writer(fh))
+	var entry [2 * checksumSize]byte
+	for offset := int64(0); offset < t.count*t.nodelen; offset += t.nodelen {
+		data := make([]byte, t.nodelen)
+		_, err = fh.ReadAt(data, offset)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+		binary.LittleEndian.PutUint32(entry[:], nodeChecksum(data))
+		if f.variableData {
+			n, err := parseNode(data, f.dims, f.coords())
+			if err != nil {
+				return err
+			}
+			stored, err := t.readStoredData(n.Point.Data)
+			if err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint32(entry[checksumSize:],
+				crc32.Checksum(stored, crcTable))
+		}
+		_, err = w.Write(entry[:f.checksumEntrySize()])
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	f.checksums = true
+	return errClass.Wrap(fh.Close())
+}
+
+// checksumsOffset is where the checksum table starts, after the nodes and
+// the data region.
+func (t *Tree) checksumsOffset() int64 {
+	return t.count*t.nodelen + t.footer.dataLen
+}
+
+// checksumEntry reads the checksum table entry of the node at offset.
+func (t *Tree) checksumEntry(offset int64) ([]byte, error) {
+	size := t.footer.checksumEntrySize()
+	entry := make([]byte, size)
+	_, err := t.r.ReadAt(entry, t.checksumsOffset()+offset/t.nodelen*size)
+	return entry, errClass.Wrap(err)
+}
+
+// verifyNode checks the serialized node data at offset against its checksum.
+func (t *Tree) verifyNode(offset int64, data []byte) error {
+	entry, err := t.checksumEntry(offset)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(entry) != nodeChecksum(data) {
+		return ErrChecksum.New("node at offset %d", offset)
+	}
+	return nil
+}
+
+// verifyData checks the stored Data of the node at offset against its
+// checksum.
+func (t *Tree) verifyData(offset int64, stored []byte) error {
+	entry, err := t.checksumEntry(offset)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(entry[checksumSize:]) !=
+		crc32.Checksum(stored, crcTable) {
+		return ErrChecksum.New("data of node at offset %d", offset)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"os"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	for _, opts := range []BuildOptions{
+		{Checksums: true},
+		{Checksums: true, DataCompression: FlateCompression}} {
+		tree := createTestTree(t, fs, 3, 10, points, opts)
+		tree.Close()
+
+		rw, err := OpenRW(tree.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rw.footer.checksums {
+			t.Fatal("checksums not recorded")
+		}
+		// tombstones and counts aren't covered by the checksums
+		err = rw.Delete(points[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range points[1:] {
+			nearest, err := rw.Nearest(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			AssertPointsEqual(nearest[0].Point, p)
+		}
+
+		corrupt := func(offset int64) {
+			fh, err := os.OpenFile(tree.path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fh.Close()
+			var b [1]byte
+			_, err = fh.ReadAt(b[:], offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b[0] ^= 0x10
+			_, err = fh.WriteAt(b[:], offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		expectMismatch := func() {
+			err := rw.Each(func(Point) error { return nil })
+			if !ErrChecksum.Contains(err) {
+				t.Fatalf("expected a checksum mismatch, got %v", err)
+			}
+		}
+
+		if rw.footer.variableData {
+			// the last byte of the data region
+			corrupt(rw.checksumsOffset() - 1)
+			expectMismatch()
+			corrupt(rw.checksumsOffset() - 1)
+		}
+		// a coordinate of the last node
+		corrupt(rw.count*rw.nodelen - rw.nodelen + pointHeaderSize)
+		expectMismatch()
+		rw.Close()
+	}
+}
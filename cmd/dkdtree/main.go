@@ -0,0 +1,532 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command dkdtree builds, queries and inspects dkdtree files.
+//
+// Usage:
+//
+//	dkdtree build [flags] <tree> [input]
+//	dkdtree knn [-n count] [-ids] <tree> <x,y,...>
+//	dkdtree within [-r radius] <tree> <x,y,...>
+//	dkdtree range <tree> <min x,y,...> <max x,y,...>
+//	dkdtree inspect <tree>
+//	dkdtree verify <tree>
+//	dkdtree dump [-format csv|jsonl] [-data text|base64|hex] [-ids] <tree>
+//	dkdtree knngraph [-k count] [-format csv|edges|mtx] <tree>
+//
+// build reads points from input, or standard input, as CSV with one
+// coordinate per column followed by an optional Data column, or as JSON
+// lines of the form {"pos": [x, y, ...], "data": "..."}, or as a NumPy .npy
+// matrix of coordinates with -format npy. Query results are
+// written as JSON lines of the same form, with a "distance" field for knn.
+// dump writes every point in the tree in either form. With -ids, knn and
+// dump also write each point's ID, which identifies it to Tree.Get.
+// knngraph writes the graph linking each point to its k nearest neighbors by
+// ID, as a CSV edge list, a space-separated weighted edge list or a Matrix
+// Market matrix.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jtolds/dkdtree"
+)
+
+var commands = map[string]func(args []string) error{
+	"build":    build,
+	"knn":      knn,
+	"within":   within,
+	"range":    rangeQuery,
+	"inspect":  inspect,
+	"verify":   verify,
+	"dump":     dump,
+	"knngraph": knnGraph,
+	"tune":     tune,
+}
+
+var dataEncodings = map[string]dkdtree.DataEncoding{
+	"text":   dkdtree.TextData,
+	"base64": dkdtree.Base64Data,
+	"hex":    dkdtree.HexData,
+}
+
+var layoutNames = map[dkdtree.Layout]string{
+	dkdtree.PreorderLayout:       "preorder",
+	dkdtree.CacheObliviousLayout: "cache-oblivious",
+	dkdtree.BlockedLayout:        "blocked",
+}
+
+var splitNames = map[dkdtree.SplitStrategy]string{
+	dkdtree.MedianSplit:          "median",
+	dkdtree.SlidingMidpointSplit: "sliding-midpoint",
+	dkdtree.SurfaceAreaSplit:     "surface-area",
+}
+
+var dimensionNames = map[dkdtree.DimensionChoice]string{
+	dkdtree.CycleDimensions:   "cycle",
+	dkdtree.WidestDimension:   "widest",
+	dkdtree.VarianceDimension: "variance",
+}
+
+var syncNames = map[dkdtree.SyncPolicy]string{
+	dkdtree.SyncOnFinish: "finish",
+	dkdtree.SyncNever:    "never",
+	dkdtree.SyncPeriodic: "periodic",
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprintln(os.Stderr,
+			"usage: dkdtree build|knn|within|range|inspect|verify|dump|"+
+				"knngraph|tune [flags] <tree> ...")
+		os.Exit(2)
+	}
+	err := commands[os.Args[1]](os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dkdtree %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// parseFlags parses args with flags, requiring exactly nargs positional
+// arguments, or at least nargs if optional is set.
+func parseFlags(flags *flag.FlagSet, args []string, nargs int,
+	optional bool) ([]string, error) {
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	rest := flags.Args()
+	if len(rest) < nargs || (!optional && len(rest) > nargs) {
+		return nil, fmt.Errorf("expected %d arguments, got %d", nargs,
+			len(rest))
+	}
+	return rest, nil
+}
+
+func build(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	dims := flags.Int("dims", 0, "number of dimensions (required)")
+	maxDataLen := flags.Int("max-data", 0, "longest Data of any point")
+	format := flags.String("format", "csv", "input format: csv, jsonl or npy")
+	npyData := flags.String("npy-data", "", ".npy file of Data for -format npy")
+	header := flags.Bool("header", false, "skip the first CSV record")
+	layout := flags.String("layout", "preorder",
+		"node layout: preorder, cache-oblivious or blocked")
+	variable := flags.Bool("variable-data", false, "store Data unpadded")
+	checksums := flags.Bool("checksums", false, "store node checksums")
+	float32s := flags.Bool("float32", false, "store coordinates as float32s")
+	codec := flags.String("codec", "",
+		"coordinate codec: quantized8, quantized16 or quantized32")
+	boxes := flags.Bool("boxes", false, "store subtree bounding boxes")
+	leafSize := flags.Int("leaf-size", 0,
+		"read subtrees of up to this many points in one read")
+	normalize := flags.Bool("normalize", false,
+		"standardize each dimension by its mean and standard deviation")
+	syncPolicy := flags.String("sync", "finish",
+		"when to sync the tree file: finish, never or periodic")
+	syncBytes := flags.Int64("sync-bytes", 64<<20,
+		"bytes written between syncs with -sync periodic")
+	tmpdir := flags.String("tmp", os.TempDir(), "directory for temporary files")
+	direct := flags.Bool("direct-io", false,
+		"bypass the page cache for temporary files")
+	split := flags.String("split", "median",
+		"split strategy: median, sliding-midpoint or surface-area")
+	splitDim := flags.String("split-dim", "cycle",
+		"split dimension choice: cycle, widest or variance")
+	checkpointDir := flags.String("checkpoint-dir", "",
+		"directory to checkpoint the build in, resuming if interrupted")
+	positionIndex := flags.String("position-index", "",
+		"also write a positions-only index of the tree to this path")
+	rest, err := parseFlags(flags, args, 1, true)
+	if err != nil {
+		return err
+	}
+	if *dims <= 0 {
+		return fmt.Errorf("-dims is required")
+	}
+	if len(rest) > 2 {
+		return fmt.Errorf("expected at most 2 arguments, got %d", len(rest))
+	}
+
+	opts := dkdtree.BuildOptions{VariableData: *variable,
+		Checksums: *checksums, Float32: *float32s, Boxes: *boxes,
+		LeafSize: *leafSize, Normalize: *normalize, SyncBytes: *syncBytes,
+		DirectIO: *direct, CheckpointDir: *checkpointDir,
+		PositionIndex: *positionIndex}
+	if *codec != "" {
+		opts.CoordinateCodec = dkdtree.LookupCoordinateCodec(*codec)
+		if opts.CoordinateCodec == nil {
+			return fmt.Errorf("unknown coordinate codec %q", *codec)
+		}
+	}
+	found := false
+	for l, name := range layoutNames {
+		if name == *layout {
+			opts.Layout, found = l, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown layout %q", *layout)
+	}
+	found = false
+	for s, name := range splitNames {
+		if name == *split {
+			opts.SplitStrategy, found = s, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown split strategy %q", *split)
+	}
+	found = false
+	for c, name := range dimensionNames {
+		if name == *splitDim {
+			opts.SplitDimension, found = c, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown split dimension choice %q", *splitDim)
+	}
+	found = false
+	for s, name := range syncNames {
+		if name == *syncPolicy {
+			opts.Sync, found = s, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown sync policy %q", *syncPolicy)
+	}
+
+	in := io.Reader(os.Stdin)
+	if len(rest) == 2 {
+		fh, err := os.Open(rest[1])
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		in = fh
+	}
+
+	setPath := filepath.Join(*tmpdir,
+		fmt.Sprintf("dkdtree-%d.points", os.Getpid()))
+	set, err := dkdtree.NewPointSet(setPath, *dims, *maxDataLen)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(setPath)
+	switch *format {
+	case "csv":
+		_, err = set.LoadCSV(in, dkdtree.LoadOptions{Header: *header})
+	case "jsonl":
+		_, err = set.LoadJSONL(in, dkdtree.LoadOptions{})
+	case "npy":
+		var data io.Reader
+		if *npyData != "" {
+			fh, err := os.Open(*npyData)
+			if err != nil {
+				set.Close()
+				return err
+			}
+			defer fh.Close()
+			data = fh
+		}
+		_, err = set.LoadNPY(in, data)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		set.Close()
+		return err
+	}
+	tree, err := dkdtree.CreateTreeWithOptions(rest[0], *tmpdir, set, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("built %d points\n", tree.Count())
+	return tree.Close()
+}
+
+func parsePos(s string) ([]float64, error) {
+	var pos []float64
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		pos = append(pos, v)
+	}
+	return pos, nil
+}
+
+// query opens the tree at args[0], parses the positions that follow it and
+// calls fn, which writes out the points it finds as JSON lines with enc.
+func query(args []string, opts dkdtree.ExportOptions,
+	fn func(t *dkdtree.Tree, pos [][]float64,
+		enc *dkdtree.PointEncoder) error) error {
+	t, err := dkdtree.OpenTree(args[0])
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	var pos [][]float64
+	for _, arg := range args[1:] {
+		p, err := parsePos(arg)
+		if err != nil {
+			return err
+		}
+		pos = append(pos, p)
+	}
+	enc := dkdtree.NewJSONLEncoder(os.Stdout, opts)
+	err = fn(t, pos, enc)
+	if err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+func dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	format := flags.String("format", "jsonl", "output format: csv or jsonl")
+	data := flags.String("data", "text", "Data encoding: text, base64 or hex")
+	header := flags.Bool("header", false, "start CSV with a header record")
+	ids := flags.Bool("ids", false, "write point IDs")
+	rest, err := parseFlags(flags, args, 1, false)
+	if err != nil {
+		return err
+	}
+	opts := dkdtree.ExportOptions{Header: *header, IDs: *ids}
+	var ok bool
+	opts.Data, ok = dataEncodings[*data]
+	if !ok {
+		return fmt.Errorf("unknown Data encoding %q", *data)
+	}
+	var enc *dkdtree.PointEncoder
+	switch *format {
+	case "csv":
+		enc = dkdtree.NewCSVEncoder(os.Stdout, opts)
+	case "jsonl":
+		enc = dkdtree.NewJSONLEncoder(os.Stdout, opts)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	t, err := dkdtree.OpenTree(rest[0])
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	return t.Encode(enc)
+}
+
+var graphFormats = map[string]dkdtree.GraphFormat{
+	"csv":   dkdtree.EdgeListCSV,
+	"edges": dkdtree.WeightedEdgeList,
+	"mtx":   dkdtree.MatrixMarket,
+}
+
+func knnGraph(args []string) error {
+	flags := flag.NewFlagSet("knngraph", flag.ContinueOnError)
+	k := flags.Int("k", 10, "number of neighbors per point")
+	format := flags.String("format", "csv", "output format: csv, edges or mtx")
+	rest, err := parseFlags(flags, args, 1, false)
+	if err != nil {
+		return err
+	}
+	f, ok := graphFormats[*format]
+	if !ok {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	t, err := dkdtree.OpenTree(rest[0])
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	return t.WriteKNNGraph(os.Stdout, *k, f)
+}
+
+func knn(args []string) error {
+	flags := flag.NewFlagSet("knn", flag.ContinueOnError)
+	n := flags.Int("n", 1, "number of neighbors")
+	ids := flags.Bool("ids", false, "write point IDs")
+	rest, err := parseFlags(flags, args, 2, false)
+	if err != nil {
+		return err
+	}
+	return query(rest, dkdtree.ExportOptions{IDs: *ids},
+		func(t *dkdtree.Tree, pos [][]float64,
+			enc *dkdtree.PointEncoder) error {
+			// queries on a normalized tree are normalized the same way
+			var searcher dkdtree.Searcher = t
+			if t.Normalization() != nil {
+				searcher, err = dkdtree.NewTransformedTree(t, nil)
+				if err != nil {
+					return err
+				}
+			}
+			nearest, err := searcher.Nearest(dkdtree.Point{Pos: pos[0]}, *n)
+			if err != nil {
+				return err
+			}
+			for _, pd := range nearest {
+				err = enc.EncodeDistance(pd)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+}
+
+func within(args []string) error {
+	flags := flag.NewFlagSet("within", flag.ContinueOnError)
+	radius := flags.Float64("r", 0, "radius")
+	rest, err := parseFlags(flags, args, 2, false)
+	if err != nil {
+		return err
+	}
+	return query(rest, dkdtree.ExportOptions{},
+		func(t *dkdtree.Tree, pos [][]float64,
+			enc *dkdtree.PointEncoder) error {
+			return t.WithinFunc(dkdtree.Point{Pos: pos[0]}, *radius,
+				enc.Encode)
+		})
+}
+
+func rangeQuery(args []string) error {
+	flags := flag.NewFlagSet("range", flag.ContinueOnError)
+	rest, err := parseFlags(flags, args, 3, false)
+	if err != nil {
+		return err
+	}
+	return query(rest, dkdtree.ExportOptions{},
+		func(t *dkdtree.Tree, pos [][]float64,
+			enc *dkdtree.PointEncoder) error {
+			return t.Range(pos[0], pos[1], enc.Encode)
+		})
+}
+
+func inspect(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	rest, err := parseFlags(flags, args, 1, false)
+	if err != nil {
+		return err
+	}
+	t, err := dkdtree.OpenTree(rest[0])
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	info := t.Info()
+
+	stats, err := t.Stats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("format version: %d\n", info.Version)
+	fmt.Printf("file size:      %d\n", stats.FileSize)
+	fmt.Printf("dimensions:     %d\n", info.Dims)
+	fmt.Printf("max data len:   %d\n", info.MaxDataLen)
+	fmt.Printf("points:         %d (%d deleted, %d pending)\n", stats.Nodes,
+		stats.Deleted, stats.Pending)
+	fmt.Printf("depth:          %d\n", stats.Depth)
+	fmt.Printf("min:            %v\n", info.Min)
+	fmt.Printf("max:            %v\n", info.Max)
+	fmt.Printf("layout:         %s\n", layoutNames[info.Options.Layout])
+	fmt.Printf("variable data:  %v\n", info.Options.VariableData)
+	fmt.Printf("compressed:     %v\n",
+		info.Options.DataCompression != dkdtree.NoCompression)
+	fmt.Printf("checksums:      %v\n", info.Options.Checksums)
+	fmt.Printf("float32:        %v\n", info.Options.Float32)
+	if c := info.Options.CoordinateCodec; c != nil {
+		fmt.Printf("codec:          %s\n", c.Name())
+	}
+	fmt.Printf("boxes:          %v\n", info.Options.Boxes)
+	if tf := info.Options.TagField; tf != nil {
+		fmt.Printf("tag field:      %d bytes at offset %d\n", tf.Width, tf.Offset)
+	}
+	fmt.Printf("leaf size:      %d\n", info.Options.LeafSize)
+	fmt.Printf("split:          %s\n", splitNames[info.Options.SplitStrategy])
+	fmt.Printf("split dim:      %s\n",
+		dimensionNames[info.Options.SplitDimension])
+	fmt.Printf("grid:           %d\n", info.Options.GridResolution)
+	if n := info.Options.Normalization; n != nil {
+		fmt.Printf("mean:           %v\n", n.Mean)
+		fmt.Printf("std dev:        %v\n", n.StdDev)
+	}
+	for i, level := range stats.Levels {
+		fmt.Printf("level %3d:      %d nodes, imbalance %.3f mean, %.3f max\n",
+			i, level.Nodes, level.MeanImbalance, level.MaxImbalance)
+	}
+	return nil
+}
+
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	rest, err := parseFlags(flags, args, 1, false)
+	if err != nil {
+		return err
+	}
+	err = dkdtree.VerifyTree(rest[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func tune(args []string) error {
+	flags := flag.NewFlagSet("tune", flag.ContinueOnError)
+	queries := flags.Int("queries", 200, "number of points to query with")
+	k := flags.Int("k", 10, "number of nearest points to query for")
+	tmpdir := flags.String("tmp", os.TempDir(),
+		"directory to build candidate trees in")
+	rest, err := parseFlags(flags, args, 1, false)
+	if err != nil {
+		return err
+	}
+	t, err := dkdtree.OpenTree(rest[0])
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	results, err := t.Tune(context.Background(), dkdtree.TuneOptions{
+		TmpDir: *tmpdir, Queries: *queries, K: *k})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-16s %5s %12s %12s %12s %10s %10s\n", "layout", "leaf",
+		"cache bytes", "build", "latency", "nodes", "bytes")
+	for _, r := range results {
+		fmt.Printf("%-16s %5d %12d %12v %12v %10.1f %10.0f\n",
+			layoutNames[r.Build.Layout], r.Build.LeafSize, r.CacheBytes,
+			r.BuildTime.Round(time.Millisecond), r.Latency, r.NodesVisited,
+			r.BytesRead)
+	}
+	if len(results) > 0 {
+		best := results[0]
+		fmt.Printf("suggested: build with -layout %s -leaf-size %d, "+
+			"open with CacheBytes %d\n", layoutNames[best.Build.Layout],
+			best.Build.LeafSize, best.CacheBytes)
+	}
+	return nil
+}
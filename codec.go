@@ -0,0 +1,245 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// CoordinateCodec stores the coordinates of a tree's points in a compact,
+// fixed-size encoding in place of float64s. See BuildOptions.CoordinateCodec.
+//
+// Encodings are relative to the bounds of the tree, and may be lossy, but
+// they must preserve order along each dimension, so that the tree's splits
+// still hold, and decode to coordinates within the bounds. Encoding decoded
+// coordinates again must give back the same coordinates, so that rebuilding
+// a tree doesn't lose more precision.
+type CoordinateCodec interface {
+	// Name identifies the codec. It is recorded in trees built with the
+	// codec, which can only be opened once a codec of the same name is
+	// registered. See RegisterCoordinateCodec.
+	Name() string
+	// Size returns the size of an encoded position with dims coordinates.
+	Size(dims int) int
+	// Encode encodes pos into dst, which is Size(len(pos)) bytes long. min
+	// and max bound pos and every other point in the tree.
+	Encode(dst []byte, pos, min, max []float64)
+	// Decode decodes src, as encoded with the same min and max, into pos.
+	Decode(pos []float64, src []byte, min, max []float64)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]CoordinateCodec{}
+)
+
+// RegisterCoordinateCodec makes c available to trees that record its name.
+// The quantized codecs are registered already. Registering a second codec
+// under the same name replaces the first.
+func RegisterCoordinateCodec(c CoordinateCodec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// LookupCoordinateCodec returns the registered codec with the given name, or
+// nil if there isn't one.
+func LookupCoordinateCodec(name string) CoordinateCodec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[name]
+}
+
+// QuantizedCodec stores each coordinate as an unsigned integer of Bits bits,
+// spreading the integers evenly over the tree's extent along its dimension.
+// A coordinate is off by at most half the extent divided by 2^Bits-1, so for
+// longitudes, 16 bits are good to within about 300m, and 32 bits to within
+// a few centimeters. Bits must be 8, 16 or 32.
+type QuantizedCodec struct {
+	Bits int
+}
+
+// The quantized codecs, for BuildOptions.CoordinateCodec.
+var (
+	Quantized8  = QuantizedCodec{Bits: 8}
+	Quantized16 = QuantizedCodec{Bits: 16}
+	Quantized32 = QuantizedCodec{Bits: 32}
+)
+
+func init() {
+	RegisterCoordinateCodec(Quantized8)
+	RegisterCoordinateCodec(Quantized16)
+	RegisterCoordinateCodec(Quantized32)
+}
+
+func (c QuantizedCodec) Name() string {
+	return fmt.Sprintf("quantized%d", c.Bits)
+}
+
+func (c QuantizedCodec) Size(dims int) int { return dims * c.Bits / 8 }
+
+func (c QuantizedCodec) Encode(dst []byte, pos, min, max []float64) {
+	steps := float64(uint64(1)<<uint(c.Bits) - 1)
+	for i, v := range pos {
+		var q uint32
+		if max[i] > min[i] {
+			q = uint32(math.Round(
+				math.Max(0, math.Min(1, (v-min[i])/(max[i]-min[i]))) * steps))
+		}
+		switch c.Bits {
+		case 8:
+			dst[i] = byte(q)
+		case 16:
+			binary.LittleEndian.PutUint16(dst[i*2:], uint16(q))
+		default:
+			binary.LittleEndian.PutUint32(dst[i*4:], q)
+		}
+	}
+}
+
+func (c QuantizedCodec) Decode(pos []float64, src []byte, min, max []float64) {
+	steps := uint64(1)<<uint(c.Bits) - 1
+	for i := range pos {
+		var q uint64
+		switch c.Bits {
+		case 8:
+			q = uint64(src[i])
+		case 16:
+			q = uint64(binary.LittleEndian.Uint16(src[i*2:]))
+		default:
+			q = uint64(binary.LittleEndian.Uint32(src[i*4:]))
+		}
+		// the ends are exact, so the tree's bounds still bound its points
+		switch q {
+		case 0:
+			pos[i] = min[i]
+		case steps:
+			pos[i] = max[i]
+		default:
+			pos[i] = math.Min(max[i],
+				min[i]+float64(q)/float64(steps)*(max[i]-min[i]))
+		}
+	}
+}
+
+func (c QuantizedCodec) check() error {
+	if c.Bits != 8 && c.Bits != 16 && c.Bits != 32 {
+		return errClass.New("quantized codecs need 8, 16 or 32 bits, not %d",
+			c.Bits)
+	}
+	return nil
+}
+
+// checkCodec validates the coordinate codec of opts, if any.
+func checkCodec(opts BuildOptions) error {
+	c := opts.CoordinateCodec
+	if c == nil {
+		return nil
+	}
+	if opts.Float32 {
+		return errClass.New("Float32 can't be combined with a coordinate codec")
+	}
+	if q, ok := c.(QuantizedCodec); ok {
+		err := q.check()
+		if err != nil {
+			return err
+		}
+	}
+	if LookupCoordinateCodec(c.Name()) == nil {
+		return ErrUnsupported.New("coordinate codec %q isn't registered",
+			c.Name())
+	}
+	return nil
+}
+
+// coords is how the coordinates of a tree's points are serialized: as
+// float64s or float32s, by point serialization version, or encoded by a
+// codec relative to the tree's bounds.
+type coords struct {
+	version  byte
+	codec    CoordinateCodec
+	min, max []float64
+}
+
+// posSize returns the size of the coordinates of a point with dims
+// dimensions serialized with version, which may differ from c's, as it
+// comes from the point itself.
+func (c coords) posSize(version byte, dims int) (int, error) {
+	if dims < 0 || int64(dims) > maxInt/float64Size {
+		// a corrupt header, or on 32-bit platforms, more dimensions than
+		// an int can size
+		return 0, ErrCorrupt.New("point has %d dimensions", uint32(dims))
+	}
+	switch version {
+	case pointVersionFloat64:
+		return dims * float64Size, nil
+	case pointVersionFloat32:
+		return dims * float32Size, nil
+	case pointVersionEncoded:
+		if c.codec == nil {
+			return 0, ErrCorrupt.New("encoded coordinates without a codec")
+		}
+		if dims != len(c.min) {
+			return 0, ErrCorrupt.New(
+				"point has %d dimensions, expected %d", dims, len(c.min))
+		}
+		return c.codec.Size(dims), nil
+	}
+	return 0, ErrCorrupt.New("invalid serialization version")
+}
+
+// decode decodes the coordinates at the start of body, serialized with
+// version and already known to fit, into pos.
+func (c coords) decode(version byte, body []byte, pos []float64) {
+	switch version {
+	case pointVersionFloat32:
+		for i := range pos {
+			pos[i] = float64(math.Float32frombits(
+				binary.LittleEndian.Uint32(body[i*float32Size:])))
+		}
+	case pointVersionEncoded:
+		c.codec.Decode(pos, body, c.min, c.max)
+	default:
+		for i := range pos {
+			pos[i] = math.Float64frombits(
+				binary.LittleEndian.Uint64(body[i*float64Size:]))
+		}
+	}
+}
+
+// round returns pos as it reads back once serialized, for matching points
+// against a tree's stored coordinates.
+func (c coords) round(pos []float64) []float64 {
+	switch c.version {
+	case pointVersionFloat32:
+		return roundFloat32s(pos)
+	case pointVersionEncoded:
+		for i, v := range pos {
+			// encoding would clamp it to a stored point it isn't
+			if v < c.min[i] || v > c.max[i] {
+				return pos
+			}
+		}
+		buf := make([]byte, c.codec.Size(len(pos)))
+		c.codec.Encode(buf, pos, c.min, c.max)
+		rv := make([]float64, len(pos))
+		c.codec.Decode(rv, buf, c.min, c.max)
+		return rv
+	}
+	return pos
+}
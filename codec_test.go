@@ -0,0 +1,156 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// renamedCodec is a quantized codec registered under another name.
+type renamedCodec struct {
+	QuantizedCodec
+	name string
+}
+
+func (c renamedCodec) Name() string { return c.name }
+
+func TestCoordinateCodec(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	wide := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer wide.Close()
+	for _, opts := range []BuildOptions{
+		{CoordinateCodec: Quantized16},
+		{CoordinateCodec: Quantized32},
+		{CoordinateCodec: Quantized8, VariableData: true, Checksums: true,
+			Boxes: true}} {
+		codec := opts.CoordinateCodec.(QuantizedCodec)
+		tree := createTestTree(t, fs, 3, 10, points, opts)
+		if !opts.VariableData &&
+			tree.nodelen != wide.nodelen-3*float64Size+int64(codec.Size(3)) {
+			t.Fatalf("%+v: got nodes of %d bytes", opts, tree.nodelen)
+		}
+		if info := tree.Info(); info.Options.CoordinateCodec != codec ||
+			info.Version != footerVersionCodec {
+			t.Fatalf("%+v: codec not recorded: %+v", opts, info)
+		}
+		err := tree.Verify()
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+
+		var stored []Point
+		err = tree.Each(func(p Point) error {
+			stored = append(stored, p)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range points {
+			nearest, err := tree.Nearest(points[i], 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := nearest[0].Point
+			for j, v := range points[i].Pos {
+				step := (wide.footer.max[j] - wide.footer.min[j]) /
+					float64(uint64(1)<<uint(codec.Bits)-1)
+				if math.Abs(got.Pos[j]-v) > step/2*(1+1e-9) {
+					t.Fatalf("%+v: %v decoded as %v", opts, v, got.Pos[j])
+				}
+			}
+			if codec.Bits > 8 && !bytes.Equal(got.Data, points[i].Data) {
+				t.Fatalf("%+v: wrong point found", opts)
+			}
+
+			// searches are exact over the decoded coordinates
+			q := NewPoint(3, 1)
+			nearest, err = tree.Nearest(q, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dists := make([]float64, 0, len(stored))
+			for j := range stored {
+				dists = append(dists, q.distanceSquared(&stored[j]))
+			}
+			sort.Float64s(dists)
+			for j, pd := range nearest {
+				if pd.Distance != dists[j] {
+					t.Fatalf("%+v: result %d at %v, expected %v", opts, j,
+						pd.Distance, dists[j])
+				}
+			}
+		}
+		tree.Close()
+
+		rw, err := OpenRW(tree.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rw.Delete(points[rand.Intn(len(points))])
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		err = rw.Compact(fs.Temp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rw.Count() != int64(len(points)-1) || rw.footer.codec != codec {
+			t.Fatal("compaction lost a point or the codec")
+		}
+		rw.Close()
+	}
+
+	for _, opts := range []BuildOptions{
+		{CoordinateCodec: Quantized16, Float32: true},
+		{CoordinateCodec: QuantizedCodec{Bits: 12}},
+		{CoordinateCodec: renamedCodec{Quantized16, "unregistered"}}} {
+		log, err := NewPointSet(fs.Temp(), 3, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = CreateTreeWithOptions(fs.Path(tempName("")), fs.Temp(), log,
+			opts)
+		if err == nil {
+			t.Fatalf("%+v: expected the codec to be refused", opts)
+		}
+		log.Close()
+	}
+	_, err := CreateTreeInMemory(3, 10, points,
+		BuildOptions{CoordinateCodec: Quantized16})
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected in-memory trees to refuse codecs, got %v", err)
+	}
+
+	custom := renamedCodec{Quantized16, "test-codec"}
+	RegisterCoordinateCodec(custom)
+	tree := createTestTree(t, fs, 3, 10, points,
+		BuildOptions{CoordinateCodec: custom})
+	tree.Close()
+	codecsMu.Lock()
+	delete(codecs, custom.Name())
+	codecsMu.Unlock()
+	_, err = OpenTree(tree.path)
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected an unregistered codec to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+// cursorStep is a node on a NodeCursor's path from the root, with the
+// bounds of its subtree. Steps aren't modified once made, so clones of a
+// cursor share them.
+type cursorStep struct {
+	offset int64
+	n      Node
+	b      box
+}
+
+// NodeCursor is a position among a tree's nodes, for searches the package
+// doesn't provide, such as best-first searches with bounds of their own. It
+// starts at the root and moves down to either child and back up, tracking
+// the bounding box of the current node's subtree. Cursors are cheap to
+// Clone, so a search can keep one for each subtree it has yet to visit.
+// Points inserted but not yet merged aren't in any node.
+type NodeCursor struct {
+	t    *Tree
+	path []cursorStep
+}
+
+// Cursor returns a cursor at the root of the tree, or an error if the tree
+// has no nodes.
+func (t *Tree) Cursor() (*NodeCursor, error) {
+	if t.root == -1 {
+		return nil, errClass.New("tree is empty")
+	}
+	c := &NodeCursor{t: t}
+	return c, c.push(t.root, t.bounds())
+}
+
+// push moves the cursor to the node at offset, whose subtree b bounds.
+func (c *NodeCursor) push(offset int64, b box) error {
+	_, err := c.t.tightenBox(offset, &b)
+	if err != nil {
+		return err
+	}
+	n, err := c.t.Node(offset)
+	if err != nil {
+		return err
+	}
+	c.path = append(c.path, cursorStep{offset: offset, n: n, b: b})
+	return nil
+}
+
+func (c *NodeCursor) top() *cursorStep { return &c.path[len(c.path)-1] }
+
+// Node returns the node at the cursor.
+func (c *NodeCursor) Node() Node { return c.top().n }
+
+// Offset returns the offset of the node at the cursor, for Tree.Node.
+func (c *NodeCursor) Offset() int64 { return c.top().offset }
+
+// ID returns the ID of the point at the cursor, as in PointDistance.ID.
+func (c *NodeCursor) ID() uint64 { return c.t.pointID(c.top().offset) }
+
+// Depth returns the number of moves down from the root to the cursor.
+func (c *NodeCursor) Depth() int { return len(c.path) - 1 }
+
+// Bounds returns a box bounding every point in the subtree at the cursor:
+// the tree's bounds, narrowed by the splits of the nodes above, and by the
+// subtree's stored box if the tree has BuildOptions.Boxes.
+func (c *NodeCursor) Bounds() (min, max []float64) {
+	b := &c.top().b
+	return append([]float64(nil), b.min...), append([]float64(nil), b.max...)
+}
+
+// Left moves the cursor to the left child of its node. If there is none,
+// it returns false and the cursor stays put.
+func (c *NodeCursor) Left() (bool, error) { return c.down(true) }
+
+// Right is Left, but for the right child.
+func (c *NodeCursor) Right() (bool, error) { return c.down(false) }
+
+func (c *NodeCursor) down(left bool) (bool, error) {
+	top := c.top()
+	child := top.n.Right
+	if left {
+		child = top.n.Left
+	}
+	if child == -1 {
+		return false, nil
+	}
+	b := box{
+		min: append([]float64(nil), top.b.min...),
+		max: append([]float64(nil), top.b.max...)}
+	if left {
+		b.max[top.n.Dim] = top.n.Split()
+	} else {
+		b.min[top.n.Dim] = top.n.Split()
+	}
+	err := c.push(child, b)
+	return err == nil, err
+}
+
+// Parent moves the cursor to the parent of its node. At the root, it
+// returns false and the cursor stays put.
+func (c *NodeCursor) Parent() bool {
+	if len(c.path) == 1 {
+		return false
+	}
+	c.path = c.path[:len(c.path)-1]
+	return true
+}
+
+// Clone returns a copy of the cursor that moves independently.
+func (c *NodeCursor) Clone() *NodeCursor {
+	return &NodeCursor{t: c.t, path: append([]cursorStep(nil), c.path...)}
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"container/heap"
+	"testing"
+)
+
+// cursorEntry is a cursor in a best-first search, keyed by the squared
+// distance from the query point to its subtree's bounds.
+type cursorEntry struct {
+	c        *NodeCursor
+	distance float64
+}
+
+type cursorQueue []cursorEntry
+
+func (q *cursorQueue) Len() int { return len(*q) }
+func (q *cursorQueue) Less(i, j int) bool {
+	return (*q)[i].distance < (*q)[j].distance
+}
+func (q *cursorQueue) Swap(i, j int)      { (*q)[i], (*q)[j] = (*q)[j], (*q)[i] }
+func (q *cursorQueue) Push(x interface{}) { *q = append(*q, x.(cursorEntry)) }
+func (q *cursorQueue) Pop() (i interface{}) {
+	i, *q = (*q)[len(*q)-1], (*q)[:len(*q)-1]
+	return i
+}
+
+func (q *cursorQueue) push(p *Point, c *NodeCursor) {
+	min, max := c.Bounds()
+	heap.Push(q, cursorEntry{c: c,
+		distance: (&box{min: min, max: max}).minDistance(p)})
+}
+
+func TestNodeCursor(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	for _, opts := range []BuildOptions{{}, {Boxes: true}} {
+		tree := createTestTree(t, fs, 3, 10, points, opts)
+
+		// a depth-first walk with one cursor visits every node once, within
+		// its bounds
+		c, err := tree.Cursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := map[uint64]bool{}
+		var walk func() int
+		walk = func() int {
+			n := c.Node()
+			if seen[c.ID()] {
+				t.Fatalf("%+v: node %d visited twice", opts, c.Offset())
+			}
+			seen[c.ID()] = true
+			min, max := c.Bounds()
+			if !(&box{min: min, max: max}).contains(n.Point.Pos) {
+				t.Fatalf("%+v: %v is outside %v to %v", opts, n.Point, min, max)
+			}
+			depth := c.Depth()
+			for _, move := range []func() (bool, error){c.Left, c.Right} {
+				ok, err := move()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok {
+					if c.Depth() != depth+1 {
+						t.Fatalf("%+v: moved to depth %d from %d", opts, c.Depth(),
+							depth)
+					}
+					walk()
+					if !c.Parent() || c.Offset() != c.path[depth].offset {
+						t.Fatalf("%+v: lost the way back up", opts)
+					}
+				}
+			}
+			return len(seen)
+		}
+		if walk() != len(points) || c.Depth() != 0 || c.Parent() {
+			t.Fatalf("%+v: walked %d of %d nodes", opts, len(seen), len(points))
+		}
+
+		// a best-first search with a cloned cursor per subtree finds the
+		// nearest point
+		for i := 0; i < 20; i++ {
+			p := NewPoint(3, 1)
+			expected, err := tree.Nearest(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			root, err := tree.Cursor()
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := &cursorQueue{}
+			q.push(&p, root)
+			var best *PointDistance
+			for q.Len() > 0 && (best == nil || (*q)[0].distance <= best.Distance) {
+				c := heap.Pop(q).(cursorEntry).c
+				n := c.Node()
+				if d := p.distanceSquared(&n.Point); best == nil || d < best.Distance {
+					best = &PointDistance{Point: n.Point, Distance: d, ID: c.ID()}
+				}
+				for _, move := range []func(*NodeCursor) (bool, error){
+					(*NodeCursor).Left, (*NodeCursor).Right} {
+					child := c.Clone()
+					ok, err := move(child)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if ok {
+						q.push(&p, child)
+					}
+				}
+			}
+			if best.ID != expected[0].ID || best.Distance != expected[0].Distance {
+				t.Fatalf("%+v: found %v, expected %v", opts, best, expected[0])
+			}
+		}
+		tree.Close()
+	}
+
+	empty := createTestTree(t, fs, 3, 10, nil, BuildOptions{})
+	defer empty.Close()
+	_, err := empty.Cursor()
+	if err == nil {
+		t.Fatal("expected an empty tree to have no cursor")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"sort"
+)
+
+// DiffMode says how DiffTrees matches the points of two trees.
+type DiffMode int
+
+const (
+	// DiffByContent matches points with the same position and Data,
+	// wherever they are in either tree. Duplicates are matched one for one,
+	// so a point stored twice in one tree and once in the other is a
+	// difference. Positions are compared as each tree stores them.
+	DiffByContent DiffMode = iota
+	// DiffByID matches the points with the same ID in each tree, which
+	// differ if their positions or Data do. The trees' generations, which
+	// are part of their IDs (see Tree.Get), are ignored.
+	DiffByID
+)
+
+// Difference is a point DiffTrees found in one tree but not the other.
+type Difference struct {
+	Point
+	// ID is the point's ID in the tree holding it.
+	ID uint64
+	// InA is set if the point is in a and not b, and unset if it is in b
+	// and not a.
+	InA bool
+}
+
+// DiffTrees compares the live and pending points of a and b, calling fn with
+// each point one holds that the other doesn't, matching points as mode says.
+// Neither tree is held in memory: by content, each point is looked up in
+// both trees, and by ID, the trees are read side by side. By content, the
+// differences in a come first and then those in b, each in the order of
+// their IDs; by ID, they come in the order of their IDs. It stops at and
+// returns the first error fn returns.
+func DiffTrees(a, b *Tree, mode DiffMode, fn func(Difference) error) error {
+	if a.footer.dims != b.footer.dims {
+		return ErrDimensionMismatch.New("trees have different dimensions: %d and %d",
+			a.footer.dims, b.footer.dims)
+	}
+	switch mode {
+	case DiffByContent:
+		err := diffContent(a, b, true, fn)
+		if err != nil {
+			return err
+		}
+		return diffContent(b, a, false, fn)
+	case DiffByID:
+		return diffIDs(a, b, fn)
+	default:
+		return errClass.New("unknown diff mode %d", mode)
+	}
+}
+
+// diffContent calls fn with each point of a that b has fewer copies of. Of
+// the copies of a point in a, those b has no match for are the ones with
+// the highest IDs.
+func diffContent(a, b *Tree, inA bool, fn func(Difference) error) error {
+	return a.eachID(func(p Point, id uint64) error {
+		ids, err := a.equalIDs(p)
+		if err != nil {
+			return err
+		}
+		matches, err := b.equalIDs(p)
+		if err != nil {
+			return err
+		}
+		if sort.Search(len(ids), func(i int) bool { return ids[i] >= id }) <
+			len(matches) {
+			return nil
+		}
+		return fn(Difference{Point: p, ID: id, InA: inA})
+	})
+}
+
+// equalIDs returns the IDs of the live and pending points in t equal to p,
+// in order, descending both sides of any split p ties with as Delete does.
+func (t *Tree) equalIDs(p Point) ([]uint64, error) {
+	p.Pos = t.footer.coords().round(p.Pos)
+	var ids []uint64
+	var find func(offset int64) error
+	find = func(offset int64) error {
+		if offset == -1 {
+			return nil
+		}
+		n, err := t.Node(offset)
+		if err != nil {
+			return err
+		}
+		if !n.Deleted && n.Point.equal(&p) {
+			ids = append(ids, t.pointID(offset))
+		}
+		split := n.Point.Pos[n.Dim]
+		if p.Pos[n.Dim] <= split {
+			err = find(n.Left)
+			if err != nil {
+				return err
+			}
+		}
+		if p.Pos[n.Dim] >= split {
+			return find(n.Right)
+		}
+		return nil
+	}
+	err := find(t.root)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for i, pending := range t.pending.snapshot() {
+		if pending.equal(&p) {
+			ids = append(ids, t.pointID(pendingOffset(i)))
+		}
+	}
+	return ids, nil
+}
+
+// diffIDs calls fn with the points of a and b whose IDs aren't held by an
+// equal point in the other tree.
+func diffIDs(a, b *Tree, fn func(Difference) error) error {
+	total := max(a.Count(), b.Count())
+	for index := uint64(0); index < uint64(total); index++ {
+		pa, okA, err := a.pointByIndex(index)
+		if err != nil {
+			return err
+		}
+		pb, okB, err := b.pointByIndex(index)
+		if err != nil {
+			return err
+		}
+		if okA && okB && pa.equal(&pb) {
+			continue
+		}
+		if okA {
+			err = fn(Difference{Point: pa, ID: a.indexID(index), InA: true})
+			if err != nil {
+				return err
+			}
+		}
+		if okB {
+			err = fn(Difference{Point: pb, ID: b.indexID(index)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pointByIndex returns the point with the given index, and false if there
+// is none or it is deleted.
+func (t *Tree) pointByIndex(index uint64) (Point, bool, error) {
+	if index >= uint64(t.count) {
+		pending := t.pending.snapshot()
+		if index-uint64(t.count) >= uint64(len(pending)) {
+			return Point{}, false, nil
+		}
+		return pending[index-uint64(t.count)], true, nil
+	}
+	n, err := t.Node(int64(index) * t.nodelen)
+	if err != nil || n.Deleted {
+		return Point{}, false, err
+	}
+	return n.Point, true, nil
+}
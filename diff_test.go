@@ -0,0 +1,106 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDiffTrees(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 2, 10)
+	// a duplicate, to be matched one for one
+	points = append(points, points[0])
+	full := createTestTree(t, fs, 2, 10, points, BuildOptions{})
+	defer full.Close()
+	partial := createTestTree(t, fs, 2, 10, points[:150], BuildOptions{})
+	partial.Close()
+	incremental, err := OpenRW(partial.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer incremental.Close()
+	for _, p := range points[150:] {
+		err = incremental.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diff := func(a, b *Tree, mode DiffMode) (rv []Difference) {
+		err := DiffTrees(a, b, mode, func(d Difference) error {
+			rv = append(rv, d)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rv
+	}
+	if d := diff(full, incremental, DiffByContent); len(d) != 0 {
+		t.Fatalf("unexpected differences %+v", d)
+	}
+
+	extra := NewPoint(2, 10)
+	err = incremental.Insert(extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = incremental.Delete(points[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := diff(full, incremental, DiffByContent)
+	if len(d) != 2 {
+		t.Fatalf("got %d differences, expected 2: %+v", len(d), d)
+	}
+	if !d[0].InA || !d[0].equal(&points[0]) {
+		t.Fatalf("expected the deleted copy to be only in a, got %+v", d[0])
+	}
+	if d[1].InA || !d[1].equal(&extra) {
+		t.Fatalf("expected the inserted point to be only in b, got %+v", d[1])
+	}
+
+	// a copy of the tree numbers its points the same way
+	data, err := os.ReadFile(full.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := fs.Path(tempName(""))
+	err = os.WriteFile(copied, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, err := OpenRW(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	if d := diff(full, rw, DiffByID); len(d) != 0 {
+		t.Fatalf("unexpected differences %+v", d)
+	}
+	err = rw.UpdateData(7, []byte("changed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = diff(full, rw, DiffByID)
+	if len(d) != 2 || d[0].ID != 7 || !d[0].InA || d[1].ID != 7 || d[1].InA ||
+		string(d[1].Data) != "changed" {
+		t.Fatalf("unexpected differences %+v", d)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// directAlign is the alignment of the buffers, offsets and lengths of
+	// reads and writes to files opened for direct I/O.
+	directAlign = 4096
+	// directBufferSize is how much is read or written to such files at once.
+	directBufferSize = 1 << 20
+)
+
+// alignedBuffer returns a buffer of size bytes starting at a multiple of
+// directAlign in memory.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directAlign)
+	skip := 0
+	rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directAlign - 1))
+	if rem != 0 {
+		skip = directAlign - rem
+	}
+	return buf[skip : skip+size : skip+size]
+}
+
+// openDirect opens path with flag and, where the platform and file system
+// support it, direct I/O, which bypasses the page cache. ok is false if the
+// file was opened without direct I/O.
+func openDirect(path string, flag int) (fh *os.File, ok bool, err error) {
+	if directFlag != 0 {
+		fh, err = os.OpenFile(path, flag|directFlag, 0644)
+		if err == nil {
+			return fh, true, nil
+		}
+		// some file systems, such as tmpfs, refuse direct I/O
+		if !errors.Is(err, syscall.EINVAL) {
+			return nil, false, err
+		}
+	}
+	fh, err = os.OpenFile(path, flag, 0644)
+	return fh, false, err
+}
+
+// createFile creates the file at path for writing, with direct I/O if direct
+// is set and it is supported.
+func createFile(path string, direct bool) (io.WriteCloser, error) {
+	if !direct {
+		return os.Create(path)
+	}
+	fh, ok, err := openDirect(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil || !ok {
+		return fh, err
+	}
+	return &directWriter{fh: fh, buf: alignedBuffer(directBufferSize)}, nil
+}
+
+// openFile opens the file at path for reading, with direct I/O if direct is
+// set and it is supported. Reads must be sequential.
+func openFile(path string, direct bool) (io.ReadCloser, error) {
+	if !direct {
+		return os.Open(path)
+	}
+	fh, ok, err := openDirect(path, os.O_RDONLY)
+	if err != nil || !ok {
+		return fh, err
+	}
+	return &directReader{fh: fh, buf: alignedBuffer(directBufferSize)}, nil
+}
+
+// directWriter writes sequentially to a file opened for direct I/O, in
+// aligned blocks. The last block is padded out to the alignment, and the
+// padding is truncated away on Close.
+type directWriter struct {
+	fh   *os.File
+	buf  []byte
+	n    int
+	size int64
+}
+
+func (w *directWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		c := copy(w.buf[w.n:], p)
+		w.n += c
+		written += c
+		p = p[c:]
+		if w.n == len(w.buf) {
+			err = w.flush()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *directWriter) flush() error {
+	n := (w.n + directAlign - 1) &^ (directAlign - 1)
+	for i := w.n; i < n; i++ {
+		w.buf[i] = 0
+	}
+	_, err := w.fh.Write(w.buf[:n])
+	w.size += int64(w.n)
+	w.n = 0
+	return err
+}
+
+func (w *directWriter) Close() error {
+	var err error
+	if w.n > 0 {
+		err = w.flush()
+	}
+	if err == nil {
+		err = w.fh.Truncate(w.size)
+	}
+	if err != nil {
+		w.fh.Close()
+		return err
+	}
+	return w.fh.Close()
+}
+
+// directReader reads sequentially from a file opened for direct I/O, in
+// aligned blocks.
+type directReader struct {
+	fh         *os.File
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+func (r *directReader) Read(p []byte) (int, error) {
+	for r.start == r.end {
+		if r.eof {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.fh, r.buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.eof, err = true, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.start, r.end = 0, n
+	}
+	n := copy(p, r.buf[r.start:r.end])
+	r.start += n
+	return n, nil
+}
+
+func (r *directReader) Close() error {
+	return r.fh.Close()
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestDirectFile(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	for _, size := range []int{0, 1, directAlign, directBufferSize + 17} {
+		data := make([]byte, size)
+		rand.Read(data)
+		path := fs.Temp()
+		w, err := createFile(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// odd write sizes, so writes straddle blocks
+		for rest := data; len(rest) > 0; {
+			n := 1 + rand.Intn(3000)
+			if n > len(rest) {
+				n = len(rest)
+			}
+			_, err = w.Write(rest[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := openFile(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: read back %d different bytes", size, len(got))
+		}
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(2000, 3, 10)
+	plain := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer plain.Close()
+	direct := createTestTree(t, fs, 3, 10, points, BuildOptions{DirectIO: true})
+	defer direct.Close()
+
+	for i := 0; i < 20; i++ {
+		q := NewPoint(3, 10)
+		expected, err := plain.Nearest(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := direct.Nearest(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(withoutIDs(got), withoutIDs(expected)) {
+			t.Fatalf("got %v, expected %v", got, expected)
+		}
+	}
+}
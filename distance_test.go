@@ -0,0 +1,51 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestSquaredDistance(t *testing.T) {
+	for dims := 1; dims <= 70; dims++ {
+		a, b := NewPoint(dims, 1), NewPoint(dims, 1)
+		var expected float64
+		for i := range a.Pos {
+			delta := a.Pos[i] - b.Pos[i]
+			expected += delta * delta
+		}
+		actual := squaredDistance(a.Pos, b.Pos)
+		if math.Abs(actual-expected) > 1e-12*expected {
+			t.Fatalf("%d dims: got %v, expected %v", dims, actual, expected)
+		}
+	}
+}
+
+func benchmarkSquaredDistance(b *testing.B, dims int) {
+	x, y := make([]float64, dims), make([]float64, dims)
+	for i := range x {
+		x[i], y[i] = rand.Float64(), rand.Float64()
+	}
+	var sum float64
+	for i := 0; i < b.N; i++ {
+		sum += squaredDistance(x, y)
+	}
+}
+
+func BenchmarkSquaredDistance3(b *testing.B)   { benchmarkSquaredDistance(b, 3) }
+func BenchmarkSquaredDistance128(b *testing.B) { benchmarkSquaredDistance(b, 128) }
+func BenchmarkSquaredDistance512(b *testing.B) { benchmarkSquaredDistance(b, 512) }
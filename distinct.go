@@ -0,0 +1,58 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"container/heap"
+)
+
+// NearestDistinct is Nearest, but returns at most one point for each key,
+// the nearest with that key, where key picks the key out of a point's Data.
+// This finds, say, the n nearest documents when each has many points, with
+// a document ID in its Data. The search carries on until it has n distinct
+// keys, which reads more of the tree the more points share a key, but far
+// less than asking Nearest for enough points to be sure of n keys. key must
+// not keep Data.
+func (t *Tree) NearestDistinct(p Point, n int, key func(data []byte) string) (
+	[]PointDistance, error) {
+	rv, _, err := t.nearest(n, &nearestQuery{p: p, key: key})
+	return rv, err
+}
+
+// addDistinct is add for queries with a key, keeping only the nearest point
+// for each key in h. It must be called with mu held if the query is shared.
+func (q *nearestQuery) addDistinct(n neighbor) {
+	k := q.key(n.Data)
+	if _, ok := q.keys[k]; ok {
+		// the point already kept for k is replaced if n comes before it
+		for i := range q.h {
+			if q.key(q.h[i].Data) == k {
+				if n.before(&q.h[i].PointDistance) {
+					q.h[i] = n
+					heap.Fix(&q.h, i)
+				}
+				return
+			}
+		}
+	}
+	if q.h.Len() >= q.h.Cap() {
+		if !n.before(&q.h[0].PointDistance) {
+			return
+		}
+		delete(q.keys, q.key(heap.Pop(&q.h).(neighbor).Data))
+	}
+	heap.Push(&q.h, n)
+	q.keys[k] = struct{}{}
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"testing"
+)
+
+func TestNearestDistinct(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	for i := range points {
+		points[i].Data = []byte{byte(i % 37), byte(i)}
+	}
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	key := func(data []byte) string { return string(data[:1]) }
+	for _, n := range []int{1, 10, 37, 50} {
+		for _, q := range newTestPoints(20, 3, 1) {
+			nearest, err := tree.NearestDistinct(q, n, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			all, err := tree.NearestExhaustive(q, len(points))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected []PointDistance
+			seen := map[string]bool{}
+			for _, pd := range all {
+				if !seen[key(pd.Data)] && len(expected) < n {
+					seen[key(pd.Data)] = true
+					expected = append(expected, pd)
+				}
+			}
+			if len(nearest) != len(expected) {
+				t.Fatalf("got %d points, expected %d", len(nearest),
+					len(expected))
+			}
+			for i := range expected {
+				AssertPointsEqual(nearest[i].Point, expected[i].Point)
+			}
+		}
+	}
+}
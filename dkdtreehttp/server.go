@@ -0,0 +1,480 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dkdtreehttp serves queries against open dkdtree trees over a small
+// JSON HTTP API.
+//
+// Every endpoint takes a tree parameter naming the tree to query, which may
+// be left out if the server has only one tree. Points are given as
+// comma-separated coordinates. Results are JSON: points are objects of the
+// form {"pos": [x, y, ...], "data": "<base64>"}, with "id" and "distance"
+// fields for nearest neighbors. An id can be passed to /get to fetch the
+// point's Data again, until the tree is rebuilt.
+//
+//	GET  /nearest?p=x,y,...&n=count   the n points nearest p (n defaults to 1)
+//	POST /knn                         a batch of nearest neighbor queries
+//	POST /knn/stream?k=count          a stream of nearest neighbor queries
+//	GET  /range?min=x,y,...&max=x,y,...  the points in a box
+//	GET  /get?id=id                   the Data of a point, as {"data": ...}
+//	GET  /stats                       the tree's shape and query stats
+//
+// /knn takes a body of the form {"points": [[x, y, ...], ...], "k": count}
+// and returns a list of results for each point, found with NearestBatch.
+//
+// /knn/stream is for bulk jobs with more queries than fit in one /knn
+// request. Its body is a stream of JSON values, one per query, of the form
+// {"pos": [x, y, ...], "k": count}, where k defaults to the k parameter.
+// Results are streamed back as JSON lines as they are found, one list per
+// query in the order the queries were sent. Queries that arrive together are
+// answered together with NearestBatch, and the results are flushed whenever
+// the server has answered everything it has read, so a client may either
+// write all its queries up front or wait for each result in turn. An error
+// after the first result ends the stream with a line of the form
+// {"error": "..."}, following the results of the queries before it.
+package dkdtreehttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jtolds/dkdtree"
+)
+
+// streamBatch is the most /knn/stream queries answered with one
+// NearestBatch call.
+const streamBatch = 256
+
+// DefaultMaxResults is the default for Options.MaxResults.
+const DefaultMaxResults = 10000
+
+// DefaultMaxBodyBytes is the default for Options.MaxBodyBytes.
+const DefaultMaxBodyBytes = 32 << 20
+
+// Options configures a Server.
+type Options struct {
+	// MaxResults bounds the number of points any one query may return, and
+	// the number of points in a /knn batch. Range queries that find more
+	// fail. Defaults to DefaultMaxResults.
+	MaxResults int
+	// MaxBodyBytes bounds the size of a /knn body, and of each query in a
+	// /knn/stream body, which as a whole may be any length. Defaults to
+	// DefaultMaxBodyBytes.
+	MaxBodyBytes int64
+}
+
+// Server is an http.Handler answering queries against a set of named trees.
+// The trees stay owned by the caller, who must keep them open while the
+// Server is in use.
+type Server struct {
+	trees map[string]*dkdtree.Tree
+	opts  Options
+	mux   *http.ServeMux
+}
+
+// New returns a Server for trees, keyed by the names requests use for them.
+func New(trees map[string]*dkdtree.Tree, opts Options) *Server {
+	if opts.MaxResults <= 0 {
+		opts.MaxResults = DefaultMaxResults
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	s := &Server{trees: trees, opts: opts, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/nearest", s.handle(http.MethodGet, s.nearest))
+	s.mux.HandleFunc("/knn", s.handle(http.MethodPost, s.knn))
+	s.mux.HandleFunc("/knn/stream", s.knnStream)
+	s.mux.HandleFunc("/range", s.handle(http.MethodGet, s.rangeQuery))
+	s.mux.HandleFunc("/get", s.handle(http.MethodGet, s.get))
+	s.mux.HandleFunc("/stats", s.handle(http.MethodGet, s.stats))
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// requestError is an error the client caused, reported with a 400.
+type requestError struct{ msg string }
+
+func (e *requestError) Error() string { return e.msg }
+
+func badRequest(format string, args ...interface{}) error {
+	return &requestError{msg: fmt.Sprintf(format, args...)}
+}
+
+// handle adapts fn, which queries the tree a request names and returns the
+// result to encode, to an http.HandlerFunc accepting method.
+func (s *Server) handle(method string,
+	fn func(t *dkdtree.Tree, r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := s.start(w, r, method)
+		if !ok {
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.opts.MaxBodyBytes)
+		rv, err := fn(t, r)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rv)
+	}
+}
+
+// start checks that r uses method and returns the tree it names. If not, it
+// writes the error response and returns false.
+func (s *Server) start(w http.ResponseWriter, r *http.Request,
+	method string) (*dkdtree.Tree, bool) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("use %s", method))
+		return nil, false
+	}
+	t, err := s.tree(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return nil, false
+	}
+	return t, true
+}
+
+// errorStatus returns the status to report err with.
+func errorStatus(err error) int {
+	if _, ok := err.(*requestError); ok ||
+		dkdtree.ErrDimensionMismatch.Contains(err) ||
+		dkdtree.ErrNonFinite.Contains(err) ||
+		dkdtree.ErrQueryTooLarge.Contains(err) {
+		return http.StatusBadRequest
+	}
+	if dkdtree.ErrNotFound.Contains(err) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// tree returns the tree r names.
+func (s *Server) tree(r *http.Request) (*dkdtree.Tree, error) {
+	name := r.URL.Query().Get("tree")
+	if name == "" && len(s.trees) == 1 {
+		for _, t := range s.trees {
+			return t, nil
+		}
+	}
+	t, ok := s.trees[name]
+	if !ok {
+		return nil, fmt.Errorf("no tree %q", name)
+	}
+	return t, nil
+}
+
+// point is the JSON form of a point. Data is base64, as it may be binary.
+type point struct {
+	Pos      []float64 `json:"pos"`
+	Data     []byte    `json:"data,omitempty"`
+	ID       *uint64   `json:"id,omitempty"`
+	Distance *float64  `json:"distance,omitempty"`
+}
+
+func distances(pds []dkdtree.PointDistance) []point {
+	rv := make([]point, 0, len(pds))
+	for i := range pds {
+		rv = append(rv, point{Pos: pds[i].Pos, Data: pds[i].Data,
+			ID: &pds[i].ID, Distance: &pds[i].Distance})
+	}
+	return rv
+}
+
+// parsePos parses the comma-separated coordinates in parameter name.
+func parsePos(r *http.Request, name string) ([]float64, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return nil, badRequest("missing %s", name)
+	}
+	var pos []float64
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, badRequest("%s: %v", name, err)
+		}
+		pos = append(pos, v)
+	}
+	return pos, nil
+}
+
+// count parses the count in parameter name, which defaults to def.
+func (s *Server) count(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, badRequest("invalid %s %q", name, v)
+	}
+	if n > s.opts.MaxResults {
+		return 0, badRequest("%s is more than %d", name, s.opts.MaxResults)
+	}
+	return n, nil
+}
+
+func (s *Server) nearest(t *dkdtree.Tree, r *http.Request) (interface{},
+	error) {
+	pos, err := parsePos(r, "p")
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.count(r, "n", 1)
+	if err != nil {
+		return nil, err
+	}
+	nearest, err := t.Nearest(dkdtree.Point{Pos: pos}, n)
+	if err != nil {
+		return nil, err
+	}
+	return distances(nearest), nil
+}
+
+type knnRequest struct {
+	Points [][]float64 `json:"points"`
+	K      int         `json:"k"`
+}
+
+func (s *Server) knn(t *dkdtree.Tree, r *http.Request) (interface{},
+	error) {
+	var req knnRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return nil, badRequest("invalid body: %v", err)
+	}
+	if req.K < 0 || req.K > s.opts.MaxResults ||
+		len(req.Points) > s.opts.MaxResults {
+		return nil, badRequest("k and the number of points must be at "+
+			"most %d", s.opts.MaxResults)
+	}
+	queries := make([]dkdtree.Point, 0, len(req.Points))
+	for _, pos := range req.Points {
+		queries = append(queries, dkdtree.Point{Pos: pos})
+	}
+	nearest, err := t.NearestBatch(queries, req.K)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([][]point, 0, len(nearest))
+	for _, pds := range nearest {
+		rv = append(rv, distances(pds))
+	}
+	return rv, nil
+}
+
+// streamQuery is one query in a /knn/stream body.
+type streamQuery struct {
+	Pos []float64 `json:"pos"`
+	K   *int      `json:"k"`
+}
+
+func (s *Server) knnStream(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.start(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	k, err := s.count(r, "k", 1)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	// results are written while the body is still being read, which HTTP/1
+	// servers only allow when asked. HTTP/2 needn't be asked, so the error is
+	// ignored.
+	rc := http.NewResponseController(w)
+	rc.EnableFullDuplex()
+	body := &queryLimitReader{r: r.Body, max: s.opts.MaxBodyBytes}
+	dec := json.NewDecoder(body)
+	body.dec = dec
+	enc := json.NewEncoder(w)
+	started := false
+	fail := func(err error) {
+		if !started {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		enc.Encode(map[string]string{"error": err.Error()})
+	}
+
+	var queries []dkdtree.Point
+	var ks []int
+	answer := func() error {
+		if len(queries) == 0 {
+			return nil
+		}
+		// queries are grouped by k so each group is one NearestBatch call
+		for len(queries) > 0 {
+			n := 1
+			for n < len(queries) && ks[n] == ks[0] {
+				n++
+			}
+			nearest, err := t.NearestBatch(queries[:n], ks[0])
+			if err != nil {
+				return err
+			}
+			if !started {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				started = true
+			}
+			for _, pds := range nearest {
+				err = enc.Encode(distances(pds))
+				if err != nil {
+					return err
+				}
+			}
+			queries, ks = queries[n:], ks[n:]
+		}
+		rc.Flush()
+		return nil
+	}
+
+	for {
+		var q streamQuery
+		err := dec.Decode(&q)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err = badRequest("invalid query: %v", err)
+		} else if q.K != nil && (*q.K < 0 || *q.K > s.opts.MaxResults) {
+			err = badRequest("k must be at most %d", s.opts.MaxResults)
+		}
+		if err != nil {
+			// the queries before the bad one still get their results
+			if aerr := answer(); aerr != nil {
+				err = aerr
+			}
+			fail(err)
+			return
+		}
+		qk := k
+		if q.K != nil {
+			qk = *q.K
+		}
+		queries = append(queries, dkdtree.Point{Pos: q.Pos})
+		ks = append(ks, qk)
+		// answer what has been read before blocking for more, so clients
+		// waiting on each result aren't stalled
+		if len(queries) >= streamBatch || !pending(dec) {
+			err = answer()
+			if err != nil {
+				fail(err)
+				return
+			}
+		}
+	}
+	err = answer()
+	if err != nil {
+		fail(err)
+		return
+	}
+	if !started {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+}
+
+// queryLimitReader fails reads once the JSON value dec is decoding is more
+// than max bytes long.
+type queryLimitReader struct {
+	r    io.Reader
+	dec  *json.Decoder
+	read int64
+	max  int64
+}
+
+func (l *queryLimitReader) Read(p []byte) (int, error) {
+	if l.read-l.dec.InputOffset() > l.max {
+		return 0, fmt.Errorf("query larger than %d bytes", l.max)
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+// pending reports whether dec has more than whitespace buffered.
+func pending(dec *json.Decoder) bool {
+	buf, _ := io.ReadAll(dec.Buffered())
+	return len(bytes.TrimSpace(buf)) > 0
+}
+
+func (s *Server) get(t *dkdtree.Tree, r *http.Request) (interface{},
+	error) {
+	v := r.URL.Query().Get("id")
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return nil, badRequest("invalid id %q", v)
+	}
+	data, err := t.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{"data": data}, nil
+}
+
+func (s *Server) rangeQuery(t *dkdtree.Tree, r *http.Request) (interface{},
+	error) {
+	min, err := parsePos(r, "min")
+	if err != nil {
+		return nil, err
+	}
+	max, err := parsePos(r, "max")
+	if err != nil {
+		return nil, err
+	}
+	rv := []point{}
+	err = t.Range(min, max, func(p dkdtree.Point) error {
+		if len(rv) >= s.opts.MaxResults {
+			return badRequest("more than %d points in range",
+				s.opts.MaxResults)
+		}
+		rv = append(rv, point{Pos: p.Pos, Data: p.Data})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// statsResponse is the result of /stats.
+type statsResponse struct {
+	Dims    int                    `json:"dims"`
+	Count   int64                  `json:"count"`
+	Version int                    `json:"version"`
+	Queries dkdtree.AggregateStats `json:"queries"`
+}
+
+func (s *Server) stats(t *dkdtree.Tree, r *http.Request) (interface{},
+	error) {
+	info := t.Info()
+	return statsResponse{Dims: t.Dims(), Count: t.Count(),
+		Version: info.Version, Queries: t.AggregateStats()}, nil
+}
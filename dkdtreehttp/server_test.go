@@ -0,0 +1,249 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtreehttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jtolds/dkdtree"
+)
+
+func createTree(t *testing.T) *dkdtree.Tree {
+	dir := t.TempDir()
+	set, err := dkdtree.NewPointSet(filepath.Join(dir, "points"), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			err = set.Add(dkdtree.Point{Pos: []float64{float64(x),
+				float64(y)}, Data: []byte{byte(x), byte(y)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tree, err := dkdtree.CreateTree(filepath.Join(dir, "tree"), dir, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestServer(t *testing.T) {
+	tree := createTree(t)
+	defer tree.Close()
+	server := httptest.NewServer(New(map[string]*dkdtree.Tree{"grid": tree},
+		Options{MaxResults: 50, MaxBodyBytes: 1 << 10}))
+	defer server.Close()
+
+	call := func(method, path, body string, expected int, rv interface{}) {
+		req, err := http.NewRequest(method, server.URL+path,
+			strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("%s %s: got status %d, expected %d", method, path,
+				resp.StatusCode, expected)
+		}
+		if rv != nil {
+			err = json.NewDecoder(resp.Body).Decode(rv)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var nearest []point
+	call("GET", "/nearest?p=3.1,4.2&n=2", "", 200, &nearest)
+	if len(nearest) != 2 || nearest[0].Pos[0] != 3 || nearest[0].Pos[1] != 4 ||
+		string(nearest[0].Data) != "\x03\x04" || nearest[0].Distance == nil ||
+		nearest[0].ID == nil {
+		t.Fatalf("got %+v", nearest)
+	}
+	var got map[string][]byte
+	call("GET", fmt.Sprintf("/get?id=%d", *nearest[0].ID), "", 200, &got)
+	if string(got["data"]) != "\x03\x04" {
+		t.Fatalf("got %+v", got)
+	}
+	// the only tree needn't be named
+	call("GET", "/nearest?tree=grid&p=0,0", "", 200, &nearest)
+	if len(nearest) != 1 || *nearest[0].Distance != 0 {
+		t.Fatalf("got %+v", nearest)
+	}
+
+	var batch [][]point
+	call("POST", "/knn", `{"points": [[0, 0], [9, 9]], "k": 3}`, 200, &batch)
+	if len(batch) != 2 || len(batch[0]) != 3 || batch[1][0].Pos[0] != 9 {
+		t.Fatalf("got %+v", batch)
+	}
+
+	var inRange []point
+	call("GET", "/range?min=1,1&max=2,3", "", 200, &inRange)
+	if len(inRange) != 6 {
+		t.Fatalf("got %d points in range, expected 6", len(inRange))
+	}
+
+	var stats statsResponse
+	call("GET", "/stats", "", 200, &stats)
+	if stats.Dims != 2 || stats.Count != 100 || stats.Queries.Queries != 4 {
+		t.Fatalf("got %+v", stats)
+	}
+
+	call("GET", "/nearest?p=1,2,3", "", 400, nil)
+	call("GET", "/nearest?p=1,x", "", 400, nil)
+	call("GET", "/nearest?p=1,NaN", "", 400, nil)
+	call("GET", "/nearest?p=1,2&n=51", "", 400, nil)
+	call("GET", "/range?min=0,0&max=9,9", "", 400, nil)
+	call("GET", "/nearest?tree=other&p=1,2", "", 404, nil)
+	call("POST", "/nearest?p=1,2", "", 405, nil)
+	call("POST", "/knn", "{", 400, nil)
+	// small enough for MaxResults, but too long for MaxBodyBytes
+	call("POST", "/knn", `{"points": [[0.`+strings.Repeat("0", 1<<10)+
+		`, 0]], "k": 1}`, 400, nil)
+	call("GET", "/get?id=100", "", 404, nil)
+	call("GET", "/get?id=x", "", 400, nil)
+}
+
+func TestKNNStream(t *testing.T) {
+	tree := createTree(t)
+	defer tree.Close()
+	server := httptest.NewServer(New(map[string]*dkdtree.Tree{"grid": tree},
+		Options{MaxResults: 50, MaxBodyBytes: 1 << 10}))
+	defer server.Close()
+
+	// enough queries to need several batches
+	var body strings.Builder
+	for i := 0; i < 3*streamBatch; i++ {
+		fmt.Fprintf(&body, "{\"pos\": [%d, %d]}\n", i%10, i/10%10)
+	}
+	fmt.Fprintf(&body, `{"pos": [9, 9], "k": 3}`)
+	resp, err := http.Post(server.URL+"/knn/stream?k=2", "application/x-ndjson",
+		strings.NewReader(body.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for i := 0; i <= 3*streamBatch; i++ {
+		var nearest []point
+		err = dec.Decode(&nearest)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if i == 3*streamBatch {
+			if len(nearest) != 3 || nearest[0].Pos[0] != 9 {
+				t.Fatalf("got %+v", nearest)
+			}
+			break
+		}
+		if len(nearest) != 2 || nearest[0].Pos[0] != float64(i%10) ||
+			nearest[0].Pos[1] != float64(i/10%10) {
+			t.Fatalf("query %d: got %+v", i, nearest)
+		}
+	}
+	var extra interface{}
+	if dec.Decode(&extra) == nil {
+		t.Fatalf("got extra result %v", extra)
+	}
+
+	// a client may wait for each result before sending the next query
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", server.URL+"/knn/stream", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+	fmt.Fprintf(pw, `{"pos": [1, 2]}`)
+	resp = <-done
+	if resp == nil {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	dec = json.NewDecoder(resp.Body)
+	for _, q := range [][2]int{{1, 2}, {5, 6}} {
+		if q[0] != 1 {
+			fmt.Fprintf(pw, `{"pos": [%d, %d]}`, q[0], q[1])
+		}
+		var nearest []point
+		err = dec.Decode(&nearest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nearest) != 1 || nearest[0].Pos[0] != float64(q[0]) {
+			t.Fatalf("got %+v", nearest)
+		}
+	}
+	pw.Close()
+
+	// the stream is longer than MaxBodyBytes, but each query must fit
+	resp, err = http.Post(server.URL+"/knn/stream", "application/x-ndjson",
+		strings.NewReader(`{"pos": [0.`+strings.Repeat("0", 1<<12)+`, 0]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	// an error before any result is a plain error response
+	resp, err = http.Post(server.URL+"/knn/stream", "application/x-ndjson",
+		strings.NewReader(`{"pos": [1, 2, 3]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	// and ends the stream after one
+	resp, err = http.Post(server.URL+"/knn/stream", "application/x-ndjson",
+		strings.NewReader(`{"pos": [1, 2]} {"pos": [1, 2], "k": 51}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var first []point
+	var last map[string]string
+	dec = json.NewDecoder(resp.Body)
+	if dec.Decode(&first) != nil || dec.Decode(&last) != nil ||
+		last["error"] == "" {
+		t.Fatalf("got %+v then %+v", first, last)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtreetest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/jtolds/dkdtree"
+)
+
+// CheckKNearest runs a k nearest neighbor query for each of queries against
+// index and ref, returning an error describing the first result that
+// disagrees. Distances may differ by rounding. Points equally distant from a
+// query may come back in either order, or either may be left out at the
+// end of the results, so each result is only checked to be a point of ref
+// at its reported distance.
+func CheckKNearest(index dkdtree.SpatialIndex, ref *Reference,
+	queries []dkdtree.Point, k int) error {
+	counts := ref.counts()
+	for _, q := range queries {
+		got, err := index.KNearest(q.Pos, k)
+		if err != nil {
+			return err
+		}
+		expected, err := ref.KNearest(q.Pos, k)
+		if err != nil {
+			return err
+		}
+		if len(got) != len(expected) {
+			return fmt.Errorf("query %v: got %d points, expected %d", q.Pos,
+				len(got), len(expected))
+		}
+		seen := map[string]int{}
+		for i, pd := range got {
+			if !closeTo(pd.Distance, expected[i].Distance) {
+				return fmt.Errorf("query %v: result %d at distance %v, "+
+					"expected %v", q.Pos, i, pd.Distance, expected[i].Distance)
+			}
+			if !closeTo(pd.Distance, squaredDistance(q.Pos, pd.Pos)) {
+				return fmt.Errorf("query %v: result %d at %v is reported at "+
+					"distance %v, but is %v away", q.Pos, i, pd.Pos, pd.Distance,
+					squaredDistance(q.Pos, pd.Pos))
+			}
+			key := pointKey(&pd.Point)
+			seen[key]++
+			if seen[key] > counts[key] {
+				return fmt.Errorf("query %v: result %d at %v isn't in the "+
+					"reference, or is returned too many times", q.Pos, i, pd.Pos)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckRange runs a radius query for each of queries against index and ref,
+// returning an error describing the first point one returns that the other
+// doesn't. Points within rounding of radius away may be returned by either.
+func CheckRange(index dkdtree.SpatialIndex, ref *Reference,
+	queries []dkdtree.Point, radius float64) error {
+	for _, q := range queries {
+		got, err := index.Range(q.Pos, radius)
+		if err != nil {
+			return err
+		}
+		expected, err := ref.Range(q.Pos, radius)
+		if err != nil {
+			return err
+		}
+		err = compareSets(q.Pos, radius, got, expected)
+		if err != nil {
+			return fmt.Errorf("query %v: %v", q.Pos, err)
+		}
+	}
+	return nil
+}
+
+// compareSets compares the points got and expected within radius of pos,
+// ignoring points that are about radius away.
+func compareSets(pos []float64, radius float64, got,
+	expected []dkdtree.Point) error {
+	sortPoints(got)
+	sortPoints(expected)
+	for len(got) > 0 || len(expected) > 0 {
+		var c int
+		switch {
+		case len(got) == 0:
+			c = 1
+		case len(expected) == 0:
+			c = -1
+		default:
+			c = comparePoints(&got[0], &expected[0])
+		}
+		switch {
+		case c == 0:
+			got, expected = got[1:], expected[1:]
+			continue
+		case c < 0:
+			if !closeTo(squaredDistance(pos, got[0].Pos), radius*radius) {
+				return fmt.Errorf("got %v, which is out of range", got[0].Pos)
+			}
+			got = got[1:]
+		default:
+			if !closeTo(squaredDistance(pos, expected[0].Pos), radius*radius) {
+				return fmt.Errorf("missing %v", expected[0].Pos)
+			}
+			expected = expected[1:]
+		}
+	}
+	return nil
+}
+
+// CheckEquivalent checks that index holds the same points as ref, by their
+// counts and dimensions, CheckKNearest with k and CheckRange with radius.
+func CheckEquivalent(index dkdtree.SpatialIndex, ref *Reference,
+	queries []dkdtree.Point, k int, radius float64) error {
+	if index.Dims() != ref.Dims() {
+		return fmt.Errorf("index has %d dimensions, expected %d", index.Dims(),
+			ref.Dims())
+	}
+	if index.Len() != ref.Len() {
+		return fmt.Errorf("index has %d points, expected %d", index.Len(),
+			ref.Len())
+	}
+	err := CheckKNearest(index, ref, queries, k)
+	if err != nil {
+		return err
+	}
+	return CheckRange(index, ref, queries, radius)
+}
+
+// AssertKNearest is CheckKNearest, failing tb if it returns an error.
+func AssertKNearest(tb testing.TB, index dkdtree.SpatialIndex,
+	ref *Reference, queries []dkdtree.Point, k int) {
+	tb.Helper()
+	if err := CheckKNearest(index, ref, queries, k); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// AssertRange is CheckRange, failing tb if it returns an error.
+func AssertRange(tb testing.TB, index dkdtree.SpatialIndex, ref *Reference,
+	queries []dkdtree.Point, radius float64) {
+	tb.Helper()
+	if err := CheckRange(index, ref, queries, radius); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// AssertEquivalent is CheckEquivalent, failing tb if it returns an error.
+func AssertEquivalent(tb testing.TB, index dkdtree.SpatialIndex,
+	ref *Reference, queries []dkdtree.Point, k int, radius float64) {
+	tb.Helper()
+	if err := CheckEquivalent(index, ref, queries, k, radius); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// counts returns how many times each point is in ref, by pointKey.
+func (r *Reference) counts() map[string]int {
+	counts := make(map[string]int, len(r.points))
+	for i := range r.points {
+		counts[pointKey(&r.points[i])]++
+	}
+	return counts
+}
+
+// pointKey identifies a point by its position and Data.
+func pointKey(p *dkdtree.Point) string {
+	buf := make([]byte, 0, 8*len(p.Pos)+len(p.Data))
+	for _, v := range p.Pos {
+		bits := math.Float64bits(v)
+		for i := 0; i < 8; i++ {
+			buf = append(buf, byte(bits>>(8*i)))
+		}
+	}
+	return string(append(buf, p.Data...))
+}
+
+func sortPoints(points []dkdtree.Point) {
+	sort.Slice(points, func(i, j int) bool {
+		return comparePoints(&points[i], &points[j]) < 0
+	})
+}
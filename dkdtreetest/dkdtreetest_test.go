@@ -0,0 +1,105 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtreetest
+
+import (
+	"flag"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/jtolds/dkdtree"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	UpdateGolden = *update
+	os.Exit(m.Run())
+}
+
+func TestEquivalent(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	points := Duplicate(rng, Clustered(rng, 2000, 3, 5, 0.02, 4), 100)
+	ref := NewReference(3, points)
+	queries := Uniform(rng, 50, 3, 0)
+
+	for _, opts := range []dkdtree.BuildOptions{{}, {VariableData: true},
+		{SplitStrategy: dkdtree.SlidingMidpointSplit}} {
+		tree := NewTree(t, 3, 4, points, opts)
+		AssertEquivalent(t, dkdtree.AsSpatialIndex(tree), ref, queries, 10,
+			0.05)
+	}
+	mem, err := dkdtree.CreateTreeInMemory(3, 4, points,
+		dkdtree.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+	AssertEquivalent(t, dkdtree.AsSpatialIndex(mem), ref, queries, 10, 0.05)
+}
+
+func TestCheckCatchesMistakes(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	points := Uniform(rng, 500, 2, 2)
+	tree := dkdtree.AsSpatialIndex(NewTree(t, 2, 2, points,
+		dkdtree.BuildOptions{}))
+
+	missing := NewReference(2, points)
+	if !missing.Delete(points[0]) {
+		t.Fatal("expected to delete a point")
+	}
+	queries := []dkdtree.Point{points[0]}
+	if CheckKNearest(tree, missing, queries, 3) == nil {
+		t.Fatal("expected a point missing from the reference to be caught")
+	}
+	if CheckRange(tree, missing, queries, 0.1) == nil {
+		t.Fatal("expected a point missing from the reference to be caught")
+	}
+	if CheckEquivalent(tree, missing, queries, 3, 0.1) == nil {
+		t.Fatal("expected differing counts to be caught")
+	}
+
+	extra := NewReference(2, points)
+	err := extra.Insert(dkdtree.Point{Pos: []float64{0.5, 0.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries = []dkdtree.Point{{Pos: []float64{0.5, 0.5}}}
+	if CheckKNearest(tree, extra, queries, 1) == nil {
+		t.Fatal("expected a point missing from the tree to be caught")
+	}
+	if extra.Insert(dkdtree.Point{Pos: []float64{1}}) == nil {
+		t.Fatal("expected a point of the wrong dimension to be refused")
+	}
+}
+
+func TestLatticeGolden(t *testing.T) {
+	points := Lattice(5, 2)
+	if len(points) != 25 {
+		t.Fatalf("got %d lattice points, expected 25", len(points))
+	}
+	tree := NewTree(t, 2, 8, points, dkdtree.BuildOptions{})
+	AssertKNearest(t, dkdtree.AsSpatialIndex(tree), NewReference(2, points),
+		Uniform(rand.New(rand.NewSource(3)), 20, 2, 0), 6)
+
+	// four points are tied nearest the middle of a cell, and more beyond
+	results, err := tree.Nearest(dkdtree.Point{Pos: []float64{1.5, 2.5}}, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertGolden(t, "testdata/lattice.golden", results)
+}
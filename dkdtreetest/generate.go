@@ -0,0 +1,118 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtreetest
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/jtolds/dkdtree"
+)
+
+// Uniform returns n points with coordinates uniform in [0, 1), each with
+// dataLen bytes of random Data. With a dataLen of 0 they make good queries.
+func Uniform(rng *rand.Rand, n, dims, dataLen int) []dkdtree.Point {
+	points := make([]dkdtree.Point, 0, n)
+	for i := 0; i < n; i++ {
+		p := dkdtree.Point{Pos: make([]float64, dims)}
+		for j := range p.Pos {
+			p.Pos[j] = rng.Float64()
+		}
+		if dataLen > 0 {
+			p.Data = make([]byte, dataLen)
+			rng.Read(p.Data)
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// Clustered returns n points spread among clusters clusters, with centers
+// uniform in [0, 1) and points normally distributed around them with a
+// standard deviation of spread along each dimension, each with dataLen
+// bytes of random Data. Clustered data is where kd-trees prune worst, so it
+// makes for sterner tests than uniform data.
+func Clustered(rng *rand.Rand, n, dims, clusters int, spread float64,
+	dataLen int) []dkdtree.Point {
+	centers := Uniform(rng, clusters, dims, 0)
+	points := Uniform(rng, n, dims, dataLen)
+	for _, p := range points {
+		center := centers[rng.Intn(clusters)]
+		for j := range p.Pos {
+			p.Pos[j] = center.Pos[j] + rng.NormFloat64()*spread
+		}
+	}
+	return points
+}
+
+// Lattice returns the side^dims points of a grid with integer coordinates
+// from 0 to side-1, each with its index as 8 bytes of big-endian Data. So
+// many points are equally distant from each other that it exercises how
+// ties are broken.
+func Lattice(side, dims int) []dkdtree.Point {
+	n := 1
+	for i := 0; i < dims; i++ {
+		n *= side
+	}
+	points := make([]dkdtree.Point, 0, n)
+	for i := 0; i < n; i++ {
+		p := dkdtree.Point{Pos: make([]float64, dims), Data: make([]byte, 8)}
+		for j, rest := 0, i; j < dims; j, rest = j+1, rest/side {
+			p.Pos[j] = float64(rest % side)
+		}
+		binary.BigEndian.PutUint64(p.Data, uint64(i))
+		points = append(points, p)
+	}
+	return points
+}
+
+// Duplicate returns points with n more copies of points chosen at random,
+// all in random order.
+func Duplicate(rng *rand.Rand, points []dkdtree.Point,
+	n int) []dkdtree.Point {
+	rv := append([]dkdtree.Point(nil), points...)
+	for i := 0; i < n; i++ {
+		rv = append(rv, points[rng.Intn(len(points))])
+	}
+	rng.Shuffle(len(rv), func(i, j int) { rv[i], rv[j] = rv[j], rv[i] })
+	return rv
+}
+
+// NewTree builds a tree of points in a temporary directory of tb's, which
+// is closed and removed when the test finishes, failing tb if it can't.
+func NewTree(tb testing.TB, dims, maxDataLen int, points []dkdtree.Point,
+	opts dkdtree.BuildOptions) *dkdtree.Tree {
+	tb.Helper()
+	dir := tb.TempDir()
+	set, err := dkdtree.NewPointSet(filepath.Join(dir, "points"), dims, maxDataLen)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, p := range points {
+		err = set.Add(p)
+		if err != nil {
+			set.Close()
+			tb.Fatal(err)
+		}
+	}
+	tree, err := dkdtree.CreateTreeWithOptions(filepath.Join(dir, "tree"), dir, set, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { tree.Close() })
+	return tree
+}
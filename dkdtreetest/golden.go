@@ -0,0 +1,98 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtreetest
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jtolds/dkdtree"
+)
+
+// UpdateGolden, if set, has AssertGolden write golden files rather than
+// compare against them. Tests usually set it from a flag of their own:
+//
+//	var update = flag.Bool("update", false, "rewrite golden files")
+//
+//	func TestMain(m *testing.M) {
+//		flag.Parse()
+//		dkdtreetest.UpdateGolden = *update
+//		os.Exit(m.Run())
+//	}
+var UpdateGolden bool
+
+// Golden returns results as AssertGolden writes them: JSON lines, as
+// dkdtree.PointEncoder writes points with distances, with base64 Data.
+// IDs are left out, as they change when a tree is rebuilt.
+func Golden(results []dkdtree.PointDistance) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := dkdtree.NewJSONLEncoder(&buf,
+		dkdtree.ExportOptions{Data: dkdtree.Base64Data})
+	for _, pd := range results {
+		err := enc.EncodeDistance(pd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := enc.Flush()
+	return buf.Bytes(), err
+}
+
+// AssertGolden fails tb unless results match the golden file at path, line
+// for line, or writes them to path if UpdateGolden is set. Results must come
+// back in the same order every time, which dkdtree's do, ties and all.
+func AssertGolden(tb testing.TB, path string,
+	results []dkdtree.PointDistance) {
+	tb.Helper()
+	got, err := Golden(results)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if UpdateGolden {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, got, 0644)
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		tb.Fatalf("no golden file %s; set UpdateGolden to write it", path)
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	gotLines := bytes.Split(got, []byte("\n"))
+	expectedLines := bytes.Split(expected, []byte("\n"))
+	for i := 0; i < len(gotLines) || i < len(expectedLines); i++ {
+		var g, e []byte
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(expectedLines) {
+			e = expectedLines[i]
+		}
+		if !bytes.Equal(g, e) {
+			tb.Fatalf("%s:%d: got %s, expected %s", path, i+1, g, e)
+		}
+	}
+}
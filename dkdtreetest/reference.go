@@ -0,0 +1,198 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dkdtreetest helps test code built on dkdtree: a brute-force
+// Reference index to check query results against, generators of random
+// datasets, checks that an index agrees with a Reference, and golden files
+// of query results.
+//
+// A typical property test builds a tree and a Reference from the same
+// generated points, then checks them against each other:
+//
+//	points := dkdtreetest.Clustered(rng, 10000, 3, 8, 0.01, 4)
+//	tree := dkdtreetest.NewTree(t, 3, 4, points, dkdtree.BuildOptions{})
+//	ref := dkdtreetest.NewReference(3, points)
+//	dkdtreetest.AssertEquivalent(t, dkdtree.AsSpatialIndex(tree), ref,
+//		dkdtreetest.Uniform(rng, 100, 3, 0), 10, 0.05)
+package dkdtreetest
+
+import (
+	"bytes"
+	"math"
+	"sort"
+
+	"github.com/jtolds/dkdtree"
+)
+
+// Reference is a brute-force spatial index of points held in memory. Every
+// query scans every point, so its results are right by construction, if
+// slow. It implements dkdtree.SpatialIndex, with the result order of
+// dkdtree.Tree: by distance, then by position, then by Data.
+type Reference struct {
+	dims   int
+	points []dkdtree.Point
+}
+
+// NewReference returns a Reference holding points, which must have dims
+// dimensions.
+func NewReference(dims int, points []dkdtree.Point) *Reference {
+	return &Reference{
+		dims:   dims,
+		points: append([]dkdtree.Point(nil), points...)}
+}
+
+func (r *Reference) check(pos []float64) error {
+	if len(pos) != r.dims {
+		return dkdtree.ErrDimensionMismatch.New(
+			"point has wrong dimension: %d, expected %d", len(pos), r.dims)
+	}
+	return nil
+}
+
+// Insert adds p.
+func (r *Reference) Insert(p dkdtree.Point) error {
+	err := r.check(p.Pos)
+	if err != nil {
+		return err
+	}
+	r.points = append(r.points, p)
+	return nil
+}
+
+// Delete removes one point with p's position and Data, as Tree.Delete does,
+// and reports whether there was one.
+func (r *Reference) Delete(p dkdtree.Point) bool {
+	for i := range r.points {
+		if samePoint(&r.points[i], &p) {
+			r.points = append(r.points[:i], r.points[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Points returns the points in the Reference, in the order they were added.
+func (r *Reference) Points() []dkdtree.Point {
+	return append([]dkdtree.Point(nil), r.points...)
+}
+
+func (r *Reference) Len() int64 { return int64(len(r.points)) }
+func (r *Reference) Dims() int  { return r.dims }
+
+// Nearest returns the point closest to pos, and false if there are none.
+func (r *Reference) Nearest(pos []float64) (dkdtree.Point, bool, error) {
+	nearest, err := r.KNearest(pos, 1)
+	if err != nil || len(nearest) == 0 {
+		return dkdtree.Point{}, false, err
+	}
+	return nearest[0].Point, true, nil
+}
+
+// KNearest returns the k points closest to pos, closest first.
+func (r *Reference) KNearest(pos []float64, k int) ([]dkdtree.PointDistance,
+	error) {
+	err := r.check(pos)
+	if err != nil || k <= 0 {
+		return nil, err
+	}
+	all := make([]dkdtree.PointDistance, 0, len(r.points))
+	for _, p := range r.points {
+		all = append(all, dkdtree.PointDistance{
+			Point:    p,
+			Distance: squaredDistance(pos, p.Pos)})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Distance != all[j].Distance {
+			return all[i].Distance < all[j].Distance
+		}
+		return comparePoints(&all[i].Point, &all[j].Point) < 0
+	})
+	if len(all) > k {
+		all = all[:k]
+	}
+	return all, nil
+}
+
+// Range returns every point within radius of pos, including those exactly
+// radius away, as Tree.Within does. radius is not squared.
+func (r *Reference) Range(pos []float64, radius float64) ([]dkdtree.Point,
+	error) {
+	err := r.check(pos)
+	if err != nil {
+		return nil, err
+	}
+	var rv []dkdtree.Point
+	for _, p := range r.points {
+		if squaredDistance(pos, p.Pos) <= radius*radius {
+			rv = append(rv, p)
+		}
+	}
+	return rv, nil
+}
+
+// Box returns every point within the box from min to max, including its
+// boundary, as Tree.Range does.
+func (r *Reference) Box(min, max []float64) ([]dkdtree.Point, error) {
+	err := r.check(min)
+	if err == nil {
+		err = r.check(max)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rv []dkdtree.Point
+next:
+	for _, p := range r.points {
+		for i, v := range p.Pos {
+			if v < min[i] || v > max[i] {
+				continue next
+			}
+		}
+		rv = append(rv, p)
+	}
+	return rv, nil
+}
+
+func squaredDistance(a, b []float64) float64 {
+	var sum float64
+	for i, v := range a {
+		delta := v - b[i]
+		sum += delta * delta
+	}
+	return sum
+}
+
+// comparePoints orders points as dkdtree breaks ties between results: by
+// position, lexicographically, then by Data.
+func comparePoints(a, b *dkdtree.Point) int {
+	for i, v := range a.Pos {
+		switch {
+		case v < b.Pos[i]:
+			return -1
+		case v > b.Pos[i]:
+			return 1
+		}
+	}
+	return bytes.Compare(a.Data, b.Data)
+}
+
+func samePoint(a, b *dkdtree.Point) bool {
+	return len(a.Pos) == len(b.Pos) && comparePoints(a, b) == 0
+}
+
+// closeTo reports whether distances a and b are equal but for rounding,
+// which may differ between implementations that sum in different orders.
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
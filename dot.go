@@ -0,0 +1,73 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MaxDOTNodes is the largest tree WriteDOT will render.
+const MaxDOTNodes = 1000
+
+// WriteDOT writes the structure of the tree to w as a GraphViz DOT graph.
+// Inner nodes are labeled with their split dimension and value, and leaves
+// with their point. Deleted nodes are dashed. Trees with more than
+// MaxDOTNodes nodes are refused, as GraphViz can't usefully lay them out.
+func (t *Tree) WriteDOT(w io.Writer) error {
+	if t.count > MaxDOTNodes {
+		return errClass.New("tree has %d nodes, more than the %d WriteDOT allows",
+			t.count, MaxDOTNodes)
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph dkdtree {")
+	err := t.scan(func(offset int64, n Node) error {
+		var label string
+		if n.Left == -1 && n.Right == -1 {
+			label = formatPos(n.Point.Pos)
+		} else {
+			label = fmt.Sprintf("x%d = %s", n.Dim,
+				strconv.FormatFloat(n.Point.Pos[n.Dim], 'g', -1, 64))
+		}
+		style := ""
+		if n.Deleted {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(bw, "\tn%d [label=%q%s];\n", offset, label, style)
+		if n.Left != -1 {
+			fmt.Fprintf(bw, "\tn%d -> n%d [label=\"<=\"];\n", offset, n.Left)
+		}
+		if n.Right != -1 {
+			fmt.Fprintf(bw, "\tn%d -> n%d [label=\">\"];\n", offset, n.Right)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(bw, "}")
+	return errClass.Wrap(bw.Flush())
+}
+
+func formatPos(pos []float64) string {
+	coords := make([]string, 0, len(pos))
+	for _, v := range pos {
+		coords = append(coords, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	return "(" + strings.Join(coords, ", ") + ")"
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteDOT(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	tree := createTestTree(t, fs, 2, 4, newTestPoints(7, 2, 4), BuildOptions{})
+	defer tree.Close()
+
+	var buf bytes.Buffer
+	err := tree.WriteDOT(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph dkdtree {\n") ||
+		!strings.HasSuffix(dot, "}\n") {
+		t.Fatalf("malformed graph:\n%s", dot)
+	}
+	if nodes := strings.Count(dot, "[label=") - strings.Count(dot, "->"); nodes != 7 {
+		t.Fatalf("got %d nodes, expected 7:\n%s", nodes, dot)
+	}
+	// every node but the root has one incoming edge
+	if edges := strings.Count(dot, "->"); edges != 6 {
+		t.Fatalf("got %d edges, expected 6:\n%s", edges, dot)
+	}
+
+	big := createTestTree(t, fs, 2, 4, newTestPoints(MaxDOTNodes+1, 2, 4),
+		BuildOptions{})
+	defer big.Close()
+	err = big.WriteDOT(&buf)
+	if err == nil {
+		t.Fatal("expected an oversized tree to be refused")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// syncer carries out a build's SyncPolicy for the tree file it writes. A nil
+// syncer never syncs, for files that aren't the tree file.
+type syncer struct {
+	policy   SyncPolicy
+	every    int64
+	unsynced int64
+}
+
+func newSyncer(opts BuildOptions) (*syncer, error) {
+	switch opts.Sync {
+	case SyncOnFinish, SyncNever:
+	case SyncPeriodic:
+		if opts.SyncBytes <= 0 {
+			return nil, errClass.New("SyncPeriodic requires a positive " +
+				"SyncBytes")
+		}
+	default:
+		return nil, errClass.New("unknown sync policy %d", opts.Sync)
+	}
+	return &syncer{policy: opts.Sync, every: opts.SyncBytes}, nil
+}
+
+// writer returns a writer to fh that counts what is written through it
+// toward the next periodic sync.
+func (s *syncer) writer(fh *os.File) *syncWriter {
+	return &syncWriter{s: s, fh: fh}
+}
+
+// wrote records that n more bytes were written to fh, syncing it if
+// SyncBytes have been written since the last sync.
+func (s *syncer) wrote(fh *os.File, n int) error {
+	if s == nil || s.policy != SyncPeriodic {
+		return nil
+	}
+	s.unsynced += int64(n)
+	if s.unsynced < s.every {
+		return nil
+	}
+	s.unsynced = 0
+	return errClass.Wrap(fh.Sync())
+}
+
+// finish syncs the completed tree file fh, unless the policy is SyncNever.
+func (s *syncer) finish(fh *os.File) error {
+	if s == nil || s.policy == SyncNever {
+		return nil
+	}
+	return errClass.Wrap(fh.Sync())
+}
+
+// finishDir syncs the directory the tree at path was renamed into, unless
+// the policy is SyncNever.
+func (s *syncer) finishDir(path string) {
+	if s == nil || s.policy == SyncNever {
+		return
+	}
+	syncDir(filepath.Dir(path))
+}
+
+type syncWriter struct {
+	s  *syncer
+	fh *os.File
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	n, err := w.fh.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.s.wrote(w.fh, n)
+}
+
+func (w *syncWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.fh.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	return n, w.s.wrote(w.fh, n)
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSyncPolicy(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(300, 3, 10)
+	plain := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer plain.Close()
+
+	for _, opts := range []BuildOptions{
+		{Sync: SyncNever},
+		{Sync: SyncPeriodic, SyncBytes: 100},
+		{Sync: SyncPeriodic, SyncBytes: 100, Layout: BlockedLayout,
+			Checksums: true, Boxes: true},
+		{Sync: SyncPeriodic, SyncBytes: 1 << 20, VariableData: true},
+	} {
+		tree := createTestTree(t, fs, 3, 10, points, opts)
+		for i := 0; i < 20; i++ {
+			q := NewPoint(3, 10)
+			expected, err := plain.Nearest(q, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tree.Nearest(q, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(withoutIDs(got), withoutIDs(expected)) {
+				t.Fatalf("%+v: got %v, expected %v", opts, got, expected)
+			}
+		}
+		tree.Close()
+	}
+
+	set, err := NewPointSet(fs.Temp(), 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	for _, opts := range []BuildOptions{
+		{Sync: SyncPeriodic},
+		{Sync: SyncPeriodic + 1},
+	} {
+		_, err = CreateTreeWithOptions(fs.Path("bad"), fs.Temp(), set, opts)
+		if err == nil {
+			t.Fatalf("%+v: expected an error", opts)
+		}
+	}
+}
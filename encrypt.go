@@ -0,0 +1,247 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// encBlockSize is the number of bytes of a tree file sealed together by an
+// encrypted Backend. Each read decrypts every block it touches, so this is
+// kept near the size of a node or two.
+const encBlockSize = 4096
+
+// encFileIDSize is the size of the random ID an encrypted file starts with.
+const encFileIDSize = 16
+
+// EncryptedBackend returns a Backend that stores tree files in b encrypted
+// with AES-GCM under key, which must be 16, 24 or 32 bytes long. See
+// EncryptedBackendAEAD.
+func EncryptedBackend(b Backend, key []byte) (Backend, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	return EncryptedBackendAEAD(b, aead), nil
+}
+
+// EncryptedBackendAEAD returns a Backend that stores tree files in b
+// encrypted with aead. Each file starts with a random ID, and is split into
+// blocks of 4 KiB that are each sealed with a random nonce, the file's ID and
+// their position in the file, so blocks can't be altered, reordered, dropped
+// or swapped for blocks of another file without reads of them failing with
+// ErrCorrupt. Trees are opened from the Backend with OpenTreeBackend and
+// queried as usual, decrypting only the blocks holding the nodes they read,
+// so a node cache (see OpenOptions.CacheBytes) saves decrypting the top of
+// the tree again for every query.
+//
+// Only files saved to the Backend are encrypted. Trees are still built in
+// plaintext locally before being saved with Tree.SaveTo, so the local copy
+// and the build's temporary files should be kept somewhere suitable and
+// removed once the tree is saved.
+func EncryptedBackendAEAD(b Backend, aead cipher.AEAD) Backend {
+	return &encBackend{b: b, aead: aead}
+}
+
+type encBackend struct {
+	b    Backend
+	aead cipher.AEAD
+}
+
+// sealedSize is the stored size of a full block.
+func (e *encBackend) sealedSize() int64 {
+	return int64(e.aead.NonceSize() + encBlockSize + e.aead.Overhead())
+}
+
+// blockAD returns the additional data a block is sealed with: the ID of its
+// file, its index, and whether it is the last block, so the file can't be
+// truncated to a block boundary unnoticed.
+func blockAD(id []byte, index int64, last bool) []byte {
+	ad := make([]byte, encFileIDSize+9)
+	copy(ad, id)
+	binary.LittleEndian.PutUint64(ad[encFileIDSize:], uint64(index))
+	if last {
+		ad[encFileIDSize+8] = 1
+	}
+	return ad
+}
+
+func (e *encBackend) Open(name string) (BackendReader, error) {
+	r, err := e.b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	stored, sealed := r.Size()-encFileIDSize, e.sealedSize()
+	extra := int64(e.aead.NonceSize() + e.aead.Overhead())
+	blocks := (stored + sealed - 1) / sealed
+	lastLen := stored - (blocks-1)*sealed
+	if stored <= 0 || lastLen < extra {
+		r.Close()
+		return nil, ErrCorrupt.New("%s: invalid encrypted file size %d",
+			name, r.Size())
+	}
+	id := make([]byte, encFileIDSize)
+	_, err = r.ReadAt(id, 0)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	er := &encReader{e: e, r: r, id: id, blocks: blocks,
+		size: (blocks-1)*encBlockSize + lastLen - extra}
+	// check the key and that the file is whole up front
+	_, err = er.block(blocks - 1)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return er, nil
+}
+
+func (e *encBackend) Create(name string) (io.WriteCloser, error) {
+	id := make([]byte, encFileIDSize)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	w, err := e.b.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(id)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &encWriter{e: e, w: w, id: id,
+		buf: make([]byte, 0, encBlockSize)}, nil
+}
+
+func (e *encBackend) Remove(name string) error {
+	return e.b.Remove(name)
+}
+
+// encWriter seals what is written to it a block at a time. A full block is
+// only sealed once more is written, as the last block is sealed differently.
+type encWriter struct {
+	e     *encBackend
+	w     io.WriteCloser
+	id    []byte
+	buf   []byte
+	index int64
+}
+
+func (w *encWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		if len(w.buf) == encBlockSize {
+			err = w.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):encBlockSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *encWriter) seal(last bool) error {
+	aead := w.e.aead
+	out := make([]byte, aead.NonceSize(),
+		aead.NonceSize()+len(w.buf)+aead.Overhead())
+	_, err := rand.Read(out)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	out = aead.Seal(out, out, w.buf, blockAD(w.id, w.index, last))
+	_, err = w.w.Write(out)
+	w.buf = w.buf[:0]
+	w.index++
+	return err
+}
+
+// Close seals the last block, which is empty if nothing was written, and
+// closes the underlying file.
+func (w *encWriter) Close() error {
+	err := w.seal(true)
+	if cerr := w.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type encReader struct {
+	e      *encBackend
+	r      BackendReader
+	id     []byte
+	blocks int64
+	size   int64
+}
+
+func (r *encReader) Size() int64 { return r.size }
+
+func (r *encReader) Close() error { return r.r.Close() }
+
+// block reads and decrypts block index.
+func (r *encReader) block(index int64) ([]byte, error) {
+	aead := r.e.aead
+	sealed := r.e.sealedSize()
+	data := make([]byte, sealed)
+	n, err := r.r.ReadAt(data, encFileIDSize+index*sealed)
+	if n < len(data) && index == r.blocks-1 && err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data = data[:n]
+	nonce := data[:aead.NonceSize()]
+	plain, err := aead.Open(data[aead.NonceSize():aead.NonceSize()],
+		nonce, data[aead.NonceSize():], blockAD(r.id, index, index == r.blocks-1))
+	if err != nil {
+		return nil, ErrCorrupt.New("encrypted block %d: %v", index, err)
+	}
+	return plain, nil
+}
+
+func (r *encReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errClass.New("negative offset")
+	}
+	for len(p) > 0 && off < r.size {
+		index := off / encBlockSize
+		plain, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p, plain[off-index*encBlockSize:])
+		n += c
+		off += int64(c)
+		p = p[c:]
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestEncryptedBackend(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	secret := []byte("secret!!")
+	points[0].Data = secret
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	mem := memBackend{}
+	key := bytes.Repeat([]byte{7}, 32)
+	b, err := EncryptedBackend(mem, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.SaveTo(b, "saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(mem["saved"].Bytes(), secret) {
+		t.Fatal("Data stored in plaintext")
+	}
+
+	stored, err := OpenTreeBackend(b, "saved", OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Count() != tree.Count() {
+		t.Fatalf("stored tree has %d points, expected %d", stored.Count(),
+			tree.Count())
+	}
+	for _, p := range points[:50] {
+		nearest, err := stored.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+	}
+	stored.Close()
+
+	wrong, err := EncryptedBackend(mem, bytes.Repeat([]byte{8}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenTreeBackend(wrong, "saved", OpenOptions{})
+	if !ErrCorrupt.Contains(err) {
+		t.Fatalf("expected a corruption error with the wrong key, got %v", err)
+	}
+
+	// dropping the last block is caught, as the new last block wasn't
+	// sealed as the last
+	sealed := b.(*encBackend).sealedSize()
+	data := mem["saved"].Bytes()
+	last := int64(len(data)) - (int64(len(data))-encFileIDSize-1)%sealed - 1
+	mem["truncated"] = bytes.NewBuffer(data[:last])
+	_, err = OpenTreeBackend(b, "truncated", OpenOptions{})
+	if !ErrCorrupt.Contains(err) {
+		t.Fatalf("expected a corruption error when truncated, got %v", err)
+	}
+
+	tampered := append([]byte(nil), data...)
+	tampered[encFileIDSize+sealed/2] ^= 1
+	mem["tampered"] = bytes.NewBuffer(tampered)
+	r, err := b.Open("tampered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.ReadAt(make([]byte, 10), 0)
+	if !ErrCorrupt.Contains(err) {
+		t.Fatalf("expected a corruption error when tampered, got %v", err)
+	}
+	r.Close()
+
+	// a block from another file under the same key, at the same index,
+	// doesn't fit
+	err = tree.SaveTo(b, "again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spliced := append([]byte(nil), data...)
+	copy(spliced[encFileIDSize:encFileIDSize+sealed],
+		mem["again"].Bytes()[encFileIDSize:])
+	mem["spliced"] = bytes.NewBuffer(spliced)
+	r, err = b.Open("spliced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.ReadAt(make([]byte, 10), 0)
+	if !ErrCorrupt.Contains(err) {
+		t.Fatalf("expected a corruption error when spliced, got %v", err)
+	}
+	r.Close()
+}
+
+func TestEncryptedBackendSizes(t *testing.T) {
+	b, err := EncryptedBackend(memBackend{}, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, encBlockSize, 3*encBlockSize + 5} {
+		data := bytes.Repeat([]byte{1, 2, 3}, size)[:size]
+		w, err := b.Create("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := b.Open("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Size() != int64(size) {
+			t.Fatalf("got size %d, expected %d", r.Size(), size)
+		}
+		got, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: read back different bytes", size)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	stderrors "errors"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+// ErrorClass is a class of the errors this package returns, such as
+// ErrCorrupt. An error of a class matches it and the classes it descends
+// from under errors.Is, so errors.Is(err, ErrCorrupt) and
+// ErrCorrupt.Contains(err) both report whether err is a corruption error,
+// including ErrHole and ErrChecksum ones. Errors wrapping another, such as an
+// error from the os package, unwrap to it, so errors.Is(err, fs.ErrNotExist)
+// works as well.
+type ErrorClass struct {
+	class  *errors.ErrorClass
+	parent *ErrorClass
+}
+
+func newErrorClass(name string) *ErrorClass {
+	return &ErrorClass{class: errors.NewClass(name)}
+}
+
+// NewClass returns a subclass of c.
+func (c *ErrorClass) NewClass(name string) *ErrorClass {
+	return &ErrorClass{class: c.class.NewClass(name), parent: c}
+}
+
+// Error returns the name of the class, so that it can be the target of
+// errors.Is.
+func (c *ErrorClass) Error() string { return c.class.String() }
+
+// New returns an error of the class with a formatted message.
+func (c *ErrorClass) New(format string, args ...interface{}) error {
+	return &classError{class: c, err: c.class.New(format, args...)}
+}
+
+// Wrap returns err as an error of the class, or err itself if it is nil or
+// already of the class.
+func (c *ErrorClass) Wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	inner := err
+	if ce, ok := err.(*classError); ok {
+		if ce.class.within(c) {
+			return err
+		}
+		inner = ce.err
+	}
+	return &classError{class: c, err: c.class.Wrap(inner), cause: err}
+}
+
+// Contains reports whether err is, or wraps, an error of the class.
+func (c *ErrorClass) Contains(err error) bool {
+	return stderrors.Is(err, c)
+}
+
+// within reports whether c is other or descends from it.
+func (c *ErrorClass) within(other *ErrorClass) bool {
+	for ; c != nil; c = c.parent {
+		if c == other {
+			return true
+		}
+	}
+	return false
+}
+
+// classError is an error of an ErrorClass. err is the error of the
+// underlying spacemonkeygo class, which formats it, and cause is the error
+// it wraps, if any.
+type classError struct {
+	class *ErrorClass
+	err   error
+	cause error
+}
+
+func (e *classError) Error() string { return e.err.Error() }
+func (e *classError) Unwrap() error { return e.cause }
+
+func (e *classError) Is(target error) bool {
+	c, ok := target.(*ErrorClass)
+	return ok && e.class.within(c)
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func TestErrorsIs(t *testing.T) {
+	tfs := newTestFS(t)
+	defer tfs.Delete()
+
+	set, err := NewPointSet(tfs.Temp(), 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	err = set.Add(Point{Pos: []float64{0, 0}})
+	if !errors.Is(err, ErrDimensionMismatch) || errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected only a dimension mismatch, got %v", err)
+	}
+	err = set.Add(Point{Pos: []float64{0, 0, 0}, Data: make([]byte, 5)})
+	if !errors.Is(err, ErrDataTooLarge) {
+		t.Fatalf("expected data too large, got %v", err)
+	}
+
+	// subclasses match their parents, but not each other
+	err = ErrHole.New("node %d", 7)
+	if !errors.Is(err, ErrHole) || !errors.Is(err, ErrCorrupt) ||
+		errors.Is(err, ErrChecksum) {
+		t.Fatalf("unexpected matches for %v", err)
+	}
+	if wrapped := errClass.Wrap(err); wrapped != err {
+		t.Fatalf("wrapping in a parent class changed %v to %v", err, wrapped)
+	}
+	wrapped := ErrNotFound.Wrap(err)
+	if !errors.Is(wrapped, ErrNotFound) || !errors.Is(wrapped, ErrCorrupt) ||
+		!ErrCorrupt.Contains(wrapped) {
+		t.Fatalf("unexpected matches for %v", wrapped)
+	}
+
+	// wrapped system errors unwrap to themselves
+	_, err = OpenTree(tfs.Path("missing"))
+	var perr *fs.PathError
+	if !errors.Is(err, fs.ErrNotExist) || !errors.As(err, &perr) {
+		t.Fatalf("expected a missing file error, got %v", err)
+	}
+
+	err = os.WriteFile(tfs.Path("garbage"), make([]byte, 4096), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenTree(tfs.Path("garbage"))
+	if !errors.Is(err, ErrCorrupt) || errors.Is(err, ErrVersion) {
+		t.Fatalf("expected a corrupt tree, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// DataEncoding is how a PointEncoder writes Data.
+type DataEncoding int
+
+const (
+	// TextData writes Data as a string. It is the default. In JSON, bytes
+	// that aren't valid UTF-8 are replaced, so binary Data should use one of
+	// the other encodings.
+	TextData DataEncoding = iota
+	// Base64Data writes Data in standard base64.
+	Base64Data
+	// HexData writes Data in lowercase hexadecimal.
+	HexData
+)
+
+// ExportOptions configures a PointEncoder.
+type ExportOptions struct {
+	// Data is how Data is written. Defaults to TextData.
+	Data DataEncoding
+	// Header, if set, starts CSV output with a record naming the columns:
+	// x0, x1 and so on for the coordinates, then data, then id and distance
+	// if the first point written has them.
+	Header bool
+	// IDs, if set, writes the ID of each point with a distance, and of each
+	// point Tree.Encode dumps, for use with Tree.Get.
+	IDs bool
+}
+
+// PointEncoder writes points, and points with their distances, as JSON lines
+// or CSV, in the forms PointSet.LoadJSONL and PointSet.LoadCSV read with
+// their default options. JSON lines have a "pos" array, a "data" field unless
+// Data is empty, an "id" field if IDs are written and a "distance" field for
+// points with distances. CSV records have a column for each coordinate, then
+// one for Data, then one for the ID and one for the distance. Output is
+// buffered until Flush.
+type PointEncoder struct {
+	w      *bufio.Writer
+	json   *json.Encoder
+	csv    *csv.Writer
+	opts   ExportOptions
+	record []string
+	wrote  bool
+}
+
+// NewJSONLEncoder returns a PointEncoder writing JSON lines to w.
+func NewJSONLEncoder(w io.Writer, opts ExportOptions) *PointEncoder {
+	bw := bufio.NewWriter(w)
+	return &PointEncoder{w: bw, json: json.NewEncoder(bw), opts: opts}
+}
+
+// NewCSVEncoder returns a PointEncoder writing CSV to w.
+func NewCSVEncoder(w io.Writer, opts ExportOptions) *PointEncoder {
+	bw := bufio.NewWriter(w)
+	return &PointEncoder{w: bw, csv: csv.NewWriter(bw), opts: opts}
+}
+
+// exportedPoint is the JSON form of a point.
+type exportedPoint struct {
+	Pos      []float64 `json:"pos"`
+	Data     string    `json:"data,omitempty"`
+	ID       *uint64   `json:"id,omitempty"`
+	Distance *float64  `json:"distance,omitempty"`
+}
+
+func (e *PointEncoder) data(data []byte) string {
+	switch e.opts.Data {
+	case Base64Data:
+		return base64.StdEncoding.EncodeToString(data)
+	case HexData:
+		return hex.EncodeToString(data)
+	default:
+		return string(data)
+	}
+}
+
+// encode writes p, along with id and distance unless they are nil. id is
+// left out unless the options ask for IDs.
+func (e *PointEncoder) encode(p *Point, id *uint64, distance *float64) error {
+	if !e.opts.IDs {
+		id = nil
+	}
+	if e.json != nil {
+		return errClass.Wrap(e.json.Encode(exportedPoint{Pos: p.Pos,
+			Data: e.data(p.Data), ID: id, Distance: distance}))
+	}
+	if !e.wrote && e.opts.Header {
+		e.record = e.record[:0]
+		for i := range p.Pos {
+			e.record = append(e.record, "x"+strconv.Itoa(i))
+		}
+		e.record = append(e.record, "data")
+		if id != nil {
+			e.record = append(e.record, "id")
+		}
+		if distance != nil {
+			e.record = append(e.record, "distance")
+		}
+		err := e.csv.Write(e.record)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	e.wrote = true
+	e.record = e.record[:0]
+	for _, v := range p.Pos {
+		e.record = append(e.record, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	e.record = append(e.record, e.data(p.Data))
+	if id != nil {
+		e.record = append(e.record, strconv.FormatUint(*id, 10))
+	}
+	if distance != nil {
+		e.record = append(e.record,
+			strconv.FormatFloat(*distance, 'g', -1, 64))
+	}
+	return errClass.Wrap(e.csv.Write(e.record))
+}
+
+// Encode writes p.
+func (e *PointEncoder) Encode(p Point) error {
+	return e.encode(&p, nil, nil)
+}
+
+// EncodeDistance writes pd's point with its distance, and its ID if the
+// options ask for IDs.
+func (e *PointEncoder) EncodeDistance(pd PointDistance) error {
+	return e.encode(&pd.Point, &pd.ID, &pd.Distance)
+}
+
+// Flush writes out any buffered output.
+func (e *PointEncoder) Flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		err := e.csv.Error()
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	return errClass.Wrap(e.w.Flush())
+}
+
+// Encode writes every point Each visits to enc and flushes enc, dumping the
+// tree as JSON lines or CSV.
+func (t *Tree) Encode(enc *PointEncoder) error {
+	err := t.eachID(func(p Point, id uint64) error {
+		return enc.encode(&p, &id, nil)
+	})
+	if err != nil {
+		return err
+	}
+	return enc.Flush()
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPointEncoder(t *testing.T) {
+	p := Point{Pos: []float64{1.5, -2}, Data: []byte("a,\xff")}
+	pd := PointDistance{Point: Point{Pos: []float64{3, 4}}, Distance: 0.25,
+		ID: 7}
+
+	for _, test := range []struct {
+		csv      bool
+		opts     ExportOptions
+		expected string
+	}{
+		{false, ExportOptions{Data: HexData},
+			"{\"pos\":[1.5,-2],\"data\":\"612cff\"}\n" +
+				"{\"pos\":[3,4],\"distance\":0.25}\n"},
+		{true, ExportOptions{Data: Base64Data, Header: true},
+			"x0,x1,data\n1.5,-2,YSz/\n3,4,,0.25\n"},
+		{true, ExportOptions{},
+			"1.5,-2,\"a,\xff\"\n3,4,,0.25\n"},
+		{false, ExportOptions{IDs: true},
+			"{\"pos\":[1.5,-2],\"data\":\"a,\ufffd\"}\n" +
+				"{\"pos\":[3,4],\"id\":7,\"distance\":0.25}\n"},
+		{true, ExportOptions{IDs: true},
+			"1.5,-2,\"a,\xff\"\n3,4,,7,0.25\n"},
+	} {
+		var buf bytes.Buffer
+		enc := NewJSONLEncoder(&buf, test.opts)
+		if test.csv {
+			enc = NewCSVEncoder(&buf, test.opts)
+		}
+		err := enc.Encode(p)
+		if err == nil {
+			err = enc.EncodeDistance(pd)
+		}
+		if err == nil {
+			err = enc.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Fatalf("got %q, expected %q", buf.String(), test.expected)
+		}
+	}
+}
+
+func TestEncodeTree(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	for i := range points {
+		// text Data, so it survives CSV and JSON as is
+		points[i].Data = []byte(strings.Repeat("d", i%10))
+	}
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	for _, csv := range []bool{false, true} {
+		var buf bytes.Buffer
+		enc := NewJSONLEncoder(&buf, ExportOptions{})
+		if csv {
+			enc = NewCSVEncoder(&buf, ExportOptions{Header: true})
+		}
+		err := tree.Encode(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		set, err := NewPointSet(fs.Temp(), 3, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if csv {
+			_, err = set.LoadCSV(&buf, LoadOptions{Header: true})
+		} else {
+			_, err = set.LoadJSONL(&buf, LoadOptions{})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !samePoints(loadedPoints(t, fs, set), points) {
+			t.Fatalf("csv %v: points didn't round trip", csv)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := tree.Encode(NewJSONLEncoder(&buf, ExportOptions{IDs: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dec := json.NewDecoder(&buf); dec.More(); {
+		var p exportedPoint
+		err = dec.Decode(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.ID == nil {
+			t.Fatal("expected an id")
+		}
+		data, err := tree.Get(*p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != p.Data {
+			t.Fatalf("id %d has data %q, expected %q", *p.ID, data, p.Data)
+		}
+	}
+}
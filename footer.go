@@ -0,0 +1,548 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	footerVersion = 1
+	// footerVersionVariableData marks trees with variable-length data, which
+	// earlier readers must refuse rather than misread.
+	footerVersionVariableData = 2
+	// footerVersionCompressedData marks trees with compressed variable-length
+	// data.
+	footerVersionCompressedData = 3
+	// footerVersionChecksums marks trees with a checksum table.
+	footerVersionChecksums = 4
+	// footerVersionFloat32 marks trees with float32 coordinates.
+	footerVersionFloat32 = 5
+	// footerVersionBoxes marks trees with a box table.
+	footerVersionBoxes = 6
+	// footerVersionTags marks trees with a tag table.
+	footerVersionTags = 7
+	// footerVersionCodec marks trees with encoded coordinates.
+	footerVersionCodec = 8
+	// footerVersionNormalized marks trees whose points were normalized, which
+	// earlier readers would query in the wrong coordinates.
+	footerVersionNormalized = 9
+	footerMagic             = "dkdT"
+	// a footer ends with its body length and the magic bytes
+	footerTrailerSize = uint32Size + len(footerMagic)
+)
+
+// footer section tags
+const (
+	sectionGrid       = 1
+	sectionLayout     = 2
+	sectionTimeField  = 3
+	sectionData       = 4
+	sectionChecksums  = 5
+	sectionFloat32    = 6
+	sectionBoxes      = 7
+	sectionLeafSize   = 8
+	sectionTags       = 9
+	sectionSplit      = 10
+	sectionDimension  = 11
+	sectionCodec      = 12
+	sectionNormalize  = 13
+	sectionGeneration = 14
+)
+
+// footer describes a tree file. It is written after the last node so that
+// the tree can be streamed out before its summary information is known.
+type footer struct {
+	dims       int
+	maxDataLen int
+	count      int64
+	root       int64
+
+	// min and max bound every point in the tree. they are all zeros if the
+	// tree is empty.
+	min, max []float64
+
+	grid      *Grid
+	layout    Layout
+	timeField *TimeField
+
+	// variableData is set if node Data is stored in a region of dataLen
+	// bytes after the nodes. See BuildOptions.VariableData.
+	variableData bool
+	dataLen      int64
+	// compression is how each node's Data is compressed in the data region.
+	compression Compression
+	// checksums is set if a checksum table follows the data region. See
+	// addChecksums.
+	checksums bool
+	// float32 is set if coordinates are stored as float32s, with point
+	// serialization version 1.
+	float32 bool
+	// codec, if set, encodes the coordinates, with point serialization
+	// version 2.
+	codec CoordinateCodec
+	// boxes is set if a table of subtree bounding boxes follows the checksum
+	// table. See addBoxes.
+	boxes bool
+	// tagField is set if a table of subtree tags follows the box table. See
+	// addTags.
+	tagField *TagField
+	// leafSize is the size of the subtrees searches read at once. See
+	// BuildOptions.LeafSize. Earlier readers can ignore it, so it doesn't
+	// change the version.
+	leafSize int
+	// split is how the tree's split points were chosen. See
+	// BuildOptions.SplitStrategy. Like leafSize, it doesn't change the
+	// version.
+	split SplitStrategy
+	// dimensions is how the dimensions the tree's nodes split along were
+	// chosen. See BuildOptions.SplitDimension. It doesn't change the version
+	// either.
+	dimensions DimensionChoice
+	// normalization, if set, is how the tree's points were normalized. See
+	// BuildOptions.Normalize. Earlier readers would answer queries in the
+	// normalized coordinates without knowing it, so unlike leafSize, it
+	// changes the version.
+	normalization *Normalization
+	// generation counts the rebuilds that led to the tree, and is part of
+	// every point ID. See Tree.Get. Earlier readers hand out IDs without
+	// it, which is no worse than they did before, so it doesn't change the
+	// version.
+	generation uint32
+}
+
+func (f *footer) nodeSize() int64 {
+	maxDataLen := f.maxDataLen
+	if f.variableData {
+		maxDataLen = dataRefSize
+	}
+	return int64(nodeSizeCoords(f.coords(), f.dims, maxDataLen))
+}
+
+// pointVersion is the serialization version of the points in the tree.
+// describe returns the parameters the tree was built with, for error
+// messages.
+func (f *footer) describe() string {
+	return fmt.Sprintf("%d dimensions and a max data length of %d "+
+		"(%d points, format version %d)", f.dims, f.maxDataLen, f.count,
+		f.version())
+}
+
+func (f *footer) pointVersion() byte {
+	switch {
+	case f.codec != nil:
+		return pointVersionEncoded
+	case f.float32:
+		return pointVersionFloat32
+	}
+	return pointVersionFloat64
+}
+
+// coords returns how the tree's coordinates are serialized.
+func (f *footer) coords() coords {
+	return coords{version: f.pointVersion(), codec: f.codec, min: f.min,
+		max: f.max}
+}
+
+// checksumEntrySize is the size of each node's entry in the checksum table.
+func (f *footer) checksumEntrySize() int64 {
+	if f.variableData {
+		return 2 * checksumSize
+	}
+	return checksumSize
+}
+
+// checksumsLen is the size of the checksum table, if there is one.
+func (f *footer) checksumsLen() int64 {
+	if !f.checksums {
+		return 0
+	}
+	return f.count * f.checksumEntrySize()
+}
+
+// buildOptions returns the build options recorded in the footer, for
+// rebuilding the tree the same way.
+func (f *footer) buildOptions() BuildOptions {
+	opts := BuildOptions{Layout: f.layout, VariableData: f.variableData,
+		DataCompression: f.compression, Checksums: f.checksums,
+		Float32: f.float32, CoordinateCodec: f.codec, Boxes: f.boxes,
+		LeafSize: f.leafSize, SplitStrategy: f.split,
+		SplitDimension: f.dimensions, Normalization: f.normalization}
+	if f.grid != nil {
+		opts.GridResolution = f.grid.Resolution
+		opts.MaxGridCells = len(f.grid.Counts)
+	}
+	if f.timeField != nil {
+		tf := *f.timeField
+		opts.TimeField = &tf
+	}
+	if f.tagField != nil {
+		tf := *f.tagField
+		opts.TagField = &tf
+	}
+	return opts
+}
+
+func (f *footer) serialize(w io.Writer) error {
+	var body bytes.Buffer
+	body.WriteByte(f.version())
+	binary.Write(&body, binary.LittleEndian, uint32(f.dims))
+	binary.Write(&body, binary.LittleEndian, uint32(f.maxDataLen))
+	binary.Write(&body, binary.LittleEndian, f.count)
+	binary.Write(&body, binary.LittleEndian, f.root)
+	binary.Write(&body, binary.LittleEndian, uint32(len(f.min)))
+	binary.Write(&body, binary.LittleEndian, f.min)
+	binary.Write(&body, binary.LittleEndian, f.max)
+
+	var sections [][]byte
+	if f.grid != nil {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionGrid))
+		binary.Write(&section, binary.LittleEndian, uint32(f.grid.Resolution))
+		binary.Write(&section, binary.LittleEndian, f.grid.Counts)
+		sections = append(sections, section.Bytes())
+	}
+	if f.layout != PreorderLayout {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionLayout))
+		binary.Write(&section, binary.LittleEndian, uint32(f.layout))
+		sections = append(sections, section.Bytes())
+	}
+	if f.timeField != nil {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionTimeField))
+		binary.Write(&section, binary.LittleEndian, uint32(f.timeField.Offset))
+		binary.Write(&section, binary.LittleEndian, uint32(f.timeField.Width))
+		sections = append(sections, section.Bytes())
+	}
+	if f.variableData {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionData))
+		binary.Write(&section, binary.LittleEndian, f.dataLen)
+		if f.compression != NoCompression {
+			binary.Write(&section, binary.LittleEndian, uint32(f.compression))
+		}
+		sections = append(sections, section.Bytes())
+	}
+	if f.checksums {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionChecksums))
+		sections = append(sections, section.Bytes())
+	}
+	if f.float32 {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionFloat32))
+		sections = append(sections, section.Bytes())
+	}
+	if f.codec != nil {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionCodec))
+		section.WriteString(f.codec.Name())
+		sections = append(sections, section.Bytes())
+	}
+	if f.boxes {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionBoxes))
+		sections = append(sections, section.Bytes())
+	}
+	if f.tagField != nil {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionTags))
+		binary.Write(&section, binary.LittleEndian, uint32(f.tagField.Offset))
+		binary.Write(&section, binary.LittleEndian, uint32(f.tagField.Width))
+		sections = append(sections, section.Bytes())
+	}
+	if f.leafSize > 0 {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionLeafSize))
+		binary.Write(&section, binary.LittleEndian, uint32(f.leafSize))
+		sections = append(sections, section.Bytes())
+	}
+	if f.split != MedianSplit {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionSplit))
+		binary.Write(&section, binary.LittleEndian, uint32(f.split))
+		sections = append(sections, section.Bytes())
+	}
+	if f.dimensions != CycleDimensions {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionDimension))
+		binary.Write(&section, binary.LittleEndian, uint32(f.dimensions))
+		sections = append(sections, section.Bytes())
+	}
+	if f.normalization != nil {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionNormalize))
+		binary.Write(&section, binary.LittleEndian, f.normalization.Mean)
+		binary.Write(&section, binary.LittleEndian, f.normalization.StdDev)
+		sections = append(sections, section.Bytes())
+	}
+	if f.generation != 0 {
+		var section bytes.Buffer
+		binary.Write(&section, binary.LittleEndian, uint32(sectionGeneration))
+		binary.Write(&section, binary.LittleEndian, f.generation)
+		sections = append(sections, section.Bytes())
+	}
+	binary.Write(&body, binary.LittleEndian, uint32(len(sections)))
+	for _, section := range sections {
+		binary.Write(&body, binary.LittleEndian, uint32(len(section)))
+		body.Write(section)
+	}
+
+	// counts and offsets are 64-bit, but the footer's own length isn't,
+	// which only a huge grid could run into
+	if int64(body.Len()) > math.MaxUint32 {
+		return errClass.New("footer of %d bytes is too large", body.Len())
+	}
+	binary.Write(&body, binary.LittleEndian, uint32(body.Len()))
+	body.WriteString(footerMagic)
+	_, err := w.Write(body.Bytes())
+	return errClass.Wrap(err)
+}
+
+// footerReader consumes a footer body, remembering the first short read.
+type footerReader struct {
+	buf []byte
+	err error
+}
+
+func (r *footerReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = ErrCorrupt.New("truncated footer")
+		return nil
+	}
+	rv := r.buf[:n]
+	r.buf = r.buf[n:]
+	return rv
+}
+
+func (r *footerReader) uint32() uint32 {
+	if b := r.next(uint32Size); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *footerReader) int64() int64 {
+	if b := r.next(uint64Size); b != nil {
+		return int64(binary.LittleEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *footerReader) floats(n int) []float64 {
+	if n < 0 || n > len(r.buf)/float64Size {
+		r.err = ErrCorrupt.New("truncated footer")
+		return nil
+	}
+	rv := make([]float64, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		rv = append(rv, math.Float64frombits(uint64(r.int64())))
+	}
+	return rv
+}
+
+// readFooter reads the footer from the end of a tree file of size filelen,
+// returning the footer and the length of the node region that precedes it.
+func readFooter(r io.ReaderAt, filelen int64) (f footer, nodesLen int64,
+	err error) {
+	if filelen < int64(footerTrailerSize) {
+		return f, 0, ErrCorrupt.New("missing footer")
+	}
+	var trailer [footerTrailerSize]byte
+	_, err = r.ReadAt(trailer[:], filelen-int64(len(trailer)))
+	if err != nil {
+		return f, 0, errClass.Wrap(err)
+	}
+	if string(trailer[uint32Size:]) != footerMagic {
+		return f, 0, ErrCorrupt.New("missing footer")
+	}
+	bodyLen := int64(binary.LittleEndian.Uint32(trailer[:]))
+	nodesLen = filelen - int64(len(trailer)) - bodyLen
+	if nodesLen < 0 {
+		return f, 0, ErrCorrupt.New("truncated footer")
+	}
+	body := make([]byte, bodyLen)
+	_, err = r.ReadAt(body, nodesLen)
+	if err != nil {
+		return f, 0, errClass.Wrap(err)
+	}
+	f, err = parseFooter(body)
+	return f, nodesLen, err
+}
+
+func parseFooter(body []byte) (f footer, err error) {
+	r := &footerReader{buf: body}
+	version := r.next(1)
+	if version != nil && (version[0] < footerVersion ||
+		version[0] > footerVersionNormalized) {
+		return f, ErrVersion.New("unsupported footer version %d", version[0])
+	}
+	// on 32-bit platforms these can overflow an int, so they're checked
+	// with checkNodeSize before anything is sized by them
+	dims, maxDataLen := int64(r.uint32()), int64(r.uint32())
+	f.dims, f.maxDataLen = int(dims), int(maxDataLen)
+	f.count = r.int64()
+	f.root = r.int64()
+	boundsLen := int(r.uint32())
+	if boundsLen != 0 && boundsLen != f.dims {
+		return f, ErrCorrupt.New("invalid footer bounds")
+	}
+	f.min = r.floats(boundsLen)
+	f.max = r.floats(boundsLen)
+
+	sections := int(r.uint32())
+	for i := 0; i < sections && r.err == nil; i++ {
+		section := &footerReader{buf: r.next(int(r.uint32()))}
+		switch section.uint32() {
+		case sectionGrid:
+			resolution := int(section.uint32())
+			cells := len(section.buf) / uint64Size
+			if resolution <= 0 || cells != expectedCells(f.dims, resolution) {
+				return f, ErrCorrupt.New("invalid grid section")
+			}
+			f.grid = &Grid{
+				Min:        f.min,
+				Max:        f.max,
+				Resolution: resolution,
+				Counts:     make([]uint64, 0, cells)}
+			for j := 0; j < cells; j++ {
+				f.grid.Counts = append(f.grid.Counts, uint64(section.int64()))
+			}
+		case sectionLayout:
+			f.layout = Layout(section.uint32())
+		case sectionTimeField:
+			f.timeField = &TimeField{
+				Offset: int(section.uint32()),
+				Width:  int(section.uint32())}
+			if section.err == nil && f.timeField.check(f.maxDataLen) != nil {
+				return f, ErrCorrupt.New("invalid time field section")
+			}
+		case sectionData:
+			f.variableData = true
+			f.dataLen = section.int64()
+			if len(section.buf) > 0 {
+				f.compression = Compression(section.uint32())
+				if f.compression != FlateCompression {
+					return f, ErrCorrupt.New("invalid data compression")
+				}
+			}
+		case sectionChecksums:
+			f.checksums = true
+		case sectionFloat32:
+			f.float32 = true
+		case sectionCodec:
+			name := string(section.next(len(section.buf)))
+			f.codec = LookupCoordinateCodec(name)
+			if f.codec == nil {
+				return f, ErrUnsupported.New(
+					"unregistered coordinate codec %q", name)
+			}
+		case sectionBoxes:
+			f.boxes = true
+		case sectionTags:
+			f.tagField = &TagField{
+				Offset: int(section.uint32()),
+				Width:  int(section.uint32())}
+			if section.err == nil && f.tagField.check(f.maxDataLen) != nil {
+				return f, ErrCorrupt.New("invalid tag section")
+			}
+		case sectionLeafSize:
+			f.leafSize = int(section.uint32())
+			if section.err == nil &&
+				(f.leafSize <= 0 || f.layout != PreorderLayout) {
+				return f, ErrCorrupt.New("invalid leaf size section")
+			}
+		case sectionSplit:
+			f.split = SplitStrategy(section.uint32())
+			if section.err == nil && f.split.check() != nil {
+				return f, ErrCorrupt.New("invalid split section")
+			}
+		case sectionDimension:
+			f.dimensions = DimensionChoice(section.uint32())
+			if section.err == nil && f.dimensions.check() != nil {
+				return f, ErrCorrupt.New("invalid dimension section")
+			}
+		case sectionNormalize:
+			f.normalization = &Normalization{Mean: section.floats(f.dims),
+				StdDev: section.floats(f.dims)}
+			if section.err == nil && f.normalization.check(f.dims) != nil {
+				return f, ErrCorrupt.New("invalid normalization section")
+			}
+		case sectionGeneration:
+			f.generation = section.uint32()
+			if section.err == nil && f.generation > maxGeneration {
+				return f, ErrCorrupt.New("invalid generation section")
+			}
+		}
+		if section.err != nil {
+			return f, section.err
+		}
+	}
+	if r.err == nil && version != nil && version[0] != f.version() {
+		return f, ErrCorrupt.New("footer sections don't match version %d",
+			version[0])
+	}
+	if r.err == nil {
+		if f.variableData {
+			maxDataLen = dataRefSize
+		}
+		err = checkNodeSize(dims, maxDataLen)
+		if err != nil {
+			return f, err
+		}
+	}
+	return f, r.err
+}
+
+// version returns the footer version for the features f describes, which is
+// the oldest that readers need to understand the tree.
+func (f *footer) version() byte {
+	switch {
+	case f.normalization != nil:
+		return footerVersionNormalized
+	case f.codec != nil:
+		return footerVersionCodec
+	case f.tagField != nil:
+		return footerVersionTags
+	case f.boxes:
+		return footerVersionBoxes
+	case f.float32:
+		return footerVersionFloat32
+	case f.checksums:
+		return footerVersionChecksums
+	case f.compression != NoCompression:
+		return footerVersionCompressedData
+	case f.variableData:
+		return footerVersionVariableData
+	default:
+		return footerVersion
+	}
+}
+
+func expectedCells(dims, resolution int) int {
+	cells, ok := gridCells(dims, resolution, math.MaxInt32)
+	if !ok {
+		return -1
+	}
+	return cells
+}
@@ -0,0 +1,235 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+// Forest queries a set of trees with the same dimensions as one, so that a
+// dataset too large to build as a single tree can be built as several, split
+// up by hash, by region or however is convenient. Queries fan out to every
+// tree concurrently and their results are merged.
+type Forest struct {
+	trees []*Tree
+}
+
+// NewForest returns a Forest over trees, which it takes ownership of.
+func NewForest(trees ...*Tree) (*Forest, error) {
+	if len(trees) == 0 {
+		return nil, errClass.New("a forest needs at least one tree")
+	}
+	for _, t := range trees[1:] {
+		if t.Dims() != trees[0].Dims() {
+			return nil, ErrDimensionMismatch.New(
+				"trees have different dimensions: %d and %d",
+				trees[0].Dims(), t.Dims())
+		}
+	}
+	return &Forest{trees: trees}, nil
+}
+
+// OpenForest opens the trees at paths with OpenTree and returns a Forest over
+// them.
+func OpenForest(paths ...string) (*Forest, error) {
+	trees := make([]*Tree, 0, len(paths))
+	for _, path := range paths {
+		t, err := OpenTree(path)
+		if err != nil {
+			for _, t := range trees {
+				t.Close()
+			}
+			return nil, err
+		}
+		trees = append(trees, t)
+	}
+	f, err := NewForest(trees...)
+	if err != nil {
+		for _, t := range trees {
+			t.Close()
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// Trees returns the trees in the forest.
+func (f *Forest) Trees() []*Tree { return f.trees }
+
+func (f *Forest) Dims() int { return f.trees[0].Dims() }
+
+// Count returns the total Count of the trees.
+func (f *Forest) Count() (count int64) {
+	for _, t := range f.trees {
+		count += t.Count()
+	}
+	return count
+}
+
+// Close closes every tree.
+func (f *Forest) Close() error {
+	var errs errors.ErrorGroup
+	for _, t := range f.trees {
+		errs.Add(t.Close())
+	}
+	return errs.Finalize()
+}
+
+// each calls fn with every tree concurrently, returning the first error.
+func (f *Forest) each(fn func(i int, t *Tree) error) error {
+	return eachTree(f.trees, fn)
+}
+
+// eachTree calls fn with every tree in trees concurrently, returning the
+// first error.
+func eachTree(trees []*Tree, fn func(i int, t *Tree) error) error {
+	errs := make([]error, len(trees))
+	var wg sync.WaitGroup
+	for i, t := range trees {
+		wg.Add(1)
+		go func(i int, t *Tree) {
+			defer wg.Done()
+			errs[i] = fn(i, t)
+		}(i, t)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Nearest returns the n nearest points to p across every tree, as
+// Tree.Nearest would for a single tree holding all of their points. IDs in
+// the results only identify points within their own tree.
+//
+// The trees are searched concurrently against one shared bound, the
+// furthest of the n nearest points any of them has found so far, so each
+// tree prunes subtrees that can't beat the other trees' results as well as
+// its own.
+func (f *Forest) Nearest(p Point, n int) ([]PointDistance, error) {
+	across := newSharedBound()
+	return nearestAcross(f.trees, n, func(t *Tree) ([]PointDistance, error) {
+		rv, _, err := t.nearest(n, &nearestQuery{p: p, across: across})
+		return rv, err
+	})
+}
+
+// sharedBound is the distance of the furthest of the nearest points found so
+// far by concurrent searches of several trees for the same points. Every
+// search has found at least as many points within it as are wanted, so
+// nothing further away can be a result.
+type sharedBound struct {
+	bits uint64 // math.Float64bits of the bound, accessed atomically
+}
+
+func newSharedBound() *sharedBound {
+	return &sharedBound{bits: math.Float64bits(math.Inf(1))}
+}
+
+func (b *sharedBound) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&b.bits))
+}
+
+// lower lowers the bound to dist, if dist is lower.
+func (b *sharedBound) lower(dist float64) {
+	for {
+		old := atomic.LoadUint64(&b.bits)
+		if dist >= math.Float64frombits(old) ||
+			atomic.CompareAndSwapUint64(&b.bits, old, math.Float64bits(dist)) {
+			return
+		}
+	}
+}
+
+// nearestAcross runs search, a query for the n points nearest some point,
+// on every tree in trees concurrently, and merges the results.
+func nearestAcross(trees []*Tree, n int,
+	search func(t *Tree) ([]PointDistance, error)) ([]PointDistance, error) {
+	results := make([][]PointDistance, len(trees))
+	err := eachTree(trees, func(i int, t *Tree) (err error) {
+		results[i], err = search(t)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeNearest(n, results...), nil
+}
+
+// mergeNearest merges results, each closest first, into the n closest of
+// them all, in result order.
+func mergeNearest(n int, results ...[]PointDistance) []PointDistance {
+	var rv []PointDistance
+	for _, r := range results {
+		rv = append(rv, r...)
+	}
+	sortResults(rv)
+	if len(rv) > n {
+		rv = rv[:n]
+	}
+	return rv
+}
+
+// Within returns every point within radius of p across every tree, in no
+// particular order. See Tree.Within.
+func (f *Forest) Within(p Point, radius float64) ([]Point, error) {
+	results := make([][]Point, len(f.trees))
+	err := f.each(func(i int, t *Tree) (err error) {
+		results[i], err = t.Within(p, radius)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rv []Point
+	for _, r := range results {
+		rv = append(rv, r...)
+	}
+	return rv, nil
+}
+
+// CountWithin returns the number of points within radius of p across every
+// tree.
+func (f *Forest) CountWithin(p Point, radius float64) (int64, error) {
+	counts := make([]int64, len(f.trees))
+	err := f.each(func(i int, t *Tree) (err error) {
+		counts[i], err = t.CountWithin(p, radius)
+		return err
+	})
+	var total int64
+	for _, c := range counts {
+		total += c
+	}
+	return total, err
+}
+
+// Range calls fn with every point inside the box from min to max in each
+// tree in turn. It stops at and returns the first error fn returns.
+func (f *Forest) Range(min, max []float64, fn func(Point) error) error {
+	for _, t := range f.trees {
+		err := t.Range(min, max, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestForest(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(900, 3, 10)
+	whole := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer whole.Close()
+
+	var trees []*Tree
+	for i := 0; i < 3; i++ {
+		trees = append(trees,
+			createTestTree(t, fs, 3, 10, points[i*300:(i+1)*300], BuildOptions{}))
+	}
+	forest, err := NewForest(trees...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forest.Close()
+	if forest.Count() != whole.Count() {
+		t.Fatalf("forest has %d points, expected %d", forest.Count(),
+			whole.Count())
+	}
+
+	for i := 0; i < 20; i++ {
+		q := NewPoint(3, 10)
+		expected, err := whole.Nearest(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := forest.Nearest(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != len(expected) {
+			t.Fatalf("got %d results, expected %d", len(actual), len(expected))
+		}
+		for j := range expected {
+			if actual[j].Distance != expected[j].Distance {
+				t.Fatalf("result %d differs from a single tree", j)
+			}
+		}
+
+		expectedCount, err := whole.CountWithin(q, 0.2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		within, err := forest.Within(q, 0.2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := forest.CountWithin(q, 0.2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(within)) != expectedCount || count != expectedCount {
+			t.Fatalf("got %d and %d points in range, expected %d", len(within),
+				count, expectedCount)
+		}
+	}
+
+	other := createTestTree(t, fs, 2, 10, newTestPoints(10, 2, 10),
+		BuildOptions{})
+	defer other.Close()
+	_, err = NewForest(whole, other)
+	if err == nil {
+		t.Fatal("expected an error mixing dimensions")
+	}
+}
+
+// newTestForest builds a forest of shards trees, splitting points between
+// them round robin.
+func newTestForest(t testing.TB, fs *baseFS, points []Point,
+	shards int) *Forest {
+	split := make([][]Point, shards)
+	for i, p := range points {
+		split[i%shards] = append(split[i%shards], p)
+	}
+	trees := make([]*Tree, 0, shards)
+	for _, points := range split {
+		trees = append(trees, createTestTree(t, fs, 3, 10, points,
+			BuildOptions{}))
+	}
+	forest, err := NewForest(trees...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forest
+}
+
+// nearestIndependently is Forest.Nearest as it was before the trees shared a
+// bound: each finds its own n nearest, and they're merged.
+func nearestIndependently(f *Forest, p Point, n int) ([]PointDistance,
+	error) {
+	return nearestAcross(f.trees, n, func(t *Tree) ([]PointDistance, error) {
+		return t.Nearest(p, n)
+	})
+}
+
+func TestForestSharedBound(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	// repeat the positions of some points, so results tie on distance and
+	// position across trees. Their Data differs, as nothing orders points
+	// that are wholly the same.
+	for _, p := range points[:100] {
+		points = append(points, Point{Pos: p.Pos,
+			Data: bytes.Repeat([]byte{0xff}, 10)})
+	}
+
+	for _, shards := range []int{1, 2, 5, 16} {
+		forest := newTestForest(t, fs, points, shards)
+		for _, n := range []int{1, 10, 100, 2000} {
+			for i := 0; i < 10; i++ {
+				q := NewPoint(3, 10)
+				if i%2 == 1 {
+					q = points[i]
+				}
+				expected, err := nearestIndependently(forest, q, n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				actual, err := forest.Nearest(q, n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(actual, expected) {
+					t.Fatalf("%d shards, n=%d: shared bound results differ",
+						shards, n)
+				}
+			}
+		}
+		err := forest.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkForestNearest compares searching a forest's trees against one
+// shared bound with searching each independently and merging.
+func BenchmarkForestNearest(b *testing.B) {
+	fs := newTestFS(b)
+	defer fs.Delete()
+
+	points := newTestPoints(50000, 3, 10)
+	for _, shards := range []int{2, 8, 32} {
+		forest := newTestForest(b, fs, points, shards)
+		for _, n := range []int{1, 10, 100, 1000} {
+			name := fmt.Sprintf("shards=%d/n=%d", shards, n)
+			b.Run(name+"/shared", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_, err := forest.Nearest(NewPoint(3, 10), n)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run(name+"/independent", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_, err := nearestIndependently(forest, NewPoint(3, 10), n)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+		forest.Close()
+	}
+}
@@ -23,6 +23,12 @@ import (
 
 type baseFS struct {
 	base string
+	// direct is set if point sets split into the file system's temporary
+	// files use direct I/O.
+	direct bool
+	// metrics, if set, is told the size of each point set split into the
+	// file system's temporary files.
+	metrics Metrics
 }
 
 func newBaseFS(path string) (*baseFS, error) {
@@ -67,6 +73,18 @@ func tempName(base string) string {
 
 }
 
+// syncDir commits changes to the entries of the directory dir, such as a
+// file renamed into it, to stable storage. Not every platform can sync a
+// directory, so this is best effort.
+func syncDir(dir string) {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	fh.Sync()
+	fh.Close()
+}
+
 func (fs *baseFS) Temp() string {
 	return tempName(filepath.Join(fs.base, "tmp"))
 }
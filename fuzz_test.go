@@ -0,0 +1,110 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"testing/fstest"
+)
+
+func FuzzParsePoint(f *testing.F) {
+	for _, p := range newTestPoints(5, 3, 20) {
+		var buf bytes.Buffer
+		err := p.serialize(&buf, 20, nil)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{})
+	f.Add([]byte{pointVersionFloat64, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, _, err := parsePoint(data)
+		rp, _, rerr := parsePointFromReader(bytes.NewReader(data))
+		if (err == nil) != (rerr == nil) {
+			t.Fatalf("parsePoint: %v, parsePointFromReader: %v", err, rerr)
+		}
+		if err == nil && !sameBits(p, rp) {
+			t.Fatal("parsers disagree")
+		}
+	})
+}
+
+// sameBits is like Point.equal, but compares positions bit for bit, so
+// that fuzzed NaNs match themselves.
+func sameBits(p1, p2 Point) bool {
+	if len(p1.Pos) != len(p2.Pos) || string(p1.Data) != string(p2.Data) {
+		return false
+	}
+	for i := range p1.Pos {
+		if math.Float64bits(p1.Pos[i]) != math.Float64bits(p2.Pos[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func FuzzParseNode(f *testing.F) {
+	n := Node{Point: NewPoint(3, 20), Left: -1, Right: 64, Count: 2, Dim: 1}
+	var buf bytes.Buffer
+	err := n.serialize(&buf, 20, nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	f.Add(make([]byte, buf.Len()))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, err := parseNode(data, 3, coords{})
+		_, rerr := parseNodeInto(data, 3, coords{}, make([]float64, 3))
+		if (err == nil) != (rerr == nil) {
+			t.Fatalf("parseNode: %v, parseNodeInto: %v", err, rerr)
+		}
+		_, _, _ = parseNodeFromReader(bytes.NewReader(data))
+	})
+}
+
+func FuzzOpenTree(f *testing.F) {
+	tmp := newTestFS(f)
+	defer tmp.Delete()
+	points := newTestPoints(20, 2, 8)
+	for _, opts := range []BuildOptions{{}, {Checksums: true},
+		{CoordinateCodec: Quantized16}} {
+		tree := createTestTree(f, tmp, 2, 8, points, opts)
+		var buf bytes.Buffer
+		_, err := tree.WriteTo(&buf)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+		err = tree.Close()
+		if err != nil {
+			f.Fatal(err)
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tree, err := OpenTreeFS(fstest.MapFS{"tree": {Data: data}}, "tree")
+		if err != nil {
+			return
+		}
+		defer tree.Close()
+		// searches may only assume a tree that passes verification
+		if tree.Verify() != nil {
+			return
+		}
+		_, _ = tree.Nearest(Point{Pos: []float64{0.5, 0.5}}, 5)
+	})
+}
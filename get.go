@@ -0,0 +1,99 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+// ErrNotFound is the class of errors returned for IDs that don't name a live
+// point.
+var ErrNotFound = errClass.NewClass("not found")
+
+// ErrTooManyPoints is the class of errors returned by builds and inserts
+// that would give a tree more points than its IDs can number, maxPoints.
+var ErrTooManyPoints = errClass.NewClass("too many points")
+
+const (
+	// idIndexBits is how many of the low bits of an ID hold the point's
+	// index. The rest hold the generation of the tree the ID came from.
+	idIndexBits = 40
+	idIndexMask = 1<<idIndexBits - 1
+	// maxPoints is how many points, stored and pending, a tree can hold, as
+	// the last of them has the largest index an ID can hold.
+	maxPoints = 1 << idIndexBits
+	// maxGeneration is the largest generation an ID can hold, after which
+	// generations start again from zero.
+	maxGeneration = 1<<(64-idIndexBits) - 1
+)
+
+// pointIndex returns the index of the point in the node at offset, or of the
+// pending point with that stand-in offset. Stored points are numbered by
+// their position in the tree file, and pending points after them in the
+// order they were inserted.
+func (t *Tree) pointIndex(offset int64) uint64 {
+	if offset < -1 {
+		return uint64(t.count) + uint64(-2-offset)
+	}
+	return uint64(offset / t.nodelen)
+}
+
+// pointID returns the ID of the point in the node at offset, or of the
+// pending point with that stand-in offset.
+func (t *Tree) pointID(offset int64) uint64 {
+	return t.indexID(t.pointIndex(offset))
+}
+
+// indexID returns the ID of the point with the given index: the index,
+// tagged with the tree's generation.
+func (t *Tree) indexID(index uint64) uint64 {
+	return uint64(t.footer.generation)<<idIndexBits | index
+}
+
+// idIndex returns the index of the point with the given ID, or an
+// ErrNotFound error if the ID is from another generation of the tree.
+func (t *Tree) idIndex(id uint64) (uint64, error) {
+	if id>>idIndexBits != uint64(t.footer.generation) {
+		return 0, ErrNotFound.New("id %d is from generation %d of the tree, "+
+			"not %d", id, id>>idIndexBits, t.footer.generation)
+	}
+	return id & idIndexMask, nil
+}
+
+// Get returns the Data of the point with the given ID, as reported in the ID
+// of query results, without a search. IDs are assigned when the tree is
+// built and stay the same until it is rebuilt by Compact, Merge or
+// Maintain, which renumbers its points. Inserted points get IDs following
+// the stored points'. Each rebuild starts a new generation of the tree,
+// which is part of every ID, so IDs from before a rebuild are ErrNotFound
+// errors rather than naming some other point, as are IDs of deleted points
+// and unknown IDs. Generations wrap around after 2^24 rebuilds.
+func (t *Tree) Get(id uint64) ([]byte, error) {
+	index, err := t.idIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	if index >= uint64(t.count) {
+		pending := t.pending.snapshot()
+		if index-uint64(t.count) >= uint64(len(pending)) {
+			return nil, ErrNotFound.New("no point with id %d", id)
+		}
+		return pending[index-uint64(t.count)].Data, nil
+	}
+	n, err := t.Node(int64(index) * t.nodelen)
+	if err != nil {
+		return nil, err
+	}
+	if n.Deleted {
+		return nil, ErrNotFound.New("point %d is deleted", id)
+	}
+	return n.Point.Data, nil
+}
@@ -0,0 +1,219 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	for _, opts := range []BuildOptions{{}, {VariableData: true}} {
+		tree := createTestTree(t, fs, 3, 10, points, opts)
+		tree.Close()
+		rw, err := OpenRW(tree.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inserted := newTestPoints(5, 3, 10)
+		for _, p := range inserted {
+			err = rw.Insert(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		seen := map[uint64]bool{}
+		for i := 0; i < 20; i++ {
+			q := NewPoint(3, 10)
+			if i < len(inserted) {
+				q = inserted[i]
+			}
+			nearest, err := rw.Nearest(q, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next, _, err := rw.NearestIter(q).Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next.ID != nearest[0].ID {
+				t.Fatalf("%+v: NearestIter gave id %d, Nearest %d", opts, next.ID,
+					nearest[0].ID)
+			}
+			for _, pd := range nearest {
+				data, err := rw.Get(pd.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, pd.Data) {
+					t.Fatalf("%+v: got data %x for id %d, expected %x", opts, data,
+						pd.ID, pd.Data)
+				}
+				seen[pd.ID] = true
+			}
+		}
+		for i := range inserted {
+			if !seen[uint64(len(points)+i)] {
+				t.Fatalf("%+v: inserted point %d not found by its id", opts, i)
+			}
+		}
+
+		nearest, err := rw.Nearest(points[0], 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rw.Delete(points[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rw.Get(nearest[0].ID)
+		if err == nil {
+			t.Fatalf("%+v: expected an error getting a deleted point", opts)
+		}
+		_, err = rw.Get(uint64(len(points) + len(inserted)))
+		if err == nil {
+			t.Fatalf("%+v: expected an error getting an unknown id", opts)
+		}
+		rw.Close()
+	}
+}
+
+func TestGetAfterRebuild(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(100, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	inserted := NewPoint(3, 10)
+	err = rw.Insert(inserted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := rw.Nearest(inserted, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.Merge(fs.Temp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every point is renumbered, and the inserted one's old ID is now in
+	// range of the stored points, but none of the old IDs name anything
+	for _, pd := range before {
+		_, err = rw.Get(pd.ID)
+		if !ErrNotFound.Contains(err) {
+			t.Fatalf("expected ErrNotFound for stale id %d, got %v", pd.ID, err)
+		}
+		err = rw.UpdateData(pd.ID, nil)
+		if !ErrNotFound.Contains(err) {
+			t.Fatalf("expected ErrNotFound updating stale id %d, got %v",
+				pd.ID, err)
+		}
+	}
+
+	after, err := rw.Nearest(inserted, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pd := range after {
+		data, err := rw.Get(pd.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, pd.Data) {
+			t.Fatalf("got data %x for id %d, expected %x", data, pd.ID, pd.Data)
+		}
+	}
+
+	// the generation is kept when the tree is reopened
+	rw.Close()
+	reopened, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	_, err = reopened.Get(after[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reopened.Get(before[0].ID)
+	if !ErrNotFound.Contains(err) {
+		t.Fatalf("expected ErrNotFound for stale id %d, got %v", before[0].ID,
+			err)
+	}
+}
+
+func TestTooManyPoints(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	// neither test can hold 2^40 points, so they pretend to
+	log, err := NewPointSet(fs.Temp(), 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	err = log.Add(NewPoint(3, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.count = maxPoints + 1
+	_, err = CreateTreeWithOptions(fs.Path("tree"), fs.Temp(), log,
+		BuildOptions{})
+	if !ErrTooManyPoints.Contains(err) {
+		t.Fatalf("expected ErrTooManyPoints building, got %v", err)
+	}
+
+	tree := createTestTree(t, fs, 3, 10, newTestPoints(10, 3, 10),
+		BuildOptions{})
+	tree.Close()
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	count := rw.count
+	rw.count = maxPoints - 1
+	err = rw.Insert(NewPoint(3, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := rw.Nearest(NewPoint(3, 10), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pd := range results {
+		if pd.ID&^idIndexMask != 0 {
+			t.Fatalf("id %d spills into the generation", pd.ID)
+		}
+	}
+	err = rw.Insert(NewPoint(3, 10))
+	if !ErrTooManyPoints.Contains(err) {
+		t.Fatalf("expected ErrTooManyPoints inserting, got %v", err)
+	}
+	rw.count = count
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+)
+
+// GraphFormat is how WriteKNNGraph writes a kNN graph.
+type GraphFormat int
+
+const (
+	// EdgeListCSV writes a CSV record per edge holding the ID of the point,
+	// the ID of its neighbor and the distance between them, after a header
+	// record naming the columns source, target and distance. It is the
+	// default.
+	EdgeListCSV GraphFormat = iota
+	// WeightedEdgeList writes a line per edge holding the same fields
+	// separated by spaces, with no header, as read by NetworkX's
+	// read_weighted_edgelist and igraph's Read_Ncol.
+	WeightedEdgeList
+	// MatrixMarket writes the graph as a sparse real matrix in Matrix Market
+	// coordinate format, as read by SciPy's mmread, with a row and column
+	// for each point numbered from 1, and the distances as entries. Rows
+	// are numbered by point ID less the tree's generation (see Tree.Get),
+	// so that they start from 1 however often the tree has been rebuilt.
+	MatrixMarket
+)
+
+// WriteKNNGraph writes the directed graph linking every undeleted point in
+// the tree to its k nearest other points, including pending inserted ones,
+// to w in the given format. Points are identified by their IDs, as in query
+// results. Edges are written a point at a time, closest neighbor first, as
+// AllKNN finds them, so only a batch of points' neighbors is held in memory
+// however large the graph.
+func (t *Tree) WriteKNNGraph(w io.Writer, k int, format GraphFormat) error {
+	if k <= 0 {
+		return errClass.New("k must be positive")
+	}
+	bw := bufio.NewWriter(w)
+	var edges, expected int64
+	var line []byte
+	switch format {
+	case EdgeListCSV:
+		_, err := bw.WriteString("source,target,distance\n")
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	case WeightedEdgeList:
+	case MatrixMarket:
+		// the header gives the number of entries up front, so it's worked
+		// out from the subtree count of the root
+		var live int64
+		if t.root != -1 {
+			root, err := t.Node(t.root)
+			if err != nil {
+				return err
+			}
+			live = root.Count
+		}
+		pending := int64(t.pending.len())
+		expected = live * min(int64(k), live+pending-1)
+		line = append(line, "%%MatrixMarket matrix coordinate real general\n"...)
+		line = strconv.AppendInt(line, t.count+pending, 10)
+		line = append(line, ' ')
+		line = strconv.AppendInt(line, t.count+pending, 10)
+		line = append(line, ' ')
+		line = strconv.AppendInt(line, expected, 10)
+		line = append(line, '\n')
+		_, err := bw.Write(line)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	default:
+		return errClass.New("unknown graph format %d", format)
+	}
+
+	sep := byte(' ')
+	if format == EdgeListCSV {
+		sep = ','
+	}
+	// Matrix Market numbers rows and columns from 1
+	id := func(id uint64) uint64 { return id }
+	if format == MatrixMarket {
+		id = func(id uint64) uint64 { return id&idIndexMask + 1 }
+	}
+	b := newKNNBatcher(t, k,
+		func(p Point, exclude int64, neighbors []PointDistance) error {
+			src := id(t.pointID(exclude))
+			for _, n := range neighbors {
+				line = strconv.AppendUint(line[:0], src, 10)
+				line = append(line, sep)
+				line = strconv.AppendUint(line, id(n.ID), 10)
+				line = append(line, sep)
+				line = strconv.AppendFloat(line, n.Distance, 'g', -1, 64)
+				line = append(line, '\n')
+				_, err := bw.Write(line)
+				if err != nil {
+					return errClass.Wrap(err)
+				}
+			}
+			edges += int64(len(neighbors))
+			return nil
+		})
+	err := t.allKNN(b)
+	if err != nil {
+		return err
+	}
+	if format == MatrixMarket && edges != expected {
+		return errClass.New("wrote %d entries, but the header promised %d",
+			edges, expected)
+	}
+	return errClass.Wrap(bw.Flush())
+}
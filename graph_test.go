@@ -0,0 +1,107 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWriteKNNGraph(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	err = rw.Delete(points[7])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range newTestPoints(3, 3, 10) {
+		err = rw.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const k = 4
+	graph, err := rw.KNNGraph(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for i, row := range graph {
+		for _, n := range row {
+			expected = append(expected, fmt.Sprintf("%d %d", i,
+				rw.pointID(n.Offset)))
+		}
+	}
+	if len(expected) != (len(points)-1)*k {
+		t.Fatalf("%d edges in the graph, expected %d", len(expected),
+			(len(points)-1)*k)
+	}
+
+	for _, format := range []GraphFormat{EdgeListCSV, WeightedEdgeList,
+		MatrixMarket} {
+		var buf bytes.Buffer
+		err = rw.WriteKNNGraph(&buf, k, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var edges []string
+		s := bufio.NewScanner(&buf)
+		for line := 0; s.Scan(); line++ {
+			switch {
+			case format == EdgeListCSV && line == 0:
+				if s.Text() != "source,target,distance" {
+					t.Fatalf("unexpected header %q", s.Text())
+				}
+				continue
+			case format == MatrixMarket && line == 0:
+				continue
+			case format == MatrixMarket && line == 1:
+				size := fmt.Sprint(len(points)+3, " ", len(points)+3, " ",
+					len(expected))
+				if s.Text() != size {
+					t.Fatalf("size line %q, expected %q", s.Text(), size)
+				}
+				continue
+			}
+			var src, dst uint64
+			var distance float64
+			_, err = fmt.Sscan(strings.ReplaceAll(s.Text(), ",", " "), &src,
+				&dst, &distance)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format == MatrixMarket {
+				src, dst = src-1, dst-1
+			}
+			edges = append(edges, fmt.Sprintf("%d %d", src, dst))
+		}
+		if strings.Join(edges, "\n") != strings.Join(expected, "\n") {
+			t.Fatalf("format %d: edges differ from KNNGraph", format)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+const (
+	// DefaultMaxGridCells is the largest grid a build will emit unless
+	// BuildOptions.MaxGridCells says otherwise.
+	DefaultMaxGridCells = 1 << 20
+)
+
+// Grid is a coarse uniform grid over the bounding box of a tree's points,
+// counting how many points fall in each cell. Cells are half-open on their
+// upper edge, except for the last cell along each dimension, which includes
+// Max.
+type Grid struct {
+	Min, Max   []float64
+	Resolution int
+	// Counts is indexed by cell, with the first dimension varying fastest.
+	Counts []uint64
+}
+
+func gridCells(dims, resolution, maxCells int) (cells int, ok bool) {
+	cells = 1
+	for i := 0; i < dims; i++ {
+		if cells > maxCells/resolution {
+			return 0, false
+		}
+		cells *= resolution
+	}
+	return cells, true
+}
+
+func newGrid(min, max []float64, resolution, maxCells int) (*Grid, error) {
+	if maxCells <= 0 {
+		maxCells = DefaultMaxGridCells
+	}
+	cells, ok := gridCells(len(min), resolution, maxCells)
+	if !ok {
+		return nil, errClass.New("grid resolution %d over %d dimensions exceeds "+
+			"%d cells", resolution, len(min), maxCells)
+	}
+	return &Grid{
+		Min:        append([]float64(nil), min...),
+		Max:        append([]float64(nil), max...),
+		Resolution: resolution,
+		Counts:     make([]uint64, cells)}, nil
+}
+
+func (g *Grid) axisCell(dim int, v float64) int {
+	width := g.Max[dim] - g.Min[dim]
+	if width <= 0 {
+		return 0
+	}
+	c := int((v - g.Min[dim]) / width * float64(g.Resolution))
+	if c < 0 {
+		return 0
+	}
+	if c >= g.Resolution {
+		return g.Resolution - 1
+	}
+	return c
+}
+
+// Cell returns the index into Counts of the cell containing pos. Positions
+// outside of the grid are clamped to the nearest edge cell.
+func (g *Grid) Cell(pos []float64) (cell int) {
+	stride := 1
+	for i, v := range pos {
+		cell += g.axisCell(i, v) * stride
+		stride *= g.Resolution
+	}
+	return cell
+}
+
+// CellBounds returns the extent of the cell with index cell.
+func (g *Grid) CellBounds(cell int) (min, max []float64) {
+	min = make([]float64, len(g.Min))
+	max = make([]float64, len(g.Max))
+	for i := range g.Min {
+		c := cell % g.Resolution
+		cell /= g.Resolution
+		width := (g.Max[i] - g.Min[i]) / float64(g.Resolution)
+		min[i] = g.Min[i] + width*float64(c)
+		max[i] = g.Min[i] + width*float64(c+1)
+		if c == g.Resolution-1 {
+			max[i] = g.Max[i]
+		}
+	}
+	return min, max
+}
+
+func (g *Grid) add(pos []float64) {
+	g.Counts[g.Cell(pos)]++
+}
+
+func (g *Grid) copy() Grid {
+	return Grid{
+		Min:        append([]float64(nil), g.Min...),
+		Max:        append([]float64(nil), g.Max...),
+		Resolution: g.Resolution,
+		Counts:     append([]uint64(nil), g.Counts...)}
+}
+
+// GridCounts returns the grid of point counts recorded when the tree was
+// built with a positive BuildOptions.GridResolution.
+func (t *Tree) GridCounts() (Grid, error) {
+	if t.footer.grid == nil {
+		return Grid{}, errClass.New("tree was built without a grid")
+	}
+	return t.footer.grid.copy(), nil
+}
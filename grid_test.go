@@ -0,0 +1,88 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"testing"
+)
+
+func TestGridCounts(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	dims, resolution := 3, 4
+	points := newTestPoints(500, dims, 10)
+	tree := createTestTree(t, fs, dims, 10, points,
+		BuildOptions{GridResolution: resolution})
+	defer tree.Close()
+
+	grid, err := tree.GridCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grid.Counts) != resolution*resolution*resolution {
+		t.Fatalf("unexpected cell count %d", len(grid.Counts))
+	}
+
+	total := uint64(0)
+	for cell, count := range grid.Counts {
+		min, max := grid.CellBounds(cell)
+		expected := uint64(0)
+		for _, p := range points {
+			inside := true
+			for i, v := range p.Pos {
+				upper := v < max[i] || (v == max[i] && max[i] == grid.Max[i])
+				if v < min[i] || !upper {
+					inside = false
+				}
+			}
+			if inside {
+				expected++
+			}
+		}
+		if count != expected {
+			t.Fatalf("cell %d: got %d points, expected %d", cell, count, expected)
+		}
+		total += count
+	}
+	if total != uint64(len(points)) {
+		t.Fatalf("grid counted %d points, expected %d", total, len(points))
+	}
+
+	_, err = createTestTree(t, fs, dims, 10, points, BuildOptions{}).GridCounts()
+	if err == nil {
+		t.Fatal("expected an error for a tree without a grid")
+	}
+}
+
+func TestGridTooLarge(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	log, err := NewPointSet(fs.Temp(), 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	err = log.Add(NewPoint(10, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateTreeWithOptions(fs.Path("tree"), fs.Temp(), log,
+		BuildOptions{GridResolution: 10, MaxGridCells: 1000})
+	if err == nil {
+		t.Fatal("expected an error for an oversized grid")
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// handleVersion is the version of the encoding TreeHandle.MarshalBinary
+// writes.
+const handleVersion = 1
+
+// TreeHandle describes an open tree well enough to open it again in
+// another process, or later, without passing along how it was opened by
+// convention. It implements encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler, so it can be sent with encoding/gob or stored
+// in a job queue as it is.
+type TreeHandle struct {
+	// Path is the tree file's path.
+	Path string
+	// Writable is set if the tree was opened with OpenRWWithOptions.
+	Writable bool
+	// Options are the options the tree was opened with. BatchDistance,
+	// Metrics and Logger can't be encoded, so they are left out and need
+	// setting again before Open if wanted.
+	Options OpenOptions
+
+	// footer is the encoded footer of the tree file when the handle was
+	// made, which Open checks the file against.
+	footer []byte
+}
+
+// Handle returns a TreeHandle for the tree, which must have been opened from
+// a file.
+func (t *Tree) Handle() (TreeHandle, error) {
+	if t.fh == nil {
+		return TreeHandle{}, errClass.New("tree wasn't opened from a file")
+	}
+	var footer bytes.Buffer
+	err := t.footer.serialize(&footer)
+	if err != nil {
+		return TreeHandle{}, err
+	}
+	opts := t.opts
+	opts.BatchDistance, opts.Metrics, opts.Logger = nil, nil, nil
+	return TreeHandle{Path: t.path, Writable: t.writable, Options: opts,
+		footer: footer.Bytes()}, nil
+}
+
+// Info describes the tree file as it was when the handle was made.
+func (h TreeHandle) Info() (Info, error) {
+	if len(h.footer) < footerTrailerSize {
+		return Info{}, errClass.New("handle has no footer")
+	}
+	f, err := parseFooter(h.footer[:len(h.footer)-footerTrailerSize])
+	if err != nil {
+		return Info{}, err
+	}
+	return f.info(), nil
+}
+
+// Open opens the tree the handle describes, as it was opened when the
+// handle was made. If the file has been rebuilt or replaced since, such as
+// by Compact, Open fails rather than open a different tree under the same
+// name; open it with OpenTreeWithOptions instead to get the tree as it is
+// now. Deletes and inserts made in place since are kept.
+func (h TreeHandle) Open() (*Tree, error) {
+	var t *Tree
+	var err error
+	if h.Writable {
+		t, err = OpenRWWithOptions(h.Path, h.Options)
+	} else {
+		t, err = OpenTreeWithOptions(h.Path, h.Options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var footer bytes.Buffer
+	err = t.footer.serialize(&footer)
+	if err == nil && !bytes.Equal(footer.Bytes(), h.footer) {
+		err = errClass.New("tree at %s changed since its handle was made",
+			h.Path)
+	}
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// treeHandleWire is the encoded form of a TreeHandle.
+type treeHandleWire struct {
+	Version          int
+	Path             string
+	Writable         bool
+	QueryConcurrency int           `json:",omitempty"`
+	SkipHoles        bool          `json:",omitempty"`
+	Mmap             bool          `json:",omitempty"`
+	CacheBytes       int64         `json:",omitempty"`
+	SyncWrites       bool          `json:",omitempty"`
+	Prefetch         int           `json:",omitempty"`
+	PinLevels        int           `json:",omitempty"`
+	Dims             int           `json:",omitempty"`
+	SlowQuery        time.Duration `json:",omitempty"`
+	MaxDataLen       int           `json:",omitempty"`
+	MaxQueryBytes    int64         `json:",omitempty"`
+	Footer           []byte
+}
+
+// MarshalBinary encodes the handle.
+func (h TreeHandle) MarshalBinary() ([]byte, error) {
+	o := h.Options
+	data, err := json.Marshal(treeHandleWire{
+		Version:          handleVersion,
+		Path:             h.Path,
+		Writable:         h.Writable,
+		QueryConcurrency: o.QueryConcurrency,
+		SkipHoles:        o.SkipHoles,
+		Mmap:             o.Mmap,
+		CacheBytes:       o.CacheBytes,
+		SyncWrites:       o.SyncWrites,
+		Prefetch:         o.Prefetch,
+		PinLevels:        o.PinLevels,
+		Dims:             o.Dims,
+		SlowQuery:        o.SlowQuery,
+		MaxDataLen:       o.MaxDataLen,
+		MaxQueryBytes:    o.MaxQueryBytes,
+		Footer:           h.footer})
+	return data, errClass.Wrap(err)
+}
+
+// UnmarshalBinary decodes a handle encoded by MarshalBinary.
+func (h *TreeHandle) UnmarshalBinary(data []byte) error {
+	var w treeHandleWire
+	err := json.Unmarshal(data, &w)
+	if err != nil {
+		return errClass.New("invalid tree handle: %v", err)
+	}
+	if w.Version != handleVersion {
+		return ErrVersion.New("tree handle version %d, expected %d",
+			w.Version, handleVersion)
+	}
+	*h = TreeHandle{
+		Path:     w.Path,
+		Writable: w.Writable,
+		Options: OpenOptions{
+			QueryConcurrency: w.QueryConcurrency,
+			SkipHoles:        w.SkipHoles,
+			Mmap:             w.Mmap,
+			CacheBytes:       w.CacheBytes,
+			SyncWrites:       w.SyncWrites,
+			Prefetch:         w.Prefetch,
+			PinLevels:        w.PinLevels,
+			Dims:             w.Dims,
+			SlowQuery:        w.SlowQuery,
+			MaxDataLen:       w.MaxDataLen,
+			MaxQueryBytes:    w.MaxQueryBytes},
+		footer: w.Footer}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestTreeHandle(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(100, 2, 10)
+	tree := createTestTree(t, fs, 2, 10, points, BuildOptions{Boxes: true})
+	tree.Close()
+	rw, err := OpenRWWithOptions(tree.path, OpenOptions{CacheBytes: 1 << 20,
+		Dims: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	// handles travel through gob as they are
+	h, err := rw.Handle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded TreeHandle
+	err = gob.NewDecoder(&buf).Decode(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Path != tree.path || !decoded.Writable ||
+		decoded.Options.CacheBytes != 1<<20 || decoded.Options.Dims != 2 {
+		t.Fatalf("unexpected handle %+v", decoded)
+	}
+	info, err := decoded.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Count != 100 || !info.Options.Boxes {
+		t.Fatalf("unexpected info %+v", info)
+	}
+
+	reopened, err := decoded.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reopened.Delete(points[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+	// deletes in place don't change the tree the handle refers to
+	reopened, err = decoded.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+
+	err = rw.Compact(fs.Temp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decoded.Open()
+	if err == nil {
+		t.Fatal("expected a rebuilt tree to fail to open")
+	}
+
+	err = decoded.UnmarshalBinary([]byte("{}"))
+	if !ErrVersion.Contains(err) {
+		t.Fatalf("expected a version error, got %v", err)
+	}
+}
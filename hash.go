@@ -0,0 +1,71 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// canonicalHash hashes a fixed little-endian encoding of p that doesn't
+// depend on any tree's max data length. Negative zero is encoded as zero, as
+// the two compare equal.
+func (p *Point) canonicalHash() (sum [sha256.Size]byte) {
+	h := sha256.New()
+	var buf [uint64Size]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(p.Pos)))
+	h.Write(buf[:uint32Size])
+	for _, v := range p.Pos {
+		if v == 0 {
+			v = 0
+		}
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+		h.Write(buf[:])
+	}
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(p.Data)))
+	h.Write(buf[:uint32Size])
+	h.Write(p.Data)
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// ContentHash returns a hash of the set of points in the tree (with
+// multiplicity), ignoring deleted points. Trees holding the same points hash
+// the same regardless of how they were built or laid out. It holds a 32 byte
+// digest per point in memory while sorting them into a canonical order.
+func (t *Tree) ContentHash() (sum [sha256.Size]byte, err error) {
+	digests := make([][sha256.Size]byte, 0, t.count)
+	err = t.scan(func(offset int64, n Node) error {
+		if !n.Deleted {
+			digests = append(digests, n.Point.canonicalHash())
+		}
+		return nil
+	})
+	if err != nil {
+		return sum, err
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return bytes.Compare(digests[i][:], digests[j][:]) < 0
+	})
+	h := sha256.New()
+	for i := range digests {
+		h.Write(digests[i][:])
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestContentHash(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	shuffled := append([]Point(nil), points...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	a := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer a.Close()
+	// a different max data length changes the file layout but not the content
+	b := createTestTree(t, fs, 3, 50, shuffled, BuildOptions{})
+	defer b.Close()
+	c := createTestTree(t, fs, 3, 10, points[1:], BuildOptions{})
+	defer c.Close()
+
+	hashA, err := a.ContentHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashB, err := b.ContentHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashC, err := c.ContentHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashA != hashB {
+		t.Fatal("same points hashed differently")
+	}
+	if hashA == hashC {
+		t.Fatal("different points hashed the same")
+	}
+}
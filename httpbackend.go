@@ -0,0 +1,276 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultHTTPBlockSize is the default for HTTPOptions.BlockSize.
+	DefaultHTTPBlockSize = 64 << 10
+	// DefaultHTTPCacheBlocks is the default for HTTPOptions.CacheBlocks.
+	DefaultHTTPCacheBlocks = 256
+)
+
+// HTTPOptions configures HTTPBackend.
+type HTTPOptions struct {
+	// Client makes the requests. Defaults to http.DefaultClient.
+	Client *http.Client
+	// BlockSize is how many bytes are fetched with each range request.
+	// Larger blocks take fewer round trips for nodes near each other in the
+	// file. Defaults to DefaultHTTPBlockSize.
+	BlockSize int
+	// CacheBlocks is how many of the most recently used blocks are kept in
+	// memory for each open file. Defaults to DefaultHTTPCacheBlocks.
+	CacheBlocks int
+}
+
+// HTTPBackend returns a read-only Backend over the files under base, a URL
+// ending in a slash, read with HTTP range requests, so a tree published to a
+// static file host or CDN can be queried without downloading it. The server
+// must support range requests. Reads are fetched in blocks, which are cached
+// for each open file, so the top of the tree is only fetched once.
+//
+// Each open file is pinned to the version it had when opened, going by its
+// ETag or else its Last-Modified time, which every later request sends in
+// If-Range, even for blocks fetched again after falling out of the cache. If
+// the file is replaced while open, reads of blocks not cached fail rather
+// than mixing the two versions.
+func HTTPBackend(base string, opts HTTPOptions) (Backend, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = DefaultHTTPBlockSize
+	}
+	if opts.CacheBlocks <= 0 {
+		opts.CacheBlocks = DefaultHTTPCacheBlocks
+	}
+	return &httpBackend{base: u, opts: opts}, nil
+}
+
+type httpBackend struct {
+	base *url.URL
+	opts HTTPOptions
+}
+
+func (b *httpBackend) Open(name string) (BackendReader, error) {
+	ref, err := url.Parse(name)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	f := &httpFile{b: b, url: b.base.ResolveReference(ref).String(),
+		lru: list.New(), blocks: map[int64]*list.Element{}}
+	// the size and version come from the first block's response
+	data, err := f.fetch(0, true)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		f.blocks[0] = f.lru.PushFront(&httpBlock{index: 0, data: data})
+	}
+	return f, nil
+}
+
+func (b *httpBackend) Create(name string) (io.WriteCloser, error) {
+	return nil, errClass.New("%s: HTTP backend is read-only", name)
+}
+
+func (b *httpBackend) Remove(name string) error {
+	return errClass.New("%s: HTTP backend is read-only", name)
+}
+
+// httpFile reads a file with range requests, caching the blocks it fetches.
+type httpFile struct {
+	b   *httpBackend
+	url string
+	// size and validator, the ETag or Last-Modified time of the file, or
+	// empty if it had neither, are set when the file is opened and never
+	// change.
+	size      int64
+	validator string
+
+	mu     sync.Mutex
+	lru    *list.List // of *httpBlock, most recently used first
+	blocks map[int64]*list.Element
+}
+
+type httpBlock struct {
+	index int64
+	data  []byte
+}
+
+func (f *httpFile) Size() int64 { return f.size }
+
+func (f *httpFile) Close() error { return nil }
+
+// block returns block index of the file, fetching it if it isn't cached.
+func (f *httpFile) block(index int64) ([]byte, error) {
+	f.mu.Lock()
+	if e, ok := f.blocks[index]; ok {
+		f.lru.MoveToFront(e)
+		f.mu.Unlock()
+		return e.Value.(*httpBlock).data, nil
+	}
+	f.mu.Unlock()
+
+	data, err := f.fetch(index, false)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.blocks[index]; !ok {
+		f.blocks[index] = f.lru.PushFront(&httpBlock{index: index, data: data})
+		for f.lru.Len() > f.b.opts.CacheBlocks {
+			last := f.lru.Back()
+			delete(f.blocks, last.Value.(*httpBlock).index)
+			f.lru.Remove(last)
+		}
+	}
+	return data, nil
+}
+
+// fetch requests block index. When the file is being opened, pin is set,
+// and its size and version are learned from the response. After that, every
+// response must match them.
+func (f *httpFile) fetch(index int64, pin bool) ([]byte, error) {
+	blockSize := int64(f.b.opts.BlockSize)
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	start := index * blockSize
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start,
+		start+blockSize-1))
+	if !pin && f.validator != "" {
+		req.Header.Set("If-Range", f.validator)
+	}
+	resp, err := f.b.opts.Client.Do(req)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// a server supporting ranges only sends the whole file in place of
+		// one if it changed
+		if !pin && f.validator != "" {
+			return nil, errClass.New("%s: file changed while open", f.url)
+		}
+		return nil, errClass.New("%s: range request failed: %s", f.url,
+			resp.Status)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// only an empty file has no first block
+		if pin {
+			return nil, nil
+		}
+		fallthrough
+	default:
+		return nil, errClass.New("%s: range request failed: %s", f.url,
+			resp.Status)
+	}
+	first, last, size, err := parseContentRange(
+		resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, errClass.New("%s: %v", f.url, err)
+	}
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if pin {
+		f.size = size
+		f.validator = validator
+	} else if size != f.size || validator != f.validator {
+		return nil, errClass.New("%s: file changed while open", f.url)
+	}
+	expected := f.size - start
+	if expected > blockSize {
+		expected = blockSize
+	}
+	if first != start || last != start+expected-1 {
+		return nil, errClass.New("%s: got bytes %d-%d, expected %d-%d",
+			f.url, first, last, start, start+expected-1)
+	}
+	data := make([]byte, expected)
+	_, err = io.ReadFull(resp.Body, data)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	return data, nil
+}
+
+// parseContentRange returns the range and complete length from a
+// Content-Range header of the form "bytes first-last/size".
+func parseContentRange(header string) (first, last, size int64, err error) {
+	invalid := fmt.Errorf("invalid Content-Range %q", header)
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+	span, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+	from, to, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+	first, err = strconv.ParseInt(from, 10, 64)
+	if err == nil {
+		last, err = strconv.ParseInt(to, 10, 64)
+	}
+	if err == nil {
+		size, err = strconv.ParseInt(total, 10, 64)
+	}
+	if err != nil {
+		return 0, 0, 0, invalid
+	}
+	return first, last, size, nil
+}
+
+func (f *httpFile) ReadAt(p []byte, off int64) (n int, err error) {
+	blockSize := int64(f.b.opts.BlockSize)
+	for len(p) > 0 && off < f.size {
+		index := off / blockSize
+		data, err := f.block(index)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p, data[off-index*blockSize:])
+		n += c
+		off += int64(c)
+		p = p[c:]
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
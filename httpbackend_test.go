@@ -0,0 +1,139 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPBackend(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(5000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+	var file bytes.Buffer
+	_, err := tree.WriteTo(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int64
+	var version atomic.Value
+	version.Store(`"1"`)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/trees/tree":
+			case "/trees/bad-range":
+				// answers every request with the first block
+				w.Header().Set("Content-Range",
+					fmt.Sprintf("bytes 0-4095/%d", file.Len()))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(file.Bytes()[:4096])
+				return
+			default:
+				http.NotFound(w, r)
+				return
+			}
+			atomic.AddInt64(&requests, 1)
+			w.Header().Set("ETag", version.Load().(string))
+			http.ServeContent(w, r, "tree", time.Time{},
+				bytes.NewReader(file.Bytes()))
+		}))
+	defer server.Close()
+
+	b, err := HTTPBackend(server.URL+"/trees/", HTTPOptions{BlockSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := OpenTreeBackend(b, "tree", OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	if remote.Count() != tree.Count() {
+		t.Fatalf("got %d points, expected %d", remote.Count(), tree.Count())
+	}
+	for _, p := range points[:20] {
+		nearest, err := remote.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+	}
+	blocks := int64(file.Len()+4095) / 4096
+	if requests >= blocks {
+		t.Fatalf("made %d requests for a file of %d blocks", requests, blocks)
+	}
+
+	_, err = OpenTreeBackend(b, "missing", OpenOptions{})
+	if err == nil {
+		t.Fatal("expected an error opening a missing tree")
+	}
+	_, err = OpenTreeBackend(b, "bad-range", OpenOptions{})
+	if err == nil {
+		t.Fatal("expected an error when served the wrong range")
+	}
+
+	// republishing the tree at the same size fails reads of blocks that
+	// aren't cached yet
+	r, err := b.Open("tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version.Store(`"2"`)
+	_, err = r.ReadAt(make([]byte, 10), 8192)
+	if err == nil {
+		t.Fatal("expected an error reading a changed file")
+	}
+	r.Close()
+
+	// nor does the first block, fetched again once it has been evicted
+	version.Store(`"1"`)
+	small, err := HTTPBackend(server.URL+"/trees/",
+		HTTPOptions{BlockSize: 4096, CacheBlocks: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = small.Open("tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.ReadAt(make([]byte, 10), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version.Store(`"2"`)
+	_, err = r.ReadAt(make([]byte, 10), 0)
+	if err == nil {
+		t.Fatal("expected an error reading the first block of a changed file")
+	}
+	if r.Size() != int64(file.Len()) {
+		t.Fatalf("size changed to %d", r.Size())
+	}
+	r.Close()
+
+	if _, err = b.Create("tree"); err == nil {
+		t.Fatal("expected the backend to be read-only")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+// ErrUnsupported is the class of errors returned by a SpatialIndex for
+// operations the underlying index can't perform. Check for it with
+// ErrUnsupported.Contains(err).
+var ErrUnsupported = errClass.NewClass("unsupported")
+
+// SpatialIndex is a minimal interface common to spatial indexes, so that
+// code can be written against several kinds of index at once. Distances are
+// squared Euclidean.
+type SpatialIndex interface {
+	// Nearest returns the point closest to pos, and false if the index is
+	// empty.
+	Nearest(pos []float64) (Point, bool, error)
+	// KNearest returns up to k points closest to pos, closest first.
+	KNearest(pos []float64, k int) ([]PointDistance, error)
+	// Range returns every point within radius of pos, in no particular
+	// order.
+	Range(pos []float64, radius float64) ([]Point, error)
+	// Insert adds p to the index, if the index supports it.
+	Insert(p Point) error
+	// Len returns the number of points in the index.
+	Len() int64
+	// Dims returns the number of dimensions of points in the index.
+	Dims() int
+}
+
+// AsSpatialIndex adapts t to the SpatialIndex interface. Trees are immutable,
+// so Insert always fails with ErrUnsupported. Len is t.Count(), which
+// includes any deleted points.
+func AsSpatialIndex(t *Tree) SpatialIndex { return treeIndex{t: t} }
+
+type treeIndex struct {
+	t *Tree
+}
+
+func (i treeIndex) Nearest(pos []float64) (Point, bool, error) {
+	nearest, err := i.t.Nearest(Point{Pos: pos}, 1)
+	if err != nil || len(nearest) == 0 {
+		return Point{}, false, err
+	}
+	return nearest[0].Point, true, nil
+}
+
+func (i treeIndex) KNearest(pos []float64, k int) ([]PointDistance, error) {
+	return i.t.Nearest(Point{Pos: pos}, k)
+}
+
+func (i treeIndex) Range(pos []float64, radius float64) ([]Point, error) {
+	return i.t.Within(Point{Pos: pos}, radius)
+}
+
+func (i treeIndex) Insert(p Point) error {
+	return ErrUnsupported.New("trees can't be inserted into")
+}
+
+func (i treeIndex) Len() int64 { return i.t.Count() }
+func (i treeIndex) Dims() int  { return i.t.Dims() }
@@ -0,0 +1,74 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"testing"
+)
+
+func TestSpatialIndex(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+	index := AsSpatialIndex(tree)
+
+	if index.Len() != 200 || index.Dims() != 3 {
+		t.Fatalf("got len %d dims %d", index.Len(), index.Dims())
+	}
+
+	q := NewPoint(3, 10)
+	expected, err := tree.Nearest(q, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nearest, found, err := index.Nearest(q.Pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !nearest.equal(&expected[0].Point) {
+		t.Fatal("Nearest disagrees with the tree")
+	}
+	knearest, err := index.KNearest(q.Pos, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(knearest) != len(expected) {
+		t.Fatalf("got %d points, expected %d", len(knearest), len(expected))
+	}
+	for i := range expected {
+		if !knearest[i].Point.equal(&expected[i].Point) {
+			t.Fatal("KNearest disagrees with the tree")
+		}
+	}
+	inRange, err := index.Range(q.Pos, 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := tree.CountWithin(q, 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(inRange)) != count {
+		t.Fatalf("got %d points in range, expected %d", len(inRange), count)
+	}
+
+	err = index.Insert(q)
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected an unsupported error, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"io"
+	"os"
+)
+
+// FormatVersion is the newest tree file format version this package reads
+// and writes. Files are written in the oldest version that can represent
+// them, so trees built without newer options stay readable by older
+// versions of this package.
+const FormatVersion = footerVersionNormalized
+
+// Info describes a tree file, as recorded in the footer at its end.
+type Info struct {
+	// Version is the format version of the file.
+	Version int
+	// Dims is the number of dimensions of every point.
+	Dims int
+	// MaxDataLen is the longest Data a point may have.
+	MaxDataLen int
+	// Count is the number of points stored, including deleted points but not
+	// pending inserted points.
+	Count int64
+	// Min and Max bound every point stored. They are nil if the tree is
+	// empty.
+	Min, Max []float64
+	// Options are the build options recorded in the file, for rebuilding the
+	// tree the same way.
+	Options BuildOptions
+}
+
+func (f *footer) info() Info {
+	info := Info{
+		Version:    int(f.version()),
+		Dims:       f.dims,
+		MaxDataLen: f.maxDataLen,
+		Count:      f.count,
+		Options:    f.buildOptions()}
+	if f.count > 0 {
+		info.Min = append([]float64(nil), f.min...)
+		info.Max = append([]float64(nil), f.max...)
+	}
+	return info
+}
+
+// ReadInfo reads the description of the tree file of size bytes in r
+// without opening the tree. Files in a newer format version than
+// FormatVersion are reported with ErrVersion.
+func ReadInfo(r io.ReaderAt, size int64) (Info, error) {
+	f, _, err := readFooter(r, size)
+	if err != nil {
+		return Info{}, err
+	}
+	return f.info(), nil
+}
+
+// ReadInfoFile is ReadInfo for the tree file at path.
+func ReadInfoFile(path string) (Info, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return Info{}, errClass.Wrap(err)
+	}
+	defer fh.Close()
+	stat, err := fh.Stat()
+	if err != nil {
+		return Info{}, errClass.Wrap(err)
+	}
+	return ReadInfo(fh, stat.Size())
+}
+
+// Info describes the tree's file.
+func (t *Tree) Info() Info { return t.footer.info() }
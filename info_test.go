@@ -0,0 +1,69 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestInfo(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(100, 3, 10)
+	opts := BuildOptions{Layout: CacheObliviousLayout, Checksums: true}
+	tree := createTestTree(t, fs, 3, 10, points, opts)
+	tree.Close()
+
+	info, err := ReadInfoFile(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != footerVersionChecksums || info.Dims != 3 ||
+		info.MaxDataLen != 10 || info.Count != int64(len(points)) ||
+		info.Options.Layout != opts.Layout || !info.Options.Checksums {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	for _, p := range points {
+		for i, v := range p.Pos {
+			if v < info.Min[i] || v > info.Max[i] {
+				t.Fatalf("point %v outside of bounds", p.Pos)
+			}
+		}
+	}
+
+	// claim a newer version
+	data, err := os.ReadFile(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer := data[len(data)-footerTrailerSize:]
+	bodyLen := int(binary.LittleEndian.Uint32(trailer))
+	data[len(data)-footerTrailerSize-bodyLen] = FormatVersion + 1
+	err = os.WriteFile(tree.path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadInfoFile(tree.path)
+	if !ErrVersion.Contains(err) {
+		t.Fatalf("expected a version error, got %v", err)
+	}
+	_, err = OpenTree(tree.path)
+	if !ErrVersion.Contains(err) {
+		t.Fatalf("expected a version error, got %v", err)
+	}
+}
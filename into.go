@@ -0,0 +1,263 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"container/heap"
+	"time"
+)
+
+// ResultBuffer holds the memory NearestInto reuses from one query to the
+// next. The zero value is ready to use. A ResultBuffer must not be used by
+// more than one query at a time.
+type ResultBuffer struct {
+	q    nearestQuery
+	node []byte
+	pos  []float64
+	free []Point
+	rv   []PointDistance
+}
+
+// reset readies b for a query for the n points nearest p in t, taking back
+// the storage of the last query's results.
+func (b *ResultBuffer) reset(t *Tree, p Point, n int) {
+	for _, pd := range b.rv {
+		b.free = append(b.free, pd.Point)
+	}
+	b.rv = b.rv[:0]
+	if cap(b.rv) < n {
+		b.rv = make([]PointDistance, 0, n)
+	}
+	if cap(b.q.h) < n {
+		b.q.h = make(maxHeap, 0, n)
+	}
+	b.q = nearestQuery{p: p, h: b.q.h[:0:n], exclude: -1}
+	if int64(cap(b.node)) < t.nodelen {
+		b.node = make([]byte, t.nodelen)
+	}
+	b.node = b.node[:t.nodelen]
+	if cap(b.pos) < t.footer.dims {
+		b.pos = make([]float64, t.footer.dims)
+	}
+	b.pos = b.pos[:t.footer.dims]
+}
+
+// add offers the point of n, dist from the query, copying it into storage
+// of b's own if it is kept.
+func (b *ResultBuffer) add(offset int64, n *Node, dist float64, ref bool) {
+	h := &b.q.h
+	var pt Point
+	if h.Len() >= h.Cap() {
+		cand := neighbor{PointDistance: PointDistance{Point: n.Point,
+			Distance: dist}, dataRef: ref}
+		top := &(*h)[0]
+		if refTie(&cand, top) {
+			b.q.unsure = true
+		}
+		if !cand.before(&top.PointDistance) {
+			return
+		}
+		// the next of the kept points to go is a child of the top
+		for i := 1; i <= 2 && i < h.Len(); i++ {
+			if refTie(top, &(*h)[i]) {
+				b.q.unsure = true
+			}
+		}
+		pt = top.Point
+	} else if len(b.free) > 0 {
+		pt = b.free[len(b.free)-1]
+		b.free = b.free[:len(b.free)-1]
+	}
+	pt.Pos = append(pt.Pos[:0], n.Point.Pos...)
+	pt.Data = append(pt.Data[:0], n.Point.Data...)
+	nb := neighbor{PointDistance: PointDistance{Point: pt, Distance: dist},
+		offset: offset, dataRef: ref}
+	if h.Len() >= h.Cap() {
+		(*h)[0] = nb
+		heap.Fix(h, 0)
+	} else {
+		*h = append(*h, nb)
+		heap.Fix(h, h.Len()-1)
+	}
+}
+
+// NearestInto is Nearest, but keeps the points it finds in buf, which it
+// reuses from one call to the next instead of allocating. Nodes are parsed
+// into scratch space and only the points that make it into the results are
+// copied, so a server answering many queries with a buffer per goroutine
+// doesn't make garbage in proportion to the nodes it visits. Once buf is
+// warmed up, queries of trees with fixed-size Data, no Checksums and no
+// Boxes allocate nothing. The returned slice and its points belong to buf
+// and are only valid until its next use.
+func (t *Tree) NearestInto(p Point, n int, buf *ResultBuffer) (
+	[]PointDistance, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	start := time.Now()
+	err := t.checkDims(p)
+	if err == nil {
+		err = t.checkResults(int64(n))
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf.reset(t, p, n)
+	err = t.searchInto(t.root, buf)
+	if err != nil {
+		return nil, err
+	}
+	for i, pending := range t.pending.snapshot() {
+		buf.add(pendingOffset(i), &Node{Point: pending},
+			p.distanceSquared(&pending), false)
+	}
+	if buf.q.unsure {
+		// points tied down to their positions were told apart by where
+		// their Data is stored, so leave this rare query to Nearest, which
+		// reads it
+		rv, err := t.Nearest(p, n)
+		if err != nil {
+			return nil, err
+		}
+		for _, pd := range rv {
+			var pt Point
+			if len(buf.free) > 0 {
+				pt = buf.free[len(buf.free)-1]
+				buf.free = buf.free[:len(buf.free)-1]
+			}
+			pt.Pos = append(pt.Pos[:0], pd.Pos...)
+			pt.Data = append(pt.Data[:0], pd.Data...)
+			buf.rv = append(buf.rv, PointDistance{Point: pt,
+				Distance: pd.Distance, ID: pd.ID})
+		}
+		return buf.rv, nil
+	}
+	h := &buf.q.h
+	resolved := false
+	for i := range *h {
+		if !(*h)[i].dataRef {
+			continue
+		}
+		data, err := t.readData((*h)[i].offset, (*h)[i].Data)
+		if err != nil {
+			return nil, err
+		}
+		(*h)[i].Data = append((*h)[i].Data[:0], data...)
+		(*h)[i].dataRef = false
+		resolved = true
+	}
+	if resolved {
+		// reading Data can reorder points tied on distance and position
+		heap.Init(h)
+	}
+	t.recordQuery(buf.q.stats, start)
+
+	// empty the heap furthest first into the back of the results
+	buf.rv = buf.rv[:h.Len()]
+	for last := h.Len() - 1; last >= 0; last-- {
+		h.Swap(0, last)
+		buf.rv[last] = (*h)[last].PointDistance
+		buf.rv[last].ID = t.pointID((*h)[last].offset)
+		*h = (*h)[:last]
+		if last > 0 {
+			heap.Fix(h, 0)
+		}
+	}
+	return buf.rv, nil
+}
+
+// readNodeInto reads the node at offset using buf's scratch space, leaving
+// the Data of trees with variable-length data as the reference to it, and
+// reports whether it did. The node is only valid until the next read.
+func (t *Tree) readNodeInto(offset int64, buf *ResultBuffer) (n Node,
+	ref bool, err error) {
+	if n, ok := t.pinned.get(offset); ok {
+		return n, false, nil
+	}
+	if t.cache != nil {
+		n, err = t.Node(offset)
+		return n, false, err
+	}
+	_, err = t.r.ReadAt(buf.node, offset)
+	if err != nil {
+		return Node{}, false, err
+	}
+	if t.footer.checksums && !isHole(buf.node) {
+		err = t.verifyNode(offset, buf.node)
+		if err != nil {
+			return Node{}, false, err
+		}
+	}
+	n, err = parseNodeInto(buf.node, t.footer.dims, t.footer.coords(), buf.pos)
+	if err != nil {
+		if t.opts.SkipHoles && ErrHole.Contains(err) {
+			return Node{Point: Point{Pos: buf.pos}, Left: -1, Right: -1,
+				Deleted: true}, false, nil
+		}
+		return Node{}, false, err
+	}
+	return n, t.footer.variableData, nil
+}
+
+// searchInto is search for NearestInto. The node read at each level is
+// overwritten by its children, so nothing about it is used once they have
+// been searched but the split.
+func (t *Tree) searchInto(offset int64, buf *ResultBuffer) error {
+	if offset == -1 {
+		return nil
+	}
+	q := &buf.q
+	if t.footer.boxes {
+		b, err := t.nodeBox(offset)
+		if err != nil {
+			return err
+		}
+		if q.outOfReach(&b) {
+			q.prune(offset)
+			return nil
+		}
+	}
+
+	n, ref, err := t.readNodeInto(offset, buf)
+	if err != nil {
+		return err
+	}
+	err = q.visit(t.nodelen)
+	if err != nil {
+		return err
+	}
+
+	c := q.p.Pos[n.Dim] - n.Point.Pos[n.Dim]
+	if !n.Deleted {
+		q.stats.PointsCompared++
+		buf.add(offset, &n, q.p.distanceSquared(&n.Point), ref)
+	}
+
+	dim := n.Dim
+	near, far := n.Left, n.Right
+	if c > 0 {
+		near, far = far, near
+	}
+	t.prefetch.fetch(far)
+	err = t.searchInto(near, buf)
+	if err != nil {
+		return err
+	}
+	if q.explore(dim, c) {
+		return t.searchInto(far, buf)
+	}
+	q.prune(far)
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNearestInto(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	for _, opts := range []BuildOptions{
+		{},
+		{Float32: true},
+		{VariableData: true},
+		{Checksums: true, Boxes: true},
+	} {
+		tree := createTestTree(t, fs, 3, 10, points, opts)
+		var buf ResultBuffer
+		for i := 0; i < 20; i++ {
+			q := NewPoint(3, 10)
+			n := 1 + i%7
+			expected, err := tree.Nearest(q, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := tree.NearestInto(q, n, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(actual) != len(expected) {
+				t.Fatalf("%+v: got %d results, expected %d", opts, len(actual),
+					len(expected))
+			}
+			for j := range expected {
+				if actual[j].Distance != expected[j].Distance ||
+					!bytes.Equal(actual[j].Data, expected[j].Data) {
+					t.Fatalf("%+v: result %d differs from Nearest", opts, j)
+				}
+			}
+		}
+		tree.Close()
+	}
+
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+	var buf ResultBuffer
+	q := NewPoint(3, 10)
+	allocs := testing.AllocsPerRun(100, func() {
+		_, err := tree.NearestInto(q, 10, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("got %v allocations per query, expected none", allocs)
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"container/heap"
+)
+
+// iterEntry is either a subtree yet to be explored, keyed by a lower bound on
+// the distance to anything in it, or a point, keyed by its distance. offset
+// is that of the subtree's root or of the point's node.
+type iterEntry struct {
+	distance float64
+	offset   int64
+	point    *Point
+}
+
+// iterEntryBytes is the memory an iterEntry takes in an iterQueue, not
+// counting its point.
+const iterEntryBytes = 32
+
+// bytes estimates the memory e holds, for OpenOptions.MaxQueryBytes.
+func (e *iterEntry) bytes() int64 {
+	if e.point == nil {
+		return iterEntryBytes
+	}
+	return iterEntryBytes + resultBytes(e.point)
+}
+
+type iterQueue []iterEntry
+
+func (q *iterQueue) Len() int { return len(*q) }
+
+// Less orders entries by distance. At the same distance, subtrees come
+// first, so that every point tied with another is found before either is
+// returned, and points come in result order. See PointDistance.
+func (q *iterQueue) Less(i, j int) bool {
+	a, b := &(*q)[i], &(*q)[j]
+	if a.distance != b.distance {
+		return a.distance < b.distance
+	}
+	if a.point == nil || b.point == nil {
+		return a.point == nil && b.point != nil
+	}
+	return comparePoints(a.point, b.point) < 0
+}
+
+func (q *iterQueue) Swap(i, j int)      { (*q)[i], (*q)[j] = (*q)[j], (*q)[i] }
+func (q *iterQueue) Push(x interface{}) { *q = append(*q, x.(iterEntry)) }
+func (q *iterQueue) Pop() (i interface{}) {
+	i, *q = (*q)[len(*q)-1], (*q)[:len(*q)-1]
+	return i
+}
+
+// NearestIterator yields the points of a tree in order of increasing
+// distance from a query point. See Tree.NearestIter.
+type NearestIterator struct {
+	t      *Tree
+	p      Point
+	queue  iterQueue
+	budget *queryBudget
+	err    error
+}
+
+// NearestIter returns an iterator over every point in the tree in order of
+// increasing distance from p, found with a best-first search. Unlike
+// Nearest, the number of points wanted doesn't need to be known up front;
+// the search only goes as far as Next is called. If p has the wrong number
+// of dimensions, Next returns the error. The queue of nodes and points
+// still to be returned counts against OpenOptions.MaxQueryBytes.
+func (t *Tree) NearestIter(p Point) *NearestIterator {
+	it := &NearestIterator{t: t, p: p, budget: t.newBudget()}
+	it.err = t.checkDims(p)
+	if it.err != nil {
+		return it
+	}
+	if t.root != -1 {
+		it.queue = append(it.queue, iterEntry{offset: t.root})
+	}
+	pending := t.pending.snapshot()
+	for i := range pending {
+		it.queue = append(it.queue, iterEntry{
+			distance: p.distanceSquared(&pending[i]),
+			offset:   pendingOffset(i),
+			point:    &pending[i]})
+	}
+	for i := range it.queue {
+		if it.err == nil {
+			it.err = it.budget.charge(it.queue[i].bytes())
+		}
+	}
+	heap.Init(&it.queue)
+	return it
+}
+
+// push adds e to the queue.
+func (it *NearestIterator) push(e iterEntry) {
+	heap.Push(&it.queue, e)
+	if it.err == nil {
+		it.err = it.budget.charge(e.bytes())
+	}
+}
+
+// Next returns the next closest point. ok is false once every point has been
+// returned or an error has occurred. Distances are squared.
+func (it *NearestIterator) Next() (pd PointDistance, ok bool, err error) {
+	for it.err == nil && len(it.queue) > 0 {
+		entry := heap.Pop(&it.queue).(iterEntry)
+		it.budget.release(entry.bytes())
+		if entry.point != nil {
+			return PointDistance{Point: *entry.point, Distance: entry.distance,
+				ID: it.t.pointID(entry.offset)}, true, nil
+		}
+
+		n, err := it.t.Node(entry.offset)
+		if err != nil {
+			it.err = err
+			break
+		}
+		if !n.Deleted {
+			it.push(iterEntry{
+				distance: it.p.distanceSquared(&n.Point),
+				offset:   entry.offset,
+				point:    &n.Point})
+		}
+
+		c := it.p.Pos[n.Dim] - n.Point.Pos[n.Dim]
+		near, far := n.Left, n.Right
+		if c > 0 {
+			near, far = far, near
+		}
+		if near != -1 {
+			it.push(iterEntry{distance: entry.distance, offset: near})
+		}
+		if far != -1 {
+			bound := c * c
+			if bound < entry.distance {
+				bound = entry.distance
+			}
+			it.push(iterEntry{distance: bound, offset: far})
+		}
+	}
+	return PointDistance{}, false, it.err
+}
+
+// iterRegion is the region a RangeIterator searches.
+type iterRegion struct {
+	// contains reports whether a point is in the region, along with the
+	// distance to report for it.
+	contains func(p *Point) (distance float64, ok bool)
+	// disjoint reports whether no point in a box can be in the region, and
+	// covers whether every point in it is.
+	disjoint, covers func(b *box) bool
+}
+
+// rangeFrame is a subtree a RangeIterator has yet to visit. b bounds the
+// subtree, unless inside is set, in which case the whole subtree is known to
+// be in the region and b is unused.
+type rangeFrame struct {
+	offset int64
+	b      box
+	inside bool
+}
+
+// RangeIterator yields the points of a box or radius query one at a time,
+// in no particular order. See Tree.RangeIter and Tree.WithinIter.
+type RangeIterator struct {
+	t       *Tree
+	region  iterRegion
+	stack   []rangeFrame
+	pending []Point
+	next    int
+	err     error
+}
+
+// RangeIter returns an iterator over every point inside the axis-aligned box
+// from min to max, inclusive, the same points Range visits. Results are
+// found as Next is called rather than collected up front, so memory use
+// depends on the depth of the tree and not on how many points the box
+// holds. Distances are zero. If the box is invalid, Next returns the error.
+func (t *Tree) RangeIter(min, max []float64) *RangeIterator {
+	q, err := t.rangeBox(min, max)
+	return t.rangeIter(err, iterRegion{
+		contains: func(p *Point) (float64, bool) {
+			return 0, q.contains(p.Pos)
+		},
+		disjoint: func(b *box) bool { return !q.intersects(b) },
+		covers:   q.containsBox})
+}
+
+// WithinIter is RangeIter, but for every point within radius of p, the same
+// points WithinFunc visits. Distances are squared.
+func (t *Tree) WithinIter(p Point, radius float64) *RangeIterator {
+	err := t.checkRange(p, radius)
+	radius2 := radius * radius
+	return t.rangeIter(err, iterRegion{
+		contains: func(o *Point) (float64, bool) {
+			dist := p.distanceSquared(o)
+			return dist, dist <= radius2
+		},
+		disjoint: func(b *box) bool { return b.minDistance(&p) > radius2 },
+		covers:   func(b *box) bool { return b.maxDistance(&p) <= radius2 }})
+}
+
+func (t *Tree) rangeIter(err error, region iterRegion) *RangeIterator {
+	it := &RangeIterator{t: t, region: region, err: err}
+	if err != nil {
+		return it
+	}
+	if t.root != -1 {
+		it.stack = append(it.stack, rangeFrame{offset: t.root, b: t.bounds()})
+	}
+	it.pending = t.pending.snapshot()
+	return it
+}
+
+// Next returns the next point in the region. ok is false once every point
+// has been returned or an error has occurred.
+func (it *RangeIterator) Next() (pd PointDistance, ok bool, err error) {
+	for it.err == nil && len(it.stack) > 0 {
+		f := it.stack[len(it.stack)-1]
+		it.stack = it.stack[:len(it.stack)-1]
+		if !f.inside {
+			// the frame owns its box, so there's nothing to restore
+			_, err := it.t.tightenBox(f.offset, &f.b)
+			if err != nil {
+				it.err = err
+				break
+			}
+			if it.region.disjoint(&f.b) {
+				continue
+			}
+			f.inside = it.region.covers(&f.b)
+		}
+
+		n, err := it.t.Node(f.offset)
+		if err != nil {
+			it.err = err
+			break
+		}
+		// push the right child first so the left subtree is visited first,
+		// in the same order as Range
+		if f.inside {
+			for _, child := range []int64{n.Right, n.Left} {
+				if child != -1 {
+					it.stack = append(it.stack, rangeFrame{offset: child, inside: true})
+				}
+			}
+		} else {
+			split := n.Point.Pos[n.Dim]
+			if n.Right != -1 {
+				right := box{
+					min: append([]float64(nil), f.b.min...),
+					max: append([]float64(nil), f.b.max...)}
+				right.min[n.Dim] = split
+				it.stack = append(it.stack, rangeFrame{offset: n.Right, b: right})
+			}
+			if n.Left != -1 {
+				f.b.max[n.Dim] = split
+				it.stack = append(it.stack, rangeFrame{offset: n.Left, b: f.b})
+			}
+		}
+		if n.Deleted {
+			continue
+		}
+		dist, in := it.region.contains(&n.Point)
+		if in || f.inside {
+			return PointDistance{Point: n.Point, Distance: dist,
+				ID: it.t.pointID(f.offset)}, true, nil
+		}
+	}
+	for it.err == nil && it.next < len(it.pending) {
+		i := it.next
+		it.next++
+		if dist, in := it.region.contains(&it.pending[i]); in {
+			return PointDistance{Point: it.pending[i], Distance: dist,
+				ID: it.t.pointID(pendingOffset(i))}, true, nil
+		}
+	}
+	return PointDistance{}, false, it.err
+}
@@ -0,0 +1,207 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// pendingWrites tags a record of in-place writes to the tree file in the
+// pending log. Point records start with their serialization version, which
+// is never this.
+const pendingWrites = 0xff
+
+// treeWrite is an in-place write of data at offset in the tree file.
+type treeWrite struct {
+	offset int64
+	data   []byte
+}
+
+// writeBatch collects the in-place writes of one change to the tree, such as
+// a Delete, so that they can be logged before any of them is made. See
+// Tree.commit.
+type writeBatch []treeWrite
+
+func (b *writeBatch) write(offset int64, data []byte) {
+	*b = append(*b, treeWrite{offset: offset, data: data})
+}
+
+// encode returns b as a pending log record: the tag, the number of writes,
+// each write's offset, length and data, and a checksum of all of it.
+func (b writeBatch) encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(pendingWrites)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(b)))
+	for _, w := range b {
+		binary.Write(&buf, binary.LittleEndian, w.offset)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(w.data)))
+		buf.Write(w.data)
+	}
+	binary.Write(&buf, binary.LittleEndian, crc32.Checksum(buf.Bytes(),
+		crcTable))
+	return buf.Bytes()
+}
+
+// readWriteBatch reads a record written by writeBatch.encode from r. A
+// record cut short is an io.ErrUnexpectedEOF error, and one that doesn't
+// match its checksum is an ErrCorrupt error.
+func readWriteBatch(r io.Reader) (writeBatch, error) {
+	var buf bytes.Buffer
+	r = io.TeeReader(r, &buf)
+	var header [1 + uint32Size]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	n := binary.LittleEndian.Uint32(header[1:])
+	var b writeBatch
+	for i := uint32(0); i < n; i++ {
+		var w [uint64Size + uint32Size]byte
+		_, err = io.ReadFull(r, w[:])
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		// the length may be corrupt, so the data is only buffered as it
+		// actually arrives
+		var data bytes.Buffer
+		length := int64(binary.LittleEndian.Uint32(w[uint64Size:]))
+		copied, err := io.CopyN(&data, r, length)
+		if err != nil || copied != length {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b.write(int64(binary.LittleEndian.Uint64(w[:])), data.Bytes())
+	}
+	sum := crc32.Checksum(buf.Bytes(), crcTable)
+	var expected [uint32Size]byte
+	_, err = io.ReadFull(r, expected[:])
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if binary.LittleEndian.Uint32(expected[:]) != sum {
+		return nil, ErrCorrupt.New("pending log write record checksum mismatch")
+	}
+	return b, nil
+}
+
+// commit makes the in-place writes of one change to the tree, after logging
+// them in the pending log, so that if the process dies partway through, the
+// change is finished when the tree is next opened rather than left half
+// made, with subtree counts that disagree with the tombstones below them.
+// With OpenOptions.SyncWrites, the log is synced before the tree is
+// written, so that holds after a power failure too.
+func (t *Tree) commit(b writeBatch) error {
+	if len(b) == 0 {
+		return nil
+	}
+	err := t.pending.appendWrites(b)
+	if err != nil {
+		return err
+	}
+	if t.opts.SyncWrites {
+		err = t.pending.sync()
+		if err != nil {
+			return err
+		}
+	}
+	err = t.applyWrites(b)
+	if err != nil {
+		return err
+	}
+	return t.syncWrites()
+}
+
+// applyWrites makes the writes of b to the tree file, dropping the nodes
+// they change from the node cache.
+func (t *Tree) applyWrites(b writeBatch) error {
+	for _, w := range b {
+		_, err := t.fh.WriteAt(w.data, w.offset)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+		if w.offset < t.count*t.nodelen {
+			err = t.uncache(w.offset - w.offset%t.nodelen)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replay finishes the last batch of in-place writes in the pending log, if
+// the tree file doesn't already hold it. Every earlier batch was finished
+// before the record after it was logged, and the last is the latest to
+// write any of its bytes, so making it again is harmless. A tree opened for
+// reading only is read through the finished writes instead.
+func (t *Tree) replay() error {
+	b := t.pending.writes
+	for _, w := range b {
+		current := make([]byte, len(w.data))
+		_, err := t.r.ReadAt(current, w.offset)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+		if bytes.Equal(current, w.data) {
+			continue
+		}
+		if t.writable {
+			return t.applyWrites(b)
+		}
+		t.r = newOverlayReader(t.r, b)
+		// nodes pinned while opening were read without the writes
+		if t.pinned != nil {
+			t.pinned, err = t.pinLevels(t.opts.PinLevels)
+		}
+		return err
+	}
+	return nil
+}
+
+// overlayReader reads through r, but with writes made over what it holds.
+type overlayReader struct {
+	r io.ReaderAt
+	// writes are sorted by offset, and don't overlap.
+	writes writeBatch
+}
+
+func newOverlayReader(r io.ReaderAt, b writeBatch) *overlayReader {
+	writes := append(writeBatch(nil), b...)
+	sort.Slice(writes, func(i, j int) bool {
+		return writes[i].offset < writes[j].offset
+	})
+	return &overlayReader{r: r, writes: writes}
+}
+
+func (o *overlayReader) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = o.r.ReadAt(p, off)
+	end := off + int64(n)
+	i := sort.Search(len(o.writes), func(i int) bool {
+		w := o.writes[i]
+		return w.offset+int64(len(w.data)) > off
+	})
+	for ; i < len(o.writes) && o.writes[i].offset < end; i++ {
+		w := o.writes[i]
+		if w.offset >= off {
+			copy(p[w.offset-off:n], w.data)
+		} else {
+			copy(p[:n], w.data[off-w.offset:])
+		}
+	}
+	return n, err
+}
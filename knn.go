@@ -0,0 +1,196 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"sort"
+	"time"
+)
+
+// NeighborRef refers to a point by the offset of its node, which can be
+// passed to Tree.Node.
+type NeighborRef struct {
+	Offset   int64
+	Distance float64
+}
+
+// nearestExcluding is Nearest, but leaves the node at offset exclude out of
+// the results and reports node offsets.
+func (t *Tree) nearestExcluding(p Point, n int, exclude int64) (
+	[]NeighborRef, error) {
+	q := nearestQuery{p: p, h: make(maxHeap, 0, n), exclude: exclude}
+	err := t.search(t.root, &q)
+	if err != nil {
+		return nil, err
+	}
+	t.searchPending(&q)
+	sort.Sort(sort.Reverse(&q.h))
+	rv := make([]NeighborRef, 0, len(q.h))
+	for _, n := range q.h {
+		rv = append(rv, NeighborRef{Offset: n.offset, Distance: n.Distance})
+	}
+	return rv, nil
+}
+
+// KNNGraphFunc finds the k nearest other points to every undeleted point in
+// the tree, calling fn with each point and its neighbors, closest first.
+// Points are visited in file order, and only one point's neighbors are held
+// at a time. It stops at and returns the first error fn returns.
+func (t *Tree) KNNGraphFunc(k int,
+	fn func(src NeighborRef, neighbors []NeighborRef) error) error {
+	if k <= 0 {
+		return errClass.New("k must be positive")
+	}
+	return t.scan(func(offset int64, n Node) error {
+		if n.Deleted {
+			return nil
+		}
+		neighbors, err := t.nearestExcluding(n.Point, k, offset)
+		if err != nil {
+			return err
+		}
+		return fn(NeighborRef{Offset: offset}, neighbors)
+	})
+}
+
+// KNNGraph returns the k nearest other points to every point in the tree.
+// The result has one row per node, in file order; rows for deleted points
+// are nil.
+func (t *Tree) KNNGraph(k int) ([][]NeighborRef, error) {
+	rv := make([][]NeighborRef, t.count)
+	err := t.KNNGraphFunc(k, func(src NeighborRef,
+		neighbors []NeighborRef) error {
+		rv[src.Offset/t.nodelen] = neighbors
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// allKNNBatch is how many points AllKNN and Join search for at a time.
+const allKNNBatch = 256
+
+// knnBatcher collects points to find the nearest neighbors of in a tree,
+// searching for a batch of them in a single traversal once the batch fills.
+// fn is called with each point, the offset it was excluded by and its
+// neighbors.
+type knnBatcher struct {
+	t     *Tree
+	k     int
+	batch []*nearestQuery
+	fn    func(p Point, exclude int64, neighbors []PointDistance) error
+}
+
+func newKNNBatcher(t *Tree, k int,
+	fn func(p Point, exclude int64, neighbors []PointDistance) error) *knnBatcher {
+	return &knnBatcher{t: t, k: k, fn: fn,
+		batch: make([]*nearestQuery, 0, allKNNBatch)}
+}
+
+// add queues p, leaving the node at offset exclude out of its neighbors.
+func (b *knnBatcher) add(p Point, exclude int64) error {
+	b.batch = append(b.batch, &nearestQuery{p: p, h: make(maxHeap, 0, b.k),
+		exclude: exclude})
+	if len(b.batch) < cap(b.batch) {
+		return nil
+	}
+	return b.flush()
+}
+
+// flush searches for the queued points and calls fn with each of them.
+func (b *knnBatcher) flush() error {
+	if len(b.batch) == 0 {
+		return nil
+	}
+	start := time.Now()
+	err := b.t.searchBatch(b.t.root, b.batch)
+	if err != nil {
+		return err
+	}
+	for _, q := range b.batch {
+		b.t.searchPending(q)
+		b.t.recordQuery(q.stats, start)
+		err = b.fn(q.p, q.exclude, q.h.Points())
+		if err != nil {
+			return err
+		}
+	}
+	b.batch = b.batch[:0]
+	return nil
+}
+
+// AllKNN finds the k nearest other points to every undeleted point in the
+// tree, calling fn with each point and its neighbors, closest first, like
+// KNNGraphFunc. Points are taken in file order a batch at a time and each
+// batch is searched for in a single traversal, as with NearestBatch. Points
+// near each other in the file are near each other in space, so a batch
+// shares most of the nodes it reads, which makes this far faster than a
+// query per point on a tree that doesn't fit in memory. It stops at and
+// returns the first error fn returns.
+func (t *Tree) AllKNN(k int,
+	fn func(p Point, neighbors []PointDistance) error) error {
+	if k <= 0 {
+		return errClass.New("k must be positive")
+	}
+	b := newKNNBatcher(t, k,
+		func(p Point, exclude int64, neighbors []PointDistance) error {
+			return fn(p, neighbors)
+		})
+	return t.allKNN(b)
+}
+
+// allKNN adds every undeleted point in the tree to b, in file order, each
+// excluding itself, and flushes b.
+func (t *Tree) allKNN(b *knnBatcher) error {
+	err := t.scan(func(offset int64, n Node) error {
+		if n.Deleted {
+			return nil
+		}
+		return b.add(n.Point, offset)
+	})
+	if err != nil {
+		return err
+	}
+	return b.flush()
+}
+
+// Join finds the k nearest points in b to every point in a, including a's
+// pending inserted points, calling fn with each point of a and its
+// neighbors in b, closest first. The points of a are taken in file order a
+// batch at a time, and each batch is searched for in a single traversal of
+// b as in AllKNN. It stops at and returns the first error fn returns.
+func Join(a, b *Tree, k int,
+	fn func(p Point, neighbors []PointDistance) error) error {
+	if k <= 0 {
+		return errClass.New("k must be positive")
+	}
+	if a.footer.dims != b.footer.dims {
+		return ErrDimensionMismatch.New("trees have different dimensions: %d and %d",
+			a.footer.dims, b.footer.dims)
+	}
+	batcher := newKNNBatcher(b, k,
+		func(p Point, exclude int64, neighbors []PointDistance) error {
+			return fn(p, neighbors)
+		})
+	err := a.Each(func(p Point) error {
+		return batcher.add(p, -1)
+	})
+	if err != nil {
+		return err
+	}
+	return batcher.flush()
+}
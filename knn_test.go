@@ -0,0 +1,172 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestKNNGraph(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	const k = 5
+	tree := createTestTree(t, fs, 3, 10, newTestPoints(150, 3, 10),
+		BuildOptions{})
+	defer tree.Close()
+
+	var offsets []int64
+	var points []Point
+	err := tree.scan(func(offset int64, n Node) error {
+		offsets = append(offsets, offset)
+		points = append(points, n.Point)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	graph, err := tree.KNNGraph(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph) != len(points) {
+		t.Fatalf("got %d rows, expected %d", len(graph), len(points))
+	}
+
+	for i := range points {
+		var expected []NeighborRef
+		for j := range points {
+			if i != j {
+				expected = append(expected, NeighborRef{Offset: offsets[j],
+					Distance: points[i].distanceSquared(&points[j])})
+			}
+		}
+		sort.Slice(expected, func(a, b int) bool {
+			return expected[a].Distance < expected[b].Distance
+		})
+		expected = expected[:k]
+
+		if len(graph[i]) != k {
+			t.Fatalf("row %d has %d neighbors, expected %d", i, len(graph[i]), k)
+		}
+		for j := range expected {
+			if graph[i][j] != expected[j] {
+				t.Fatalf("row %d neighbor %d: got %v, expected %v", i, j,
+					graph[i][j], expected[j])
+			}
+		}
+	}
+}
+
+func TestAllKNN(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	const k = 4
+	points := newTestPoints(600, 3, 10)
+	ro := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	ro.Close()
+	tree, err := OpenRW(ro.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	err = tree.Delete(points[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := points[1:]
+
+	seen := 0
+	err = tree.AllKNN(k, func(p Point, neighbors []PointDistance) error {
+		seen++
+		var expected []float64
+		self := false
+		for i := range live {
+			d := p.distanceSquared(&live[i])
+			if !self && live[i].equal(&p) {
+				self = true
+				continue
+			}
+			expected = append(expected, d)
+		}
+		sort.Float64s(expected)
+		if len(neighbors) != k {
+			t.Fatalf("got %d neighbors, expected %d", len(neighbors), k)
+		}
+		for i, n := range neighbors {
+			if n.Distance != expected[i] {
+				t.Fatalf("neighbor %d: got distance %v, expected %v", i,
+					n.Distance, expected[i])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != len(live) {
+		t.Fatalf("saw %d points, expected %d", seen, len(live))
+	}
+}
+
+func TestJoin(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	const k = 3
+	pointsA := newTestPoints(400, 2, 10)
+	pointsB := newTestPoints(700, 2, 10)
+	a := createTestTree(t, fs, 2, 10, pointsA, BuildOptions{})
+	defer a.Close()
+	b := createTestTree(t, fs, 2, 10, pointsB, BuildOptions{})
+	defer b.Close()
+
+	seen := 0
+	err := Join(a, b, k, func(p Point, neighbors []PointDistance) error {
+		seen++
+		expected := make([]float64, 0, len(pointsB))
+		for i := range pointsB {
+			expected = append(expected, p.distanceSquared(&pointsB[i]))
+		}
+		sort.Float64s(expected)
+		if len(neighbors) != k {
+			t.Fatalf("got %d neighbors, expected %d", len(neighbors), k)
+		}
+		for i, n := range neighbors {
+			if n.Distance != expected[i] {
+				t.Fatalf("neighbor %d: got distance %v, expected %v", i,
+					n.Distance, expected[i])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != len(pointsA) {
+		t.Fatalf("saw %d points, expected %d", seen, len(pointsA))
+	}
+
+	c := createTestTree(t, fs, 3, 10, newTestPoints(10, 3, 10), BuildOptions{})
+	defer c.Close()
+	err = Join(a, c, k, func(Point, []PointDistance) error { return nil })
+	if err == nil {
+		t.Fatal("expected an error joining trees of different dimensions")
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"os"
+)
+
+// Layout is the order nodes are written to a tree file in. Queries follow
+// the child offsets stored in each node, so any layout can be read the same
+// way; layouts differ in how many disk pages a search touches.
+type Layout int
+
+const (
+	// PreorderLayout writes each node before its subtrees. It is the default.
+	PreorderLayout Layout = iota
+	// CacheObliviousLayout writes nodes in van Emde Boas order: the top half
+	// of the tree's levels, laid out recursively, followed by each subtree
+	// hanging below them, laid out recursively. Nodes near each other in the
+	// tree end up near each other on disk at every scale, so the layout does
+	// well without being tuned to a particular block size. Building it keeps
+	// 24 bytes per node in memory.
+	CacheObliviousLayout
+	// BlockedLayout groups nodes into blocks of up to layoutBlockSize (4 KiB)
+	// bytes, each holding the top levels of a subtree, breadth first, with
+	// the subtrees hanging below a block in blocks of their own. A search
+	// then reads several levels of the tree for each block it touches. Blocks
+	// aren't padded out to page boundaries, so a block may straddle two
+	// pages. Building it keeps 24 bytes per node in memory.
+	BlockedLayout
+)
+
+// layoutBlockSize is the size in bytes of the blocks of BlockedLayout.
+const layoutBlockSize = 4096
+
+// relayout rewrites the preorder tree file src to dst in the given layout.
+func relayout(src, dst string, f *footer, layout Layout,
+	fill PaddingFill, fsync *syncer) error {
+	fh, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	t := &Tree{r: fh, root: f.root, count: f.count, nodelen: f.nodeSize(),
+		footer: *f}
+
+	// children by node index
+	left := make([]int64, t.count)
+	right := make([]int64, t.count)
+	index := func(offset int64) int64 {
+		if offset == -1 {
+			return -1
+		}
+		return offset / t.nodelen
+	}
+	err = t.scan(func(offset int64, n Node) error {
+		left[index(offset)] = index(n.Left)
+		right[index(offset)] = index(n.Right)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var order []int64
+	switch layout {
+	case CacheObliviousLayout:
+		order = vebOrder(left, right, index(t.root))
+	case BlockedLayout:
+		perBlock := layoutBlockSize / t.nodelen
+		if perBlock < 1 {
+			perBlock = 1
+		}
+		order = blockedOrder(left, right, index(t.root), int(perBlock))
+	default:
+		return errClass.New("unknown layout %d", layout)
+	}
+
+	position := make([]int64, t.count)
+	for newIdx, oldIdx := range order {
+		position[oldIdx] = int64(newIdx)
+	}
+	relocate := func(offset int64) int64 {
+		if offset == -1 {
+			return -1
+		}
+		return position[index(offset)] * t.nodelen
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fsync.writer(out))
+	for _, oldIdx := range order {
+		n, err := t.Node(oldIdx * t.nodelen)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		n.Left = relocate(n.Left)
+		n.Right = relocate(n.Right)
+		err = n.serialize(w, f.maxDataLen, fill)
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		out.Close()
+		return errClass.Wrap(err)
+	}
+	f.root = relocate(t.root)
+	return out.Close()
+}
+
+// vebOrder returns node indexes in van Emde Boas order given each node's
+// children.
+func vebOrder(left, right []int64, root int64) []int64 {
+	if root == -1 {
+		return nil
+	}
+
+	// find the height of the tree
+	type frame struct {
+		idx   int64
+		depth int
+	}
+	height := 0
+	stack := []frame{{root, 1}}
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if f.depth > height {
+			height = f.depth
+		}
+		for _, child := range []int64{left[f.idx], right[f.idx]} {
+			if child != -1 {
+				stack = append(stack, frame{child, f.depth + 1})
+			}
+		}
+	}
+
+	// descendants appends the nodes depth levels below idx, left to right
+	var descendants func(idx int64, depth int, out []int64) []int64
+	descendants = func(idx int64, depth int, out []int64) []int64 {
+		if idx == -1 {
+			return out
+		}
+		if depth == 0 {
+			return append(out, idx)
+		}
+		out = descendants(left[idx], depth-1, out)
+		return descendants(right[idx], depth-1, out)
+	}
+
+	order := make([]int64, 0, len(left))
+	// layout appends the nodes less than height levels below idx
+	var layout func(idx int64, height int)
+	layout = func(idx int64, height int) {
+		if height == 1 {
+			order = append(order, idx)
+			return
+		}
+		top := height / 2
+		layout(idx, top)
+		for _, bottom := range descendants(idx, top, nil) {
+			layout(bottom, height-top)
+		}
+	}
+	layout(root, height)
+	return order
+}
+
+// blockedOrder returns node indexes in blocks of up to perBlock nodes, given
+// each node's children. Each block is filled breadth first from its root, and
+// the children left out of a block root blocks of their own, which follow in
+// breadth first order.
+func blockedOrder(left, right []int64, root int64, perBlock int) []int64 {
+	if root == -1 {
+		return nil
+	}
+	order := make([]int64, 0, len(left))
+	roots := []int64{root}
+	for len(roots) > 0 {
+		block := []int64{roots[0]}
+		roots = roots[1:]
+		for i := 0; i < len(block); i++ {
+			for _, child := range []int64{left[block[i]], right[block[i]]} {
+				if child == -1 {
+					continue
+				}
+				if len(block) < perBlock {
+					block = append(block, child)
+				} else {
+					roots = append(roots, child)
+				}
+			}
+		}
+		order = append(order, block...)
+	}
+	return order
+}
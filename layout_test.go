@@ -0,0 +1,176 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"testing"
+)
+
+func TestVEBOrder(t *testing.T) {
+	// a complete tree of height 4, numbered in breadth first order
+	left := make([]int64, 15)
+	right := make([]int64, 15)
+	for i := range left {
+		left[i], right[i] = -1, -1
+		if 2*i+2 < len(left) {
+			left[i], right[i] = int64(2*i+1), int64(2*i+2)
+		}
+	}
+	expected := []int64{0, 1, 2, 3, 7, 8, 4, 9, 10, 5, 11, 12, 6, 13, 14}
+	order := vebOrder(left, right, 0)
+	if len(order) != len(expected) {
+		t.Fatalf("got %v, expected %v", order, expected)
+	}
+	for i := range order {
+		if order[i] != expected[i] {
+			t.Fatalf("got %v, expected %v", order, expected)
+		}
+	}
+}
+
+func TestCacheObliviousLayout(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	preorder := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer preorder.Close()
+	veb := createTestTree(t, fs, 3, 10, points,
+		BuildOptions{Layout: CacheObliviousLayout})
+	defer veb.Close()
+
+	reopened, err := OpenTree(veb.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.footer.layout != CacheObliviousLayout {
+		t.Fatal("layout not recorded in the footer")
+	}
+
+	for i := 0; i < 20; i++ {
+		q := NewPoint(3, 10)
+		expected, err := preorder.Nearest(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := reopened.Nearest(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range expected {
+			if expected[j].Distance != actual[j].Distance {
+				t.Fatal("layouts disagree")
+			}
+		}
+	}
+}
+
+func benchmarkLayout(b *testing.B, layout Layout) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fs.Delete()
+
+	log, err := NewPointSet(fs.Temp(), 3, 16)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 20000; i++ {
+		err = log.Add(NewPoint(3, 16))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	tree, err := CreateTreeWithOptions(fs.Path("tree"), fs.Temp(), log,
+		BuildOptions{Layout: layout})
+	if err != nil {
+		b.Fatal(err)
+	}
+	tree.Close()
+
+	// each iteration opens the tree anew, though the OS page cache will
+	// still be warm; drop it externally for truly cold numbers.
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree, err := OpenTree(fs.Path("tree"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = tree.Nearest(NewPoint(3, 16), 10)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tree.Close()
+	}
+}
+
+func BenchmarkPreorderLayout(b *testing.B) { benchmarkLayout(b, PreorderLayout) }
+func BenchmarkCacheObliviousLayout(b *testing.B) {
+	benchmarkLayout(b, CacheObliviousLayout)
+}
+
+func TestBlockedOrder(t *testing.T) {
+	// a complete tree of height 4, numbered in breadth first order
+	left := make([]int64, 15)
+	right := make([]int64, 15)
+	for i := range left {
+		left[i], right[i] = -1, -1
+		if 2*i+2 < len(left) {
+			left[i], right[i] = int64(2*i+1), int64(2*i+2)
+		}
+	}
+	for perBlock, expected := range map[int][]int64{
+		3: {0, 1, 2, 3, 7, 8, 4, 9, 10, 5, 11, 12, 6, 13, 14},
+		4: {0, 1, 2, 3, 4, 9, 10, 5, 11, 12, 6, 13, 14, 7, 8},
+		7: {0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14},
+	} {
+		order := blockedOrder(left, right, 0, perBlock)
+		if len(order) != len(expected) {
+			t.Fatalf("got %v, expected %v", order, expected)
+		}
+		for i := range order {
+			if order[i] != expected[i] {
+				t.Fatalf("%d per block: got %v, expected %v", perBlock, order,
+					expected)
+			}
+		}
+	}
+}
+
+func TestBlockedLayout(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points,
+		BuildOptions{Layout: BlockedLayout})
+	defer tree.Close()
+	if tree.footer.layout != BlockedLayout {
+		t.Fatal("layout not recorded in the footer")
+	}
+	err := tree.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points[:50] {
+		nearest, err := tree.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math"
+	"sort"
+)
+
+// Result is a point found by NearestLazy. Its Data is only read when asked
+// for, so a query over wide payloads only pays for the ones it uses.
+type Result struct {
+	Pos      []float64
+	Distance float64
+	// ID identifies the point to Tree.Get.
+	ID uint64
+
+	t      *Tree
+	offset int64
+	data   []byte
+	// ref is set if data is still the reference to the point's Data in the
+	// data region. See Tree.nodeShape.
+	ref bool
+}
+
+// Data returns the point's Data, reading it on the first call if it wasn't
+// read by the query. It must be called while the tree is open, and not by
+// more than one goroutine at a time.
+func (r *Result) Data() ([]byte, error) {
+	if r.ref {
+		data, err := r.t.readData(r.offset, r.data)
+		if err != nil {
+			return nil, err
+		}
+		r.data, r.ref = data, false
+	}
+	return r.data, nil
+}
+
+// Point returns the point, reading its Data as Data does.
+func (r *Result) Point() (Point, error) {
+	data, err := r.Data()
+	if err != nil {
+		return Point{}, err
+	}
+	return Point{Pos: r.Pos, Data: data}, nil
+}
+
+// Dist returns the plain Euclidean distance, the square root of Distance.
+func (r *Result) Dist() float64 { return math.Sqrt(r.Distance) }
+
+// NearestLazy is Nearest, but leaves the Data of the results to be read by
+// Result.Data. Only trees built with VariableData or DataCompression keep
+// Data apart from the coordinates, so elsewhere, or with a node cache, the
+// Data has already been read with the node, and Result.Data just returns it.
+// Results are ordered as Nearest orders them.
+func (t *Tree) NearestLazy(p Point, n int) ([]Result, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	q := &nearestQuery{p: p, lazyResults: true}
+	err := t.searchNearest(n, q)
+	if err != nil {
+		return nil, err
+	}
+	h := q.h
+	sort.Sort(sort.Reverse(&h))
+	// results tied on distance and position are ordered by Data, so read
+	// it for them after all
+	resolved := false
+	for i := 1; i < len(h); i++ {
+		if !refTie(&h[i-1], &h[i]) {
+			continue
+		}
+		err = t.resolveData(h[i-1 : i+1])
+		if err != nil {
+			return nil, err
+		}
+		resolved = true
+	}
+	if resolved {
+		sort.Sort(sort.Reverse(&h))
+	}
+	rv := make([]Result, 0, len(h))
+	for _, nb := range h {
+		rv = append(rv, Result{Pos: nb.Pos, Distance: nb.Distance, ID: nb.ID,
+			t: t, offset: nb.offset, data: nb.Data, ref: nb.dataRef})
+	}
+	return rv, nil
+}
@@ -0,0 +1,219 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// legacyLinksSize is the size of the fields that follow a node's point in
+// tree files written before footers were added: Left, Right and Dim, with no
+// Count.
+const legacyLinksSize = 2*uint64Size + uint32Size
+
+// legacyReader presents a tree file written before footers were added in
+// the current format, so such files can still be opened for reading. Those
+// files are nothing but nodes, all of one size, in preorder with the root
+// first, so the subtree counts and footer are worked out when the file is
+// opened.
+type legacyReader struct {
+	r      io.ReaderAt
+	oldlen int64
+	newlen int64
+	// counts holds the subtree count of each node, by index.
+	counts []int64
+	footer []byte
+}
+
+// openLegacy returns nil if the size bytes of r end in a footer. Otherwise
+// it reads them as a tree file from before footers were added, which takes a
+// pass over the whole file. dims is used as the dimensions of an empty file,
+// which doesn't record any.
+func openLegacy(r io.ReaderAt, size int64, dims int) (*legacyReader, error) {
+	if size >= int64(footerTrailerSize) {
+		var trailer [footerTrailerSize]byte
+		_, err := r.ReadAt(trailer[:], size-int64(len(trailer)))
+		if err != nil {
+			return nil, errClass.Wrap(err)
+		}
+		if string(trailer[uint32Size:]) == footerMagic {
+			return nil, nil
+		}
+	}
+
+	l := &legacyReader{r: r}
+	f := footer{dims: dims, root: -1}
+	if size > 0 {
+		var header [pointHeaderSize]byte
+		_, err := r.ReadAt(header[:], 0)
+		if err != nil {
+			return nil, ErrCorrupt.New("missing footer")
+		}
+		h, _, err := parsePointHeader(header[:], coords{})
+		if err != nil {
+			return nil, err
+		}
+		if h.version != 0 || h.dims == 0 {
+			return nil, ErrCorrupt.New("missing footer")
+		}
+		f.dims = int(h.dims)
+		f.maxDataLen = int(h.datalen + h.padlen)
+		err = checkNodeSize(int64(h.dims), int64(h.datalen)+int64(h.padlen))
+		if err != nil {
+			return nil, err
+		}
+		l.oldlen = int64(pointSize(f.dims, f.maxDataLen) + legacyLinksSize)
+		if size%l.oldlen != 0 {
+			return nil, ErrCorrupt.New("Invalid tree file")
+		}
+		f.count = size / l.oldlen
+		f.root = 0
+		f.min, f.max, err = l.countNodes(f.dims, f.count)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.newlen = int64(f.nodeSize())
+
+	var buf bytes.Buffer
+	err := f.serialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+	l.footer = buf.Bytes()
+	return l, nil
+}
+
+// countNodes fills in l.counts from the n nodes of the file, checking that
+// they form a single tree, and returns the bounds of their points. Children
+// follow their parents, so a pass from the end sees every child first.
+func (l *legacyReader) countNodes(dims int, n int64) (min, max []float64,
+	err error) {
+	l.counts = make([]int64, n)
+	referenced := make([]bool, n)
+	child := func(i int64, link []byte) (int64, error) {
+		offset := int64(binary.LittleEndian.Uint64(link))
+		if offset == -1 {
+			return 0, nil
+		}
+		if offset <= i*l.oldlen || offset%l.oldlen != 0 ||
+			offset/l.oldlen >= n || referenced[offset/l.oldlen] {
+			return 0, ErrCorrupt.New("invalid child offset %d", offset)
+		}
+		referenced[offset/l.oldlen] = true
+		return l.counts[offset/l.oldlen], nil
+	}
+
+	buf := make([]byte, l.oldlen)
+	for i := n - 1; i >= 0; i-- {
+		_, err := l.r.ReadAt(buf, i*l.oldlen)
+		if err != nil {
+			return nil, nil, errClass.Wrap(err)
+		}
+		p, links, err := parsePoint(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(p.Pos) != dims || len(links) != legacyLinksSize ||
+			binary.LittleEndian.Uint32(links[2*uint64Size:]) >= uint32(dims) {
+			return nil, nil, ErrCorrupt.New("Invalid tree file")
+		}
+		left, err := child(i, links)
+		if err != nil {
+			return nil, nil, err
+		}
+		right, err := child(i, links[uint64Size:])
+		if err != nil {
+			return nil, nil, err
+		}
+		l.counts[i] = 1 + left + right
+
+		if min == nil {
+			min = append([]float64(nil), p.Pos...)
+			max = append([]float64(nil), p.Pos...)
+		}
+		for d, v := range p.Pos {
+			if v < min[d] {
+				min[d] = v
+			}
+			if v > max[d] {
+				max[d] = v
+			}
+		}
+	}
+	if l.counts[0] != n {
+		return nil, nil, ErrCorrupt.New("%d nodes unreachable from the root",
+			n-l.counts[0])
+	}
+	return min, max, nil
+}
+
+func (l *legacyReader) size() int64 {
+	return int64(len(l.counts))*l.newlen + int64(len(l.footer))
+}
+
+// ReadAt reads from the file as it would be in the current format.
+func (l *legacyReader) ReadAt(p []byte, off int64) (n int, err error) {
+	nodesLen := int64(len(l.counts)) * l.newlen
+	for len(p) > 0 {
+		var src []byte
+		switch {
+		case off < 0:
+			return n, errClass.New("negative offset")
+		case off < nodesLen:
+			i := off / l.newlen
+			node, err := l.node(i)
+			if err != nil {
+				return n, err
+			}
+			src = node[off-i*l.newlen:]
+		case off < nodesLen+int64(len(l.footer)):
+			src = l.footer[off-nodesLen:]
+		default:
+			return n, io.EOF
+		}
+		copied := copy(p, src)
+		p = p[copied:]
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// node returns the ith node in the current format, with Count added and
+// its children's offsets moved to match.
+func (l *legacyReader) node(i int64) ([]byte, error) {
+	rv := make([]byte, l.newlen)
+	old := rv[:l.oldlen]
+	_, err := l.r.ReadAt(old, i*l.oldlen)
+	if err != nil {
+		return nil, err
+	}
+	var links [legacyLinksSize]byte
+	copy(links[:], old[l.oldlen-legacyLinksSize:])
+	out := rv[l.oldlen-legacyLinksSize:]
+	for j := 0; j < 2; j++ {
+		offset := int64(binary.LittleEndian.Uint64(links[j*uint64Size:]))
+		if offset != -1 {
+			offset = offset / l.oldlen * l.newlen
+		}
+		binary.LittleEndian.PutUint64(out[j*uint64Size:], uint64(offset))
+	}
+	binary.LittleEndian.PutUint64(out[2*uint64Size:], uint64(l.counts[i]))
+	copy(out[3*uint64Size:], links[2*uint64Size:])
+	return rv, nil
+}
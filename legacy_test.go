@@ -0,0 +1,154 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeLegacyTree writes points to path as a tree file in the format from
+// before footers were added.
+func writeLegacyTree(t *testing.T, path string, dims, maxData int,
+	points []Point) {
+	var buf bytes.Buffer
+	var write func(points []Point, depth int) int64
+	write = func(points []Point, depth int) int64 {
+		if len(points) == 0 {
+			return -1
+		}
+		dim := depth % dims
+		sort.Slice(points, func(i, j int) bool {
+			return points[i].Pos[dim] < points[j].Pos[dim]
+		})
+		mid := len(points) / 2
+		offset := int64(buf.Len())
+		err := points[mid].serialize(&buf, maxData, ZeroPadding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		links := buf.Len()
+		buf.Write(make([]byte, legacyLinksSize))
+		left := write(points[:mid], depth+1)
+		right := write(points[mid+1:], depth+1)
+		node := buf.Bytes()[links:]
+		binary.LittleEndian.PutUint64(node, uint64(left))
+		binary.LittleEndian.PutUint64(node[uint64Size:], uint64(right))
+		binary.LittleEndian.PutUint32(node[2*uint64Size:], uint32(dim))
+		return offset
+	}
+	write(append([]Point(nil), points...), 0)
+	err := os.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenLegacyTree(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(300, 3, 10)
+	path := fs.Path(tempName(""))
+	writeLegacyTree(t, path, 3, 10, points)
+
+	_, err := OpenRW(path)
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected ErrUnsupported opening a legacy tree writable, "+
+			"got %v", err)
+	}
+
+	legacy, err := OpenTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+	if legacy.Count() != int64(len(points)) {
+		t.Fatalf("got count %d, expected %d", legacy.Count(), len(points))
+	}
+	err = legacy.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the legacy tree written out again is an ordinary tree file
+	var rewritten bytes.Buffer
+	_, err = legacy.WriteTo(&rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgradedPath := fs.Path(tempName(""))
+	err = os.WriteFile(upgradedPath, rewritten.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := OpenTree(upgradedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upgraded.Close()
+	if upgraded.legacy {
+		t.Fatal("rewritten tree still read as a legacy tree")
+	}
+
+	current := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer current.Close()
+	for i := 0; i < 20; i++ {
+		q := NewPoint(3, 10)
+		expected, err := current.Nearest(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tree := range []*Tree{legacy, upgraded} {
+			actual, err := tree.Nearest(q, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(withoutIDs(actual), withoutIDs(expected)) {
+				t.Fatalf("got %v, expected %v", actual, expected)
+			}
+		}
+	}
+}
+
+func TestOpenLegacyEmptyTree(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	path := fs.Path(tempName(""))
+	err := os.WriteFile(path, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := OpenTreeWithOptions(path, OpenOptions{Dims: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.Count() != 0 {
+		t.Fatalf("got count %d, expected 0", tree.Count())
+	}
+	nearest, err := tree.Nearest(Point{Pos: []float64{0, 0}}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 0 {
+		t.Fatalf("got %d neighbors from an empty tree", len(nearest))
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+// ErrQueryTooLarge is the class of errors returned by queries that would
+// allocate more than OpenOptions.MaxQueryBytes. Check for it with
+// ErrQueryTooLarge.Contains(err).
+var ErrQueryTooLarge = errClass.NewClass("query too large")
+
+// resultOverhead estimates the memory a query result takes beyond its
+// coordinates and Data: a PointDistance, with the headers of both slices,
+// in the heap or slice holding it.
+const resultOverhead = 96
+
+// queryBudget tracks the memory a query has allocated against
+// OpenOptions.MaxQueryBytes. A nil queryBudget has no limit.
+type queryBudget struct {
+	limit, used int64
+}
+
+func (t *Tree) newBudget() *queryBudget {
+	if t.opts.MaxQueryBytes <= 0 {
+		return nil
+	}
+	return &queryBudget{limit: t.opts.MaxQueryBytes}
+}
+
+// charge counts n more bytes allocated, failing once the query goes over
+// its limit.
+func (b *queryBudget) charge(n int64) error {
+	if b == nil {
+		return nil
+	}
+	b.used += n
+	if b.used > b.limit {
+		return ErrQueryTooLarge.New("query needs more than %d bytes", b.limit)
+	}
+	return nil
+}
+
+// release counts n bytes freed.
+func (b *queryBudget) release(n int64) {
+	if b != nil {
+		b.used -= n
+	}
+}
+
+// resultBytes estimates the memory a result for p holds.
+func resultBytes(p *Point) int64 {
+	return resultOverhead + int64(len(p.Pos))*float64Size + int64(len(p.Data))
+}
+
+// checkResults fails if n results as large as the tree's points can be
+// would take more than MaxQueryBytes. Queries for a fixed number of results
+// check this before making room for them.
+func (t *Tree) checkResults(n int64) error {
+	limit := t.opts.MaxQueryBytes
+	if limit <= 0 {
+		return nil
+	}
+	size := resultOverhead + int64(t.footer.dims)*float64Size +
+		int64(t.footer.maxDataLen)
+	if n > limit/size {
+		return ErrQueryTooLarge.New("%d results may need more than %d bytes",
+			n, limit)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"testing"
+)
+
+func TestMaxQueryBytes(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 2, 10)
+	tree := createTestTree(t, fs, 2, 10, points, BuildOptions{})
+	tree.Close()
+	tree, err := OpenTreeWithOptions(tree.path,
+		OpenOptions{MaxQueryBytes: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	q := NewPoint(2, 10)
+	_, err = tree.Nearest(q, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tree.Nearest(q, 1000000)
+	if !ErrQueryTooLarge.Contains(err) {
+		t.Fatalf("expected a huge Nearest to be too large, got %v", err)
+	}
+	_, err = tree.NearestBatch([]Point{q, q, q}, 50)
+	if !ErrQueryTooLarge.Contains(err) {
+		t.Fatalf("expected a large batch to be too large, got %v", err)
+	}
+
+	within, err := tree.Within(q, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(within) > 10 {
+		t.Fatalf("%d points in a tiny radius", len(within))
+	}
+	_, err = tree.Within(q, 2)
+	if !ErrQueryTooLarge.Contains(err) {
+		t.Fatalf("expected a huge Within to be too large, got %v", err)
+	}
+	_, err = tree.WithinDistances(q, 2)
+	if !ErrQueryTooLarge.Contains(err) {
+		t.Fatalf("expected a huge WithinDistances to be too large, got %v",
+			err)
+	}
+	// streaming queries aren't limited
+	count := 0
+	err = tree.WithinFunc(q, 2, func(Point) error {
+		count++
+		return nil
+	})
+	if err != nil || count != len(points) {
+		t.Fatalf("WithinFunc found %d points: %v", count, err)
+	}
+
+	// the iterator's queue counts too
+	small, err := OpenTreeWithOptions(tree.path,
+		OpenOptions{MaxQueryBytes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+	_, _, err = small.NearestIter(q).Next()
+	if !ErrQueryTooLarge.Contains(err) {
+		t.Fatalf("expected the iterator to run out of room, got %v", err)
+	}
+	large, err := OpenTreeWithOptions(tree.path,
+		OpenOptions{MaxQueryBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer large.Close()
+	it := large.NearestIter(q)
+	for i := 0; i < len(points); i++ {
+		_, ok, err := it.Next()
+		if err != nil || !ok {
+			t.Fatalf("iterator stopped after %d points: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// LoadOptions says where each record read by PointSet.LoadCSV or
+// PointSet.LoadJSONL keeps its point.
+type LoadOptions struct {
+	// PosColumns are the indexes of the CSV columns holding each coordinate,
+	// in order. Defaults to the first columns, one per dimension.
+	PosColumns []int
+	// DataColumns are the indexes of the CSV columns holding Data. One
+	// column is stored as is; more are stored together as a CSV record.
+	// Defaults to the column after the default PosColumns, if a record has
+	// it.
+	DataColumns []int
+	// Header, if set, skips the first CSV record.
+	Header bool
+	// Comma is the CSV field delimiter. Defaults to ','.
+	Comma rune
+
+	// PosField is the JSON field holding the coordinates as an array.
+	// Defaults to "pos".
+	PosField string
+	// PosFields, if set, are JSON fields each holding one coordinate, in
+	// order, instead of PosField.
+	PosFields []string
+	// DataField is the JSON field holding Data. Strings are stored as their
+	// text and any other value as its JSON. Defaults to "data".
+	DataField string
+
+	// SkipNonFinite, if set, skips records with NaN or infinite
+	// coordinates, which would otherwise be an error. Such coordinates can't
+	// be ordered, so they can't be stored in a tree.
+	SkipNonFinite bool
+}
+
+// loader turns records into points for a PointSet.
+type loader struct {
+	pl      *PointSet
+	opts    LoadOptions
+	line    int
+	skipped bool
+	loaded  int64
+}
+
+// add adds the point with coordinates pos and Data data, or skips it.
+func (l *loader) add(pos []float64, data []byte) error {
+	if len(pos) != l.pl.dims {
+		return ErrDimensionMismatch.New("line %d: %d coordinates, expected %d",
+			l.line, len(pos), l.pl.dims)
+	}
+	if len(data) > l.pl.maxDataLen {
+		return ErrDataTooLarge.New("line %d: %d bytes of Data, more than %d",
+			l.line, len(data), l.pl.maxDataLen)
+	}
+	for _, v := range pos {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			if l.opts.SkipNonFinite {
+				return nil
+			}
+			return ErrNonFinite.New("line %d: coordinate %v", l.line, v)
+		}
+	}
+	err := l.pl.Add(Point{Pos: pos, Data: data})
+	if err != nil {
+		return l.errorf("%v", err)
+	}
+	l.loaded++
+	return nil
+}
+
+func (l *loader) errorf(format string, args ...interface{}) error {
+	return errClass.New("line %d: %s", l.line, fmt.Sprintf(format, args...))
+}
+
+// LoadCSV adds a point to pl for each record read from r, taking the
+// coordinates and Data from the columns opts names. Leading and trailing
+// space around coordinates is ignored. Errors name the line they occurred
+// on. It returns the number of points added.
+func (pl *PointSet) LoadCSV(r io.Reader, opts LoadOptions) (int64, error) {
+	l := &loader{pl: pl, opts: opts}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	if opts.Comma != 0 {
+		cr.Comma = opts.Comma
+	}
+	posColumns := opts.PosColumns
+	if posColumns == nil {
+		posColumns = make([]int, pl.dims)
+		for i := range posColumns {
+			posColumns[i] = i
+		}
+	}
+	var fields []string
+	var data bytes.Buffer
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return l.loaded, nil
+		}
+		if err != nil {
+			return l.loaded, errClass.Wrap(err)
+		}
+		l.line, _ = cr.FieldPos(0)
+		if opts.Header && !l.skipped {
+			l.skipped = true
+			continue
+		}
+		column := func(i int) (string, error) {
+			if i < 0 || i >= len(record) {
+				return "", l.errorf("no column %d in %d columns", i,
+					len(record))
+			}
+			return record[i], nil
+		}
+
+		pos := make([]float64, len(posColumns))
+		for i, c := range posColumns {
+			field, err := column(c)
+			if err != nil {
+				return l.loaded, err
+			}
+			pos[i], err = strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				return l.loaded, l.errorf("column %d: %v", c, err)
+			}
+		}
+
+		dataColumns := opts.DataColumns
+		if dataColumns == nil && opts.PosColumns == nil &&
+			len(record) > pl.dims {
+			dataColumns = []int{pl.dims}
+		}
+		var pdata []byte
+		switch len(dataColumns) {
+		case 0:
+		case 1:
+			field, err := column(dataColumns[0])
+			if err != nil {
+				return l.loaded, err
+			}
+			pdata = []byte(field)
+		default:
+			fields = fields[:0]
+			for _, c := range dataColumns {
+				field, err := column(c)
+				if err != nil {
+					return l.loaded, err
+				}
+				fields = append(fields, field)
+			}
+			data.Reset()
+			w := csv.NewWriter(&data)
+			w.Write(fields)
+			w.Flush()
+			pdata = bytes.TrimSuffix(data.Bytes(), []byte("\n"))
+			pdata = append([]byte(nil), pdata...)
+		}
+		err = l.add(pos, pdata)
+		if err != nil {
+			return l.loaded, err
+		}
+	}
+}
+
+// LoadJSONL adds a point to pl for each JSON object read from r, one per
+// line, taking the coordinates and Data from the fields opts names. Blank
+// lines are skipped. Errors name the line they occurred on. It returns the
+// number of points added.
+func (pl *PointSet) LoadJSONL(r io.Reader, opts LoadOptions) (int64,
+	error) {
+	l := &loader{pl: pl, opts: opts}
+	posField, dataField := opts.PosField, opts.DataField
+	if posField == "" {
+		posField = "pos"
+	}
+	if dataField == "" {
+		dataField = "data"
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	for l.line = 1; scanner.Scan(); l.line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record map[string]json.RawMessage
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return l.loaded, l.errorf("%v", err)
+		}
+		field := func(name string, v interface{}) error {
+			raw, ok := record[name]
+			if !ok {
+				return l.errorf("no %q field", name)
+			}
+			err := json.Unmarshal(raw, v)
+			if err != nil {
+				return l.errorf("%q: %v", name, err)
+			}
+			return nil
+		}
+
+		var pos []float64
+		if opts.PosFields != nil {
+			pos = make([]float64, len(opts.PosFields))
+			for i, name := range opts.PosFields {
+				err = field(name, &pos[i])
+				if err != nil {
+					return l.loaded, err
+				}
+			}
+		} else {
+			err = field(posField, &pos)
+			if err != nil {
+				return l.loaded, err
+			}
+		}
+
+		var data []byte
+		if raw, ok := record[dataField]; ok {
+			var s string
+			if json.Unmarshal(raw, &s) == nil {
+				data = []byte(s)
+			} else if string(raw) != "null" {
+				data = append([]byte(nil), raw...)
+			}
+		}
+		err = l.add(pos, data)
+		if err != nil {
+			return l.loaded, err
+		}
+	}
+	return l.loaded, errClass.Wrap(scanner.Err())
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadedPoints returns every point in the tree built from set.
+func loadedPoints(t *testing.T, fs *baseFS, set *PointSet) []Point {
+	tree, err := CreateTree(fs.Path(tempName("")), fs.Temp(), set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	var points []Point
+	err = tree.Each(func(p Point) error {
+		points = append(points, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return points
+}
+
+func TestLoadCSV(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	load := func(input string, opts LoadOptions) ([]Point, int64, error) {
+		set, err := NewPointSet(fs.Temp(), 2, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := set.LoadCSV(strings.NewReader(input), opts)
+		if err != nil {
+			set.Close()
+			return nil, loaded, err
+		}
+		return loadedPoints(t, fs, set), loaded, nil
+	}
+
+	points, loaded, err := load("1, 2,\"a,b\"\n3,4\n", LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Point{{Pos: []float64{1, 2}, Data: []byte("a,b")},
+		{Pos: []float64{3, 4}, Data: []byte{}}}
+	if loaded != 2 || !samePoints(points, expected) {
+		t.Fatalf("loaded %d: %v", loaded, points)
+	}
+
+	points, _, err = load("name;x;y;tag\nfoo;1;2;t\nbar;NaN;3;u\n",
+		LoadOptions{Header: true, Comma: ';', PosColumns: []int{2, 1},
+			DataColumns: []int{0, 3}, SkipNonFinite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []Point{{Pos: []float64{2, 1}, Data: []byte("foo,t")}}
+	if !samePoints(points, expected) {
+		t.Fatalf("got %v", points)
+	}
+
+	for _, input := range []string{"1,2\n3,x\n", "1,2\n3\n", "1,2\nInf,3\n"} {
+		_, loaded, err = load(input, LoadOptions{})
+		if err == nil || loaded != 1 ||
+			!strings.Contains(err.Error(), "line 2") {
+			t.Fatalf("%q: loaded %d, got %v", input, loaded, err)
+		}
+	}
+}
+
+func TestLoadJSONL(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	load := func(input string, opts LoadOptions) ([]Point, error) {
+		set, err := NewPointSet(fs.Temp(), 2, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = set.LoadJSONL(strings.NewReader(input), opts)
+		if err != nil {
+			set.Close()
+			return nil, err
+		}
+		return loadedPoints(t, fs, set), nil
+	}
+
+	points, err := load("{\"pos\": [1, 2], \"data\": \"a\"}\n\n"+
+		"{\"pos\": [3, 4], \"data\": {\"k\": 1}}\n", LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Point{{Pos: []float64{1, 2}, Data: []byte("a")},
+		{Pos: []float64{3, 4}, Data: []byte("{\"k\": 1}")}}
+	if !samePoints(points, expected) {
+		t.Fatalf("got %v", points)
+	}
+
+	points, err = load("{\"lat\": 1, \"lon\": 2, \"id\": \"x\"}\n",
+		LoadOptions{PosFields: []string{"lon", "lat"}, DataField: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []Point{{Pos: []float64{2, 1}, Data: []byte("x")}}
+	if !samePoints(points, expected) {
+		t.Fatalf("got %v", points)
+	}
+
+	_, err = load("{\"pos\": [1, 2]}\n{\"pos\": [1]}\n", LoadOptions{})
+	if !ErrDimensionMismatch.Contains(err) ||
+		!strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected a dimension mismatch on line 2, got %v", err)
+	}
+}
+
+// samePoints reports whether got and expected hold the same points, in any
+// order, treating nil and empty Data alike.
+func samePoints(got, expected []Point) bool {
+	if len(got) != len(expected) {
+		return false
+	}
+	used := make([]bool, len(got))
+	for _, e := range expected {
+		found := false
+		for i, g := range got {
+			if !used[i] && reflect.DeepEqual(g.Pos, e.Pos) &&
+				string(g.Data) == string(e.Data) {
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// buildLog logs the progress of a build to BuildOptions.Logger. A nil
+// *buildLog, for builds without a Logger, logs nothing.
+type buildLog struct {
+	l     *slog.Logger
+	path  string
+	start time.Time
+	// name and started are the current phase and when it began.
+	name    string
+	started time.Time
+}
+
+func newBuildLog(l *slog.Logger, path string, points *PointSet) *buildLog {
+	if l == nil {
+		return nil
+	}
+	l.Info("dkdtree: build started", "path", path, "points", points.count,
+		"dims", points.dims, "max_data_len", points.maxDataLen)
+	now := time.Now()
+	return &buildLog{l: l, path: path, start: now, started: now}
+}
+
+// phase ends the current phase, logging how long it took, and starts the
+// one called name.
+func (b *buildLog) phase(name string) {
+	if b == nil {
+		return
+	}
+	b.endPhase()
+	b.name, b.started = name, time.Now()
+}
+
+func (b *buildLog) endPhase() {
+	if b.name != "" {
+		b.l.Debug("dkdtree: build phase done", "path", b.path,
+			"phase", b.name, "duration", time.Since(b.started))
+	}
+	b.name = ""
+}
+
+// finish logs the end of the build, which failed if err is set.
+func (b *buildLog) finish(err error) {
+	if b == nil {
+		return
+	}
+	if err != nil {
+		b.l.Error("dkdtree: build failed", "path", b.path, "phase", b.name,
+			"duration", time.Since(b.start), "error", err)
+		return
+	}
+	b.endPhase()
+	b.l.Info("dkdtree: build finished", "path", b.path,
+		"duration", time.Since(b.start))
+}
+
+// logSlowQuery logs a query that took at least OpenOptions.SlowQuery.
+func (t *Tree) logSlowQuery(s QueryStats, latency time.Duration) {
+	l := t.opts.Logger
+	if l == nil || t.opts.SlowQuery <= 0 || latency < t.opts.SlowQuery {
+		return
+	}
+	l.LogAttrs(context.Background(), slog.LevelWarn, "dkdtree: slow query",
+		slog.String("path", t.path),
+		slog.Duration("latency", latency),
+		slog.Int64("nodes_visited", s.NodesVisited),
+		slog.Int64("bytes_read", s.BytesRead),
+		slog.Int64("points_compared", s.PointsCompared),
+		slog.Int64("subtrees_pruned", s.SubtreesPruned))
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects log output from concurrent queries.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogger(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	var out logBuffer
+	logger := slog.New(slog.NewTextHandler(&out,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	expect := func(msgs ...string) {
+		t.Helper()
+		for _, msg := range msgs {
+			if !strings.Contains(out.String(), msg) {
+				t.Fatalf("expected %q in log:\n%s", msg, out.String())
+			}
+		}
+	}
+
+	points := newTestPoints(300, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{
+		Logger: logger, Checksums: true})
+	tree.Close()
+	expect(`msg="dkdtree: build started"`, "points=300",
+		"phase=split", "phase=write", "phase=checksums",
+		`msg="dkdtree: build finished"`)
+
+	out.buf.Reset()
+	rw, err := OpenRWWithOptions(tree.path, OpenOptions{Logger: logger,
+		SlowQuery: time.Nanosecond, CacheBytes: 10 * tree.nodelen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	_, err = rw.Nearest(points[0], 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(`msg="dkdtree: slow query"`, "nodes_visited=",
+		`msg="dkdtree: cache evicted nodes"`)
+
+	err = rw.Insert(points[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.Merge(fs.Temp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(`msg="dkdtree: rebuild started"`, "pending=1",
+		`msg="dkdtree: rebuild finished"`, "points=301")
+}
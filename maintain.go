@@ -0,0 +1,213 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// MaintenancePolicy says when Tree.Maintain rebuilds a tree. Each threshold
+// is ignored if zero.
+type MaintenancePolicy struct {
+	// Interval is how often the tree is checked. It defaults to a minute.
+	Interval time.Duration
+	// MaxDeletedRatio is the largest fraction of the points stored in the
+	// tree file that may be deleted.
+	MaxDeletedRatio float64
+	// MaxPending is the most inserted points that may wait to be merged.
+	MaxPending int
+	// MaxImbalance is the highest mean imbalance any level in the top half
+	// of the tree may have, as reported by Tree.Stats. Checking it walks the
+	// whole tree.
+	MaxImbalance float64
+	// BytesPerSecond, if positive, limits how fast a rebuild reads the tree
+	// and builds the new one. See RebuildOptions.
+	BytesPerSecond int64
+	// Busy and YieldInterval have rebuilds yield to foreground work. See
+	// RebuildOptions.
+	Busy          func() bool
+	YieldInterval time.Duration
+	// TmpDir is where rebuilds keep their temporary files.
+	TmpDir string
+	// Lock, if set, is held while the tree is checked and rebuilt, to keep
+	// out other uses of the tree, which a rebuild must not overlap. The
+	// write half of a sync.RWMutex whose read half is held around queries
+	// lets Maintain run alongside them.
+	Lock sync.Locker
+}
+
+// Maintain checks the tree, opened with OpenRW, every policy.Interval until
+// ctx is canceled, and rebuilds it as Compact does whenever it crosses one
+// of policy's thresholds. It is meant to be run in a goroutine of its own.
+// It returns the first error a check or rebuild hits, or ctx's error once
+// canceled.
+func (t *Tree) Maintain(ctx context.Context, policy MaintenancePolicy) error {
+	if !t.writable {
+		return errClass.New("tree not opened for writing")
+	}
+	interval := policy.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		err := t.maintain(ctx, policy)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// maintain checks the tree once, rebuilding it if policy says to.
+func (t *Tree) maintain(ctx context.Context, policy MaintenancePolicy) error {
+	if policy.Lock != nil {
+		policy.Lock.Lock()
+		defer policy.Lock.Unlock()
+	}
+	due, err := t.maintenanceDue(policy)
+	if err != nil || !due {
+		return err
+	}
+	return t.rebuild(ctx, policy.TmpDir, RebuildOptions{
+		BytesPerSecond: policy.BytesPerSecond,
+		Busy:           policy.Busy,
+		YieldInterval:  policy.YieldInterval}.throttle())
+}
+
+// maintenanceDue reports whether the tree has crossed any of policy's
+// thresholds.
+func (t *Tree) maintenanceDue(policy MaintenancePolicy) (bool, error) {
+	if policy.MaxPending > 0 && t.Pending() > policy.MaxPending {
+		return true, nil
+	}
+	if policy.MaxDeletedRatio > 0 && t.count > 0 {
+		root, err := t.Node(t.root)
+		if err != nil {
+			return false, err
+		}
+		// the root's subtree count only includes live points
+		deleted := t.count - root.Count
+		if float64(deleted)/float64(t.count) > policy.MaxDeletedRatio {
+			return true, nil
+		}
+	}
+	if policy.MaxImbalance > 0 {
+		stats, err := t.Stats()
+		if err != nil {
+			return false, err
+		}
+		// the bottom levels are uneven in any tree, as their nodes have too
+		// few points to split evenly
+		for _, level := range stats.Levels[:stats.Depth/2] {
+			if level.MeanImbalance > policy.MaxImbalance {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// DefaultYieldInterval is how long a rebuild pauses while
+// RebuildOptions.Busy reports foreground work, if YieldInterval isn't set.
+const DefaultYieldInterval = 10 * time.Millisecond
+
+// throttle paces reads to a rate in bytes per second, if rate is positive,
+// and pauses while busy reports foreground work, if busy is set. A nil
+// throttle doesn't wait.
+type throttle struct {
+	rate  float64
+	start time.Time
+	bytes int64
+	busy  func() bool
+	yield time.Duration
+}
+
+// throttleSlack is how far ahead of its rate a throttle may get before it
+// waits, so that it doesn't sleep for every read.
+const throttleSlack = 10 * time.Millisecond
+
+func newThrottle(bytesPerSecond int64) *throttle {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &throttle{rate: float64(bytesPerSecond), start: time.Now()}
+}
+
+// throttle returns the throttle for a rebuild under opts.
+func (opts RebuildOptions) throttle() *throttle {
+	th := newThrottle(opts.BytesPerSecond)
+	if opts.Busy == nil {
+		return th
+	}
+	if th == nil {
+		th = &throttle{start: time.Now()}
+	}
+	th.busy, th.yield = opts.Busy, opts.YieldInterval
+	if th.yield <= 0 {
+		th.yield = DefaultYieldInterval
+	}
+	return th
+}
+
+// wait counts n bytes read and waits until the rate allows them and busy
+// reports no foreground work, or until ctx is canceled.
+func (th *throttle) wait(ctx context.Context, n int64) error {
+	if th == nil {
+		return nil
+	}
+	if th.busy != nil && th.busy() {
+		for th.busy() {
+			err := sleep(ctx, th.yield)
+			if err != nil {
+				return err
+			}
+		}
+		// the pause doesn't count toward the rate, or the rebuild would
+		// catch up on it in a burst
+		th.start, th.bytes = time.Now(), 0
+	}
+	if th.rate <= 0 {
+		return nil
+	}
+	th.bytes += n
+	due := time.Duration(math.Ceil(float64(th.bytes) / th.rate *
+		float64(time.Second)))
+	ahead := due - time.Since(th.start)
+	if ahead < throttleSlack {
+		return nil
+	}
+	return sleep(ctx, ahead)
+}
+
+// sleep waits for d, or until ctx is canceled.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
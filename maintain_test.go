@@ -0,0 +1,181 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaintain(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	policy := MaintenancePolicy{MaxDeletedRatio: .25, MaxPending: 10,
+		TmpDir: fs.Temp()}
+	deleted, err := rw.DeleteFunc(func(p Point) bool { return p.Pos[0] < .2 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	due, err := rw.maintenanceDue(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due != (float64(deleted)/float64(len(points)) > .25) {
+		t.Fatalf("%d of %d points deleted, but due is %v", deleted,
+			len(points), due)
+	}
+	more, err := rw.DeleteFunc(func(p Point) bool { return p.Pos[0] < .5 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted += more
+	for _, p := range newTestPoints(11, 3, 10) {
+		err = rw.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	policy.Interval = time.Millisecond
+	policy.Lock = &mu
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- rw.Maintain(ctx, policy) }()
+	for {
+		mu.Lock()
+		pending, count := rw.Pending(), rw.Count()
+		mu.Unlock()
+		if pending == 0 {
+			if count != int64(len(points)-deleted+11) {
+				t.Fatalf("got %d points after maintenance, expected %d", count,
+					len(points)-deleted+11)
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	err = <-done
+	if err != context.Canceled {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	due, err = rw.maintenanceDue(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due {
+		t.Fatal("expected maintenance to be done")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	ctx := context.Background()
+	th := newThrottle(1 << 20)
+	start := time.Now()
+	for i := 0; i < 64; i++ {
+		err := th.wait(ctx, 1<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("64KiB at 1MiB/s took only %v", elapsed)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err := newThrottle(1).wait(canceled, 1<<10)
+	if err != context.Canceled {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	err = (*throttle)(nil).wait(ctx, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactWithOptions(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(2000, 2, 10)
+	tree := createTestTree(t, fs, 2, 10, points, BuildOptions{})
+	tree.Close()
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	for _, p := range points[:100] {
+		err = rw.Delete(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a rebuild that never stops yielding gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(),
+		20*time.Millisecond)
+	defer cancel()
+	err = rw.CompactWithOptions(ctx, RebuildOptions{TmpDir: fs.Temp(),
+		Busy: func() bool { return true }})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to pass, got %v", err)
+	}
+	if rw.Count() != 2000 {
+		t.Fatalf("tree changed to %d points", rw.Count())
+	}
+
+	// the read and the build together handle each point three times
+	bytes := 3 * rw.Count() * rw.nodelen
+	busy := 5
+	start := time.Now()
+	err = rw.CompactWithOptions(context.Background(), RebuildOptions{
+		TmpDir:         fs.Temp(),
+		BytesPerSecond: bytes * 10,
+		Busy: func() bool {
+			busy--
+			return busy > 0
+		},
+		YieldInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("rebuild at a tenth of its size per second took only %v",
+			elapsed)
+	}
+	if busy > 0 {
+		t.Fatal("rebuild didn't wait out the foreground work")
+	}
+	if rw.Count() != 1900 {
+		t.Fatalf("got %d points after compacting", rw.Count())
+	}
+}
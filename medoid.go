@@ -0,0 +1,63 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Medoid estimates the stored point with the smallest total Euclidean
+// distance to every other point. It picks sample reference points uniformly
+// at random and returns the point closest in total to those, which takes two
+// passes over the file and time proportional to the number of points times
+// sample. With sample at least the number of points the result is exact.
+func (t *Tree) Medoid(sample int) (Point, error) {
+	if sample <= 0 {
+		return Point{}, errClass.New("sample must be positive")
+	}
+	refs := make([]Point, 0, sample)
+	var seen int64
+	err := t.Each(func(p Point) error {
+		seen++
+		if len(refs) < sample {
+			refs = append(refs, p)
+		} else if i := rand.Int63n(seen); i < int64(sample) {
+			refs[i] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return Point{}, err
+	}
+	if len(refs) == 0 {
+		return Point{}, errClass.New("tree is empty")
+	}
+
+	var best Point
+	bestTotal := math.Inf(1)
+	err = t.Each(func(p Point) error {
+		var total float64
+		for i := range refs {
+			total += math.Sqrt(p.distanceSquared(&refs[i]))
+			if total >= bestTotal {
+				return nil
+			}
+		}
+		best, bestTotal = p, total
+		return nil
+	})
+	return best, err
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMedoid(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(80, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	var expected Point
+	best := math.Inf(1)
+	for i := range points {
+		var total float64
+		for j := range points {
+			total += math.Sqrt(points[i].distanceSquared(&points[j]))
+		}
+		if total < best {
+			expected, best = points[i], total
+		}
+	}
+
+	medoid, err := tree.Medoid(len(points))
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertPointsEqual(medoid, expected)
+
+	_, err = tree.Medoid(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"sort"
+)
+
+// CreateTreeInMemory builds a tree out of points without touching the disk:
+// the points are split in memory and the tree is kept in a byte slice in
+// the same format as a tree file, so the returned Tree answers every query
+// a tree opened with OpenTree does. It suits datasets that fit in RAM and
+// tests. The tree is read-only, and can be written out with Tree.WriteTo.
+//
+// Only the preorder layout is supported, without VariableData,
+// DataCompression, Checksums, Float32, a CoordinateCodec, Boxes or a
+// TagField, which are reported with ErrUnsupported, as are a PositionIndex,
+// Mirrors and Normalize. A Normalization the points were already normalized
+// by is recorded.
+// MaxScratchBytes is ignored.
+func CreateTreeInMemory(dims, maxDataLen int, points []Point,
+	opts BuildOptions) (*Tree, error) {
+	if opts.Layout != PreorderLayout || opts.VariableData ||
+		opts.DataCompression != NoCompression || opts.Checksums ||
+		opts.Float32 || opts.CoordinateCodec != nil || opts.Boxes ||
+		opts.TagField != nil {
+		return nil, ErrUnsupported.New("in-memory trees only support the " +
+			"preorder layout with fixed-size, uncompressed Data")
+	}
+	if opts.Normalize {
+		return nil, ErrUnsupported.New("in-memory trees can't normalize " +
+			"their points")
+	}
+	if opts.PositionIndex != "" || len(opts.Mirrors) > 0 {
+		return nil, ErrUnsupported.New("in-memory trees can't write a " +
+			"position index or mirrors; use Tree.WritePositionIndex or " +
+			"Tree.CopyTo")
+	}
+	f := footer{
+		dims:       dims,
+		maxDataLen: maxDataLen,
+		root:       -1,
+		min:        make([]float64, dims),
+		max:        make([]float64, dims),
+		leafSize:   opts.LeafSize}
+	if opts.LeafSize < 0 {
+		return nil, errClass.New("LeafSize must be positive")
+	}
+	if opts.Normalization != nil {
+		err := opts.Normalization.check(dims)
+		if err != nil {
+			return nil, err
+		}
+		f.normalization = opts.Normalization
+	}
+	err := checkNodeSize(int64(dims), int64(maxDataLen))
+	if err != nil {
+		return nil, err
+	}
+	pts := make([]Point, 0, len(points))
+	for i, p := range points {
+		if len(p.Pos) != dims {
+			return nil, ErrDimensionMismatch.New(
+				"point has wrong dimension: %d, expected %d", len(p.Pos), dims)
+		}
+		err := checkFinite(p.Pos)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			copy(f.min, p.Pos)
+			copy(f.max, p.Pos)
+		}
+		for j, v := range p.Pos {
+			if v < f.min[j] {
+				f.min[j] = v
+			}
+			if v > f.max[j] {
+				f.max[j] = v
+			}
+		}
+		pts = append(pts, p)
+	}
+
+	if opts.TimeField != nil {
+		err = opts.TimeField.check(maxDataLen)
+		if err != nil {
+			return nil, err
+		}
+		tf := *opts.TimeField
+		f.timeField = &tf
+	}
+	if opts.GridResolution > 0 {
+		f.grid, err = newGrid(f.min, f.max, opts.GridResolution,
+			opts.MaxGridCells)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = opts.SplitStrategy.check()
+	if err != nil {
+		return nil, err
+	}
+	f.split = opts.SplitStrategy
+	err = opts.SplitDimension.check()
+	if err != nil {
+		return nil, err
+	}
+	f.dimensions = opts.SplitDimension
+	b := memBuilder{dims: dims, dups: opts.Duplicates, split: f.split,
+		dimChoice: f.dimensions, grid: f.grid,
+		progress: newProgress(opts.Progress, int64(len(pts)))}
+	if opts.Dedup && b.dups == KeepDuplicates {
+		b.dups = DropExactDuplicates
+	}
+	b.build(pts, 0)
+
+	f.count = int64(len(b.nodes))
+	if f.count > 0 {
+		f.root = 0
+	}
+	nodelen := f.nodeSize()
+	if f.count > maxInt/nodelen {
+		return nil, ErrDataTooLarge.New(
+			"%d nodes are too large to hold in memory", f.count)
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(f.count * nodelen))
+	for _, n := range b.nodes {
+		if n.Left != -1 {
+			n.Left *= nodelen
+		}
+		if n.Right != -1 {
+			n.Right *= nodelen
+		}
+		err = n.serialize(&buf, maxDataLen, opts.PaddingFill)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = f.serialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+	b.progress.finish()
+
+	data := buf.Bytes()
+	return openReaderAt(bytes.NewReader(data), int64(len(data)), OpenOptions{})
+}
+
+// memBuilder splits points in memory the way nodeLog.Build does on disk,
+// collecting the nodes in preorder with the indexes of their children in
+// place of offsets.
+type memBuilder struct {
+	dims      int
+	dups      Duplicates
+	split     SplitStrategy
+	dimChoice DimensionChoice
+	grid      *Grid
+	progress  *progress
+	nodes     []Node
+}
+
+// build adds the subtree of pts, splitting on dim first, returning the
+// index of its root and how many nodes it has. Points with the same
+// coordinate along dim keep their order, so ReplaceByData keeps the point
+// added last.
+func (b *memBuilder) build(pts []Point, dim int) (index, count int64) {
+	if len(pts) == 0 {
+		return -1, 0
+	}
+	var min, max []float64
+	if b.split != MedianSplit || b.dimChoice != CycleDimensions {
+		min, max = pointBounds(pts)
+	}
+	dim = b.dimChoice.choose(pts, min, max, dim)
+	sort.SliceStable(pts, func(i, j int) bool {
+		return pts[i].Pos[dim] < pts[j].Pos[dim]
+	})
+	mid := b.split.index(pts, dim, min, max)
+	median := pts[mid]
+	var left, right []Point
+	for i := range pts {
+		p := &pts[i]
+		switch {
+		case i == mid:
+			continue
+		case b.dups == DropExactDuplicates && p.equal(&median):
+			continue
+		case b.dups == ReplaceByData && p.samePos(&median):
+			if i > mid {
+				median = *p
+			}
+			continue
+		}
+		if p.Pos[dim] <= median.Pos[dim] {
+			left = append(left, *p)
+		} else {
+			right = append(right, *p)
+		}
+	}
+
+	index = int64(len(b.nodes))
+	b.nodes = append(b.nodes, Node{})
+	if b.grid != nil {
+		b.grid.add(median.Pos)
+	}
+	b.progress.add(1)
+
+	ndim := (dim + 1) % b.dims
+	leftIndex, leftCount := b.build(left, ndim)
+	rightIndex, rightCount := b.build(right, ndim)
+	count = 1 + leftCount + rightCount
+	b.nodes[index] = Node{
+		Point: median,
+		Dim:   uint32(dim),
+		Left:  leftIndex,
+		Right: rightIndex,
+		Count: count}
+	return index, count
+}
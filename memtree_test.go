@@ -0,0 +1,112 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCreateTreeInMemory(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	disk := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer disk.Close()
+	mem, err := CreateTreeInMemory(3, 10, points, BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+
+	if mem.Count() != disk.Count() {
+		t.Fatalf("got %d points, expected %d", mem.Count(), disk.Count())
+	}
+	err = mem.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		q := NewPoint(3, 10)
+		expected, err := disk.Nearest(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := mem.Nearest(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range expected {
+			if actual[j].Distance != expected[j].Distance ||
+				!bytes.Equal(actual[j].Data, expected[j].Data) {
+				t.Fatalf("result %d differs from the tree built on disk", j)
+			}
+		}
+	}
+
+	dups := []Point{
+		{Pos: []float64{1, 1}, Data: []byte("a")},
+		{Pos: []float64{1, 1}, Data: []byte("a")},
+		{Pos: []float64{1, 1}, Data: []byte("b")},
+		{Pos: []float64{2, 2}, Data: []byte("c")},
+	}
+	for _, test := range []struct {
+		dups  Duplicates
+		count int64
+	}{
+		{KeepDuplicates, 4},
+		{DropExactDuplicates, 3},
+		{ReplaceByData, 2},
+	} {
+		tree, err := CreateTreeInMemory(2, 1, dups,
+			BuildOptions{Duplicates: test.dups})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tree.Count() != test.count {
+			t.Fatalf("duplicates %d: got %d points, expected %d", test.dups,
+				tree.Count(), test.count)
+		}
+		if test.dups == ReplaceByData {
+			nearest, err := tree.Nearest(dups[0], 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(nearest[0].Data) != "b" {
+				t.Fatalf("got data %q, expected the last added", nearest[0].Data)
+			}
+		}
+		tree.Close()
+	}
+
+	_, err = CreateTreeInMemory(3, 10, points, BuildOptions{Checksums: true})
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected unsupported, got %v", err)
+	}
+	_, err = CreateTreeInMemory(2, 10, points, BuildOptions{})
+	if !ErrDimensionMismatch.Contains(err) {
+		t.Fatalf("expected a dimension mismatch, got %v", err)
+	}
+	empty, err := CreateTreeInMemory(3, 10, nil, BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	nearest, err := empty.Nearest(NewPoint(3, 10), 1)
+	if err != nil || len(nearest) != 0 {
+		t.Fatalf("got %v, %v from an empty tree", nearest, err)
+	}
+}
@@ -0,0 +1,434 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math"
+)
+
+// PointMetric measures the distance between whole points, so it may take
+// Data into account as well as Pos.
+//
+// The tree is only split on Pos, so pruning relies on AxisBound alone. Any
+// part of Distance that comes from Data must never be negative, which keeps
+// AxisBound a lower bound and searches exact.
+type PointMetric interface {
+	// Distance returns the distance from the query a to the stored point b.
+	Distance(a, b *Point) float64
+	// AxisBound returns a lower bound on Distance from a query to any point
+	// whose position differs from the query's by delta along dimension dim.
+	AxisBound(dim uint32, delta float64) float64
+}
+
+// PreparedMetric is a PointMetric with the query point fixed.
+type PreparedMetric interface {
+	// Distance returns the distance from the query to the stored point b.
+	Distance(b *Point) float64
+	AxisBound(dim uint32, delta float64) float64
+}
+
+// PreparableMetric is a PointMetric that can precompute the terms that
+// depend only on the query, such as its norm, once per query rather than
+// once per comparison.
+type PreparableMetric interface {
+	PointMetric
+	// Prepare returns a PreparedMetric for queries from query. It must agree
+	// with the PointMetric for every point.
+	Prepare(query *Point) PreparedMetric
+}
+
+// unpreparedMetric is a PreparedMetric for a PointMetric without Prepare.
+type unpreparedMetric struct {
+	PointMetric
+	query *Point
+}
+
+func (m unpreparedMetric) Distance(b *Point) float64 {
+	return m.PointMetric.Distance(m.query, b)
+}
+
+func prepareMetric(m PointMetric, query *Point) PreparedMetric {
+	if pm, ok := m.(PreparableMetric); ok {
+		return pm.Prepare(query)
+	}
+	return unpreparedMetric{PointMetric: m, query: query}
+}
+
+// NearestMetric is Nearest, but ranks points by m instead of squared
+// Euclidean distance. If m is a PreparableMetric, it is prepared once for p.
+func (t *Tree) NearestMetric(p Point, n int, m PointMetric) (
+	[]PointDistance, error) {
+	rv, _, err := t.nearest(n, &nearestQuery{p: p,
+		metric: prepareMetric(m, &p)})
+	return rv, err
+}
+
+// NearestWeighted is Nearest, but ranks points by squared Euclidean distance
+// with each dimension's squared difference scaled by its weight, so that
+// dimensions in different units can be compared without rewriting the
+// points. weights must have an entry per dimension, none of them negative.
+func (t *Tree) NearestWeighted(p Point, weights []float64, n int) (
+	[]PointDistance, error) {
+	m, err := WeightedSquaredEuclidean(weights)
+	if err != nil {
+		return nil, err
+	}
+	if len(weights) != t.footer.dims {
+		return nil, ErrDimensionMismatch.New(
+			"wrong number of weights: %d, expected %d",
+			len(weights), t.footer.dims)
+	}
+	return t.NearestMetric(p, n, m)
+}
+
+// NearestPeriodic is Nearest, but with the dimensions dims gives a Period
+// wrapping around, as measured by PeriodicSquaredEuclidean. dims must have
+// an entry per dimension.
+func (t *Tree) NearestPeriodic(p Point, dims []Periodic, n int) (
+	[]PointDistance, error) {
+	m, err := PeriodicSquaredEuclidean(dims)
+	if err != nil {
+		return nil, err
+	}
+	if len(dims) != t.footer.dims {
+		return nil, ErrDimensionMismatch.New(
+			"wrong number of periods: %d, expected %d", len(dims), t.footer.dims)
+	}
+	return t.NearestMetric(p, n, m)
+}
+
+// WithinMetric returns every point within radius of p by m, ordered by
+// distance. If m is a PreparableMetric, it is prepared once for p.
+func (t *Tree) WithinMetric(p Point, radius float64, m PointMetric) (
+	[]PointDistance, error) {
+	err := t.checkRange(p, radius)
+	if err != nil {
+		return nil, err
+	}
+	pm := prepareMetric(m, &p)
+	q := rangeQuery{
+		p:         p,
+		distance:  pm.Distance,
+		axisBound: pm.AxisBound,
+		bound:     func() float64 { return radius }}
+	var rv []PointDistance
+	budget := t.newBudget()
+	err = t.within(q, func(offset int64, n *Node, dist float64) error {
+		rv = append(rv, PointDistance{Point: n.Point, Distance: dist,
+			ID: t.pointID(offset)})
+		return budget.charge(resultBytes(&n.Point))
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortResults(rv)
+	return rv, nil
+}
+
+var (
+	// SquaredEuclidean is the default metric used by Nearest.
+	SquaredEuclidean PointMetric = squaredEuclidean{}
+	// Euclidean is straight-line distance.
+	Euclidean PointMetric = euclidean{}
+	// Manhattan is the L1 distance, the sum of the distances along each
+	// dimension.
+	Manhattan PointMetric = manhattan{}
+	// Chebyshev is the L∞ distance, the largest distance along any one
+	// dimension.
+	Chebyshev PointMetric = chebyshev{}
+	// Cosine is cosine distance, one minus the cosine of the angle between
+	// two vectors. Its axis bound assumes every stored and query position has
+	// unit length, for which cosine distance is half the squared Euclidean
+	// distance, so normalize positions before using it.
+	Cosine PointMetric = cosine{}
+)
+
+// WeightedSquaredEuclidean returns squared Euclidean distance with the
+// squared difference along dimension i multiplied by weights[i]. A weight of
+// zero ignores its dimension. weights must not be negative.
+func WeightedSquaredEuclidean(weights []float64) (PointMetric, error) {
+	for i, w := range weights {
+		if w < 0 || math.IsNaN(w) {
+			return nil, errClass.New("invalid weight for dimension %d: %v", i, w)
+		}
+	}
+	return weightedSquaredEuclidean{weights: weights}, nil
+}
+
+type weightedSquaredEuclidean struct {
+	weights []float64
+}
+
+func (m weightedSquaredEuclidean) Distance(a, b *Point) (sum float64) {
+	for i, v := range a.Pos {
+		d := v - b.Pos[i]
+		sum += m.weights[i] * d * d
+	}
+	return sum
+}
+
+func (m weightedSquaredEuclidean) AxisBound(dim uint32, delta float64) float64 {
+	return m.weights[dim] * delta * delta
+}
+
+// Periodic describes a dimension whose coordinates wrap around, such as
+// longitude or an angle, for PeriodicSquaredEuclidean.
+type Periodic struct {
+	// Min is the least coordinate. Every stored and query coordinate in the
+	// dimension must be from Min to Min+Period, inclusive.
+	Min float64
+	// Period is how far the coordinates go before wrapping around to Min,
+	// such as 360 for degrees of longitude or 2π for an angle in radians.
+	// Zero leaves the dimension unwrapped.
+	Period float64
+}
+
+// PeriodicSquaredEuclidean returns squared Euclidean distance with the
+// difference along each dimension i that dims[i] gives a Period taken the
+// short way around, so that points either side of the seam, such as at
+// longitudes -179 and 179, are found near each other without being stored
+// twice. It is a PreparableMetric, and its searches only prune the far side
+// of a split along a periodic dimension when the seam is further still.
+func PeriodicSquaredEuclidean(dims []Periodic) (PointMetric, error) {
+	for i, d := range dims {
+		if !(d.Period >= 0) || math.IsInf(d.Period, 0) ||
+			math.IsInf(d.Min, 0) || math.IsNaN(d.Min) {
+			return nil, errClass.New("invalid period for dimension %d: %+v", i, d)
+		}
+	}
+	return periodicSquaredEuclidean{dims: dims}, nil
+}
+
+type periodicSquaredEuclidean struct {
+	dims []Periodic
+}
+
+// wrap returns the distance along a dimension of period p between two
+// coordinates delta apart.
+func wrap(delta, p float64) float64 {
+	delta = math.Abs(delta)
+	if p == 0 {
+		return delta
+	}
+	delta = math.Mod(delta, p)
+	return math.Min(delta, p-delta)
+}
+
+func (m periodicSquaredEuclidean) Distance(a, b *Point) (sum float64) {
+	for i, v := range a.Pos {
+		d := wrap(v-b.Pos[i], m.dims[i].Period)
+		sum += d * d
+	}
+	return sum
+}
+
+// AxisBound can't tell how close the seam is without the query, so it
+// doesn't prune along periodic dimensions. Prepare's does.
+func (m periodicSquaredEuclidean) AxisBound(dim uint32, delta float64) float64 {
+	if m.dims[dim].Period != 0 {
+		return 0
+	}
+	return delta * delta
+}
+
+func (m periodicSquaredEuclidean) Prepare(query *Point) PreparedMetric {
+	return preparedPeriodic{periodicSquaredEuclidean: m, query: query}
+}
+
+type preparedPeriodic struct {
+	periodicSquaredEuclidean
+	query *Point
+}
+
+func (m preparedPeriodic) Distance(b *Point) float64 {
+	return m.periodicSquaredEuclidean.Distance(m.query, b)
+}
+
+// AxisBound takes the lesser of the distance to the split and, around the
+// seam, the distance to the far end of the range, since the far side of the
+// split reaches all the way to it.
+func (m preparedPeriodic) AxisBound(dim uint32, delta float64) float64 {
+	d := m.dims[dim]
+	if d.Period == 0 {
+		return delta * delta
+	}
+	q := m.query.Pos[dim]
+	var bound float64
+	if delta > 0 {
+		bound = math.Min(delta, d.Min+d.Period-q)
+	} else {
+		bound = math.Min(-delta, q-d.Min)
+	}
+	bound = math.Max(bound, 0)
+	return bound * bound
+}
+
+type squaredEuclidean struct{}
+
+func (squaredEuclidean) Distance(a, b *Point) float64 {
+	return a.distanceSquared(b)
+}
+
+func (squaredEuclidean) AxisBound(dim uint32, delta float64) float64 {
+	return delta * delta
+}
+
+type euclidean struct{}
+
+func (euclidean) Distance(a, b *Point) float64 {
+	return math.Sqrt(a.distanceSquared(b))
+}
+
+func (euclidean) AxisBound(dim uint32, delta float64) float64 {
+	return math.Abs(delta)
+}
+
+type manhattan struct{}
+
+func (manhattan) Distance(a, b *Point) (sum float64) {
+	for i, v := range a.Pos {
+		sum += math.Abs(v - b.Pos[i])
+	}
+	return sum
+}
+
+func (manhattan) AxisBound(dim uint32, delta float64) float64 {
+	return math.Abs(delta)
+}
+
+type chebyshev struct{}
+
+func (chebyshev) Distance(a, b *Point) (max float64) {
+	for i, v := range a.Pos {
+		max = math.Max(max, math.Abs(v-b.Pos[i]))
+	}
+	return max
+}
+
+func (chebyshev) AxisBound(dim uint32, delta float64) float64 {
+	return math.Abs(delta)
+}
+
+func norm(v []float64) (sum float64) {
+	for _, x := range v {
+		sum += x * x
+	}
+	return math.Sqrt(sum)
+}
+
+func dot(a, b []float64) (sum float64) {
+	for i, x := range a {
+		sum += x * b[i]
+	}
+	return sum
+}
+
+type cosine struct{}
+
+func (cosine) Distance(a, b *Point) float64 {
+	return 1 - dot(a.Pos, b.Pos)/(norm(a.Pos)*norm(b.Pos))
+}
+
+func (cosine) AxisBound(dim uint32, delta float64) float64 {
+	return delta * delta / 2
+}
+
+func (cosine) Prepare(query *Point) PreparedMetric {
+	return preparedCosine{query: query.Pos, norm: norm(query.Pos)}
+}
+
+type preparedCosine struct {
+	query []float64
+	norm  float64
+}
+
+func (m preparedCosine) Distance(b *Point) float64 {
+	return 1 - dot(m.query, b.Pos)/(m.norm*norm(b.Pos))
+}
+
+func (preparedCosine) AxisBound(dim uint32, delta float64) float64 {
+	return delta * delta / 2
+}
+
+// Haversine returns the great-circle distance metric on a sphere of the
+// given radius, for points whose first two dimensions are latitude and
+// longitude in degrees. Any further dimensions are ignored. Longitudes wrap
+// around at ±180.
+func Haversine(radius float64) PreparableMetric {
+	return haversine{radius: radius}
+}
+
+type haversine struct {
+	radius float64
+}
+
+const radiansPerDegree = math.Pi / 180
+
+func (m haversine) Distance(a, b *Point) float64 {
+	lat1, lat2 := a.Pos[0]*radiansPerDegree, b.Pos[0]*radiansPerDegree
+	dlat := lat2 - lat1
+	dlon := (b.Pos[1] - a.Pos[1]) * radiansPerDegree
+	h := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * m.radius * math.Asin(math.Sqrt(math.Min(h, 1)))
+}
+
+// AxisBound without a query can only use latitude, as how far apart two
+// longitudes are depends on the latitude.
+func (m haversine) AxisBound(dim uint32, delta float64) float64 {
+	if dim == 0 {
+		return m.radius * math.Abs(delta) * radiansPerDegree
+	}
+	return 0
+}
+
+func (m haversine) Prepare(query *Point) PreparedMetric {
+	return preparedHaversine{haversine: m, query: query}
+}
+
+type preparedHaversine struct {
+	haversine
+	query *Point
+}
+
+func (m preparedHaversine) Distance(b *Point) float64 {
+	return m.haversine.Distance(m.query, b)
+}
+
+// AxisBound for longitude finds the smallest longitude difference any point
+// beyond the split can have, allowing for wrapping around the antimeridian,
+// and returns the distance from the query to the nearest point on that
+// meridian.
+func (m preparedHaversine) AxisBound(dim uint32, delta float64) float64 {
+	if dim != 1 {
+		return m.haversine.AxisBound(dim, delta)
+	}
+	lon := m.query.Pos[1]
+	var dlon float64
+	if delta > 0 {
+		// points beyond the split are west of the query
+		dlon = math.Min(delta, 180-lon)
+	} else {
+		dlon = math.Min(-delta, 180+lon)
+	}
+	if dlon <= 0 {
+		return 0
+	}
+	lat := math.Abs(m.query.Pos[0]) * radiansPerDegree
+	if dlon >= 90 {
+		return m.radius * (math.Pi/2 - lat)
+	}
+	return m.radius * math.Asin(math.Sin(dlon*radiansPerDegree)*math.Cos(lat))
+}
@@ -0,0 +1,355 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// priceMetric is squared Euclidean distance plus a weighted difference in
+// the price stored in Data.
+type priceMetric struct{ weight float64 }
+
+func price(p *Point) float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(p.Data))
+}
+
+func (m priceMetric) Distance(a, b *Point) float64 {
+	return a.distanceSquared(b) + m.weight*math.Abs(price(a)-price(b))
+}
+
+func (m priceMetric) AxisBound(dim uint32, delta float64) float64 {
+	return delta * delta
+}
+
+func newPricedPoint(dims int) Point {
+	p := NewPoint(dims, 1)
+	p.Data = make([]byte, float64Size)
+	binary.LittleEndian.PutUint64(p.Data, math.Float64bits(rand.Float64()))
+	return p
+}
+
+func TestNearestMetric(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := make([]Point, 0, 500)
+	for i := 0; i < cap(points); i++ {
+		points = append(points, newPricedPoint(3))
+	}
+	tree := createTestTree(t, fs, 3, float64Size, points, BuildOptions{})
+	defer tree.Close()
+
+	m := priceMetric{weight: 0.5}
+	for i := 0; i < 20; i++ {
+		q := newPricedPoint(3)
+		expected := make([]PointDistance, 0, len(points))
+		for _, p := range points {
+			expected = append(expected,
+				PointDistance{Point: p, Distance: m.Distance(&q, &p)})
+		}
+		sort.Slice(expected, func(i, j int) bool {
+			return expected[i].Distance < expected[j].Distance
+		})
+
+		actual, err := tree.NearestMetric(q, 10, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != 10 {
+			t.Fatalf("got %d results, expected 10", len(actual))
+		}
+		for j := range actual {
+			if actual[j].Distance != expected[j].Distance ||
+				!actual[j].Point.equal(&expected[j].Point) {
+				t.Fatalf("result %d differs from brute force", j)
+			}
+		}
+	}
+}
+
+// plainMetric hides any Prepare method of the metric it wraps.
+type plainMetric struct{ PointMetric }
+
+func newUnitPoints(n, dims int) []Point {
+	points := newTestPoints(n, dims, 10)
+	for _, p := range points {
+		l := norm(p.Pos)
+		for i := range p.Pos {
+			p.Pos[i] /= l
+		}
+	}
+	return points
+}
+
+func TestPreparedMetric(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	tree := createTestTree(t, fs, 8, 10, newUnitPoints(500, 8), BuildOptions{})
+	defer tree.Close()
+
+	for _, q := range newUnitPoints(20, 8) {
+		prepared, err := tree.NearestMetric(q, 10, Cosine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := tree.NearestMetric(q, 10, plainMetric{Cosine})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(prepared) != len(plain) {
+			t.Fatalf("got %d results, expected %d", len(prepared), len(plain))
+		}
+		for i := range plain {
+			if prepared[i].Distance != plain[i].Distance ||
+				!prepared[i].Point.equal(&plain[i].Point) {
+				t.Fatalf("result %d differs", i)
+			}
+		}
+	}
+}
+
+func benchmarkMetric(b *testing.B, m PointMetric) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fs.Delete()
+	points := newUnitPoints(10000, 64)
+	set, err := NewPointSet(fs.Temp(), 64, 10)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, p := range points {
+		err = set.Add(p)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	tree, err := CreateTree(fs.Path("tree"), fs.Temp(), set)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tree.Close()
+	queries := newUnitPoints(100, 64)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = tree.NearestMetric(queries[i%len(queries)], 10, m)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPreparedMetric(b *testing.B) { benchmarkMetric(b, Cosine) }
+func BenchmarkUnpreparedMetric(b *testing.B) {
+	benchmarkMetric(b, plainMetric{Cosine})
+}
+
+func TestBuiltinMetrics(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	units := newUnitPoints(500, 3)
+	globe := make([]Point, 0, 500)
+	for i := 0; i < cap(globe); i++ {
+		globe = append(globe, Point{Pos: []float64{
+			rand.Float64()*180 - 90, rand.Float64()*360 - 180}})
+	}
+	randomGlobe := func() Point {
+		return Point{Pos: []float64{rand.Float64()*180 - 90,
+			rand.Float64()*360 - 180}}
+	}
+	randomUnit := func() Point { return newUnitPoints(1, 3)[0] }
+	random := func() Point { return NewPoint(3, 10) }
+
+	for _, test := range []struct {
+		name   string
+		metric PointMetric
+		points []Point
+		query  func() Point
+		radius float64
+	}{
+		{"squared euclidean", SquaredEuclidean, points, random, 0.05},
+		{"euclidean", Euclidean, points, random, 0.2},
+		{"manhattan", Manhattan, points, random, 0.3},
+		{"chebyshev", Chebyshev, points, random, 0.15},
+		{"cosine", Cosine, units, randomUnit, 0.05},
+		{"haversine", Haversine(6371), globe, randomGlobe, 2000},
+	} {
+		dims := len(test.points[0].Pos)
+		tree := createTestTree(t, fs, dims, 10, test.points, BuildOptions{})
+		for i := 0; i < 20; i++ {
+			q := test.query()
+			expected := make([]PointDistance, 0, len(test.points))
+			for _, p := range test.points {
+				expected = append(expected, PointDistance{Point: p,
+					Distance: test.metric.Distance(&q, &p)})
+			}
+			sort.Slice(expected, func(i, j int) bool {
+				return expected[i].Distance < expected[j].Distance
+			})
+
+			nearest, err := tree.NearestMetric(q, 10, test.metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := range nearest {
+				if nearest[j].Distance != expected[j].Distance {
+					t.Fatalf("%s: nearest result %d differs from brute force",
+						test.name, j)
+				}
+			}
+
+			within, err := tree.WithinMetric(q, test.radius, test.metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inRange := 0
+			for _, pd := range expected {
+				if pd.Distance <= test.radius {
+					inRange++
+				}
+			}
+			if len(within) != inRange {
+				t.Fatalf("%s: got %d points in range, expected %d", test.name,
+					len(within), inRange)
+			}
+			for j := range within {
+				if within[j].Distance != expected[j].Distance {
+					t.Fatalf("%s: range result %d differs from brute force",
+						test.name, j)
+				}
+			}
+		}
+		tree.Close()
+	}
+}
+
+func TestNearestWeighted(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	weights := []float64{100, 1, 0}
+	for i := 0; i < 20; i++ {
+		q := NewPoint(3, 10)
+		expected := make([]float64, 0, len(points))
+		for _, p := range points {
+			var sum float64
+			for j, w := range weights {
+				d := q.Pos[j] - p.Pos[j]
+				sum += w * d * d
+			}
+			expected = append(expected, sum)
+		}
+		sort.Float64s(expected)
+
+		nearest, err := tree.NearestWeighted(q, weights, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nearest) != 10 {
+			t.Fatalf("got %d results", len(nearest))
+		}
+		for j := range nearest {
+			if math.Abs(nearest[j].Distance-expected[j]) > 1e-12 {
+				t.Fatalf("result %d: got distance %v, expected %v", j,
+					nearest[j].Distance, expected[j])
+			}
+		}
+	}
+
+	_, err := tree.NearestWeighted(NewPoint(3, 10), []float64{1, 1}, 1)
+	if err == nil {
+		t.Fatal("expected an error for too few weights")
+	}
+	_, err = tree.NearestWeighted(NewPoint(3, 10), []float64{1, -1, 1}, 1)
+	if err == nil {
+		t.Fatal("expected an error for a negative weight")
+	}
+}
+
+func TestNearestPeriodic(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 2, 10)
+	tree := createTestTree(t, fs, 2, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	dims := []Periodic{{Min: 0, Period: 1}, {}}
+	m, err := PeriodicSquaredEuclidean(dims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		q := NewPoint(2, 10)
+		// queries by the seam find points on both sides of it
+		q.Pos[0] = []float64{0.001, 0.999, 0.5, q.Pos[0]}[i%4]
+		expected := make([]float64, 0, len(points))
+		for _, p := range points {
+			d0 := math.Abs(q.Pos[0] - p.Pos[0])
+			d0 = math.Min(d0, 1-d0)
+			d1 := q.Pos[1] - p.Pos[1]
+			expected = append(expected, d0*d0+d1*d1)
+		}
+		sort.Float64s(expected)
+
+		nearest, err := tree.NearestPeriodic(q, dims, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nearest) != 10 {
+			t.Fatalf("got %d results", len(nearest))
+		}
+		for j := range nearest {
+			if math.Abs(nearest[j].Distance-expected[j]) > 1e-12 {
+				t.Fatalf("result %d: got distance %v, expected %v", j,
+					nearest[j].Distance, expected[j])
+			}
+		}
+
+		radius := expected[30]
+		within, err := tree.WithinMetric(q, radius, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := sort.SearchFloat64s(expected, math.Nextafter(radius, 2))
+		if len(within) != count {
+			t.Fatalf("found %d points within %v, expected %d", len(within),
+				radius, count)
+		}
+	}
+
+	_, err = tree.NearestPeriodic(NewPoint(2, 10), dims[:1], 1)
+	if err == nil {
+		t.Fatal("expected an error for too few periods")
+	}
+	_, err = PeriodicSquaredEuclidean([]Periodic{{Period: -1}})
+	if err == nil {
+		t.Fatal("expected an error for a negative period")
+	}
+}
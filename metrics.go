@@ -0,0 +1,65 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"io"
+	"time"
+)
+
+// Metrics receives measurements of the work a tree does, to be exported to a
+// monitoring system such as Prometheus or expvar. Counters are kept by adding
+// up what each method is called with, and a latency histogram by observing
+// each query's latency. Methods are called from the goroutines doing the
+// work, often many at once, so they must be safe for concurrent use and
+// should be quick.
+type Metrics interface {
+	// Query is called once each query is done with the work it did and how
+	// long it took. Queries answered as part of a batch, as by NearestBatch,
+	// each report the batch's latency.
+	Query(stats QueryStats, latency time.Duration)
+	// FileRead is called for each read of bytes from the tree file, whether
+	// for nodes, their Data or tables such as checksums and boxes.
+	FileRead(bytes int)
+	// CacheLookup is called for each node looked up in the node cache, if
+	// OpenOptions.CacheBytes is set, with whether it was found there.
+	CacheLookup(hit bool)
+	// BuildWrite is called as a build finishes writing bytes to one of its
+	// temporary files or the tree file.
+	BuildWrite(bytes int64)
+}
+
+// meteredReader reports reads of a tree file to Metrics.
+type meteredReader struct {
+	r       io.ReaderAt
+	metrics Metrics
+}
+
+func (m *meteredReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := m.r.ReadAt(p, off)
+	m.metrics.FileRead(n)
+	return n, err
+}
+
+// recordQuery adds the stats of a query that started at start to t's
+// aggregate stats and reports it to t's Metrics.
+func (t *Tree) recordQuery(s QueryStats, start time.Time) {
+	t.stats.record(s)
+	latency := time.Since(start)
+	if t.opts.Metrics != nil {
+		t.opts.Metrics.Query(s, latency)
+	}
+	t.logSlowQuery(s, latency)
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMetrics struct {
+	mu           sync.Mutex
+	queries      int64
+	nodesVisited int64
+	latency      time.Duration
+	bytesRead    int64
+	hits, misses int64
+	buildBytes   int64
+}
+
+func (m *testMetrics) Query(stats QueryStats, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries++
+	m.nodesVisited += stats.NodesVisited
+	m.latency += latency
+}
+
+func (m *testMetrics) FileRead(bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesRead += int64(bytes)
+}
+
+func (m *testMetrics) CacheLookup(hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hit {
+		m.hits++
+	} else {
+		m.misses++
+	}
+}
+
+func (m *testMetrics) BuildWrite(bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buildBytes += bytes
+}
+
+func TestMetrics(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	var built testMetrics
+	tree := createTestTree(t, fs, 3, 10, newTestPoints(500, 3, 10),
+		BuildOptions{Metrics: &built})
+	tree.Close()
+	fi, err := os.Stat(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the points are split into a file at each level, and the tree is
+	// written twice
+	if built.buildBytes < 3*fi.Size() {
+		t.Fatalf("build wrote %d bytes, tree is %d", built.buildBytes,
+			fi.Size())
+	}
+
+	var m testMetrics
+	tree, err = OpenTreeWithOptions(tree.path,
+		OpenOptions{Metrics: &m, CacheBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	q := NewPoint(3, 10)
+	for i := 0; i < 2; i++ {
+		_, err = tree.Nearest(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = tree.NearestBatch([]Point{q, NewPoint(3, 10)}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := tree.AggregateStats()
+	if m.queries != 4 || m.nodesVisited != stats.NodesVisited ||
+		m.latency <= 0 {
+		t.Fatalf("got %d queries visiting %d nodes in %v, expected %+v",
+			m.queries, m.nodesVisited, m.latency, stats)
+	}
+	if m.misses == 0 || m.hits == 0 {
+		t.Fatalf("got %d cache hits and %d misses", m.hits, m.misses)
+	}
+	if m.bytesRead != m.misses*tree.nodelen {
+		t.Fatalf("read %d bytes for %d cache misses", m.bytesRead, m.misses)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package dkdtree
+
+import (
+	"os"
+)
+
+// mmapFile reports that mapping isn't supported here, so the tree falls back
+// to reading through the file.
+func mmapFile(fh *os.File, size int64) (*mapping, error) {
+	return nil, nil
+}
+
+func (m *mapping) unmap() error { return nil }
@@ -0,0 +1,46 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package dkdtree
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the first size bytes of fh read-only. The mapping is shared,
+// so tombstones written through fh are seen by readers of the mapping.
+func mmapFile(fh *os.File, size int64) (*mapping, error) {
+	if size <= 0 || int64(int(size)) != size {
+		return nil, nil
+	}
+	data, err := syscall.Mmap(int(fh.Fd()), 0, int(size), syscall.PROT_READ,
+		syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	return &mapping{data: data}, nil
+}
+
+func (m *mapping) unmap() error {
+	if m == nil || m.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	return errClass.Wrap(err)
+}
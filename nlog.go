@@ -16,29 +16,51 @@ package dkdtree
 
 import (
 	"bufio"
-	"os"
+	"context"
+	"io"
 
 	"github.com/spacemonkeygo/errors"
 )
 
 type nodeLog struct {
-	fh               *os.File
+	fh               io.WriteCloser
 	buf              *bufio.Writer
 	dims, maxDataLen int
 	offset           int64
+	grid             *Grid
+	// dups is what to do with duplicates of each median.
+	dups Duplicates
+	// split is how the point each node splits at is chosen, and dimensions
+	// how the dimension it splits along is.
+	split      SplitStrategy
+	dimensions DimensionChoice
+	// ctx cancels the build.
+	ctx context.Context
+	// progress counts the nodes added.
+	progress *progress
+	// frames are the splits above the subtree being built, outermost first.
+	frames []*buildFrame
+	// checkpoints, if set, saves the build's progress from time to time.
+	checkpoints *checkpointer
 }
 
-func newNodeLog(path string, dims, maxDataLen int) (*nodeLog, error) {
-	fh, err := os.Create(path)
+func newNodeLog(path string, dims, maxDataLen int, direct bool) (*nodeLog,
+	error) {
+	fh, err := createFile(path, direct)
 	if err != nil {
 		return nil, errClass.Wrap(err)
 	}
+	return newNodeLogFile(fh, dims, maxDataLen), nil
+}
+
+func newNodeLogFile(fh io.WriteCloser, dims, maxDataLen int) *nodeLog {
 	return &nodeLog{
 		fh:         fh,
 		buf:        bufio.NewWriter(fh),
 		dims:       dims,
 		maxDataLen: maxDataLen,
-	}, nil
+		ctx:        context.Background(),
+	}
 }
 
 func (nl *nodeLog) Close() error {
@@ -52,27 +74,50 @@ func (nl *nodeLog) Add(n Node) (offset int64, err error) {
 	offset = nl.offset
 
 	if len(n.Point.Pos) != nl.dims {
-		return offset, errClass.New("point has wrong dimension: %d, expected %d",
+		return offset, ErrDimensionMismatch.New(
+			"point has wrong dimension: %d, expected %d",
 			len(n.Point.Pos), nl.dims)
 	}
 
+	if nl.grid != nil {
+		nl.grid.add(n.Point.Pos)
+	}
+
 	meter := newWriteMeter(nl.buf)
-	err = n.serialize(meter, nl.maxDataLen)
+	err = n.serialize(meter, nl.maxDataLen, nil)
 	nl.offset += meter.Amount
+	nl.progress.add(1)
 	return offset, err
 }
 
+// Build writes out the tree of log's points, splitting on dim first,
+// returning the offset of its root and how many nodes it has.
 func (nl *nodeLog) Build(fs *baseFS, log *PointSet, dim int) (
-	node_offset int64, err error) {
+	node_offset, count int64, err error) {
 	defer log.Close()
 	if log.count == 0 {
-		return -1, nil
+		return -1, 0, nil
 	}
-
-	median := log.medianEstimate(dim)
-	left, right, err := log.split(fs, median, dim, true)
+	err = nl.ctx.Err()
+	if err != nil {
+		return -1, 0, err
+	}
+	err = nl.checkpoint(log, dim)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
+	}
+	dim = log.splitDim(nl.dimensions, dim)
+
+	var median Point
+	var left, right *PointSet
+	if nl.presorted(fs, log, dim) {
+		median, left, right, err = log.splitSorted(dim)
+	} else {
+		median, left, right, err = log.split(fs,
+			log.splitEstimate(nl.split, dim), dim, true, nl.dups)
+	}
+	if err != nil {
+		return -1, 0, err
 	}
 
 	defer left.Close()
@@ -80,19 +125,47 @@ func (nl *nodeLog) Build(fs *baseFS, log *PointSet, dim int) (
 
 	ndim := (dim + 1) % log.dims
 
-	leftOffset, err := nl.Build(fs, left, ndim)
+	f := &buildFrame{dim: dim, median: median, right: right}
+	nl.frames = append(nl.frames, f)
+	f.leftOffset, f.leftCount, err = nl.Build(fs, left, ndim)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
+	f.right = nil
 
-	rightOffset, err := nl.Build(fs, right, ndim)
+	rightOffset, rightCount, err := nl.Build(fs, right, ndim)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
+	nl.frames = nl.frames[:len(nl.frames)-1]
+
+	return nl.join(f, rightOffset, rightCount)
+}
+
+// presorted reports whether log can be split on dim with splitSorted,
+// skipping the pass over its points, which it can if its points were added
+// in order along dim. Points given to the build in order along the first
+// dimension stay in that order as they are split, so every level of the tree
+// that splits on it can.
+func (nl *nodeLog) presorted(fs *baseFS, log *PointSet, dim int) bool {
+	// splitSorted only splits at the median, can't drop duplicates or read
+	// with direct I/O, and the points given to the build can't be named by a
+	// checkpoint.
+	return log.sortedAlong(dim) && nl.split == MedianSplit &&
+		nl.dups == KeepDuplicates && !fs.direct &&
+		(nl.checkpoints == nil || len(nl.frames) > 0)
+}
 
-	return nl.Add(Node{
-		Point: median,
-		Dim:   uint32(dim),
-		Left:  leftOffset,
-		Right: rightOffset})
+// join writes the node of split f, whose subtrees are both built, returning
+// its offset and how many nodes its subtree has.
+func (nl *nodeLog) join(f *buildFrame, rightOffset, rightCount int64) (
+	node_offset, count int64, err error) {
+	count = 1 + f.leftCount + rightCount
+	node_offset, err = nl.Add(Node{
+		Point: f.median,
+		Dim:   uint32(f.dim),
+		Left:  f.leftOffset,
+		Right: rightOffset,
+		Count: count})
+	return node_offset, count, err
 }
@@ -19,14 +19,78 @@ import (
 	"io"
 )
 
+func nodeSize(dims, maxDataLen int) int {
+	return nodeSizeCoords(coords{}, dims, maxDataLen)
+}
+
+// nodeSizeCoords is nodeSize for points serialized as c says.
+func nodeSizeCoords(c coords, dims, maxDataLen int) int {
+	return pointSizeCoords(c, dims, maxDataLen) + 3*uint64Size + uint32Size
+}
+
+// maxInt is the largest int, which on 32-bit platforms is much smaller than
+// the sizes a tree file can describe.
+const maxInt = int64(^uint(0) >> 1)
+
+// checkNodeSize returns an error if nodes of dims dimensions holding up to
+// maxDataLen bytes of Data are too large to hold in memory on this platform,
+// so that nodeSize can't overflow.
+func checkNodeSize(dims, maxDataLen int64) error {
+	if dims < 0 || maxDataLen < 0 {
+		return errClass.New("invalid node size: %d dimensions, %d bytes",
+			dims, maxDataLen)
+	}
+	overhead := int64(pointHeaderSize + 3*uint64Size + uint32Size)
+	if dims > (maxInt-overhead)/float64Size ||
+		maxDataLen > maxInt-overhead-dims*float64Size {
+		return ErrDataTooLarge.New("nodes of %d dimensions with %d bytes "+
+			"of Data are too large for this platform", dims, maxDataLen)
+	}
+	return nil
+}
+
+// nodeDeleted is kept in the otherwise unused high bit of a serialized
+// node's dimension so a node can be tombstoned by rewriting a single byte.
+const nodeDeleted = 1 << 31
+
+// Node is a node of a tree, as returned by Tree.Node. Every node holds a
+// point and splits its subtree along one dimension at the point's
+// coordinate. Nodes are read-only; a Point's Pos may be shared with the
+// tree's node cache and must not be modified.
 type Node struct {
-	Dim         uint32
+	// Dim is the dimension the node splits its subtree along.
+	Dim uint32
+	// Left and Right are the offsets of the node's children, for Tree.Node,
+	// or -1 if it has none. Every point in the left subtree is at most Split
+	// along Dim, and every point in the right subtree at least Split.
 	Left, Right int64
 	Point       Point
+	// Deleted is set if the node's point has been deleted. The node still
+	// splits its subtree.
+	Deleted bool
+	// Count is the number of undeleted points in the subtree rooted at this
+	// node, including the node itself.
+	Count int64
 }
 
-func (n *Node) serialize(w io.Writer, maxDataLen int) error {
-	err := n.Point.serialize(w, maxDataLen)
+// Split returns the coordinate the node splits its subtree at.
+func (n *Node) Split() float64 { return n.Point.Pos[n.Dim] }
+
+func (n *Node) serializedDim() uint32 {
+	if n.Deleted {
+		return n.Dim | nodeDeleted
+	}
+	return n.Dim
+}
+
+func (n *Node) serialize(w io.Writer, maxDataLen int, fill PaddingFill) error {
+	return n.serializeCoords(w, coords{}, maxDataLen, fill)
+}
+
+// serializeCoords is serialize with coordinates stored as c says.
+func (n *Node) serializeCoords(w io.Writer, c coords, maxDataLen int,
+	fill PaddingFill) error {
+	err := n.Point.serializeCoords(w, c, maxDataLen, fill)
 	if err != nil {
 		return err
 	}
@@ -39,23 +103,74 @@ func (n *Node) serialize(w io.Writer, maxDataLen int) error {
 	if err != nil {
 		return errClass.Wrap(err)
 	}
+	err = binary.Write(w, binary.LittleEndian, n.Count)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
 
-	return errClass.Wrap(binary.Write(w, binary.LittleEndian, n.Dim))
+	return errClass.Wrap(binary.Write(w, binary.LittleEndian, n.serializedDim()))
 }
 
-func parseNode(data []byte) (rv Node, err error) {
+// parseNode parses a node out of a tree whose points have dims dimensions
+// and coordinates stored as c says.
+func parseNode(data []byte, dims int, c coords) (rv Node, err error) {
+	if isHole(data) {
+		return rv, ErrHole.New("node is all zeroes")
+	}
 	var remaining []byte
-	rv.Point, remaining, err = parsePoint(data)
+	rv.Point, remaining, err = parsePointExpect(data, dims, c)
 	if err != nil {
 		return rv, err
 	}
+	return rv, parseNodeLinks(&rv, remaining)
+}
+
+// parseNodeInto is parseNode, but decodes the node's position into pos,
+// which must have dims elements, instead of allocating. The node's Data
+// aliases data.
+func parseNodeInto(data []byte, dims int, c coords, pos []float64) (rv Node,
+	err error) {
+	if isHole(data) {
+		return rv, ErrHole.New("node is all zeroes")
+	}
+	h, body, err := parsePointHeaderExpect(data, dims, c)
+	if err != nil {
+		return rv, err
+	}
+	c.decode(h.version, body, pos)
+	body = body[h.posBytes:]
+	rv.Point = Point{Pos: pos, Data: body[:h.datalen]}
+	return rv, parseNodeLinks(&rv, body[uint64(h.datalen)+uint64(h.padlen):])
+}
+
+// parseNodeLinks parses the fields that follow a node's point out of
+// remaining.
+func parseNodeLinks(rv *Node, remaining []byte) error {
+	if len(remaining) < 3*uint64Size+uint32Size {
+		return ErrCorrupt.New("truncated node")
+	}
 	rv.Left = int64(binary.LittleEndian.Uint64(remaining))
 	remaining = remaining[uint64Size:]
 	rv.Right = int64(binary.LittleEndian.Uint64(remaining))
 	remaining = remaining[uint64Size:]
+	rv.Count = int64(binary.LittleEndian.Uint64(remaining))
+	remaining = remaining[uint64Size:]
 	rv.Dim = binary.LittleEndian.Uint32(remaining)
 	remaining = remaining[uint32Size:]
-	return rv, nil
+	rv.Deleted = rv.Dim&nodeDeleted != 0
+	rv.Dim &^= nodeDeleted
+	return nil
+}
+
+// isHole reports whether data is entirely zero. No valid node is, as every
+// point has at least one dimension.
+func isHole(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 func parseNodeFromReader(r io.Reader) (rv Node, maxDataLen int, err error) {
@@ -74,6 +189,16 @@ func parseNodeFromReader(r io.Reader) (rv Node, maxDataLen int, err error) {
 		return rv, 0, errClass.Wrap(err)
 	}
 
-	return rv, maxDataLen, errClass.Wrap(
-		binary.Read(r, binary.LittleEndian, &rv.Dim))
+	err = binary.Read(r, binary.LittleEndian, &rv.Count)
+	if err != nil {
+		return rv, 0, errClass.Wrap(err)
+	}
+
+	err = binary.Read(r, binary.LittleEndian, &rv.Dim)
+	if err != nil {
+		return rv, 0, errClass.Wrap(err)
+	}
+	rv.Deleted = rv.Dim&nodeDeleted != 0
+	rv.Dim &^= nodeDeleted
+	return rv, maxDataLen, nil
 }
@@ -0,0 +1,185 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// npyHeader is the part of a NumPy .npy file header LoadNPY uses.
+type npyHeader struct {
+	order    binary.ByteOrder
+	kind     byte // 'f' for floats, 'u' for bytes, 'S' or 'V' for strings
+	itemSize int
+	shape    []int
+}
+
+var (
+	npyDescr   = regexp.MustCompile(`'descr':\s*'([<>|=])([a-zA-Z])(\d+)'`)
+	npyFortran = regexp.MustCompile(`'fortran_order':\s*(True|False)`)
+	npyShape   = regexp.MustCompile(`'shape':\s*\(([^)]*)\)`)
+)
+
+// readNPYHeader reads the header of a .npy file from r, leaving r at the
+// start of the array.
+func readNPYHeader(r io.Reader) (h npyHeader, err error) {
+	var magic [8]byte
+	_, err = io.ReadFull(r, magic[:])
+	if err != nil {
+		return h, errClass.Wrap(err)
+	}
+	if !bytes.Equal(magic[:6], []byte("\x93NUMPY")) {
+		return h, errClass.New("not a .npy file")
+	}
+	var headerLen int
+	switch magic[6] {
+	case 1:
+		var n uint16
+		err = binary.Read(r, binary.LittleEndian, &n)
+		headerLen = int(n)
+	case 2, 3:
+		var n uint32
+		err = binary.Read(r, binary.LittleEndian, &n)
+		headerLen = int(n)
+	default:
+		return h, ErrVersion.New(".npy version %d", magic[6])
+	}
+	if err != nil {
+		return h, errClass.Wrap(err)
+	}
+	header := make([]byte, headerLen)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return h, errClass.Wrap(err)
+	}
+
+	descr := npyDescr.FindSubmatch(header)
+	fortran := npyFortran.FindSubmatch(header)
+	shape := npyShape.FindSubmatch(header)
+	if descr == nil || fortran == nil || shape == nil {
+		return h, errClass.New("invalid .npy header %q", header)
+	}
+	if string(fortran[1]) == "True" {
+		return h, ErrUnsupported.New(".npy arrays in Fortran order")
+	}
+	h.order = binary.LittleEndian
+	if descr[1][0] == '>' {
+		h.order = binary.BigEndian
+	}
+	h.kind = descr[2][0]
+	h.itemSize, _ = strconv.Atoi(string(descr[3]))
+	for _, dim := range strings.Split(string(shape[1]), ",") {
+		dim = strings.TrimSpace(dim)
+		if dim == "" {
+			continue
+		}
+		n, err := strconv.Atoi(dim)
+		if err != nil {
+			return h, errClass.New("invalid .npy shape %q", shape[1])
+		}
+		h.shape = append(h.shape, n)
+	}
+	return h, nil
+}
+
+// LoadNPY adds a point to pl for each row of the matrix in the NumPy .npy
+// file read from coords, which must have a column per dimension of float64
+// or float32 values, as written by numpy.save. data, if not nil, is a .npy
+// file holding the Data of each point in the same order: either an array
+// of fixed-length byte strings (dtype S or V), or a matrix of uint8
+// values with a row per point. Trailing zero bytes are dropped from S
+// strings, as NumPy does. It returns the number of points added.
+func (pl *PointSet) LoadNPY(coords, data io.Reader) (int64, error) {
+	cr := bufio.NewReader(coords)
+	ch, err := readNPYHeader(cr)
+	if err != nil {
+		return 0, err
+	}
+	if ch.kind != 'f' || (ch.itemSize != 8 && ch.itemSize != 4) {
+		return 0, ErrUnsupported.New("coordinates must be float64 or " +
+			"float32")
+	}
+	if len(ch.shape) != 2 || ch.shape[1] != pl.dims {
+		return 0, ErrDimensionMismatch.New("coordinates have shape %v, "+
+			"expected (n, %d)", ch.shape, pl.dims)
+	}
+	rows := ch.shape[0]
+
+	var dr *bufio.Reader
+	dataLen, trim := 0, false
+	if data != nil {
+		dr = bufio.NewReader(data)
+		dh, err := readNPYHeader(dr)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case (dh.kind == 'S' || dh.kind == 'V') && len(dh.shape) == 1:
+			dataLen, trim = dh.itemSize, dh.kind == 'S'
+		case dh.kind == 'u' && dh.itemSize == 1 && len(dh.shape) == 2:
+			dataLen = dh.shape[1]
+		default:
+			return 0, ErrUnsupported.New("Data must be byte strings or a " +
+				"uint8 matrix")
+		}
+		if dh.shape[0] != rows {
+			return 0, errClass.New("%d rows of Data for %d points",
+				dh.shape[0], rows)
+		}
+	}
+
+	row := make([]byte, ch.itemSize*pl.dims)
+	for i := 0; i < rows; i++ {
+		_, err = io.ReadFull(cr, row)
+		if err != nil {
+			return int64(i), errClass.Wrap(err)
+		}
+		p := Point{Pos: make([]float64, pl.dims)}
+		for j := range p.Pos {
+			if ch.itemSize == 8 {
+				p.Pos[j] = math.Float64frombits(ch.order.Uint64(row[8*j:]))
+			} else {
+				p.Pos[j] = float64(math.Float32frombits(
+					ch.order.Uint32(row[4*j:])))
+			}
+			if math.IsNaN(p.Pos[j]) || math.IsInf(p.Pos[j], 0) {
+				return int64(i), ErrNonFinite.New("row %d: coordinate %v", i,
+					p.Pos[j])
+			}
+		}
+		if dr != nil {
+			p.Data = make([]byte, dataLen)
+			_, err = io.ReadFull(dr, p.Data)
+			if err != nil {
+				return int64(i), errClass.Wrap(err)
+			}
+			if trim {
+				p.Data = bytes.TrimRight(p.Data, "\x00")
+			}
+		}
+		err = pl.Add(p)
+		if err != nil {
+			return int64(i), err
+		}
+	}
+	return int64(rows), nil
+}
@@ -0,0 +1,119 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// npyFile returns a version 1 .npy file holding body with the given dtype
+// and shape, as numpy.save writes.
+func npyFile(descr, shape string, body []byte) []byte {
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, "+
+		"'shape': %s, }", descr, shape)
+	for (10+len(header)+1)%64 != 0 {
+		header += " "
+	}
+	header += "\n"
+	var buf bytes.Buffer
+	buf.WriteString("\x93NUMPY\x01\x00")
+	binary.Write(&buf, binary.LittleEndian, uint16(len(header)))
+	buf.WriteString(header)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func TestLoadNPY(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	pos := [][]float64{{1, 2}, {3.5, -4}, {5, 6}}
+	var f64, f32be []byte
+	for _, row := range pos {
+		for _, v := range row {
+			f64 = binary.LittleEndian.AppendUint64(f64, math.Float64bits(v))
+			f32be = binary.BigEndian.AppendUint32(f32be,
+				math.Float32bits(float32(v)))
+		}
+	}
+	strings := []byte("ab\x00\x00abcd\x00\x00\x00\x00")
+	matrix := []byte{1, 0, 2, 0, 3, 0}
+
+	load := func(coords, data []byte) ([]Point, error) {
+		set, err := NewPointSet(fs.Temp(), 2, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var loaded int64
+		if data == nil {
+			loaded, err = set.LoadNPY(bytes.NewReader(coords), nil)
+		} else {
+			loaded, err = set.LoadNPY(bytes.NewReader(coords),
+				bytes.NewReader(data))
+		}
+		if err != nil {
+			set.Close()
+			return nil, err
+		}
+		if loaded != int64(len(pos)) {
+			t.Fatalf("loaded %d points, expected %d", loaded, len(pos))
+		}
+		return loadedPoints(t, fs, set), nil
+	}
+	expected := func(data ...string) []Point {
+		var points []Point
+		for i, row := range pos {
+			points = append(points, Point{Pos: row, Data: []byte(data[i])})
+		}
+		return points
+	}
+
+	for _, test := range []struct {
+		coords, data []byte
+		expected     []Point
+	}{
+		{npyFile("<f8", "(3, 2)", f64), nil, expected("", "", "")},
+		{npyFile(">f4", "(3, 2)", f32be), npyFile("|S4", "(3,)", strings),
+			expected("ab", "abcd", "")},
+		{npyFile("<f8", "(3, 2)", f64), npyFile("|u1", "(3, 2)", matrix),
+			expected("\x01\x00", "\x02\x00", "\x03\x00")},
+	} {
+		points, err := load(test.coords, test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !samePoints(points, test.expected) {
+			t.Fatalf("got %v, expected %v", points, test.expected)
+		}
+	}
+
+	_, err := load(npyFile("<f8", "(2, 3)", f64), nil)
+	if !ErrDimensionMismatch.Contains(err) {
+		t.Fatalf("expected a dimension mismatch, got %v", err)
+	}
+	_, err = load(npyFile("<i8", "(3, 2)", f64), nil)
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected unsupported coordinates, got %v", err)
+	}
+	_, err = load(npyFile("<f8", "(3, 2)", f64),
+		npyFile("|S4", "(2,)", strings[:8]))
+	if err == nil {
+		t.Fatal("expected an error for too few rows of Data")
+	}
+}
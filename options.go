@@ -0,0 +1,368 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"crypto/rand"
+	"log/slog"
+	"time"
+)
+
+// BuildOptions configures CreateTreeWithOptions. The zero value is the
+// behavior of CreateTree.
+type BuildOptions struct {
+	// GridResolution, if positive, has the build record a count of points per
+	// cell of a uniform grid with GridResolution cells along each dimension.
+	// See Tree.GridCounts.
+	GridResolution int
+	// MaxGridCells bounds the total number of grid cells (GridResolution to
+	// the power of the number of dimensions). Defaults to DefaultMaxGridCells.
+	MaxGridCells int
+	// Layout is the order nodes are written to the file in. Defaults to
+	// PreorderLayout.
+	Layout Layout
+	// PaddingFill fills the unused bytes after each point's Data in the tree
+	// file. Defaults to ZeroPadding.
+	PaddingFill PaddingFill
+	// TimeField, if set, records where a timestamp is stored in each point's
+	// Data, for use by Tree.NearestInTimeRange.
+	TimeField *TimeField
+	// TagField, if set, records where a bitmask of tags is stored in each
+	// point's Data, and adds a table of the tags in each subtree to the tree
+	// file, for use by Tree.NearestTagged.
+	TagField *TagField
+	// SplitStrategy is how each node's split point is chosen. Defaults to
+	// MedianSplit.
+	SplitStrategy SplitStrategy
+	// SplitDimension is how the dimension each node splits along is chosen.
+	// Defaults to CycleDimensions.
+	SplitDimension DimensionChoice
+	// Duplicates is what to do with duplicate points. Duplicates are dropped
+	// as the points are split, so this costs no extra memory or passes. The
+	// number dropped is the number of points added less the Count of the
+	// built tree. Defaults to KeepDuplicates.
+	Duplicates Duplicates
+	// Dedup, if set, is the same as Duplicates set to DropExactDuplicates.
+	//
+	// Deprecated: Use Duplicates.
+	Dedup bool
+	// VariableData, if set, stores each point's Data unpadded in a region
+	// after the nodes instead of padded to the max data length within its
+	// node, which saves space when Data lengths vary widely. Nodes keep a
+	// fixed size with a reference to their Data in its place, at the cost of
+	// a second read for each node visited. Nearest queries without a node
+	// cache skip that read for all but the points they return, so the Data
+	// of the other points visited never enters the page cache. Such trees
+	// can't be read by versions of this package that predate the option.
+	VariableData bool
+	// DataCompression, if set, compresses each point's Data on its own.
+	// Compressed Data is stored like VariableData, which it implies.
+	DataCompression Compression
+	// Checksums, if set, stores a CRC-32C checksum of each node and its Data,
+	// which are verified as they are read. A mismatch is reported with
+	// ErrChecksum. A node's subtree count and tombstone flag are rewritten in
+	// place by Delete and aren't covered.
+	Checksums bool
+	// Float32, if set, stores coordinates as float32s, halving their size.
+	// Coordinates are rounded to the nearest float32 as the tree is written,
+	// and queries see and return the rounded coordinates. Delete rounds the
+	// point it is given to match.
+	Float32 bool
+	// CoordinateCodec, if set, stores coordinates encoded by the codec, such
+	// as Quantized16, which stores each in two bytes relative to the tree's
+	// bounds. Like Float32, which it can't be combined with, queries see and
+	// return the decoded coordinates, and Delete encodes the point it is
+	// given to match. The codec must be registered to open the tree; see
+	// RegisterCoordinateCodec.
+	CoordinateCodec CoordinateCodec
+	// Normalize, if set, standardizes each dimension of the points by its
+	// mean and standard deviation before building, in an extra two passes
+	// over them, and records the Normalization in the tree file, so that
+	// queries can be normalized the same way with Tree.Normalization or
+	// NewTransformedTree rather than with hand-kept constants. It can't be
+	// used with CheckpointDir. Stores, CappedTrees, Timelines and in-memory
+	// trees, which would normalize each of their trees differently or not at
+	// all, report it with ErrUnsupported.
+	Normalize bool
+	// Normalization, if set, records a Normalization the points were
+	// already normalized by, such as when rebuilding a normalized tree. It
+	// can't be combined with Normalize.
+	Normalization *Normalization
+	// generation is the generation of the tree being built. Rebuilds set it
+	// to one past the generation of the tree they replace.
+	generation uint32
+	// Boxes, if set, stores the bounding box of each node's subtree in a
+	// table after the nodes. Searches read a subtree's box before the
+	// subtree and skip it if the box is out of reach, which prunes far more
+	// than the splits alone when points are clustered, at the cost of an
+	// extra small read per node visited. Boxes aren't covered by Checksums,
+	// and aren't shrunk by deletions.
+	Boxes bool
+	// LeafSize, if positive, has Nearest searches read any subtree of at
+	// most LeafSize points in a single read, as a bucket, and search it in
+	// memory, rather than reading its nodes one at a time. With the preorder
+	// layout every subtree is already stored contiguously, so the tree file
+	// is unchanged but for recording LeafSize, and stays readable by earlier
+	// versions of this package. This trades reading somewhat more of the
+	// file for about log2(LeafSize) fewer random reads per search. Values
+	// around the number of nodes in a disk block or two work well. LeafSize
+	// requires PreorderLayout.
+	LeafSize int
+	// Mirrors, if set, are further copies of the finished tree for the build
+	// to write, such as to an object store, from a single read of the tree
+	// file. Each copy is checked as Tree.CopyTo checks its copy, by reading
+	// it back unless its Backend is a SumBackend. If any copy fails, the
+	// copies are removed and the build fails, leaving no tree at its path.
+	Mirrors []Mirror
+	// PositionIndex, if set, is a path the build also writes a
+	// positions-only index of the tree to once the tree is complete, for
+	// services that load the positions into memory with LoadPositionIndex
+	// and read only the Data of results from the tree file. See
+	// Tree.WritePositionIndex.
+	PositionIndex string
+	// Progress, if set, is called from time to time during the build with
+	// how much of the work is done out of a total, both in points: a pass
+	// splitting the points into nodes, which takes most of the time, and a
+	// pass writing out the nodes. It is called once more with done equal to
+	// total when the tree is complete.
+	Progress func(done, total int64)
+	// MaxScratchBytes, if positive, bounds the space the build uses in its
+	// temporary directory, which otherwise peaks at about twice the size of
+	// the points plus twice the size of the tree. If the intermediate copies
+	// of the tree don't fit, they are kept in a temporary directory next to
+	// the tree's destination instead. If the points split during the build
+	// don't fit either, the build fails. Points spooled from a channel or
+	// iterator before the build starts aren't counted.
+	MaxScratchBytes int64
+	// MaxMemoryBytes, if positive, is how many bytes of points BuildTree and
+	// CreateTreeFromChan hold in memory, by the size of their stored form,
+	// before spilling them to a temporary file. If every point fits, the tree
+	// is built in memory as by CreateTreeInMemory and written straight to its
+	// destination, unless the other options need a build on disk. Other
+	// builds ignore it.
+	MaxMemoryBytes int64
+	// Sync is when the build syncs the tree file to stable storage. Defaults
+	// to SyncOnFinish.
+	Sync SyncPolicy
+	// SyncBytes is how many bytes SyncPeriodic writes to the tree file
+	// between syncs.
+	SyncBytes int64
+	// DirectIO, if set, reads and writes the points the build splits up and
+	// the first copy of the tree it writes with direct I/O (O_DIRECT), which
+	// bypasses the page cache, so that a large build doesn't evict pages
+	// other processes depend on. These account for most of a build's I/O;
+	// the tree file itself and any intermediate copies of it go through the
+	// page cache as usual. Where direct I/O isn't supported, by the platform
+	// or the file system holding the temporary files, the files are read
+	// and written normally.
+	DirectIO bool
+	// Metrics, if set, is told how many bytes the build writes.
+	Metrics Metrics
+	// Logger, if set, is told when the build starts, finishes or fails, at
+	// the Info and Error levels, and how long each of its phases takes, at
+	// the Debug level.
+	Logger *slog.Logger
+	// CheckpointDir, if set, is where the build keeps its scratch files,
+	// instead of a new directory under tmpdir, along with a checkpoint of its
+	// progress saved every CheckpointInterval as the points are split. If
+	// the build fails or the process dies, building the same points with the
+	// same options again resumes from the last checkpoint instead of
+	// starting over, for all but the points, which must be added to a new
+	// PointSet again in the same order. A build of any other points fails
+	// rather than resuming. The directory is removed once the build
+	// succeeds.
+	// Split point files are kept until the checkpoint after they are used,
+	// so scratch space can exceed MaxScratchBytes. CheckpointDir can't be
+	// used with DirectIO.
+	CheckpointDir string
+	// CheckpointInterval is how often a build with CheckpointDir saves its
+	// progress. Defaults to DefaultCheckpointInterval.
+	CheckpointInterval time.Duration
+}
+
+// Compression is a way of compressing point Data.
+type Compression int
+
+const (
+	// NoCompression stores Data as is. It is the default.
+	NoCompression Compression = iota
+	// FlateCompression compresses Data with DEFLATE, from compress/flate.
+	FlateCompression
+)
+
+// Duplicates is a policy for points added to a build more than once.
+type Duplicates int
+
+const (
+	// KeepDuplicates stores every point added. It is the default.
+	KeepDuplicates Duplicates = iota
+	// DropExactDuplicates stores only one copy of points with equal Pos and
+	// Data.
+	DropExactDuplicates
+	// ReplaceByData stores only one point per Pos, with the Data of the
+	// point added last, so later points replace earlier ones.
+	ReplaceByData
+)
+
+// SyncPolicy is when a build syncs the tree file it writes to stable
+// storage. Temporary files are never synced.
+type SyncPolicy int
+
+const (
+	// SyncOnFinish syncs the tree file and then the directory it is renamed
+	// into once the tree is complete, so a tree that has been returned
+	// survives a crash. It is the default.
+	SyncOnFinish SyncPolicy = iota
+	// SyncNever leaves writing the tree back to the operating system. A
+	// crash soon after a build can leave a missing or truncated tree file,
+	// which fails to open. Use it where storage is battery-backed or the
+	// tree can be rebuilt.
+	SyncNever
+	// SyncPeriodic syncs the tree file every SyncBytes bytes as it is
+	// written, as well as like SyncOnFinish, so that dirty pages are written
+	// back steadily rather than all at once at the end of a large build.
+	SyncPeriodic
+)
+
+// PaddingFill fills pad, the padding after a point's Data. Readers ignore
+// padding, so this only changes the bytes written, e.g. so that encrypted
+// files don't compress to reveal their structure.
+type PaddingFill func(pad []byte) error
+
+// ZeroPadding leaves padding zeroed.
+func ZeroPadding(pad []byte) error {
+	for i := range pad {
+		pad[i] = 0
+	}
+	return nil
+}
+
+// RandomPadding fills padding from crypto/rand.
+func RandomPadding(pad []byte) error {
+	_, err := rand.Read(pad)
+	return err
+}
+
+// FixedPadding returns a PaddingFill that sets every padding byte to b.
+func FixedPadding(b byte) PaddingFill {
+	return func(pad []byte) error {
+		for i := range pad {
+			pad[i] = b
+		}
+		return nil
+	}
+}
+
+// BatchDistance returns the squared Euclidean distance from query to each of
+// positions, in order.
+type BatchDistance func(query []float64, positions [][]float64) []float64
+
+// OpenOptions configures OpenTreeWithOptions. The zero value is the behavior
+// of OpenTree.
+type OpenOptions struct {
+	// BatchDistance, if set, replaces the built-in distance computation for
+	// scans over many points, such as NearestExhaustive, which then compute
+	// distances a batch of points at a time. This lets the hot inner loop be
+	// offloaded, e.g. to a GPU. The pruning math of tree searches is
+	// unaffected.
+	BatchDistance BatchDistance
+	// QueryConcurrency, if positive, has Nearest explore both sides of the
+	// top QueryConcurrency levels of the tree concurrently, using up to
+	// 2^QueryConcurrency goroutines per query. This can lower the latency of
+	// an individual query over a large, cold tree, but costs throughput.
+	QueryConcurrency int
+	// SkipHoles, if set, has nodes that read back as all zeroes, such as
+	// hole-punched regions of a sparse file, treated as deleted points with
+	// no children, so queries miss the hole and everything beneath it rather
+	// than failing. Otherwise such nodes are reported with ErrHole.
+	SkipHoles bool
+	// Mmap, if set, maps the tree file into memory and reads nodes from the
+	// mapping, saving a system call per node visited. Where mapping files
+	// isn't supported, the tree is read through the file as usual.
+	Mmap bool
+	// CacheBytes, if positive, keeps up to CacheBytes of recently read nodes
+	// parsed in memory, by their size in the file, so that queries that keep
+	// visiting the top of the tree don't read and parse it again. The points
+	// of cached nodes are shared between queries, so points returned by
+	// queries must not be modified. See Tree.CacheStats.
+	CacheBytes int64
+	// SyncWrites, if set, has Insert, Delete and DeleteFunc on a tree opened
+	// with OpenRWWithOptions sync their changes to stable storage before
+	// returning, so that they survive a crash without calls to Sync.
+	SyncWrites bool
+	// Prefetch, if positive, has Prefetch background goroutines read the far
+	// child of each node a search passes through while the search explores
+	// the near side, so that if the search comes back for the far side it
+	// doesn't wait on the disk. This hides latency for deep trees on slow
+	// storage at the cost of reading nodes that turn out not to be needed.
+	// Prefetched nodes are kept in the node cache if CacheBytes is set.
+	Prefetch int
+	// PinLevels, if positive, reads the top PinLevels levels of the tree into
+	// memory when it is opened and keeps them there, so searches only go to
+	// the file below them. The top 20 levels of a tree are about a million
+	// nodes, which pins the part of the tree every query passes through at a
+	// small fraction of the memory of the whole tree. Pinned nodes don't count
+	// against CacheBytes. See Tree.PinnedNodes.
+	PinLevels int
+	// Dims, if positive, is the number of dimensions the tree is expected to
+	// have. Opening a tree with a different number, which is recorded in its
+	// footer, fails with ErrDimensionMismatch rather than leaving the mistake
+	// to be found by the first query.
+	Dims int
+	// Metrics, if set, is told about the tree's queries, file reads and node
+	// cache lookups as they happen.
+	Metrics Metrics
+	// Logger, if set, is told about rebuilds by Compact, Merge and Maintain,
+	// including their build phases, at the Info level, evictions from the
+	// node cache at the Debug level, and queries slower than SlowQuery at
+	// the Warn level.
+	Logger *slog.Logger
+	// SlowQuery, if positive, is the latency at or above which a query is
+	// logged to Logger.
+	SlowQuery time.Duration
+	// MaxDataLen, if positive, is the max data length the tree is expected to
+	// have been built with. Opening a tree with a different one fails with
+	// ErrDataLenMismatch. Both errors describe the parameters the tree was
+	// actually built with.
+	MaxDataLen int
+	// MaxQueryBytes, if positive, caps the memory a single query may
+	// allocate for its results and its queue of nodes to visit. Queries for
+	// a number of results, such as Nearest, check up front that that many
+	// of the largest points the tree can hold would fit, and queries that
+	// collect every match, such as Within, and NearestIter fail as soon as
+	// they go over. Either way the query fails with ErrQueryTooLarge.
+	// Queries that pass each result to a function, such as WithinFunc and
+	// Range, only hold one at a time and aren't limited.
+	MaxQueryBytes int64
+}
+
+// RebuildOptions configures Tree.CompactWithOptions.
+type RebuildOptions struct {
+	// TmpDir is where the rebuild keeps its temporary files.
+	TmpDir string
+	// BytesPerSecond, if positive, limits how fast the rebuild reads the
+	// tree, and roughly how fast it builds the new one, counting a node's
+	// worth of bytes per point the build handles, so that it leaves disk
+	// bandwidth for the work it shares the disk with.
+	BytesPerSecond int64
+	// Busy, if set, is polled as the rebuild goes, and whenever it reports
+	// foreground work, such as queries in flight on other trees on the same
+	// disk, the rebuild pauses for YieldInterval and polls again, so that it
+	// only takes the disk while the foreground work is idle.
+	Busy func() bool
+	// YieldInterval is how long the rebuild pauses each time Busy reports
+	// foreground work. Defaults to DefaultYieldInterval.
+	YieldInterval time.Duration
+}
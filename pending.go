@@ -0,0 +1,388 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// pendingSuffix names the log of points inserted into a tree since it was
+// built, which sits next to the tree file.
+const pendingSuffix = ".pending"
+
+// pendingHeader tags the record that starts a pending log, which holds the
+// generation of the tree the log belongs to. Logs written before it was
+// added have no header, and belong to generation zero.
+const pendingHeader = 0xfe
+
+// pendingLog holds points inserted into a tree but not yet merged into it.
+// The points are kept in memory and in an append-only log of serialized
+// points, so they survive reopening the tree. The log also records the
+// in-place writes of deletes and updates before they are made. See
+// Tree.commit.
+type pendingLog struct {
+	mu         sync.RWMutex
+	path       string
+	generation uint32
+	points     []Point
+	// writes is the last batch of in-place writes in the log as it was
+	// opened, for Tree.replay.
+	writes writeBatch
+	// size is the length of the valid prefix of the log file.
+	size int64
+	fh   *os.File
+}
+
+// openPendingLog loads the pending log at path, if there is one. A torn
+// record at the end of the log, as a crash mid-append would leave, is
+// ignored, and cut off before the next append. A log that belongs to a
+// generation of the tree other than generation was merged into it by a
+// rebuild that didn't get to remove it, so it is ignored too, and replaced by
+// the next append.
+func openPendingLog(path string, dims int, generation uint32) (*pendingLog,
+	error) {
+	l := &pendingLog{path: path, generation: generation}
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	defer fh.Close()
+	br := bufio.NewReader(fh)
+	r := &wrappedReader{r: br}
+	for {
+		tag, err := br.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errClass.Wrap(err)
+		}
+		if tag[0] == pendingHeader && r.pos == 0 {
+			var header [1 + uint32Size]byte
+			_, err = io.ReadFull(r, header[:])
+			if err != nil {
+				break
+			}
+			if binary.LittleEndian.Uint32(header[1:]) != generation {
+				break
+			}
+			l.size = r.pos
+			continue
+		}
+		if r.pos == 0 && generation != 0 {
+			break
+		}
+		if tag[0] == pendingWrites {
+			b, err := readWriteBatch(r)
+			if err == io.ErrUnexpectedEOF {
+				break
+			}
+			if ErrCorrupt.Contains(err) {
+				// only the last record can be torn
+				if _, perr := br.Peek(1); perr == io.EOF {
+					break
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			l.writes = b
+			l.size = r.pos
+			continue
+		}
+		p, _, err := parsePointFromReader(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(p.Pos) != dims {
+			return nil, ErrCorrupt.New("pending point has %d dimensions, "+
+				"expected %d", len(p.Pos), dims)
+		}
+		l.points = append(l.points, p)
+		l.size = r.pos
+	}
+	return l, nil
+}
+
+// snapshot returns the pending points. The caller must not modify them.
+func (l *pendingLog) snapshot() []Point {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.points[:len(l.points):len(l.points)]
+}
+
+func (l *pendingLog) len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.points)
+}
+
+// append logs p as pending, unless there are already room pending points.
+func (l *pendingLog) append(p Point, maxDataLen int, room int64) error {
+	var buf bytes.Buffer
+	err := p.serialize(&buf, maxDataLen, nil)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if int64(len(l.points)) >= room {
+		return ErrTooManyPoints.New("tree already holds %d points",
+			int64(maxPoints))
+	}
+	err = l.write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	l.points = append(l.points, Point{
+		Pos:  append([]float64(nil), p.Pos...),
+		Data: append([]byte(nil), p.Data...)})
+	return nil
+}
+
+// appendWrites logs b, the in-place writes of a change about to be made to
+// the tree.
+func (l *pendingLog) appendWrites(b writeBatch) error {
+	record := b.encode()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.write(record)
+}
+
+// write appends record to the log file, opening it if need be, and starting
+// it with a header if it is empty. l.mu must be held.
+func (l *pendingLog) write(record []byte) error {
+	if l.size == 0 {
+		header := make([]byte, 1+uint32Size, 1+uint32Size+len(record))
+		header[0] = pendingHeader
+		binary.LittleEndian.PutUint32(header[1:], l.generation)
+		record = append(header, record...)
+	}
+	if l.fh == nil {
+		fh, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+		err = fh.Truncate(l.size)
+		if err != nil {
+			fh.Close()
+			return errClass.Wrap(err)
+		}
+		l.fh = fh
+	}
+	_, err := l.fh.WriteAt(record, l.size)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	l.size += int64(len(record))
+	return nil
+}
+
+func (l *pendingLog) sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.fh == nil {
+		return nil
+	}
+	return errClass.Wrap(l.fh.Sync())
+}
+
+func (l *pendingLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fh == nil {
+		return nil
+	}
+	err := l.fh.Close()
+	l.fh = nil
+	return errClass.Wrap(err)
+}
+
+// pendingOffset is the stand-in node offset of the ith pending point. It is
+// below -1 so that it can't be mistaken for a node or for no node.
+func pendingOffset(i int) int64 { return -2 - int64(i) }
+
+// Insert adds p to a tree opened with OpenRW. Rather than changing the tree,
+// p is appended to a log next to the tree file and searched alongside it, so
+// inserts are cheap but every query scans every pending point. Call Merge
+// from time to time to fold pending points into the tree proper. The log is
+// replayed when the tree is reopened. Use Sync to make inserts durable, or
+// OpenOptions.SyncWrites. Inserted points can't be deleted until merged.
+func (t *Tree) Insert(p Point) error {
+	if !t.writable {
+		return errClass.New("tree not opened for writing")
+	}
+	err := t.checkDims(p)
+	if err != nil {
+		return err
+	}
+	err = t.pending.append(p, t.footer.maxDataLen, maxPoints-t.count)
+	if err != nil || !t.opts.SyncWrites {
+		return err
+	}
+	return t.pending.sync()
+}
+
+// Pending returns the number of points inserted but not yet merged.
+func (t *Tree) Pending() int { return t.pending.len() }
+
+// Merge rebuilds the tree to include every pending point. It is the same
+// rebuild as Compact, so deleted points are dropped as well, and
+// CompactWithOptions makes it at a limited rate.
+func (t *Tree) Merge(tmpdir string) error {
+	if !t.writable {
+		return errClass.New("tree not opened for writing")
+	}
+	return t.rebuild(context.Background(), tmpdir, nil)
+}
+
+// rebuild replaces the tree file with a fresh build of its live points,
+// reading them as fast as th allows.
+func (t *Tree) rebuild(ctx context.Context, tmpdir string,
+	th *throttle) error {
+	l := t.opts.Logger
+	if l == nil {
+		return t.rebuildTree(ctx, tmpdir, th)
+	}
+	start := time.Now()
+	l.Info("dkdtree: rebuild started", "path", t.path, "points", t.count,
+		"pending", t.pending.len())
+	err := t.rebuildTree(ctx, tmpdir, th)
+	if err != nil {
+		l.Error("dkdtree: rebuild failed", "path", t.path,
+			"duration", time.Since(start), "error", err)
+		return err
+	}
+	l.Info("dkdtree: rebuild finished", "path", t.path, "points", t.count,
+		"duration", time.Since(start))
+	return nil
+}
+
+// rebuildTree is rebuild, without the logging.
+func (t *Tree) rebuildTree(ctx context.Context, tmpdir string,
+	th *throttle) error {
+	fs, err := newBaseFS(tempName(tmpdir))
+	if err != nil {
+		return err
+	}
+	defer fs.Delete()
+
+	set, err := newPointSet(fs.Temp(), t.footer.dims, t.footer.maxDataLen,
+		true)
+	if err != nil {
+		return err
+	}
+	defer set.Close()
+	err = t.Each(func(p Point) error {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		err = th.wait(ctx, t.nodelen)
+		if err != nil {
+			return err
+		}
+		return set.Add(p)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the new tree is built beside the old one and only renamed over it
+	// once the old one is closed, since Windows can't replace an open file.
+	rebuilt := tempName(filepath.Dir(t.path))
+	opts := t.footer.buildOptions()
+	opts.Logger = t.opts.Logger
+	// a new generation, so the IDs of the old one don't name the
+	// renumbered points
+	opts.generation = (t.footer.generation + 1) & maxGeneration
+	if th != nil {
+		// the build reports progress a point at a time, twice over
+		var last int64
+		opts.Progress = func(done, total int64) {
+			th.wait(ctx, (done-last)*t.nodelen)
+			last = done
+		}
+	}
+	built, err := CreateTreeContext(ctx, rebuilt, tmpdir, set, opts)
+	if err != nil {
+		return err
+	}
+	err = built.Close()
+	if err != nil {
+		os.Remove(rebuilt)
+		return err
+	}
+
+	err = t.pending.close()
+	if err != nil {
+		os.Remove(rebuilt)
+		return err
+	}
+	t.prefetch.stop()
+	t.mapping.unmap()
+	t.fh.Close()
+	err = os.Rename(rebuilt, t.path)
+	if err != nil {
+		os.Remove(rebuilt)
+		// the old tree and its pending points are still intact
+		if rerr := t.reopen(); rerr != nil {
+			return rerr
+		}
+		return errClass.Wrap(err)
+	}
+	syncDir(filepath.Dir(t.path))
+
+	// the pending points are in the new tree now. The rename is all it
+	// takes to switch to it: the log belongs to the old generation, so the
+	// new tree ignores it even if it can't be removed, or the process dies
+	// first.
+	os.Remove(t.pending.path)
+	return t.reopen()
+}
+
+// reopen replaces t's file handles, caches and pending points with a fresh
+// open of the tree file, after rebuild has closed the old ones.
+func (t *Tree) reopen() error {
+	fh, err := os.OpenFile(t.path, os.O_RDWR, 0)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	nt, err := openTree(t.path, fh, true, t.opts)
+	if err != nil {
+		return err
+	}
+	t.r, t.fh, t.mapping, t.cache = nt.r, nt.fh, nt.mapping, nt.cache
+	t.pinned = nt.pinned
+	t.root, t.count, t.nodelen, t.footer = nt.root, nt.count, nt.nodelen,
+		nt.footer
+	t.pending = nt.pending
+	t.prefetch = nt.prefetch
+	return nil
+}
@@ -0,0 +1,284 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInsert(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(300, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points[:200], BuildOptions{})
+	err := tree.Insert(points[200])
+	if err == nil {
+		t.Fatal("expected read-only tree to refuse inserts")
+	}
+	tree.Close()
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	for _, p := range points[200:] {
+		err = rw.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = rw.Delete(points[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	// Count includes deleted points until the tree is rebuilt.
+	check := func(tr *Tree, count int64) {
+		if tr.Count() != count {
+			t.Fatalf("expected %d points, got %d", count, tr.Count())
+		}
+		seen := 0
+		err := tr.Each(func(Point) error { seen++; return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen != 299 {
+			t.Fatalf("expected to see 299 points, saw %d", seen)
+		}
+		for _, p := range points[1:] {
+			nearest, err := tr.Nearest(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nearest) != 1 || !nearest[0].Point.equal(&p) {
+				t.Fatal("point not found")
+			}
+			exhaustive, err := tr.NearestExhaustive(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exhaustive[0].Point.equal(&p) {
+				t.Fatal("point not found exhaustively")
+			}
+			count, err := tr.CountWithin(p, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 1 {
+				t.Fatalf("expected 1 point within 0, got %d", count)
+			}
+		}
+		it := tr.NearestIter(points[250])
+		pd, ok, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || !pd.Point.equal(&points[250]) {
+			t.Fatal("iterator missed inserted point")
+		}
+	}
+
+	check(rw, 300)
+	check(reopened, 300)
+	if rw.Pending() != 100 || reopened.Pending() != 100 {
+		t.Fatal("expected 100 pending points")
+	}
+
+	before, err := os.ReadDir(filepath.Dir(tree.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.Merge(fs.Temp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.ReadDir(filepath.Dir(tree.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, e := range before {
+		names[e.Name()] = true
+	}
+	for _, e := range after {
+		if !names[e.Name()] {
+			t.Fatalf("merge left %s behind", e.Name())
+		}
+	}
+	if rw.Pending() != 0 {
+		t.Fatalf("expected no pending points after merge, got %d",
+			rw.Pending())
+	}
+	check(rw, 299)
+
+	merged, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merged.Close()
+	if merged.Pending() != 0 {
+		t.Fatal("pending log survived merge")
+	}
+	check(merged, 299)
+}
+
+func TestSyncWrites(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(150, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points[:100], BuildOptions{})
+	tree.Close()
+
+	rw, err := OpenRWWithOptions(tree.path, OpenOptions{SyncWrites: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	for _, p := range points[100:] {
+		err = rw.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = rw.Delete(points[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without closing or syncing rw, as after a crash
+	reopened, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Pending() != 50 {
+		t.Fatalf("got %d pending points, expected 50", reopened.Pending())
+	}
+	nearest, err := reopened.Nearest(points[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nearest[0].Point.equal(&points[0]) {
+		t.Fatal("deleted point found")
+	}
+}
+
+func TestMergeInterrupted(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(150, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points[:100], BuildOptions{})
+	tree.Close()
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	for _, p := range points[100:] {
+		err = rw.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = rw.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := os.ReadFile(rw.pending.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.Merge(fs.Temp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.Close()
+
+	// put the merged log back, as if the process died after the new tree
+	// was renamed into place but before the log was removed
+	err = os.WriteFile(tree.path+pendingSuffix, log, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, err = OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw.Count() != 150 || rw.Pending() != 0 {
+		t.Fatalf("got %d points, %d pending, expected 150 and none",
+			rw.Count(), rw.Pending())
+	}
+	err = rw.Insert(points[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.Close()
+
+	reopened, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Count() != 151 || reopened.Pending() != 1 {
+		t.Fatalf("got %d points, %d pending, expected 151 and 1",
+			reopened.Count(), reopened.Pending())
+	}
+}
+
+func TestPendingLogWithoutHeader(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(101, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points[:100], BuildOptions{})
+	tree.Close()
+
+	// logs written before they had headers are just points
+	var log bytes.Buffer
+	err := points[100].serialize(&log, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(tree.path+pendingSuffix, log.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Pending() != 1 {
+		t.Fatalf("got %d pending points, expected 1", reopened.Pending())
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"sync/atomic"
+)
+
+// pinnedNodes holds the nodes of the top levels of a tree, read when the
+// tree is opened and kept for as long as it is open. See
+// OpenOptions.PinLevels. The set of offsets never changes, but a node is
+// replaced when Delete rewrites it, so each is held in an atomic.Value to
+// keep concurrent queries safe.
+type pinnedNodes map[int64]*atomic.Value
+
+// pinLevels reads the top levels of t, breadth first from the root.
+func (t *Tree) pinLevels(levels int) (pinnedNodes, error) {
+	pinned := pinnedNodes{}
+	level := []int64{t.root}
+	for i := 0; i < levels && len(level) > 0; i++ {
+		var next []int64
+		for _, offset := range level {
+			if offset == -1 {
+				continue
+			}
+			n, err := t.readNode(offset)
+			if err != nil {
+				return nil, err
+			}
+			v := new(atomic.Value)
+			v.Store(n)
+			pinned[offset] = v
+			next = append(next, n.Left, n.Right)
+		}
+		level = next
+	}
+	return pinned, nil
+}
+
+// get returns the pinned node at offset, if it is pinned.
+func (p pinnedNodes) get(offset int64) (Node, bool) {
+	v, ok := p[offset]
+	if !ok {
+		return Node{}, false
+	}
+	return v.Load().(Node), true
+}
+
+// refresh rereads the node at offset if it is pinned, after it changes on
+// disk.
+func (t *Tree) refreshPinned(offset int64) error {
+	v, ok := t.pinned[offset]
+	if !ok {
+		return nil
+	}
+	n, err := t.readNode(offset)
+	if err != nil {
+		return err
+	}
+	v.Store(n)
+	return nil
+}
+
+// PinnedNodes returns how many nodes are pinned in memory. See
+// OpenOptions.PinLevels.
+func (t *Tree) PinnedNodes() int { return len(t.pinned) }
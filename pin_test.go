@@ -0,0 +1,81 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"testing"
+)
+
+func TestPinLevels(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	pinned, err := OpenTreeWithOptions(tree.path, OpenOptions{PinLevels: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pinned.Close()
+	if pinned.PinnedNodes() != 15 {
+		t.Fatalf("pinned %d nodes, expected 15", pinned.PinnedNodes())
+	}
+	for i := 0; i < 20; i++ {
+		q := NewPoint(3, 10)
+		expected, err := tree.Nearest(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := pinned.Nearest(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range expected {
+			if actual[j].Distance != expected[j].Distance {
+				t.Fatalf("result %d differs from the unpinned tree", j)
+			}
+		}
+	}
+
+	rw, err := OpenRWWithOptions(tree.path, OpenOptions{PinLevels: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	root, err := rw.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.Delete(root.Point)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err = rw.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Deleted || root.Count != int64(len(points))-1 {
+		t.Fatal("pinned root wasn't updated by Delete")
+	}
+	nearest, err := rw.Nearest(root.Point, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nearest[0].Point.equal(&root.Point) {
+		t.Fatal("found the deleted root")
+	}
+}
@@ -17,9 +17,9 @@ package dkdtree
 import (
 	"bufio"
 	"io"
-	"math/rand"
 	"os"
 	"sort"
+	"sync"
 
 	"github.com/spacemonkeygo/errors"
 )
@@ -28,29 +28,73 @@ const (
 	samplingSize = 100
 )
 
+// sampleRand picks the points a PointSet samples. Every set starts from the
+// same seed rather than from a shared random source, so that the same points
+// added in the same order are always sampled the same way, and so split the
+// same way, and builds of the same input with the same options write
+// byte-identical tree files.
+type sampleRand uint64
+
+const sampleSeed sampleRand = 0x9e3779b97f4a7c15
+
+// int63n returns a number from 0 up to n, by splitmix64.
+func (r *sampleRand) int63n(n int64) int64 {
+	*r += 0x9e3779b97f4a7c15
+	z := uint64(*r)
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return int64(z % uint64(n))
+}
+
 type PointSet struct {
-	fh               *os.File
+	mu               sync.Mutex
+	fh               io.WriteCloser
 	buf              *bufio.Writer
 	dims, maxDataLen int
 	count            int64
 	reservoir        []Point
+	rng              sampleRand
+	min, max         []float64
 	deleteOnClose    bool
 	deleted          bool
 	path             string
+	// direct is set if the set's file is read and written with direct I/O.
+	direct bool
+	// unsorted[d] is set once a point is added below the one before it along
+	// dimension d, and last is the position of the point added last.
+	unsorted []bool
+	last     []float64
+	// start is where the set's points begin in its file. It is only nonzero
+	// for views of another set's points, made by splitSorted, whose file is
+	// owned by owner.
+	start int64
+	owner *PointSet
 }
 
 func newPointSet(path string, dims, maxDataLen int, deleteOnClose bool) (
 	*PointSet, error) {
-	fh, err := os.Create(path)
+	return newPointSetFile(path, dims, maxDataLen, deleteOnClose, false)
+}
+
+func newPointSetFile(path string, dims, maxDataLen int, deleteOnClose,
+	direct bool) (*PointSet, error) {
+	err := checkNodeSize(int64(dims), int64(maxDataLen))
+	if err != nil {
+		return nil, err
+	}
+	fh, err := createFile(path, direct)
 	if err != nil {
 		return nil, errClass.Wrap(err)
 	}
 	return &PointSet{
+		direct:        direct,
 		fh:            fh,
 		buf:           bufio.NewWriter(fh),
 		dims:          dims,
 		maxDataLen:    maxDataLen,
 		reservoir:     make([]Point, 0, samplingSize),
+		rng:           sampleSeed,
 		deleteOnClose: deleteOnClose,
 		path:          path,
 	}, nil
@@ -60,6 +104,95 @@ func NewPointSet(path string, dims, maxDataLen int) (*PointSet, error) {
 	return newPointSet(path, dims, maxDataLen, false)
 }
 
+// openPointSet opens count points already written to the file at path from
+// byte start on, such as a split point file named by a build checkpoint, to
+// be split. No more can be added.
+func openPointSet(path string, start, count int64, dims, maxDataLen int) (
+	*PointSet, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	defer fh.Close()
+	pl := &PointSet{
+		dims:       dims,
+		maxDataLen: maxDataLen,
+		reservoir:  make([]Point, 0, samplingSize),
+		rng:        sampleSeed,
+		path:       path,
+		start:      start,
+	}
+	size := int64(pointSize(dims, maxDataLen))
+	r := bufio.NewReader(io.NewSectionReader(fh, start, count*size))
+	for i := int64(0); i < count; i++ {
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, ErrCorrupt.New("truncated point file %#v", path)
+		}
+		p, _, err := parsePoint(data)
+		if err != nil {
+			return nil, err
+		}
+		pl.note(p)
+	}
+	return pl, nil
+}
+
+// each calls fn with every point in the set, in the order they were added.
+// The set must be closed for writing, as with closeNoDel.
+func (pl *PointSet) each(fn func(Point) error) error {
+	fh, err := openFile(pl.path, pl.direct)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer fh.Close()
+	if pl.start > 0 {
+		// views are never read with direct I/O, so fh can seek
+		_, err = fh.(io.Seeker).Seek(pl.start, io.SeekStart)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	r := bufio.NewReader(fh)
+	size := pointSize(pl.dims, pl.maxDataLen)
+	for i := int64(0); i < pl.count; i++ {
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return ErrCorrupt.New("truncated point file %#v", pl.path)
+		}
+		p, _, err := parsePoint(data)
+		if err != nil {
+			return err
+		}
+		err = fn(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sync writes out the set's buffered points and syncs its file, leaving the
+// set open.
+func (pl *PointSet) sync() error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.buf != nil {
+		err := pl.buf.Flush()
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	fh, err := os.Open(pl.path)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer fh.Close()
+	return errClass.Wrap(fh.Sync())
+}
+
 func (pl *PointSet) closeNoDel() error {
 	var errs errors.ErrorGroup
 	if pl.buf != nil {
@@ -83,6 +216,8 @@ func (pl *PointSet) del() error {
 }
 
 func (pl *PointSet) Close() error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
 	var errs errors.ErrorGroup
 	errs.Add(pl.closeNoDel())
 	if pl.deleteOnClose {
@@ -91,53 +226,112 @@ func (pl *PointSet) Close() error {
 	return errs.Finalize()
 }
 
+// Add appends p to the set. It is safe to call Add from many goroutines at
+// once, so producers can share a set rather than funnel their points through
+// one goroutine. Points added concurrently are stored in no particular order
+// relative to each other, which only matters for ReplaceByData.
 func (pl *PointSet) Add(p Point) error {
 	if len(p.Pos) != pl.dims {
-		return errClass.New("point has wrong dimension: %d, expected %d",
+		return ErrDimensionMismatch.New("point has wrong dimension: %d, expected %d",
 			len(p.Pos), pl.dims)
 	}
-	err := p.serialize(pl.buf, pl.maxDataLen)
+	err := checkFinite(p.Pos)
 	if err != nil {
 		return err
 	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	err = p.serialize(pl.buf, pl.maxDataLen, nil)
+	if err != nil {
+		return err
+	}
+	pl.note(p)
+	if pl.min == nil {
+		pl.min = append([]float64(nil), p.Pos...)
+		pl.max = append([]float64(nil), p.Pos...)
+	}
+	for i, v := range p.Pos {
+		if v < pl.min[i] {
+			pl.min[i] = v
+		}
+		if v > pl.max[i] {
+			pl.max[i] = v
+		}
+	}
+	return nil
+}
+
+// note counts p, which was just written to the set, toward its count, its
+// order along each dimension and its sample of points.
+func (pl *PointSet) note(p Point) {
 	pl.count += 1
+	if pl.last == nil {
+		pl.unsorted = make([]bool, pl.dims)
+		pl.last = make([]float64, pl.dims)
+	} else {
+		for i, v := range p.Pos {
+			if v < pl.last[i] {
+				pl.unsorted[i] = true
+			}
+		}
+	}
+	copy(pl.last, p.Pos)
 	if len(pl.reservoir) < cap(pl.reservoir) {
 		pl.reservoir = append(pl.reservoir, p)
 	} else {
-		pos := rand.Int63n(pl.count)
+		pos := pl.rng.int63n(pl.count)
 		if pos < int64(len(pl.reservoir)) {
 			pl.reservoir[pos] = p
 		}
 	}
-	return nil
 }
 
+// sortedAlong reports whether the set's points are in ascending order along
+// dimension dim.
+func (pl *PointSet) sortedAlong(dim int) bool {
+	return pl.unsorted == nil || !pl.unsorted[dim]
+}
+
+// split divides the points other than median between left, for points at
+// or below median along dim, and right. Under DropExactDuplicates every copy
+// of median is dropped, not just one. Under ReplaceByData every point at
+// median's Pos is dropped, and the last of them is returned in median's place.
 func (pl *PointSet) split(fs *baseFS, median Point, dim int,
-	deleteOnClose bool) (left, right *PointSet, err error) {
+	deleteOnClose bool, dups Duplicates) (
+	newMedian Point, left, right *PointSet, err error) {
 	defer pl.Close()
 	err = pl.closeNoDel()
 	if err != nil {
-		return nil, nil, err
+		return median, nil, nil, err
 	}
 
-	fh, err := os.Open(pl.path)
+	fh, err := openFile(pl.path, pl.direct)
 	if err != nil {
-		return nil, nil, err
+		return median, nil, nil, err
 	}
 	defer fh.Close()
+	if pl.start > 0 {
+		// views are never read with direct I/O, so fh can seek
+		_, err = fh.(io.Seeker).Seek(pl.start, io.SeekStart)
+		if err != nil {
+			return median, nil, nil, errClass.Wrap(err)
+		}
+	}
 
 	fhbuf := bufio.NewReader(fh)
 
-	left, err = newPointSet(fs.Temp(), pl.dims, pl.maxDataLen, deleteOnClose)
+	left, err = newPointSetFile(fs.Temp(), pl.dims, pl.maxDataLen,
+		deleteOnClose, fs.direct)
 	if err != nil {
-		return nil, nil, err
+		return median, nil, nil, err
 	}
 
-	right, err = newPointSet(fs.Temp(), pl.dims, pl.maxDataLen, deleteOnClose)
+	right, err = newPointSetFile(fs.Temp(), pl.dims, pl.maxDataLen,
+		deleteOnClose, fs.direct)
 	if err != nil {
 		left.closeNoDel()
 		left.del()
-		return nil, nil, err
+		return median, nil, nil, err
 	}
 
 	closeUp := func() {
@@ -153,14 +347,19 @@ func (pl *PointSet) split(fs *baseFS, median Point, dim int,
 		_, err = io.ReadFull(fhbuf, data)
 		if err != nil {
 			closeUp()
-			return nil, nil, err
+			return median, nil, nil, err
 		}
 		p, _, err := parsePoint(data)
 		if err != nil {
 			closeUp()
-			return nil, nil, err
+			return median, nil, nil, err
 		}
-		if !foundMedian && median.equal(&p) {
+		switch {
+		case dups == ReplaceByData && median.samePos(&p):
+			newMedian = p
+			continue
+		case (!foundMedian || dups == DropExactDuplicates) &&
+			median.equal(&p):
 			foundMedian = true
 			continue
 		}
@@ -171,14 +370,155 @@ func (pl *PointSet) split(fs *baseFS, median Point, dim int,
 		}
 		if err != nil {
 			closeUp()
-			return nil, nil, err
+			return median, nil, nil, err
 		}
 	}
 
-	return left, right, nil
+	if dups != ReplaceByData {
+		newMedian = median
+	}
+	if fs.metrics != nil {
+		fs.metrics.BuildWrite((left.count + right.count) *
+			int64(pointSize(pl.dims, pl.maxDataLen)))
+	}
+	return newMedian, left, right, nil
+}
+
+// splitSorted is split for a set whose points are in ascending order along
+// dim, which needs no pass over them. The median is the middle point, or the
+// last point tied with it along dim, so that every point after it is
+// further along, and left and right are views of the points before and
+// after it, sharing the set's file. The set must outlive them, and keeps
+// ownership of its file.
+func (pl *PointSet) splitSorted(dim int) (median Point, left,
+	right *PointSet, err error) {
+	err = pl.closeNoDel()
+	if err != nil {
+		return median, nil, nil, err
+	}
+	fh, err := os.Open(pl.path)
+	if err != nil {
+		return median, nil, nil, errClass.Wrap(err)
+	}
+	defer fh.Close()
+
+	size := int64(pointSize(pl.dims, pl.maxDataLen))
+	read := func(i int64) (Point, error) {
+		data := make([]byte, size)
+		_, err := fh.ReadAt(data, pl.start+i*size)
+		if err != nil {
+			return Point{}, errClass.Wrap(err)
+		}
+		p, _, err := parsePoint(data)
+		return p, err
+	}
+
+	m := pl.count / 2
+	median, err = read(m)
+	if err != nil {
+		return median, nil, nil, err
+	}
+	// binary search for the last point tied with the middle one
+	lo, hi := m, pl.count-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		p, err := read(mid)
+		if err != nil {
+			return median, nil, nil, err
+		}
+		if p.Pos[dim] <= median.Pos[dim] {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	if lo != m {
+		m = lo
+		median, err = read(m)
+		if err != nil {
+			return median, nil, nil, err
+		}
+	}
+
+	left, err = pl.view(fh, 0, m)
+	if err != nil {
+		return median, nil, nil, err
+	}
+	right, err = pl.view(fh, m+1, pl.count-m-1)
+	return median, left, right, err
+}
+
+// view returns a set of the count points of pl from the ith on, read from
+// pl's file fh, with a sample of them read at random.
+func (pl *PointSet) view(fh *os.File, i, count int64) (*PointSet, error) {
+	owner := pl
+	if pl.owner != nil {
+		owner = pl.owner
+	}
+	size := int64(pointSize(pl.dims, pl.maxDataLen))
+	v := &PointSet{
+		dims:       pl.dims,
+		maxDataLen: pl.maxDataLen,
+		count:      count,
+		path:       pl.path,
+		start:      pl.start + i*size,
+		owner:      owner,
+		unsorted:   pl.unsorted,
+		reservoir:  make([]Point, 0, samplingSize),
+		rng:        sampleSeed,
+	}
+	if count <= samplingSize {
+		data := make([]byte, count*size)
+		_, err := fh.ReadAt(data, v.start)
+		if err != nil {
+			return nil, errClass.Wrap(err)
+		}
+		for j := int64(0); j < count; j++ {
+			p, _, err := parsePoint(data[j*size : (j+1)*size])
+			if err != nil {
+				return nil, err
+			}
+			v.reservoir = append(v.reservoir, p)
+		}
+		return v, nil
+	}
+	for len(v.reservoir) < samplingSize {
+		data := make([]byte, size)
+		_, err := fh.ReadAt(data, v.start+v.rng.int63n(count)*size)
+		if err != nil {
+			return nil, errClass.Wrap(err)
+		}
+		p, _, err := parsePoint(data)
+		if err != nil {
+			return nil, err
+		}
+		v.reservoir = append(v.reservoir, p)
+	}
+	return v, nil
+}
+
+// bounds returns the smallest box holding the set's points, or for views,
+// which don't track it, the sample of them.
+func (pl *PointSet) bounds() (min, max []float64) {
+	if pl.min != nil {
+		return pl.min, pl.max
+	}
+	return pointBounds(pl.reservoir)
+}
+
+// splitDim returns the dimension to split the set along under c, where dim
+// is the next in turn, chosen from a sample of its points.
+func (pl *PointSet) splitDim(c DimensionChoice, dim int) int {
+	if c == CycleDimensions {
+		return dim
+	}
+	min, max := pl.bounds()
+	return c.choose(pl.reservoir, min, max, dim)
 }
 
-func (pl *PointSet) medianEstimate(dim int) Point {
+// splitEstimate returns the point to split the set at along dim under s,
+// chosen from a sample of its points.
+func (pl *PointSet) splitEstimate(s SplitStrategy, dim int) Point {
 	if len(pl.reservoir) == 0 {
 		panic("no points in reservoir")
 	}
@@ -186,7 +526,8 @@ func (pl *PointSet) medianEstimate(dim int) Point {
 		Dim:    dim,
 		Points: append([]Point(nil), pl.reservoir...)}
 	sort.Sort(&ps)
-	return ps.Points[len(ps.Points)/2]
+	min, max := pl.bounds()
+	return ps.Points[s.index(ps.Points, dim, min, max)]
 }
 
 type pointSorter struct {
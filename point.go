@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
 )
 
 const (
@@ -25,18 +26,39 @@ const (
 	float64Size = 8
 	uint32Size  = 4
 	uint64Size  = 8
+	// and this one into version 1
+	float32Size = 4
 )
 
 func init() {
 	if float64Size != binary.Size(float64(0)) ||
 		uint32Size != binary.Size(uint32(0)) ||
-		uint64Size != binary.Size(uint64(0)) {
+		uint64Size != binary.Size(uint64(0)) ||
+		float32Size != binary.Size(float32(0)) {
 		panic("uh oh")
 	}
 }
 
+// point serialization versions, which differ in how coordinates are stored
+const (
+	pointVersionFloat64 = 0
+	pointVersionFloat32 = 1
+	// pointVersionEncoded points store coordinates encoded by a tree's
+	// CoordinateCodec, and can only be parsed knowing it.
+	pointVersionEncoded = 2
+)
+
+// a serialized point starts with a version byte and three uint32s
+const pointHeaderSize = 1 + uint32Size*3
+
 func pointSize(dims, maxDataLen int) int {
-	return 1 + uint32Size*3 + dims*float64Size + maxDataLen
+	return pointSizeCoords(coords{}, dims, maxDataLen)
+}
+
+// pointSizeCoords is pointSize for points serialized as c says.
+func pointSizeCoords(c coords, dims, maxDataLen int) int {
+	size, _ := c.posSize(c.version, dims)
+	return pointHeaderSize + size + maxDataLen
 }
 
 type Point struct {
@@ -45,8 +67,11 @@ type Point struct {
 }
 
 func (p1 *Point) equal(p2 *Point) bool {
-	if len(p1.Pos) != len(p2.Pos) ||
-		len(p1.Data) != len(p2.Data) {
+	return p1.samePos(p2) && bytes.Equal(p1.Data, p2.Data)
+}
+
+func (p1 *Point) samePos(p2 *Point) bool {
+	if len(p1.Pos) != len(p2.Pos) {
 		return false
 	}
 	for i, f1 := range p1.Pos {
@@ -54,24 +79,62 @@ func (p1 *Point) equal(p2 *Point) bool {
 			return false
 		}
 	}
-	return bytes.Equal(p1.Data, p2.Data)
+	return true
 }
 
-func (p1 *Point) distanceSquared(p2 *Point) (sum float64) {
-	for i, v := range p1.Pos {
-		delta := v - p2.Pos[i]
-		sum += delta * delta
+// comparePoints orders points lexicographically by Pos, then by Data,
+// returning -1, 0 or 1 as a sorts before, with or after b.
+func comparePoints(a, b *Point) int {
+	for i := 0; i < len(a.Pos) && i < len(b.Pos); i++ {
+		switch {
+		case a.Pos[i] < b.Pos[i]:
+			return -1
+		case a.Pos[i] > b.Pos[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(a.Pos) < len(b.Pos):
+		return -1
+	case len(a.Pos) > len(b.Pos):
+		return 1
 	}
-	return sum
+	return bytes.Compare(a.Data, b.Data)
 }
 
-func (p *Point) serialize(w io.Writer, maxDataLen int) error {
+func (p1 *Point) distanceSquared(p2 *Point) float64 {
+	return squaredDistance(p1.Pos, p2.Pos)
+}
+
+// checkFinite returns ErrNonFinite if any of pos is NaN or infinite.
+func checkFinite(pos []float64) error {
+	for i, v := range pos {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return ErrNonFinite.New("coordinate %d is %v", i, v)
+		}
+	}
+	return nil
+}
+
+// serialize writes p, followed by padding out to maxDataLen. The padding is
+// zeroed unless fill is given.
+func (p *Point) serialize(w io.Writer, maxDataLen int, fill PaddingFill) error {
+	return p.serializeCoords(w, coords{}, maxDataLen, fill)
+}
+
+// serializeCoords is serialize with coordinates stored as c says. Version 1
+// stores them as float32s, rounding them, and version 2 encodes them with
+// c's codec.
+func (p *Point) serializeCoords(w io.Writer, c coords, maxDataLen int,
+	fill PaddingFill) error {
+	version := c.version
 	if len(p.Data) > maxDataLen {
-		return errClass.New("data length (%d) greater than max data length (%d)",
+		return ErrDataTooLarge.New(
+			"data length (%d) greater than max data length (%d)",
 			len(p.Data), maxDataLen)
 	}
 	// serialization version
-	_, err := w.Write([]byte{0})
+	_, err := w.Write([]byte{version})
 	if err != nil {
 		return errClass.Wrap(err)
 	}
@@ -94,7 +157,20 @@ func (p *Point) serialize(w io.Writer, maxDataLen int) error {
 		return errClass.Wrap(err)
 	}
 	// floating point values
-	err = binary.Write(w, binary.LittleEndian, p.Pos)
+	switch version {
+	case pointVersionFloat32:
+		pos := make([]float32, len(p.Pos))
+		for i, v := range p.Pos {
+			pos[i] = float32(v)
+		}
+		err = binary.Write(w, binary.LittleEndian, pos)
+	case pointVersionEncoded:
+		pos := make([]byte, c.codec.Size(len(p.Pos)))
+		c.codec.Encode(pos, p.Pos, c.min, c.max)
+		_, err = w.Write(pos)
+	default:
+		err = binary.Write(w, binary.LittleEndian, p.Pos)
+	}
 	if err != nil {
 		return errClass.Wrap(err)
 	}
@@ -104,62 +180,150 @@ func (p *Point) serialize(w io.Writer, maxDataLen int) error {
 		return errClass.Wrap(err)
 	}
 	// padding
-	_, err = w.Write(make([]byte, paddingLen))
+	padding := make([]byte, paddingLen)
+	if fill != nil {
+		err = fill(padding)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	_, err = w.Write(padding)
 	return errClass.Wrap(err)
 }
 
-func parsePointHeader(buf []byte) (dims, datalen, padlen uint32,
-	remaining []byte, err error) {
-	if buf[0] != 0 {
-		return 0, 0, 0, nil, errClass.New("invalid serialization version")
+// pointHeader is the header of a serialized point.
+type pointHeader struct {
+	version               byte
+	dims, datalen, padlen uint32
+	// posBytes is the size of the point's coordinates.
+	posBytes int
+}
+
+// bodySize returns the length of the point body following the header,
+// without overflowing.
+func (h *pointHeader) bodySize() uint64 {
+	return uint64(h.posBytes) + uint64(h.datalen) + uint64(h.padlen)
+}
+
+// parsePointHeader parses the header at the start of buf. c is needed to
+// parse points with encoded coordinates.
+func parsePointHeader(buf []byte, c coords) (h pointHeader, remaining []byte,
+	err error) {
+	if len(buf) < pointHeaderSize {
+		return h, nil, ErrCorrupt.New("truncated point")
 	}
+	h.version = buf[0]
 	buf = buf[1:]
 
-	dims = binary.LittleEndian.Uint32(buf)
+	h.dims = binary.LittleEndian.Uint32(buf)
 	buf = buf[uint32Size:]
-	datalen = binary.LittleEndian.Uint32(buf)
+	h.datalen = binary.LittleEndian.Uint32(buf)
 	buf = buf[uint32Size:]
-	padlen = binary.LittleEndian.Uint32(buf)
+	h.padlen = binary.LittleEndian.Uint32(buf)
 	buf = buf[uint32Size:]
-	return dims, datalen, padlen, buf, nil
+	h.posBytes, err = c.posSize(h.version, int(h.dims))
+	return h, buf, err
 }
 
 func parsePoint(buf []byte) (rv Point, remaining []byte, err error) {
-	dims, datalen, padlen, body, err := parsePointHeader(buf)
+	return parsePointCoords(buf, coords{})
+}
+
+// parsePointCoords is parsePoint for points that may have encoded
+// coordinates, which c decodes.
+func parsePointCoords(buf []byte, c coords) (rv Point, remaining []byte,
+	err error) {
+	h, body, err := parsePointHeader(buf, c)
 	if err != nil {
 		return rv, nil, err
 	}
+	if uint64(len(body)) < h.bodySize() {
+		return rv, nil, ErrCorrupt.New("truncated point")
+	}
 
-	posBytes := dims * float64Size
+	if h.version == pointVersionFloat64 {
+		rv.Pos, err = readFloats(body[:h.posBytes])
+		if err != nil {
+			return rv, nil, errClass.Wrap(err)
+		}
+	} else {
+		rv.Pos = make([]float64, h.dims)
+		c.decode(h.version, body, rv.Pos)
+	}
+	body = body[h.posBytes:]
 
-	rv.Pos, err = readFloats(body[:posBytes])
+	rv.Data = body[:h.datalen]
+
+	return rv, body[uint64(h.datalen)+uint64(h.padlen):], nil
+}
+
+// parsePointExpect is parsePointCoords for points read out of a tree, where
+// every point is known to have dims dimensions. Headers that disagree, or
+// that describe a point larger than buf, are reported as corruption.
+func parsePointExpect(buf []byte, dims int, c coords) (rv Point,
+	remaining []byte, err error) {
+	_, _, err = parsePointHeaderExpect(buf, dims, c)
 	if err != nil {
-		return rv, nil, errClass.Wrap(err)
+		return rv, nil, err
 	}
-	body = body[posBytes:]
-
-	rv.Data = body[:datalen]
+	return parsePointCoords(buf, c)
+}
 
-	return rv, body[datalen+padlen:], nil
+// parsePointHeaderExpect is parsePointHeader with the checks of
+// parsePointExpect.
+func parsePointHeaderExpect(buf []byte, dims int, c coords) (h pointHeader,
+	remaining []byte, err error) {
+	h, body, err := parsePointHeader(buf, c)
+	if err != nil {
+		return h, nil, err
+	}
+	if int(h.dims) != dims {
+		return h, nil, ErrCorrupt.New(
+			"point has %d dimensions, expected %d", h.dims, dims)
+	}
+	if uint64(len(body)) < h.bodySize() {
+		return h, nil, ErrCorrupt.New("truncated point")
+	}
+	return h, body, nil
 }
 
 func parsePointFromReader(r io.Reader) (rv Point, maxDataLen int, err error) {
-	var header [1 + 3*uint32Size]byte
+	var header [pointHeaderSize]byte
 	_, err = io.ReadFull(r, header[:])
 	if err != nil {
 		return rv, 0, err
 	}
-	dims, datalen, padlen, _, err := parsePointHeader(header[:])
+	h, _, err := parsePointHeader(header[:], coords{})
 	if err != nil {
 		return rv, 0, err
 	}
 
-	data := make([]byte, len(header)+int(dims)*float64Size+int(datalen+padlen))
-	copy(data, header[:])
-	_, err = io.ReadFull(r, data[len(header):])
-	if err != nil {
-		return rv, 0, err
+	size := h.bodySize()
+	var data []byte
+	if size <= trustedPointSize {
+		data = make([]byte, len(header)+int(size))
+		copy(data, header[:])
+		_, err = io.ReadFull(r, data[len(header):])
+		if err != nil {
+			return rv, 0, err
+		}
+	} else {
+		// the header may be corrupt, so only grow the buffer as the claimed
+		// body actually arrives rather than trusting its size up front
+		buf := bytes.NewBuffer(header[:len(header):len(header)])
+		n, err := io.Copy(buf, io.LimitReader(r, int64(size)))
+		if err != nil {
+			return rv, 0, err
+		}
+		if uint64(n) != size {
+			return rv, 0, io.ErrUnexpectedEOF
+		}
+		data = buf.Bytes()
 	}
 	rv, _, err = parsePoint(data)
-	return rv, int(datalen + padlen), err
+	return rv, int(h.datalen) + int(h.padlen), err
 }
+
+// trustedPointSize is the largest serialized point body that
+// parsePointFromReader will allocate for before seeing it.
+const trustedPointSize = 1 << 20
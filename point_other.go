@@ -12,16 +12,24 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !amd64
 // +build !amd64
 
 package dkdtree
 
 import (
 	"encoding/binary"
-	"io"
+	"math"
 )
 
+// readFloats decodes the little-endian float64s in data. Unlike on amd64,
+// data may not be aligned or in the host byte order, so the floats are
+// copied out rather than aliased.
 func readFloats(data []byte) ([]float64, error) {
 	rv := make([]float64, len(data)/float64Size)
-	return rv, binary.Read(bytes.NewReader(data), binary.LittleEndian, rv)
+	for i := range rv {
+		rv[i] = math.Float64frombits(
+			binary.LittleEndian.Uint64(data[i*float64Size:]))
+	}
+	return rv, nil
 }
@@ -17,6 +17,8 @@ package dkdtree
 import (
 	"bytes"
 	crand "crypto/rand"
+	"encoding/binary"
+	"math"
 	"math/rand"
 	"testing"
 )
@@ -71,7 +73,7 @@ func TestPoint(t *testing.T) {
 	var points [pointsToTest]Point
 	for i := range points[:] {
 		points[i] = NewPoint(dims, maxData)
-		err := points[i].serialize(&buf, maxData)
+		err := points[i].serialize(&buf, maxData, nil)
 		if err != nil {
 			panic(err)
 		}
@@ -90,3 +92,128 @@ func TestPoint(t *testing.T) {
 		AssertPointsEqual(points[i], tp)
 	}
 }
+
+func TestPaddingFill(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	const dims, maxData = 3, 64
+	points := newTestPoints(50, dims, maxData)
+
+	for _, test := range []struct {
+		name  string
+		fill  PaddingFill
+		check func(pad []byte) bool
+	}{
+		{"default", nil, func(pad []byte) bool {
+			return bytes.Count(pad, []byte{0}) == len(pad)
+		}},
+		{"zero", ZeroPadding, func(pad []byte) bool {
+			return bytes.Count(pad, []byte{0}) == len(pad)
+		}},
+		{"fixed", FixedPadding(0xab), func(pad []byte) bool {
+			return bytes.Count(pad, []byte{0xab}) == len(pad)
+		}},
+	} {
+		for _, layout := range []Layout{PreorderLayout, CacheObliviousLayout} {
+			tree := createTestTree(t, fs, dims, maxData, points,
+				BuildOptions{PaddingFill: test.fill, Layout: layout})
+			err := tree.scan(func(offset int64, n Node) error {
+				pad := readPadding(t, tree, offset)
+				if !test.check(pad) {
+					t.Fatalf("%s: unexpected padding %x", test.name, pad)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range points {
+				nearest, err := tree.Nearest(p, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				AssertPointsEqual(nearest[0].Point, p)
+			}
+			tree.Close()
+		}
+	}
+
+	tree := createTestTree(t, fs, dims, maxData, points,
+		BuildOptions{PaddingFill: RandomPadding})
+	defer tree.Close()
+	var padding []byte
+	err := tree.scan(func(offset int64, n Node) error {
+		padding = append(padding, readPadding(t, tree, offset)...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(padding, []byte{0}) > len(padding)/16 {
+		t.Fatal("random padding is mostly zeroes")
+	}
+	for _, p := range points {
+		nearest, err := tree.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+	}
+}
+
+// readPadding returns the raw padding bytes of the node at offset.
+func readPadding(t *testing.T, tree *Tree, offset int64) []byte {
+	data := make([]byte, tree.nodelen)
+	_, err := tree.r.ReadAt(data, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, body, err := parsePointHeader(data, tree.footer.coords())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := uint32(h.posBytes) + h.datalen
+	return body[start : start+h.padlen]
+}
+
+func TestReadFloats(t *testing.T) {
+	pos := []float64{0, -1.5, math.MaxFloat64, math.SmallestNonzeroFloat64,
+		math.Inf(-1)}
+	buf := make([]byte, len(pos)*float64Size)
+	for i, v := range pos {
+		binary.LittleEndian.PutUint64(buf[i*float64Size:], math.Float64bits(v))
+	}
+	got, err := readFloats(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(pos) {
+		t.Fatalf("expected %d floats, got %d", len(pos), len(got))
+	}
+	for i := range pos {
+		if got[i] != pos[i] {
+			t.Fatalf("float %d: expected %v, got %v", i, pos[i], got[i])
+		}
+	}
+}
+
+func TestCheckNodeSize(t *testing.T) {
+	if err := checkNodeSize(3, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkNodeSize(-1, 0); err == nil {
+		t.Fatal("expected negative dimensions to be refused")
+	}
+	for _, c := range []struct{ dims, maxDataLen int64 }{
+		{maxInt / float64Size, 0},
+		{3, maxInt},
+		{maxInt / float64Size / 2, maxInt / 2},
+	} {
+		err := checkNodeSize(c.dims, c.maxDataLen)
+		if !ErrDataTooLarge.Contains(err) {
+			t.Fatalf("%d dims, %d bytes: expected ErrDataTooLarge, got %v",
+				c.dims, c.maxDataLen, err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded is the class of errors returned by a QueryPool when its
+// queue is full. Check for it with ErrOverloaded.Contains(err).
+var ErrOverloaded = errClass.NewClass("overloaded")
+
+// QueryPoolOptions configures NewQueryPool.
+type QueryPoolOptions struct {
+	// Concurrency is how many queries may search the tree at once, bounding
+	// the reads they make of it. Defaults to 1.
+	Concurrency int
+	// QueueLength is how many more queries may wait for their turn. Queries
+	// beyond that fail with ErrOverloaded rather than wait. Zero means
+	// queries only run if there is room to run them right away.
+	QueueLength int
+	// Timeout, if positive, is how long each query may take, counting the
+	// time it spends queued, before it fails with
+	// context.DeadlineExceeded. A deadline already on a query's context
+	// applies as well.
+	Timeout time.Duration
+}
+
+// QueryPoolStats describes the queries a QueryPool is handling.
+type QueryPoolStats struct {
+	// Running and Queued are the queries searching the tree and waiting to.
+	Running, Queued int
+	// Rejected is how many queries have failed with ErrOverloaded.
+	Rejected int64
+}
+
+// QueryPool runs queries against a tree with bounded concurrency, so that a
+// storm of queries queues, and past a point is turned away, instead of
+// swamping the disk the tree is on. A QueryPool is safe for concurrent use.
+type QueryPool struct {
+	t     *Tree
+	opts  QueryPoolOptions
+	slots chan struct{}
+
+	mu       sync.Mutex
+	queued   int
+	rejected int64
+}
+
+var _ Searcher = (*QueryPool)(nil)
+
+// NewQueryPool returns a QueryPool running queries against t. The pool
+// doesn't own t, which must stay open while the pool is in use.
+func NewQueryPool(t *Tree, opts QueryPoolOptions) (*QueryPool, error) {
+	if opts.Concurrency < 0 || opts.QueueLength < 0 || opts.Timeout < 0 {
+		return nil, errClass.New("query pool options can't be negative")
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = 1
+	}
+	return &QueryPool{t: t, opts: opts,
+		slots: make(chan struct{}, opts.Concurrency)}, nil
+}
+
+// acquire waits for a turn to search the tree, returning ErrOverloaded if
+// the queue is full, or ctx's error if ctx is done first.
+func (qp *QueryPool) acquire(ctx context.Context) error {
+	select {
+	case qp.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	qp.mu.Lock()
+	if qp.queued >= qp.opts.QueueLength {
+		qp.rejected++
+		qp.mu.Unlock()
+		return ErrOverloaded.New("%d queries running and %d queued",
+			qp.opts.Concurrency, qp.opts.QueueLength)
+	}
+	qp.queued++
+	qp.mu.Unlock()
+	defer func() {
+		qp.mu.Lock()
+		qp.queued--
+		qp.mu.Unlock()
+	}()
+	select {
+	case qp.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Do calls fn with the pool's tree once it is fn's turn, with ctx limited
+// to the pool's Timeout, and returns fn's error. fn should pass ctx on to
+// the queries it runs, such as with Tree.NearestContext, so that they stop
+// at the deadline.
+func (qp *QueryPool) Do(ctx context.Context,
+	fn func(ctx context.Context, t *Tree) error) error {
+	if qp.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, qp.opts.Timeout)
+		defer cancel()
+	}
+	err := qp.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { <-qp.slots }()
+	return fn(ctx, qp.t)
+}
+
+// NearestContext is Tree.NearestContext, run by the pool.
+func (qp *QueryPool) NearestContext(ctx context.Context, p Point, n int) (
+	rv []PointDistance, err error) {
+	err = qp.Do(ctx, func(ctx context.Context, t *Tree) error {
+		rv, err = t.NearestContext(ctx, p, n)
+		return err
+	})
+	return rv, err
+}
+
+// Nearest is NearestContext without a context of its own, so only the
+// pool's Timeout applies.
+func (qp *QueryPool) Nearest(p Point, n int) ([]PointDistance, error) {
+	return qp.NearestContext(context.Background(), p, n)
+}
+
+// Dims returns the number of dimensions of the pool's tree.
+func (qp *QueryPool) Dims() int { return qp.t.Dims() }
+
+// Stats returns how many queries the pool is running and has queued, and
+// how many it has turned away.
+func (qp *QueryPool) Stats() QueryPoolStats {
+	qp.mu.Lock()
+	defer qp.mu.Unlock()
+	return QueryPoolStats{Running: len(qp.slots), Queued: qp.queued,
+		Rejected: qp.rejected}
+}
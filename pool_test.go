@@ -0,0 +1,95 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueryPool(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	pool, err := NewQueryPool(tree, QueryPoolOptions{Concurrency: 1,
+		QueueLength: 1, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := tree.Nearest(points[0], 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := pool.Nearest(points[0], 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(expected) || got[0].ID != expected[0].ID {
+		t.Fatal("pool query differs from the tree's")
+	}
+
+	// hold the only slot
+	started, release := make(chan struct{}), make(chan struct{})
+	held := make(chan error)
+	go func() {
+		held <- pool.Do(context.Background(),
+			func(ctx context.Context, t *Tree) error {
+				close(started)
+				<-release
+				return nil
+			})
+	}()
+	<-started
+
+	queued := make(chan error)
+	go func() {
+		_, err := pool.Nearest(points[1], 3)
+		queued <- err
+	}()
+	for pool.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = pool.Nearest(points[2], 3)
+	if !ErrOverloaded.Contains(err) {
+		t.Fatalf("expected ErrOverloaded, got %v", err)
+	}
+	// the queued query times out waiting
+	err = <-queued
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the queued query to time out, got %v", err)
+	}
+	stats := pool.Stats()
+	if stats.Running != 1 || stats.Queued != 0 || stats.Rejected != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	close(release)
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+	_, err = pool.Nearest(points[3], 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.Stats().Running != 0 {
+		t.Fatal("slot not released")
+	}
+}
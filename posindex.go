@@ -0,0 +1,130 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WritePositionIndex writes a positions-only copy of the tree to w: a tree
+// file with the same nodes in the same order, so the same point IDs, but
+// without any Data. Coordinates are stored as the tree stores them, so
+// with Float32 or a CoordinateCodec the index is correspondingly smaller.
+// Load it into memory with LoadPositionIndex and search it there, reading
+// only the Data of the results from the full tree with Tree.Get.
+//
+// Points inserted but not yet merged aren't included, and later deletions
+// from the tree aren't reflected in the index. Compact, Merge and Maintain
+// renumber the tree's points, so the index must be written again after
+// them. The grid counts, layout,
+// LeafSize and split choices are kept; Boxes, tags and the time field,
+// which need Data or tables the index doesn't have, are not.
+func (t *Tree) WritePositionIndex(w io.Writer) (n int64, err error) {
+	out := t.footer
+	out.maxDataLen = 0
+	out.timeField = nil
+	out.variableData = false
+	out.dataLen = 0
+	out.compression = NoCompression
+	out.checksums = false
+	out.boxes = false
+	out.tagField = nil
+	nodelen := out.nodeSize()
+	relocate := func(offset int64) int64 {
+		if offset == -1 {
+			return -1
+		}
+		return offset / t.nodelen * nodelen
+	}
+	out.root = relocate(t.footer.root)
+
+	meter := newWriteMeter(w)
+	bw := bufio.NewWriter(meter)
+	limit := t.count * t.nodelen
+	r := bufio.NewReader(io.NewSectionReader(t.r, 0, limit))
+	data := make([]byte, t.nodelen)
+	for offset := int64(0); offset < limit; offset += t.nodelen {
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return meter.Amount, errClass.Wrap(err)
+		}
+		// the Data itself is never needed, so it isn't read
+		n, _, err := t.parseNodeShape(offset, data)
+		if err != nil {
+			return meter.Amount, err
+		}
+		n.Point.Data = nil
+		n.Left = relocate(n.Left)
+		n.Right = relocate(n.Right)
+		err = n.serializeCoords(bw, out.coords(), 0, nil)
+		if err != nil {
+			return meter.Amount, err
+		}
+	}
+	err = out.serialize(bw)
+	if err != nil {
+		return meter.Amount, err
+	}
+	return meter.Amount, errClass.Wrap(bw.Flush())
+}
+
+// writePositionIndex writes the position index of the tree at treePath to
+// path, replacing it atomically.
+func writePositionIndex(treePath, path string, fsync *syncer) error {
+	t, err := OpenTree(treePath)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	tmp := tempName(filepath.Dir(path))
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer os.Remove(tmp)
+	_, err = t.WritePositionIndex(fh)
+	if err == nil {
+		err = fsync.finish(fh)
+	}
+	if cerr := fh.Close(); err == nil {
+		err = errClass.Wrap(cerr)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	fsync.finishDir(path)
+	return nil
+}
+
+// LoadPositionIndex reads the position index at path, as written by
+// Tree.WritePositionIndex or BuildOptions.PositionIndex, into memory. The
+// returned tree answers every query without touching the disk, with empty
+// Data in its results and the same IDs as the full tree.
+func LoadPositionIndex(path string) (*Tree, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	return openReaderAt(bytes.NewReader(data), int64(len(data)),
+		OpenOptions{})
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPositionIndex(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	for _, opts := range []BuildOptions{
+		{},
+		{VariableData: true, Checksums: true, Boxes: true},
+		{CoordinateCodec: Quantized16, LeafSize: 8},
+	} {
+		points := newTestPoints(400, 3, 50)
+		opts.PositionIndex = filepath.Join(fs.base, "positions")
+		tree := createTestTree(t, fs, 3, 50, points, opts)
+		index, err := LoadPositionIndex(opts.PositionIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		full, err := os.Stat(tree.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compact, err := os.Stat(opts.PositionIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compact.Size() >= full.Size() {
+			t.Fatalf("index of %d bytes isn't smaller than the %d byte tree",
+				compact.Size(), full.Size())
+		}
+		if index.Count() != tree.Count() {
+			t.Fatalf("index has %d points, tree has %d", index.Count(),
+				tree.Count())
+		}
+
+		for _, p := range points[:30] {
+			expected, err := tree.Nearest(p, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := index.Nearest(p, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(expected) {
+				t.Fatalf("expected %d results, got %d", len(expected),
+					len(got))
+			}
+			for i, pd := range got {
+				if len(pd.Data) != 0 {
+					t.Fatal("index returned Data")
+				}
+				if pd.Distance != expected[i].Distance ||
+					pd.ID != expected[i].ID {
+					t.Fatalf("result %d differs from the tree's", i)
+				}
+				data, err := tree.Get(pd.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, expected[i].Data) {
+					t.Fatalf("result %d has the wrong Data", i)
+				}
+			}
+		}
+		tree.Close()
+		index.Close()
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"sync"
+)
+
+// prefetchQueue is how many nodes each prefetch worker may have queued.
+const prefetchQueue = 16
+
+// prefetcher reads nodes in the background ahead of the searches that will
+// likely need them, so that by the time a search gets to a node it is in the
+// node cache, if the tree has one, or else the operating system's page cache.
+type prefetcher struct {
+	offsets chan int64
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+func newPrefetcher(t *Tree, workers int) *prefetcher {
+	p := &prefetcher{offsets: make(chan int64, workers*prefetchQueue)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer p.wg.Done()
+			for offset := range p.offsets {
+				t.Node(offset)
+			}
+		}()
+	}
+	return p
+}
+
+// fetch queues the node at offset to be read, unless the queue is full, as
+// a read that can't start soon is of no use.
+func (p *prefetcher) fetch(offset int64) {
+	if p == nil || offset < 0 {
+		return
+	}
+	select {
+	case p.offsets <- offset:
+	default:
+	}
+}
+
+// stop waits for the workers to finish reading and exit. Only the first call
+// does anything, as a tree may be closed again, or after a failed rebuild
+// already stopped its prefetcher.
+func (p *prefetcher) stop() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() { close(p.offsets) })
+	p.wg.Wait()
+}
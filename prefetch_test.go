@@ -0,0 +1,73 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"testing"
+)
+
+func TestPrefetch(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+
+	for _, opts := range []OpenOptions{
+		{Prefetch: 2},
+		{Prefetch: 4, CacheBytes: 1 << 20, Mmap: true},
+	} {
+		tree, err := OpenRWWithOptions(tree.path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check := func() {
+			for i := 0; i < 50; i++ {
+				q := NewPoint(3, 10)
+				expected, err := tree.NearestExhaustive(q, 5)
+				if err != nil {
+					t.Fatal(err)
+				}
+				actual, err := tree.Nearest(q, 5)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for j := range expected {
+					if actual[j].Distance != expected[j].Distance {
+						t.Fatalf("got distance %v, expected %v",
+							actual[j].Distance, expected[j].Distance)
+					}
+				}
+			}
+		}
+		check()
+		err = tree.Insert(NewPoint(3, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tree.Merge(fs.Temp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		check()
+		err = tree.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// closing again fails, but mustn't stop the prefetcher twice
+		tree.Close()
+	}
+}
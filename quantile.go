@@ -0,0 +1,113 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math"
+	"sort"
+)
+
+// quantileScan is how few points Quantile narrows its search down to before
+// reading them rather than counting.
+const quantileScan = 64
+
+// Quantile returns the q-th quantile, for q from 0 to 1, of the points'
+// coordinates in dimension dim: the smallest value that at least a fraction
+// q of the points, and at least one, have at or below it. 0 so gives the
+// least coordinate, 0.5 the median and 1 the greatest.
+//
+// Rather than scanning every point, Quantile bisects the range of the
+// coordinate with CountRange, which answers from stored subtree counts, and
+// only reads the few points left in the range once it is narrow enough. The
+// result is exact.
+func (t *Tree) Quantile(dim int, q float64) (float64, error) {
+	if dim < 0 || dim >= t.footer.dims {
+		return 0, errClass.New("dimension %d out of range", dim)
+	}
+	if !(q >= 0 && q <= 1) {
+		return 0, errClass.New("invalid quantile %v", q)
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	if t.root != -1 {
+		lo, hi = t.footer.min[dim], t.footer.max[dim]
+	}
+	for _, p := range t.pending.snapshot() {
+		lo, hi = math.Min(lo, p.Pos[dim]), math.Max(hi, p.Pos[dim])
+	}
+	total, err := t.countAtMost(dim, math.Inf(1))
+	if err != nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, errClass.New("no points")
+	}
+	k := max(int64(math.Ceil(q*float64(total))), 1)
+
+	// the answer is in [lo, hi], below points are less than lo and atMost
+	// are at most hi
+	below, atMost := int64(0), total
+	for lo < hi && atMost-below > quantileScan {
+		mid := lo/2 + hi/2
+		if mid >= hi {
+			mid = lo
+		}
+		count, err := t.countAtMost(dim, mid)
+		if err != nil {
+			return 0, err
+		}
+		if count >= k {
+			hi, atMost = mid, count
+		} else {
+			lo, below = math.Nextafter(mid, math.Inf(1)), count
+		}
+	}
+	if lo >= hi {
+		return hi, nil
+	}
+
+	lower, upper := t.slab(dim, lo, hi)
+	var values []float64
+	err = t.Range(lower, upper, func(p Point) error {
+		values = append(values, p.Pos[dim])
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Float64s(values)
+	if i := k - below - 1; i < int64(len(values)) {
+		return values[i], nil
+	}
+	return hi, nil
+}
+
+// countAtMost returns the number of points with a coordinate in dimension
+// dim of at most v.
+func (t *Tree) countAtMost(dim int, v float64) (int64, error) {
+	min, max := t.slab(dim, math.Inf(-1), v)
+	return t.CountRange(min, max)
+}
+
+// slab returns the corners of the box of every point with a coordinate in
+// dimension dim from lo to hi.
+func (t *Tree) slab(dim int, lo, hi float64) (min, max []float64) {
+	min = make([]float64, t.footer.dims)
+	max = make([]float64, t.footer.dims)
+	for i := range min {
+		min[i], max[i] = math.Inf(-1), math.Inf(1)
+	}
+	min[dim], max[dim] = lo, hi
+	return min, max
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestQuantile(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 2, 10)
+	// plenty of ties
+	for i := range points[:300] {
+		points[i].Pos[1] = 0.25
+	}
+	tree := createTestTree(t, fs, 2, 10, points, BuildOptions{})
+	tree.Close()
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	for _, p := range points[:50] {
+		err = rw.Delete(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	points = points[50:]
+	for i := 0; i < 20; i++ {
+		p := NewPoint(2, 10)
+		p.Pos[0] += 1
+		err = rw.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, p)
+	}
+
+	for dim := 0; dim < 2; dim++ {
+		var values []float64
+		for _, p := range points {
+			values = append(values, p.Pos[dim])
+		}
+		sort.Float64s(values)
+		for _, q := range []float64{0, 0.001, 0.1, 0.25, 0.5, 0.9, 0.99, 1} {
+			k := max(int(math.Ceil(q*float64(len(values)))), 1)
+			actual, err := rw.Quantile(dim, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != values[k-1] {
+				t.Fatalf("dim %d quantile %v: got %v, expected %v", dim, q,
+					actual, values[k-1])
+			}
+		}
+	}
+
+	_, err = rw.Quantile(2, 0.5)
+	if err == nil {
+		t.Fatal("expected an invalid dimension to fail")
+	}
+	_, err = rw.Quantile(0, 1.5)
+	if err == nil {
+		t.Fatal("expected an invalid quantile to fail")
+	}
+}
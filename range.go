@@ -0,0 +1,188 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+// Range calls fn with every point inside the axis-aligned box from min to
+// max, inclusive, in no particular order. Corners may be infinite, to leave
+// the box open on that side. It stops at and returns the first error fn
+// returns.
+func (t *Tree) Range(min, max []float64, fn func(Point) error) error {
+	q, err := t.rangeBox(min, max)
+	if err != nil {
+		return err
+	}
+	b := t.bounds()
+	err = t.rangeNode(t.root, &q, &b,
+		func(offset int64, n *Node) error { return fn(n.Point) })
+	if err != nil {
+		return err
+	}
+	for _, p := range t.pending.snapshot() {
+		if q.contains(p.Pos) {
+			err = fn(p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CountRange returns the number of points inside the axis-aligned box from
+// min to max, inclusive. Subtrees entirely inside the box are counted from
+// their stored subtree counts without being descended into, so the cost
+// depends on how much of the tree the box's edges cut through rather than on
+// how many points it holds.
+func (t *Tree) CountRange(min, max []float64) (int64, error) {
+	q, err := t.rangeBox(min, max)
+	if err != nil {
+		return 0, err
+	}
+	b := t.bounds()
+	count, err := t.countRange(t.root, &q, &b)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range t.pending.snapshot() {
+		if q.contains(p.Pos) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// countRange is rangeNode, but counts points instead of visiting them.
+func (t *Tree) countRange(offset int64, q, b *box) (count int64, err error) {
+	if offset == -1 {
+		return 0, nil
+	}
+	restore, err := t.tightenBox(offset, b)
+	if err != nil {
+		return 0, err
+	}
+	defer restore()
+	if !q.intersects(b) {
+		return 0, nil
+	}
+	n, _, err := t.nodeShape(offset, true)
+	if err != nil {
+		return 0, err
+	}
+	if q.containsBox(b) {
+		return n.Count, nil
+	}
+	if !n.Deleted && q.contains(n.Point.Pos) {
+		count++
+	}
+	split := n.Point.Pos[n.Dim]
+	oldMax := b.max[n.Dim]
+	b.max[n.Dim] = split
+	left, err := t.countRange(n.Left, q, b)
+	b.max[n.Dim] = oldMax
+	if err != nil {
+		return 0, err
+	}
+	oldMin := b.min[n.Dim]
+	b.min[n.Dim] = split
+	right, err := t.countRange(n.Right, q, b)
+	b.min[n.Dim] = oldMin
+	return count + left + right, err
+}
+
+// rangeBox validates the corners of a box query.
+func (t *Tree) rangeBox(min, max []float64) (box, error) {
+	if len(min) != t.footer.dims || len(max) != t.footer.dims {
+		return box{}, ErrDimensionMismatch.New("box corners must have %d dimensions",
+			t.footer.dims)
+	}
+	for i := range min {
+		if !(min[i] <= max[i]) {
+			return box{}, errClass.New("box min exceeds max in dimension %d", i)
+		}
+	}
+	return box{min: min, max: max}, nil
+}
+
+func (b *box) contains(pos []float64) bool {
+	for i, v := range pos {
+		if v < b.min[i] || v > b.max[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *box) containsBox(o *box) bool {
+	for i := range b.min {
+		if o.min[i] < b.min[i] || o.max[i] > b.max[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *box) intersects(o *box) bool {
+	for i := range b.min {
+		if o.max[i] < b.min[i] || o.min[i] > b.max[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rangeNode calls fn with every undeleted point in the subtree at offset
+// inside q, where b bounds the subtree. Subtrees entirely inside q are
+// emitted without testing each point. b is narrowed in place while
+// descending and restored before returning.
+func (t *Tree) rangeNode(offset int64, q, b *box,
+	fn func(offset int64, n *Node) error) error {
+	if offset == -1 {
+		return nil
+	}
+	restore, err := t.tightenBox(offset, b)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	if !q.intersects(b) {
+		return nil
+	}
+	if q.containsBox(b) {
+		return t.walk(offset, fn)
+	}
+	n, err := t.Node(offset)
+	if err != nil {
+		return err
+	}
+	if !n.Deleted && q.contains(n.Point.Pos) {
+		err = fn(offset, &n)
+		if err != nil {
+			return err
+		}
+	}
+	split := n.Point.Pos[n.Dim]
+	oldMax := b.max[n.Dim]
+	b.max[n.Dim] = split
+	err = t.rangeNode(n.Left, q, b, fn)
+	b.max[n.Dim] = oldMax
+	if err != nil {
+		return err
+	}
+	oldMin := b.min[n.Dim]
+	b.min[n.Dim] = split
+	err = t.rangeNode(n.Right, q, b, fn)
+	b.min[n.Dim] = oldMin
+	return err
+}
@@ -0,0 +1,222 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestRange(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	for i := 0; i < 50; i++ {
+		min := make([]float64, 3)
+		max := make([]float64, 3)
+		for j := range min {
+			a, b := rand.Float64()*1.2-0.1, rand.Float64()*1.2-0.1
+			if a > b {
+				a, b = b, a
+			}
+			min[j], max[j] = a, b
+		}
+		q := box{min: min, max: max}
+		expected := map[string]bool{}
+		for _, p := range points {
+			if q.contains(p.Pos) {
+				expected[fmt.Sprint(p)] = true
+			}
+		}
+		found := 0
+		err := tree.Range(min, max, func(p Point) error {
+			if !expected[fmt.Sprint(p)] {
+				t.Fatal("unexpected point")
+			}
+			found++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != len(expected) {
+			t.Fatalf("found %d points, expected %d", found, len(expected))
+		}
+		count, err := tree.CountRange(min, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != int64(len(expected)) {
+			t.Fatalf("counted %d points, expected %d", count, len(expected))
+		}
+	}
+
+	err := tree.Range([]float64{1, 0, 0}, []float64{0, 1, 1},
+		func(Point) error { return nil })
+	if err == nil {
+		t.Fatal("expected an inverted box to be rejected")
+	}
+}
+
+func TestCountRange(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 2, 10)
+	tree := createTestTree(t, fs, 2, 10, points[:900], BuildOptions{Boxes: true})
+	tree.Close()
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	deleted, err := rw.DeleteFunc(func(p Point) bool { return p.Pos[1] < .3 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted == 0 {
+		t.Fatal("expected some points to be deleted")
+	}
+	for _, p := range points[900:] {
+		err = rw.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		min := []float64{rand.Float64() / 2, rand.Float64() / 2}
+		max := []float64{min[0] + rand.Float64()/2, min[1] + rand.Float64()/2}
+		var expected int64
+		err = rw.Range(min, max, func(Point) error {
+			expected++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := rw.CountRange(min, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Fatalf("counted %d points, expected %d", count, expected)
+		}
+	}
+}
+
+func TestRangeIter(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	for _, opts := range []BuildOptions{{}, {Boxes: true}} {
+		tree := createTestTree(t, fs, 3, 10, points[:900], opts)
+		tree.Close()
+		rw, err := OpenRW(tree.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rw.DeleteFunc(func(p Point) bool { return p.Pos[2] < .2 })
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range points[900:] {
+			err = rw.Insert(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		drain := func(it *RangeIterator) map[uint64]PointDistance {
+			rv := map[uint64]PointDistance{}
+			for {
+				pd, ok, err := it.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					return rv
+				}
+				if _, dup := rv[pd.ID]; dup {
+					t.Fatalf("%+v: point %d returned twice", opts, pd.ID)
+				}
+				rv[pd.ID] = pd
+			}
+		}
+
+		for i := 0; i < 50; i++ {
+			min := []float64{rand.Float64() / 2, rand.Float64() / 2,
+				rand.Float64() / 2}
+			max := []float64{min[0] + rand.Float64()/2,
+				min[1] + rand.Float64()/2, min[2] + rand.Float64()/2}
+			got := drain(rw.RangeIter(min, max))
+			expected := 0
+			err = rw.Range(min, max, func(p Point) error {
+				expected++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != expected {
+				t.Fatalf("%+v: iterated %d points, expected %d", opts, len(got),
+					expected)
+			}
+			for _, pd := range got {
+				if !(&box{min: min, max: max}).contains(pd.Pos) {
+					t.Fatalf("%+v: %v is outside the box", opts, pd.Point)
+				}
+			}
+
+			q := NewPoint(3, 10)
+			radius := rand.Float64() / 2
+			got = drain(rw.WithinIter(q, radius))
+			expectedWithin := map[uint64]PointDistance{}
+			err = rw.WithinDistanceFunc(q, radius, func(pd PointDistance) error {
+				expectedWithin[pd.ID] = pd
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(expectedWithin) {
+				t.Fatalf("%+v: iterated %d points, expected %d", opts, len(got),
+					len(expectedWithin))
+			}
+			for id, pd := range got {
+				expected := expectedWithin[id]
+				if expected.Distance != pd.Distance || !expected.samePos(&pd.Point) {
+					t.Fatalf("%+v: got %v, expected %v", opts, pd, expected)
+				}
+			}
+		}
+
+		_, _, err = rw.RangeIter([]float64{1, 0, 0}, []float64{0, 1, 1}).Next()
+		if err == nil {
+			t.Fatal("expected an inverted box to be rejected")
+		}
+		_, _, err = rw.WithinIter(NewPoint(2, 10), 1).Next()
+		if !ErrDimensionMismatch.Contains(err) {
+			t.Fatalf("expected a dimension mismatch, got %v", err)
+		}
+		rw.Close()
+	}
+}
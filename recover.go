@@ -0,0 +1,85 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"io"
+)
+
+// Recover opens a tree file whose footer is missing, such as one whose build
+// was interrupted after the nodes were written, or one written before trees
+// had footers. r holds size bytes, and dims and maxDataLen must match the
+// build. Nodes are read until the first record that doesn't parse, and the
+// footer is reconstructed from them. Use WriteTo to save a repaired copy.
+// Any optional footer sections, such as a grid, are lost.
+func Recover(r io.ReaderAt, size int64, dims, maxDataLen int) (*Tree, error) {
+	f := footer{
+		dims:       dims,
+		maxDataLen: maxDataLen,
+		root:       -1,
+		min:        make([]float64, dims),
+		max:        make([]float64, dims)}
+	nodelen := f.nodeSize()
+	t := &Tree{r: r, root: -1, nodelen: nodelen, footer: f,
+		stats: new(statsCounters), pending: new(pendingLog)}
+
+	buf := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	data := make([]byte, nodelen)
+	for offset := int64(0); offset+nodelen <= size; offset += nodelen {
+		_, err := io.ReadFull(buf, data)
+		if err != nil {
+			return nil, errClass.Wrap(err)
+		}
+		n, err := parseNode(data, dims, coords{})
+		if err != nil {
+			if ErrCorrupt.Contains(err) {
+				break
+			}
+			return nil, err
+		}
+		for i, v := range n.Point.Pos {
+			if f.count == 0 || v < f.min[i] {
+				f.min[i] = v
+			}
+			if f.count == 0 || v > f.max[i] {
+				f.max[i] = v
+			}
+		}
+		f.count++
+	}
+
+	if f.count > 0 {
+		f.root = 0
+	}
+	limit := f.count * nodelen
+	valid := func(child int64) bool {
+		return child == -1 || (child >= 0 && child < limit && child%nodelen == 0)
+	}
+	err := t.scanRange(limit, func(offset int64, n Node) error {
+		if !valid(n.Left) || !valid(n.Right) {
+			return ErrCorrupt.New("node at %d has children out of range", offset)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.footer = f
+	t.root = f.root
+	t.count = f.count
+	return t, nil
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	data, err := os.ReadFile(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cut the file off partway through the footer
+	truncated := data[:tree.count*tree.nodelen+5]
+	err = os.WriteFile(fs.Path("truncated"), truncated, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenTree(fs.Path("truncated"))
+	if !ErrCorrupt.Contains(err) {
+		t.Fatalf("expected a corruption error, got %v", err)
+	}
+
+	recovered, err := Recover(bytes.NewReader(truncated),
+		int64(len(truncated)), 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.Count() != int64(len(points)) {
+		t.Fatalf("recovered %d points, expected %d", recovered.Count(),
+			len(points))
+	}
+	count := 0
+	err = recovered.Each(func(p Point) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(points) {
+		t.Fatalf("iterated %d points, expected %d", count, len(points))
+	}
+
+	var repaired bytes.Buffer
+	_, err = recovered.WriteTo(&repaired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(fs.Path("repaired"), repaired.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenTree(fs.Path("repaired"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	for _, p := range points[:20] {
+		nearest, err := reopened.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nearest[0].Point.equal(&p) {
+			t.Fatal("repaired tree lost a point")
+		}
+	}
+}
@@ -20,17 +20,13 @@ import (
 	"os"
 )
 
-func reverseTree(oldpath, newpath string) error {
-	fh, err := os.Open(oldpath)
-	if err != nil {
-		return err
-	}
-	defer fh.Close()
-
-	filelen, err := fh.Seek(0, 2)
+func reverseTree(oldpath, newpath string, fill PaddingFill,
+	prog *progress, fsync *syncer, direct bool) error {
+	fi, err := os.Stat(oldpath)
 	if err != nil {
 		return err
 	}
+	filelen := fi.Size()
 	if filelen == 0 {
 		dest, err := os.Create(newpath)
 		if err != nil {
@@ -40,10 +36,11 @@ func reverseTree(oldpath, newpath string) error {
 		return nil
 	}
 
-	_, err = fh.Seek(0, 0)
+	fh, err := openFile(oldpath, direct)
 	if err != nil {
 		return err
 	}
+	defer fh.Close()
 
 	source := &wrappedReader{r: bufio.NewReader(fh)}
 	dest, err := os.Create(newpath)
@@ -51,6 +48,7 @@ func reverseTree(oldpath, newpath string) error {
 		return err
 	}
 	defer dest.Close()
+	out := fsync.writer(dest)
 
 	nodelen := int64(-1)
 	maxDataLen := -1
@@ -86,10 +84,11 @@ func reverseTree(oldpath, newpath string) error {
 			node.Right = filelen - nodelen - node.Right
 		}
 
-		err = node.serialize(dest, maxDataLen)
+		err = node.serialize(out, maxDataLen, fill)
 		if err != nil {
 			return err
 		}
+		prog.add(1)
 	}
 
 	return nil
@@ -0,0 +1,124 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math/rand"
+)
+
+// Sample returns n distinct points chosen uniformly at random from the live
+// points of the tree and its pending inserted points, in random order, or
+// every point if there are no more than n. Each point is found by walking
+// down from the root by subtree counts, reading a couple of nodes per level
+// instead of scanning the tree, unless n is more than half of the points, in
+// which case a single scan is cheaper.
+func (t *Tree) Sample(n int, rng *rand.Rand) ([]Point, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	live, err := t.subtreeCount(t.root)
+	if err != nil {
+		return nil, err
+	}
+	pending := t.pending.snapshot()
+	total := live + int64(len(pending))
+	err = t.checkResults(min(int64(n), total))
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) > total/2 {
+		return t.sampleScan(n, rng)
+	}
+
+	rv := make([]Point, 0, n)
+	seen := make(map[int64]bool, n)
+	for len(rv) < n {
+		i := rng.Int63n(total)
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		if i >= live {
+			rv = append(rv, pending[i-live])
+			continue
+		}
+		p, err := t.nthPoint(i)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, p)
+	}
+	return rv, nil
+}
+
+// subtreeCount returns the number of live points in the subtree at offset.
+func (t *Tree) subtreeCount(offset int64) (int64, error) {
+	if offset == -1 {
+		return 0, nil
+	}
+	n, err := t.Node(offset)
+	return n.Count, err
+}
+
+// nthPoint returns the ith live point of the tree, counting in order of the
+// tree's splits, found by the subtree counts.
+func (t *Tree) nthPoint(i int64) (Point, error) {
+	n, err := t.Node(t.root)
+	for err == nil {
+		var left Node
+		if n.Left != -1 {
+			left, err = t.Node(n.Left)
+			if err != nil {
+				break
+			}
+			if i < left.Count {
+				n = left
+				continue
+			}
+			i -= left.Count
+		}
+		if !n.Deleted {
+			if i == 0 {
+				return n.Point, nil
+			}
+			i--
+		}
+		if n.Right == -1 {
+			return Point{}, ErrCorrupt.New("subtree counts don't add up")
+		}
+		n, err = t.Node(n.Right)
+	}
+	return Point{}, err
+}
+
+// sampleScan is Sample by reservoir sampling every point Each visits.
+func (t *Tree) sampleScan(n int, rng *rand.Rand) ([]Point, error) {
+	rv := make([]Point, 0, n)
+	seen := 0
+	err := t.Each(func(p Point) error {
+		seen++
+		if len(rv) < n {
+			rv = append(rv, p)
+		} else if j := rng.Intn(seen); j < n {
+			rv[j] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rng.Shuffle(len(rv), func(i, j int) { rv[i], rv[j] = rv[j], rv[i] })
+	return rv, nil
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSample(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(100, 2, 10)
+	for i := range points {
+		points[i].Data = []byte{byte(i)}
+	}
+	tree := createTestTree(t, fs, 2, 10, points[:90], BuildOptions{})
+	tree.Close()
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	for _, p := range points[:10] {
+		err = rw.Delete(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range points[90:] {
+		err = rw.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(0))
+	hits := make([]int, len(points))
+	for _, n := range []int{1, 5, 30, 45, 60, 90, 200} {
+		for trial := 0; trial < 200; trial++ {
+			sample, err := rw.Sample(n, rng)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := n
+			if expected > 90 {
+				expected = 90
+			}
+			if len(sample) != expected {
+				t.Fatalf("sampled %d points, expected %d", len(sample), expected)
+			}
+			seen := map[byte]bool{}
+			for _, p := range sample {
+				i := p.Data[0]
+				if i < 10 {
+					t.Fatalf("sampled deleted point %d", i)
+				}
+				if seen[i] {
+					t.Fatalf("sampled point %d twice", i)
+				}
+				seen[i] = true
+				if n == 5 {
+					hits[i]++
+				}
+			}
+		}
+	}
+	// each of the 90 live points should be in about 5/90 of the 200
+	// samples of 5, or 11 of them
+	for i, h := range hits[10:] {
+		if h == 0 || h > 40 {
+			t.Fatalf("point %d sampled %d times", i+10, h)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"io"
+)
+
+// Shrink writes a copy of src to dst with the max data length lowered to the
+// longest Data actually stored, which trims the padding of every node. The
+// structure of the tree is unchanged. It returns how many bytes smaller the
+// copy is.
+func Shrink(dst io.Writer, src *Tree) (saved int64, err error) {
+	if src.footer.variableData {
+		return 0, errClass.New("tree data is already unpadded")
+	}
+	maxDataLen := 0
+	err = src.scan(func(offset int64, n Node) error {
+		if len(n.Point.Data) > maxDataLen {
+			maxDataLen = len(n.Point.Data)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	f := src.footer
+	if tf := f.timeField; tf != nil && maxDataLen < tf.Offset+tf.Width {
+		maxDataLen = tf.Offset + tf.Width
+	}
+	if tf := f.tagField; tf != nil && maxDataLen < tf.Offset+tf.Width {
+		maxDataLen = tf.Offset + tf.Width
+	}
+	f.maxDataLen = maxDataLen
+	// the checksums cover the padding, so they aren't carried over
+	f.checksums = false
+	nodelen := f.nodeSize()
+	relocate := func(offset int64) int64 {
+		if offset == -1 {
+			return -1
+		}
+		return offset / src.nodelen * nodelen
+	}
+	f.root = relocate(f.root)
+
+	w := bufio.NewWriter(dst)
+	err = src.scan(func(offset int64, n Node) error {
+		n.Left = relocate(n.Left)
+		n.Right = relocate(n.Right)
+		return n.serializeCoords(w, f.coords(), maxDataLen, nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	// the box and tag tables are by node index, so they carry over as is
+	_, err = io.Copy(w, io.NewSectionReader(src.r, src.boxesOffset(),
+		f.boxesLen()+f.tagsLen()))
+	if err != nil {
+		return 0, errClass.Wrap(err)
+	}
+	err = f.serialize(w)
+	if err != nil {
+		return 0, err
+	}
+	err = w.Flush()
+	if err != nil {
+		return 0, errClass.Wrap(err)
+	}
+	return src.count * (src.nodelen - nodelen), nil
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"os"
+	"testing"
+)
+
+func TestShrink(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	// points carry at most 20 bytes of data in a tree that allows 4096
+	tree := createTestTree(t, fs, 3, 4096, newTestPoints(300, 3, 20),
+		BuildOptions{})
+	defer tree.Close()
+
+	fh, err := os.Create(fs.Path("shrunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := Shrink(fh, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shrunk, err := OpenTree(fs.Path("shrunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shrunk.Close()
+
+	before, err := os.Stat(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(shrunk.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved <= 0 || before.Size()-after.Size() != saved {
+		t.Fatalf("reported %d bytes saved, actually saved %d", saved,
+			before.Size()-after.Size())
+	}
+	if shrunk.Count() != tree.Count() {
+		t.Fatal("point count changed")
+	}
+
+	for i := 0; i < 20; i++ {
+		q := NewPoint(3, 20)
+		expected, err := tree.Nearest(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := shrunk.Nearest(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range expected {
+			if !expected[j].Point.equal(&actual[j].Point) {
+				t.Fatal("shrunk tree returned different results")
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"os"
+)
+
+// Snapshot returns a read-only view of the tree as it is now, which can be
+// queried and closed independently of t. The view has its own handle on the
+// tree file and its own copy of the list of pending points, so a long scan
+// of it is unaffected by later inserts, or by Compact or Merge on t, which
+// replace the tree file rather than changing it, leaving the view reading
+// the old file until it is closed. Deletions are the exception: they are
+// written in place, so the view sees points deleted after it was taken go
+// missing. Snapshot must not be called concurrently with Compact or Merge.
+func (t *Tree) Snapshot() (*Tree, error) {
+	if t.fh == nil {
+		return nil, errClass.New("tree has no file to snapshot")
+	}
+	fh, err := os.Open(t.path)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	nt, err := openTree(t.path, fh, false, t.opts)
+	if err != nil {
+		return nil, err
+	}
+	nt.pending = &pendingLog{path: t.pending.path,
+		points: t.pending.snapshot()}
+	return nt, nil
+}
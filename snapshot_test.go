@@ -0,0 +1,88 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(300, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points[:200], BuildOptions{})
+	tree.Close()
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	for _, p := range points[200:250] {
+		err = rw.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap, err := rw.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	err = snap.Insert(points[0])
+	if err == nil {
+		t.Fatal("expected the snapshot to refuse inserts")
+	}
+
+	for _, p := range points[250:] {
+		err = rw.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = rw.Merge(fs.Temp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw.Count() != 300 {
+		t.Fatalf("tree has %d points, expected 300", rw.Count())
+	}
+
+	if snap.Count() != 250 {
+		t.Fatalf("snapshot has %d points, expected 250", snap.Count())
+	}
+	seen := 0
+	err = snap.Each(func(Point) error {
+		seen++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != 250 {
+		t.Fatalf("snapshot scan saw %d points, expected 250", seen)
+	}
+	for _, p := range points[:250] {
+		nearest, err := snap.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nearest[0].Point.equal(&p) {
+			t.Fatal("snapshot lost a point")
+		}
+	}
+}
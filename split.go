@@ -0,0 +1,177 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"sort"
+)
+
+// SplitStrategy is how a build chooses the point each node splits the
+// points of its subtree at. Every node holds a point, so a split is always
+// at one of the points being split, which then goes in the node. Searches
+// read any tree the same way, whatever the strategy it was built with.
+type SplitStrategy int
+
+const (
+	// MedianSplit splits at the median along the split dimension, for a
+	// balanced tree. It is the default.
+	MedianSplit SplitStrategy = iota
+	// SlidingMidpointSplit splits at the point nearest the middle of the
+	// points' extent along the split dimension. Cells stay closer to square
+	// than with median splits where points are clustered, which prunes more
+	// of the tree per query, at the cost of an unbalanced tree. A midpoint
+	// in empty space between clusters slides to the point nearest it, so
+	// every split still separates points.
+	SlidingMidpointSplit
+	// SurfaceAreaSplit splits at the point that minimizes the number of
+	// points on each side times the surface area of that side's cell,
+	// summed, which cuts empty space away from dense regions while keeping
+	// the tree roughly balanced where points are spread evenly.
+	SurfaceAreaSplit
+)
+
+func (s SplitStrategy) check() error {
+	if s < MedianSplit || s > SurfaceAreaSplit {
+		return errClass.New("unknown split strategy %d", s)
+	}
+	return nil
+}
+
+// index returns the index of the point of pts, which are sorted along dim
+// and lie within min and max, to split them at. Builds that only sample the
+// points to be split choose from the sample.
+func (s SplitStrategy) index(pts []Point, dim int, min, max []float64) int {
+	mid := len(pts) / 2
+	switch s {
+	case SlidingMidpointSplit:
+		target := (min[dim] + max[dim]) / 2
+		i := sort.Search(len(pts), func(i int) bool {
+			return pts[i].Pos[dim] >= target
+		})
+		if i == len(pts) ||
+			(i > 0 && target-pts[i-1].Pos[dim] < pts[i].Pos[dim]-target) {
+			i--
+		}
+		return i
+	case SurfaceAreaSplit:
+		ext := make([]float64, len(min))
+		for i := range ext {
+			ext[i] = max[i] - min[i]
+		}
+		cost := func(i int) float64 {
+			split := pts[i].Pos[dim]
+			ext[dim] = split - min[dim]
+			left := surfaceArea(ext)
+			ext[dim] = max[dim] - split
+			right := surfaceArea(ext)
+			return float64(i)*left + float64(len(pts)-1-i)*right
+		}
+		best, bestCost := mid, cost(mid)
+		for i := range pts {
+			if c := cost(i); c < bestCost {
+				best, bestCost = i, c
+			}
+		}
+		return best
+	default:
+		return mid
+	}
+}
+
+// DimensionChoice is how a build chooses the dimension each node splits the
+// points of its subtree along. Each node records its dimension, so searches
+// read any tree the same way, whatever the choice it was built with.
+type DimensionChoice int
+
+const (
+	// CycleDimensions splits along each dimension in turn, starting with the
+	// first at the root. It is the default.
+	CycleDimensions DimensionChoice = iota
+	// WidestDimension splits along the dimension the points spread furthest
+	// along, so that for anisotropic data the long axes are cut first and
+	// queries descend through fewer levels that barely narrow the search.
+	WidestDimension
+	// VarianceDimension splits along the dimension of greatest variance,
+	// which is WidestDimension but less swayed by outliers.
+	VarianceDimension
+)
+
+func (c DimensionChoice) check() error {
+	if c < CycleDimensions || c > VarianceDimension {
+		return errClass.New("unknown dimension choice %d", c)
+	}
+	return nil
+}
+
+// choose returns the dimension to split points within min and max along,
+// given a sample of them, pts, and dim, the next dimension in turn.
+func (c DimensionChoice) choose(pts []Point, min, max []float64,
+	dim int) int {
+	best, bestScore := dim, -1.0
+	for i := range min {
+		var score float64
+		switch c {
+		case WidestDimension:
+			score = max[i] - min[i]
+		case VarianceDimension:
+			var sum, sumSq float64
+			for _, p := range pts {
+				sum += p.Pos[i]
+				sumSq += p.Pos[i] * p.Pos[i]
+			}
+			mean := sum / float64(len(pts))
+			score = sumSq/float64(len(pts)) - mean*mean
+		default:
+			return dim
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// pointBounds returns the smallest box holding pts.
+func pointBounds(pts []Point) (min, max []float64) {
+	min = append([]float64(nil), pts[0].Pos...)
+	max = append([]float64(nil), pts[0].Pos...)
+	for _, p := range pts[1:] {
+		for i, v := range p.Pos {
+			if v < min[i] {
+				min[i] = v
+			}
+			if v > max[i] {
+				max[i] = v
+			}
+		}
+	}
+	return min, max
+}
+
+// surfaceArea returns the surface area of a box with the given extents: the
+// sum over each pair of opposite faces of their combined area.
+func surfaceArea(ext []float64) float64 {
+	var area float64
+	for i := range ext {
+		face := 2.0
+		for j, e := range ext {
+			if j != i {
+				face *= e
+			}
+		}
+		area += face
+	}
+	return area
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSplitIndex(t *testing.T) {
+	var pts []Point
+	for _, x := range []float64{0, 1, 2, 3, 100} {
+		pts = append(pts, Point{Pos: []float64{x, x / 100}})
+	}
+	min, max := pointBounds(pts)
+	for s, expected := range map[SplitStrategy]int{
+		MedianSplit:          2,
+		SlidingMidpointSplit: 3,
+		SurfaceAreaSplit:     3,
+	} {
+		if i := s.index(pts, 0, min, max); i != expected {
+			t.Fatalf("strategy %d split at %d, expected %d", s, i, expected)
+		}
+	}
+}
+
+func TestSplitStrategies(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	// a few tight clusters, far apart
+	var points []Point
+	for i := 0; i < 1000; i++ {
+		p := NewPoint(2, 1)
+		p.Pos[0] = float64(i%4*100) + rand.Float64()
+		p.Pos[1] = float64(i%3*100) + rand.Float64()
+		points = append(points, p)
+	}
+	for _, s := range []SplitStrategy{MedianSplit, SlidingMidpointSplit,
+		SurfaceAreaSplit} {
+		opts := BuildOptions{SplitStrategy: s}
+		mem, err := CreateTreeInMemory(2, 1, points, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tree := range []*Tree{createTestTree(t, fs, 2, 1, points, opts),
+			mem} {
+			if got := tree.Info().Options.SplitStrategy; got != s {
+				t.Fatalf("tree records split strategy %d, expected %d", got, s)
+			}
+			err = tree.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, q := range newTestPoints(20, 2, 1) {
+				q.Pos[0] *= 400
+				q.Pos[1] *= 300
+				nearest, err := tree.Nearest(q, 5)
+				if err != nil {
+					t.Fatal(err)
+				}
+				all, err := tree.NearestExhaustive(q, 5)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range all {
+					if nearest[i].Distance != all[i].Distance {
+						t.Fatalf("strategy %d: result %d at %v, expected %v", s,
+							i, nearest[i].Distance, all[i].Distance)
+					}
+				}
+			}
+			tree.Close()
+		}
+	}
+
+	_, err := CreateTreeInMemory(2, 1, points,
+		BuildOptions{SplitStrategy: SurfaceAreaSplit + 1})
+	if err == nil {
+		t.Fatal("expected an unknown split strategy to fail")
+	}
+}
+
+func TestSplitDimension(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	// spread a thousand times wider along the first dimension
+	points := newTestPoints(1000, 2, 1)
+	for i := range points {
+		points[i].Pos[0] *= 1000
+	}
+	for _, c := range []DimensionChoice{CycleDimensions, WidestDimension,
+		VarianceDimension} {
+		opts := BuildOptions{SplitDimension: c}
+		mem, err := CreateTreeInMemory(2, 1, points, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tree := range []*Tree{createTestTree(t, fs, 2, 1, points, opts),
+			mem} {
+			if got := tree.Info().Options.SplitDimension; got != c {
+				t.Fatalf("tree records dimension choice %d, expected %d", got, c)
+			}
+			root, err := tree.Root()
+			if err != nil {
+				t.Fatal(err)
+			}
+			left, err := tree.Node(root.Left)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := uint32(0)
+			if c == CycleDimensions {
+				expected = 1
+			}
+			if left.Dim != expected {
+				t.Fatalf("choice %d: second level splits along %d, expected %d",
+					c, left.Dim, expected)
+			}
+			for _, q := range newTestPoints(20, 2, 1) {
+				q.Pos[0] *= 1000
+				nearest, err := tree.Nearest(q, 5)
+				if err != nil {
+					t.Fatal(err)
+				}
+				all, err := tree.NearestExhaustive(q, 5)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range all {
+					if nearest[i].Distance != all[i].Distance {
+						t.Fatalf("choice %d: result %d at %v, expected %v", c, i,
+							nearest[i].Distance, all[i].Distance)
+					}
+				}
+			}
+			tree.Close()
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"io"
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// QueryStats describes the work done by a single query.
+type QueryStats struct {
+	NodesVisited int64
+	BytesRead    int64
+	// PointsCompared is the number of distances measured from the query
+	// point, to visited nodes and pending points.
+	PointsCompared int64
+	// SubtreesPruned is the number of subtrees skipped without being read,
+	// as too far away to hold any results. A query that prunes little for
+	// the nodes it visits is one the tree's splits do little to help.
+	SubtreesPruned int64
+}
+
+// statsBuckets is the number of histogram buckets. Bucket i counts queries
+// that visited fewer than 2^i nodes but at least 2^(i-1).
+const statsBuckets = 64
+
+// AggregateStats sums the QueryStats of every query since the tree was
+// opened or the stats were last reset.
+type AggregateStats struct {
+	Queries        int64
+	NodesVisited   int64
+	BytesRead      int64
+	PointsCompared int64
+	SubtreesPruned int64
+	// NodesVisitedHistogram counts queries by the number of nodes they
+	// visited. Bucket 0 counts queries that visited no nodes, and bucket i
+	// counts queries that visited at least 2^(i-1) and fewer than 2^i nodes.
+	NodesVisitedHistogram [statsBuckets]int64
+}
+
+// NodesVisitedPercentile returns an upper bound on the number of nodes
+// visited by the fraction p of queries that visited the fewest, so 0.5 gives
+// the median and 0.99 the 99th percentile. The bound is exact to within a
+// factor of two.
+func (s *AggregateStats) NodesVisitedPercentile(p float64) int64 {
+	// the query at the percentile is the ceil(p*Queries)th fewest, and
+	// at least the first
+	target := int64(math.Ceil(p * float64(s.Queries)))
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, count := range s.NodesVisitedHistogram {
+		seen += count
+		if count > 0 && seen >= target {
+			if i == 0 {
+				return 0
+			}
+			return 1<<uint(i) - 1
+		}
+	}
+	return 0
+}
+
+// statsCounters accumulates QueryStats without locking.
+type statsCounters struct {
+	queries        int64
+	nodesVisited   int64
+	bytesRead      int64
+	pointsCompared int64
+	subtreesPruned int64
+	histogram      [statsBuckets]int64
+}
+
+func (c *statsCounters) record(s QueryStats) {
+	atomic.AddInt64(&c.queries, 1)
+	atomic.AddInt64(&c.nodesVisited, s.NodesVisited)
+	atomic.AddInt64(&c.bytesRead, s.BytesRead)
+	atomic.AddInt64(&c.pointsCompared, s.PointsCompared)
+	atomic.AddInt64(&c.subtreesPruned, s.SubtreesPruned)
+	atomic.AddInt64(&c.histogram[bits.Len64(uint64(s.NodesVisited))], 1)
+}
+
+// AggregateStats returns the accumulated stats of every Nearest and
+// NearestExhaustive query on t. Counters are read one at a time, so a
+// snapshot taken during queries may be slightly inconsistent.
+func (t *Tree) AggregateStats() AggregateStats {
+	c := t.stats
+	rv := AggregateStats{
+		Queries:        atomic.LoadInt64(&c.queries),
+		NodesVisited:   atomic.LoadInt64(&c.nodesVisited),
+		BytesRead:      atomic.LoadInt64(&c.bytesRead),
+		PointsCompared: atomic.LoadInt64(&c.pointsCompared),
+		SubtreesPruned: atomic.LoadInt64(&c.subtreesPruned)}
+	for i := range c.histogram {
+		rv.NodesVisitedHistogram[i] = atomic.LoadInt64(&c.histogram[i])
+	}
+	return rv
+}
+
+// ResetStats zeroes the accumulated stats.
+func (t *Tree) ResetStats() {
+	c := t.stats
+	atomic.StoreInt64(&c.queries, 0)
+	atomic.StoreInt64(&c.nodesVisited, 0)
+	atomic.StoreInt64(&c.bytesRead, 0)
+	atomic.StoreInt64(&c.pointsCompared, 0)
+	atomic.StoreInt64(&c.subtreesPruned, 0)
+	for i := range c.histogram {
+		atomic.StoreInt64(&c.histogram[i], 0)
+	}
+}
+
+// TreeStats describes the shape of a tree, e.g. for deciding when a tree that
+// has absorbed many deletions and inserts should be rebuilt.
+type TreeStats struct {
+	// Depth is the number of levels in the tree.
+	Depth int
+	// Nodes is the number of points stored, including deleted points.
+	Nodes int64
+	// Deleted is the number of deleted points still stored.
+	Deleted int64
+	// Pending is the number of inserted points waiting to be merged in.
+	Pending int
+	// Levels describes each level of the tree, starting with the root.
+	Levels []LevelStats
+	// FileSize is the size of the tree file in bytes.
+	FileSize int64
+	// MaxDataLen is the longest Data a point may have.
+	MaxDataLen int
+}
+
+// LevelStats describes one level of a tree. A node's imbalance is the
+// difference between the number of live points in its two subtrees divided
+// by the number in its own subtree, so it is 0 for a perfectly balanced node
+// and near 1 for a node with every point on one side.
+type LevelStats struct {
+	Nodes         int64
+	MeanImbalance float64
+	MaxImbalance  float64
+}
+
+// Stats walks the whole tree and describes its shape.
+func (t *Tree) Stats() (TreeStats, error) {
+	meter := newWriteMeter(io.Discard)
+	err := t.footer.serialize(meter)
+	if err != nil {
+		return TreeStats{}, err
+	}
+	stats := TreeStats{
+		Pending:    t.Pending(),
+		FileSize:   t.tagsOffset() + t.footer.tagsLen() + meter.Amount,
+		MaxDataLen: t.footer.maxDataLen}
+
+	var walk func(offset int64, level int) (count int64, err error)
+	walk = func(offset int64, level int) (count int64, err error) {
+		if offset == -1 {
+			return 0, nil
+		}
+		n, err := t.Node(offset)
+		if err != nil {
+			return 0, err
+		}
+		if level == len(stats.Levels) {
+			stats.Levels = append(stats.Levels, LevelStats{})
+		}
+		left, err := walk(n.Left, level+1)
+		if err != nil {
+			return 0, err
+		}
+		right, err := walk(n.Right, level+1)
+		if err != nil {
+			return 0, err
+		}
+		stats.Nodes++
+		if n.Deleted {
+			stats.Deleted++
+		}
+		ls := &stats.Levels[level]
+		ls.Nodes++
+		if n.Count > 0 {
+			imbalance := math.Abs(float64(left-right)) / float64(n.Count)
+			ls.MeanImbalance += imbalance
+			ls.MaxImbalance = math.Max(ls.MaxImbalance, imbalance)
+		}
+		return n.Count, nil
+	}
+	_, err = walk(t.root, 0)
+	if err != nil {
+		return TreeStats{}, err
+	}
+	for i := range stats.Levels {
+		stats.Levels[i].MeanImbalance /= float64(stats.Levels[i].Nodes)
+	}
+	stats.Depth = len(stats.Levels)
+	return stats, nil
+}
@@ -0,0 +1,184 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestAggregateStats(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	tree := createTestTree(t, fs, 3, 10, newTestPoints(500, 3, 10),
+		BuildOptions{})
+	defer tree.Close()
+
+	var mu sync.Mutex
+	var expected AggregateStats
+	var maxVisited int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, stats, err := tree.NearestWithStats(NewPoint(3, 10), 5)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				expected.Queries++
+				expected.NodesVisited += stats.NodesVisited
+				expected.BytesRead += stats.BytesRead
+				expected.PointsCompared += stats.PointsCompared
+				expected.SubtreesPruned += stats.SubtreesPruned
+				if stats.NodesVisited > maxVisited {
+					maxVisited = stats.NodesVisited
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	actual := tree.AggregateStats()
+	if actual.Queries != expected.Queries ||
+		actual.NodesVisited != expected.NodesVisited ||
+		actual.BytesRead != expected.BytesRead ||
+		actual.PointsCompared != expected.PointsCompared ||
+		actual.SubtreesPruned != expected.SubtreesPruned {
+		t.Fatalf("got %+v, expected %+v", actual, expected)
+	}
+	if actual.BytesRead != actual.NodesVisited*tree.nodelen {
+		t.Fatal("bytes read doesn't match nodes visited")
+	}
+	if actual.PointsCompared != actual.NodesVisited {
+		t.Fatal("points compared doesn't match nodes visited")
+	}
+	if actual.SubtreesPruned == 0 {
+		t.Fatal("no subtrees pruned")
+	}
+	var histogramTotal int64
+	for _, count := range actual.NodesVisitedHistogram {
+		histogramTotal += count
+	}
+	if histogramTotal != actual.Queries {
+		t.Fatalf("histogram counts %d queries, expected %d", histogramTotal,
+			actual.Queries)
+	}
+	p50 := actual.NodesVisitedPercentile(0.5)
+	p100 := actual.NodesVisitedPercentile(1)
+	if p50 > p100 || p100 < maxVisited || p100 >= 2*maxVisited {
+		t.Fatalf("bad percentiles: p50 %d, p100 %d, max %d", p50, p100,
+			maxVisited)
+	}
+
+	tree.ResetStats()
+	if stats := tree.AggregateStats(); stats != (AggregateStats{}) {
+		t.Fatalf("stats not reset: %+v", stats)
+	}
+}
+
+func TestNodesVisitedPercentile(t *testing.T) {
+	// nine queries visited one node and one visited 20
+	var stats AggregateStats
+	stats.Queries = 10
+	stats.NodesVisitedHistogram[1] = 9
+	stats.NodesVisitedHistogram[5] = 1
+	for _, c := range []struct {
+		p        float64
+		expected int64
+	}{
+		{0, 1},
+		{0.01, 1},
+		{0.5, 1},
+		{0.9, 1},
+		// the 10th query, though p*Queries truncates to 9
+		{0.95, 31},
+		{0.99, 31},
+		{1, 31},
+	} {
+		actual := stats.NodesVisitedPercentile(c.p)
+		if actual != c.expected {
+			t.Fatalf("percentile %v: got %d, expected %d", c.p, actual,
+				c.expected)
+		}
+	}
+
+	if actual := (&AggregateStats{}).NodesVisitedPercentile(0.5); actual != 0 {
+		t.Fatalf("got %d with no queries, expected 0", actual)
+	}
+}
+
+func TestTreeStats(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+	tree, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for _, p := range points[:20] {
+		err = tree.Delete(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range newTestPoints(5, 3, 10) {
+		err = tree.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := tree.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Nodes != 500 || stats.Deleted != 20 || stats.Pending != 5 ||
+		stats.MaxDataLen != 10 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	var buf bytes.Buffer
+	_, err = tree.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FileSize != int64(buf.Len()) {
+		t.Fatalf("got file size %d, expected %d", stats.FileSize, buf.Len())
+	}
+	if stats.Depth != len(stats.Levels) || stats.Depth < 9 {
+		t.Fatalf("unexpected depth %d", stats.Depth)
+	}
+	var nodes int64
+	for i, level := range stats.Levels {
+		nodes += level.Nodes
+		if level.Nodes > 1<<uint(i) || level.MaxImbalance > 1 ||
+			level.MeanImbalance > level.MaxImbalance {
+			t.Fatalf("unexpected level %d stats %+v", i, level)
+		}
+	}
+	if nodes != stats.Nodes || stats.Levels[0].Nodes != 1 {
+		t.Fatalf("levels have %d nodes, expected %d", nodes, stats.Nodes)
+	}
+}
@@ -0,0 +1,542 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+// storeManifestVersion is the version of the manifest format a Store
+// writes.
+const storeManifestVersion = 1
+
+// storeManifestName is the name of a Store's manifest within its directory.
+const storeManifestName = "MANIFEST"
+
+// StoreOptions configures a Store.
+type StoreOptions struct {
+	// TmpDir is where builds keep their temporary files. Defaults to the
+	// Store's directory.
+	TmpDir string
+	// Build configures the build of each generation.
+	Build BuildOptions
+	// Open configures how each generation is opened.
+	Open OpenOptions
+}
+
+// Store keeps a dataset as immutable generations, each a tree in a file of
+// its own, listed by a manifest in the same directory. Adding points or
+// compacting generations builds new files without touching the ones in use,
+// then replaces the manifest atomically, so that queries never wait on
+// maintenance and a crash at any point leaves the previous manifest, and
+// every generation it lists, intact.
+//
+// Queries that start before a change finish on the generations they
+// started with, whose files are removed once the last of them does, and
+// queries that start after it see the new ones. A Store is safe for
+// concurrent use, but only one process may open a directory at a time.
+type Store struct {
+	dir              string
+	dims, maxDataLen int
+	opts             StoreOptions
+
+	// compacting is held by Compact, so that only one compaction runs at a
+	// time.
+	compacting sync.Mutex
+	// ctx is canceled by Close, stopping the builds of compactions and Adds
+	// in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	current  *storeVersion // nil once closed
+	next     uint64
+	inFlight sync.WaitGroup
+}
+
+var _ Searcher = (*Store)(nil)
+
+// storeGen is a generation of a Store, numbered seq.
+type storeGen struct {
+	seq  uint64
+	path string
+	tree *Tree
+	// refs counts the versions listing the generation, and obsolete is set
+	// once the manifest no longer does. Both are guarded by Store.mu.
+	refs     int
+	obsolete bool
+}
+
+// storeVersion is the set of generations a manifest lists. refs counts the
+// queries using it, plus one while it is current, and is guarded by
+// Store.mu.
+type storeVersion struct {
+	gens []*storeGen
+	refs int
+}
+
+// storeManifest is the serialized form of a Store's manifest.
+type storeManifest struct {
+	Version     int
+	Generations []uint64
+}
+
+// OpenStore opens the Store kept in dir for points with dims dimensions and
+// Data up to maxDataLen bytes long, creating it if dir has no manifest yet.
+// Generation files the manifest doesn't list, left behind by a crash
+// before the manifest was replaced, are removed.
+func OpenStore(dir string, dims, maxDataLen int, opts StoreOptions) (
+	*Store, error) {
+	err := checkNodeSize(int64(dims), int64(maxDataLen))
+	if err != nil {
+		return nil, err
+	}
+	if opts.Build.Normalize {
+		return nil, ErrUnsupported.New("a store's generations can't each " +
+			"be normalized")
+	}
+	if opts.TmpDir == "" {
+		opts.TmpDir = dir
+	}
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	s := &Store{
+		dir:        dir,
+		dims:       dims,
+		maxDataLen: maxDataLen,
+		opts:       opts,
+		next:       1,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	err = s.load()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the manifest in s.dir, opens the generations it lists and
+// removes the files it doesn't.
+func (s *Store) load() error {
+	s.current = &storeVersion{refs: 1}
+	var m storeManifest
+	data, err := os.ReadFile(s.manifestPath())
+	if os.IsNotExist(err) {
+		err = s.writeManifest(nil)
+	} else if err == nil {
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			return ErrCorrupt.New("store manifest: %v", err)
+		}
+		if m.Version != storeManifestVersion {
+			return ErrVersion.New("store manifest version %d, expected %d",
+				m.Version, storeManifestVersion)
+		}
+	}
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+
+	listed := map[string]bool{}
+	for _, seq := range m.Generations {
+		g := &storeGen{seq: seq, path: s.genPath(seq), refs: 1}
+		listed[filepath.Base(g.path)] = true
+		g.tree, err = OpenTreeWithOptions(g.path, s.opts.Open)
+		if err != nil {
+			return err
+		}
+		s.current.gens = append(s.current.gens, g)
+		s.next = max(s.next, seq+1)
+		if g.tree.Dims() != s.dims {
+			return ErrDimensionMismatch.New("generation %s has %d dimensions, "+
+				"expected %d", g.path, g.tree.Dims(), s.dims)
+		}
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	for _, entry := range entries {
+		var seq uint64
+		name := entry.Name()
+		if listed[name] || !strings.HasSuffix(name, ".dkd") {
+			continue
+		}
+		_, err = fmt.Sscanf(name, "%d.dkd", &seq)
+		if err != nil {
+			continue
+		}
+		err = os.Remove(filepath.Join(s.dir, name))
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) manifestPath() string {
+	return filepath.Join(s.dir, storeManifestName)
+}
+
+func (s *Store) genPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d.dkd", seq))
+}
+
+// writeManifest replaces the manifest with one listing gens atomically.
+func (s *Store) writeManifest(gens []*storeGen) error {
+	m := storeManifest{Version: storeManifestVersion,
+		Generations: []uint64{}}
+	for _, g := range gens {
+		m.Generations = append(m.Generations, g.seq)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	path := s.manifestPath()
+	tmp := path + ".tmp"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	_, err = fh.Write(data)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err != nil {
+		fh.Close()
+		return errClass.Wrap(err)
+	}
+	err = fh.Close()
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	syncDir(s.dir)
+	return nil
+}
+
+// Dims returns the number of dimensions of the store's points.
+func (s *Store) Dims() int { return s.dims }
+
+// acquire returns the current version, marking a use of it in flight.
+func (s *Store) acquire() (*storeVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return nil, errClass.New("store closed")
+	}
+	s.current.refs++
+	s.inFlight.Add(1)
+	return s.current, nil
+}
+
+// release ends a use of v begun by acquire.
+func (s *Store) release(v *storeVersion) error {
+	s.mu.Lock()
+	err := s.unref(v)
+	s.mu.Unlock()
+	s.inFlight.Done()
+	return err
+}
+
+// unref drops a reference to v, closing the generations no version lists
+// anymore, and removing them if the manifest doesn't either. s.mu must be
+// held.
+func (s *Store) unref(v *storeVersion) error {
+	v.refs--
+	if v.refs > 0 {
+		return nil
+	}
+	var errs errors.ErrorGroup
+	for _, g := range v.gens {
+		g.refs--
+		if g.refs > 0 {
+			continue
+		}
+		errs.Add(g.tree.Close())
+		if g.obsolete {
+			errs.Add(errClass.Wrap(os.Remove(g.path)))
+		}
+	}
+	return errs.Finalize()
+}
+
+// Do calls fn with the trees of the current generations, oldest first,
+// which won't be closed before fn returns, even if a compaction replaces
+// them meanwhile. It returns fn's error, or else any error closing
+// generations that only fn was still using. fn must not keep the trees or
+// anything read from them that aliases their memory past returning.
+func (s *Store) Do(fn func(trees []*Tree) error) error {
+	v, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	trees := make([]*Tree, 0, len(v.gens))
+	for _, g := range v.gens {
+		trees = append(trees, g.tree)
+	}
+	err = fn(trees)
+	if rerr := s.release(v); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Count returns the number of points the store holds.
+func (s *Store) Count() (count int64) {
+	s.Do(func(trees []*Tree) error {
+		for _, t := range trees {
+			count += t.Count()
+		}
+		return nil
+	})
+	return count
+}
+
+// Generations returns the number of generations the store's points are
+// currently kept in.
+func (s *Store) Generations() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return 0
+	}
+	return len(s.current.gens)
+}
+
+// checkPoint checks that p is a valid point for the store.
+func (s *Store) checkPoint(p Point) error {
+	if len(p.Pos) != s.dims {
+		return ErrDimensionMismatch.New("point has wrong dimension: %d, "+
+			"expected %d", len(p.Pos), s.dims)
+	}
+	return checkFinite(p.Pos)
+}
+
+// Add builds points into a new generation and adds it to the manifest.
+func (s *Store) Add(points []Point) error {
+	for _, p := range points {
+		err := s.checkPoint(p)
+		if err != nil {
+			return err
+		}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	g, err := s.build(points, nil)
+	if err != nil {
+		return err
+	}
+	return s.install(g, nil)
+}
+
+// Compact merges every generation into one, replacing them in the manifest
+// once it is built. Queries keep running on the old generations meanwhile,
+// and Adds made meanwhile are kept as generations of their own.
+func (s *Store) Compact() error {
+	s.compacting.Lock()
+	defer s.compacting.Unlock()
+	v, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	if len(v.gens) < 2 {
+		return s.release(v)
+	}
+	sources := make([]*Tree, 0, len(v.gens))
+	for _, g := range v.gens {
+		sources = append(sources, g.tree)
+	}
+	g, err := s.build(nil, sources)
+	if err == nil {
+		err = s.install(g, v.gens)
+	}
+	if rerr := s.release(v); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// build builds a new generation out of points and the points of sources.
+func (s *Store) build(points []Point, sources []*Tree) (*storeGen, error) {
+	s.mu.Lock()
+	g := &storeGen{seq: s.next, path: s.genPath(s.next), refs: 1}
+	s.next++
+	s.mu.Unlock()
+
+	fs, err := newBaseFS(tempName(s.opts.TmpDir))
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Delete()
+	set, err := newPointSet(fs.Temp(), s.dims, s.maxDataLen, true)
+	if err != nil {
+		return nil, err
+	}
+	defer set.Close()
+	for _, p := range points {
+		err = set.Add(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range sources {
+		err = t.Each(func(p Point) error {
+			err := s.ctx.Err()
+			if err != nil {
+				return err
+			}
+			return set.Add(p)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t, err := CreateTreeContext(s.ctx, g.path, s.opts.TmpDir, set,
+		s.opts.Build)
+	if err != nil {
+		return nil, err
+	}
+	err = t.Close()
+	if err == nil {
+		g.tree, err = OpenTreeWithOptions(g.path, s.opts.Open)
+	}
+	if err != nil {
+		os.Remove(g.path)
+		return nil, err
+	}
+	return g, nil
+}
+
+// install makes a version of the current generations, with replaced taken
+// out and g put in their place, or added last if replaced is empty,
+// current, once the manifest lists it.
+func (s *Store) install(g *storeGen, replaced []*storeGen) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		g.tree.Close()
+		os.Remove(g.path)
+		return errClass.New("store closed")
+	}
+	gone := map[*storeGen]bool{}
+	for _, r := range replaced {
+		gone[r] = true
+	}
+	next := &storeVersion{refs: 1}
+	if len(replaced) > 0 {
+		next.gens = append(next.gens, g)
+	}
+	for _, c := range s.current.gens {
+		if !gone[c] {
+			c.refs++
+			next.gens = append(next.gens, c)
+		}
+	}
+	if len(replaced) == 0 {
+		next.gens = append(next.gens, g)
+	}
+
+	err := s.writeManifest(next.gens)
+	if err != nil {
+		for _, c := range next.gens {
+			c.refs--
+		}
+		g.tree.Close()
+		os.Remove(g.path)
+		return err
+	}
+	for _, r := range replaced {
+		r.obsolete = true
+	}
+	old := s.current
+	s.current = next
+	return s.unref(old)
+}
+
+// Nearest returns the n nearest points to p across every generation. IDs
+// in the results only identify points within their generation, so they
+// can't be passed to Tree.Get.
+func (s *Store) Nearest(p Point, n int) (rv []PointDistance, err error) {
+	err = s.checkPoint(p)
+	if err != nil || n <= 0 {
+		return nil, err
+	}
+	err = s.Do(func(trees []*Tree) error {
+		rv, err = (&Forest{trees: trees}).Nearest(p, n)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// Within returns every point within radius of p across every generation,
+// in no particular order. See Tree.Within.
+func (s *Store) Within(p Point, radius float64) (rv []Point, err error) {
+	if !(radius >= 0) {
+		return nil, errClass.New("invalid radius %v", radius)
+	}
+	err = s.checkPoint(p)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Do(func(trees []*Tree) error {
+		rv, err = (&Forest{trees: trees}).Within(p, radius)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// Close cancels the builds of compactions and Adds in progress, which then
+// fail, waits for queries in flight to finish and closes every generation.
+// Later queries fail, as do Adds and compactions that finish later anyway,
+// whose new generations are discarded.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	v := s.current
+	s.current = nil
+	s.mu.Unlock()
+	if v == nil {
+		return nil
+	}
+	s.cancel()
+	s.inFlight.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unref(v)
+}
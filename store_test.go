@@ -0,0 +1,191 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+	dir := fs.Path("store")
+
+	s, err := OpenStore(dir, 2, 8, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var points []Point
+	for batch := 0; batch < 3; batch++ {
+		added := newTestPoints(100, 2, 8)
+		err = s.Add(added)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, added...)
+	}
+	if s.Count() != 300 || s.Generations() != 3 {
+		t.Fatalf("%d points in %d generations", s.Count(), s.Generations())
+	}
+
+	// a query in flight keeps the generations it started with
+	started, compacted, done := make(chan struct{}), make(chan struct{}),
+		make(chan error)
+	go func() {
+		done <- s.Do(func(trees []*Tree) error {
+			close(started)
+			<-compacted
+			if len(trees) != 3 {
+				t.Errorf("%d trees", len(trees))
+			}
+			for _, tree := range trees {
+				_, err := tree.Nearest(points[0], 5)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}()
+	<-started
+	err = s.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Count() != 300 || s.Generations() != 1 {
+		t.Fatalf("%d points in %d generations", s.Count(), s.Generations())
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*.dkd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 4 {
+		t.Fatalf("%d generation files while in use", len(old))
+	}
+	close(compacted)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, err := filepath.Glob(filepath.Join(dir, "*.dkd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 {
+		t.Fatalf("%d generation files after compaction", len(left))
+	}
+
+	nearest, err := s.Nearest(points[42], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 1 || nearest[0].Distance != 0 {
+		t.Fatalf("unexpected nearest points %v", nearest)
+	}
+	within, err := s.Within(points[42], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(within) != 300 {
+		t.Fatalf("found %d points", len(within))
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// generations the manifest doesn't list are left over from a crash
+	err = os.WriteFile(filepath.Join(dir, "0000000000000099.dkd"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenStore(dir, 2, 8, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Count() != 300 || s.Generations() != 1 {
+		t.Fatalf("%d points in %d generations", s.Count(), s.Generations())
+	}
+	_, err = os.Stat(filepath.Join(dir, "0000000000000099.dkd"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("leftover generation not removed: %v", err)
+	}
+	_, err = OpenStore(dir, 3, 8, StoreOptions{})
+	if !ErrDimensionMismatch.Contains(err) {
+		t.Fatalf("expected dimension mismatch, got %v", err)
+	}
+}
+
+func TestStoreCloseCancelsCompact(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+	dir := fs.Path("store")
+
+	s, err := OpenStore(dir, 2, 8, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for batch := 0; batch < 3; batch++ {
+		err = s.Add(newTestPoints(100, 2, 8))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the compaction's build stalls until Close cancels it, so Close would
+	// never return if it waited for the compaction to finish instead
+	building := make(chan struct{})
+	var once sync.Once
+	s, err = OpenStore(dir, 2, 8, StoreOptions{Build: BuildOptions{
+		Progress: func(done, total int64) {
+			once.Do(func() {
+				close(building)
+				<-s.ctx.Done()
+			})
+		}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compacted := make(chan error)
+	go func() { compacted <- s.Compact() }()
+	<-building
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-compacted
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the compaction to be canceled, got %v", err)
+	}
+
+	s, err = OpenStore(dir, 2, 8, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Count() != 300 || s.Generations() != 3 {
+		t.Fatalf("%d points in %d generations", s.Count(), s.Generations())
+	}
+}
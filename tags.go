@@ -0,0 +1,169 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// TagField locates a little-endian unsigned bitmask of Width bytes (1, 2, 4
+// or 8) at byte Offset of each point's Data, with a bit for each of up to 64
+// tags. What the tags mean is up to the caller. Points whose Data is too
+// short to hold the bitmask have no tags.
+type TagField struct {
+	Offset int
+	Width  int
+}
+
+func (tf *TagField) check(maxDataLen int) error {
+	switch tf.Width {
+	case 1, 2, 4, 8:
+	default:
+		return errClass.New("invalid tag field width %d", tf.Width)
+	}
+	if tf.Offset < 0 || tf.Offset+tf.Width > maxDataLen {
+		return errClass.New("tag field doesn't fit in max data length %d",
+			maxDataLen)
+	}
+	return nil
+}
+
+// decode returns the tags stored in data.
+func (tf *TagField) decode(data []byte) uint64 {
+	if len(data) < tf.Offset+tf.Width {
+		return 0
+	}
+	b := data[tf.Offset : tf.Offset+tf.Width]
+	switch tf.Width {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(b))
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(b))
+	default:
+		return binary.LittleEndian.Uint64(b)
+	}
+}
+
+// TagFilter selects points by their tags. See TagField.
+type TagFilter struct {
+	// Required are the tags a point must all have.
+	Required uint64
+	// Excluded are the tags a point must have none of.
+	Excluded uint64
+}
+
+func (tf TagFilter) match(tags uint64) bool {
+	return tags&tf.Required == tf.Required && tags&tf.Excluded == 0
+}
+
+// tagEntrySize is the size of each node's entry in the tag table: the tags
+// any point in its subtree has, and then the tags every point in it has.
+const tagEntrySize = 2 * uint64Size
+
+// tagsLen is the size of the tag table, if there is one.
+func (f *footer) tagsLen() int64 {
+	if f.tagField == nil {
+		return 0
+	}
+	return f.count * tagEntrySize
+}
+
+// tagsOffset is where the tag table starts, after the box table.
+func (t *Tree) tagsOffset() int64 {
+	return t.boxesOffset() + t.footer.boxesLen()
+}
+
+// addTags appends a tag table to the tree file at path, which f describes,
+// for the tag field tf, and updates f to record it. There is an entry for
+// each node, in file order, summarizing the tags of every point in its
+// subtree, including deleted points.
+func addTags(path string, f *footer, tf TagField, fsync *syncer) error {
+	fh, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer fh.Close()
+	t := &Tree{r: fh, root: f.root, count: f.count, nodelen: f.nodeSize(),
+		footer: *f}
+	base := t.tagsOffset()
+	out := fsync.writer(fh)
+
+	var add func(offset int64) (any, all uint64, err error)
+	add = func(offset int64) (any, all uint64, err error) {
+		n, err := t.Node(offset)
+		if err != nil {
+			return 0, 0, err
+		}
+		any = tf.decode(n.Point.Data)
+		all = any
+		for _, child := range []int64{n.Left, n.Right} {
+			if child == -1 {
+				continue
+			}
+			childAny, childAll, err := add(child)
+			if err != nil {
+				return 0, 0, err
+			}
+			any |= childAny
+			all &= childAll
+		}
+		var entry [tagEntrySize]byte
+		binary.LittleEndian.PutUint64(entry[:], any)
+		binary.LittleEndian.PutUint64(entry[uint64Size:], all)
+		_, err = out.WriteAt(entry[:], base+offset/t.nodelen*tagEntrySize)
+		return any, all, errClass.Wrap(err)
+	}
+	if f.root != -1 {
+		_, _, err = add(f.root)
+		if err != nil {
+			return err
+		}
+	}
+	f.tagField = &tf
+	return errClass.Wrap(fh.Close())
+}
+
+// tagsPruned reports whether no point in the subtree at offset can match
+// filter, going by the tag table.
+func (t *Tree) tagsPruned(offset int64, filter *TagFilter) (bool, error) {
+	var entry [tagEntrySize]byte
+	_, err := t.r.ReadAt(entry[:], t.tagsOffset()+offset/t.nodelen*tagEntrySize)
+	if err != nil {
+		return false, errClass.Wrap(err)
+	}
+	any := binary.LittleEndian.Uint64(entry[:])
+	all := binary.LittleEndian.Uint64(entry[uint64Size:])
+	return any&filter.Required != filter.Required ||
+		all&filter.Excluded != 0, nil
+}
+
+// NearestTagged is Nearest, but only finds points whose tags match filter.
+// The tree must have been built with a TagField. Subtrees whose points can't
+// match are skipped without being read, going by the tags recorded for each
+// subtree, so a selective filter makes the search cheaper rather than
+// costlier.
+func (t *Tree) NearestTagged(p Point, n int, filter TagFilter) (
+	[]PointDistance, error) {
+	tf := t.footer.tagField
+	if tf == nil {
+		return nil, errClass.New("tree was built without a tag field")
+	}
+	rv, _, err := t.nearest(n, &nearestQuery{p: p, tags: &filter,
+		filter: func(p *Point) bool { return filter.match(tf.decode(p.Data)) }})
+	return rv, err
+}
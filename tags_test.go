@@ -0,0 +1,108 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestNearestTagged(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	rng := rand.New(rand.NewSource(0))
+	points := newTestPoints(500, 3, 10)
+	for i := range points {
+		// tags in the first byte, followed by more Data, with some points
+		// too short to have any
+		points[i].Data = append([]byte{byte(rng.Intn(16))},
+			points[i].Data[:len(points[i].Data)/2]...)
+		if i%50 == 0 {
+			points[i].Data = nil
+		}
+	}
+	tf := &TagField{Offset: 0, Width: 1}
+	decode := func(p *Point) uint64 { return tf.decode(p.Data) }
+
+	plain := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer plain.Close()
+	_, err := plain.NearestTagged(NewPoint(3, 10), 1, TagFilter{})
+	if err == nil {
+		t.Fatal("expected an error without a tag field")
+	}
+	_, err = CreateTreeInMemory(3, 10, points, BuildOptions{TagField: tf})
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected in-memory trees to refuse tags, got %v", err)
+	}
+
+	for _, opts := range []BuildOptions{
+		{TagField: tf},
+		{TagField: tf, VariableData: true, Boxes: true},
+	} {
+		tree := createTestTree(t, fs, 3, 10, points, opts)
+		if info := tree.Info(); info.Options.TagField == nil ||
+			*info.Options.TagField != *tf || info.Version != footerVersionTags {
+			t.Fatalf("%+v: tag field not recorded: %+v", opts, info)
+		}
+		for i, filter := range []TagFilter{
+			{},
+			{Required: 1},
+			{Excluded: 2},
+			{Required: 5, Excluded: 8},
+			{Required: 16},
+		} {
+			q := NewPoint(3, 10)
+			got, err := tree.NearestTagged(q, 5, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected []PointDistance
+			for _, p := range points {
+				if filter.match(decode(&p)) {
+					expected = append(expected,
+						PointDistance{Point: p, Distance: q.distanceSquared(&p)})
+				}
+			}
+			sortResults(expected)
+			if len(expected) > 5 {
+				expected = expected[:5]
+			}
+			if len(got) != len(expected) {
+				t.Fatalf("%+v: filter %d found %d points, expected %d", opts, i,
+					len(got), len(expected))
+			}
+			for j := range got {
+				if got[j].Distance != expected[j].Distance ||
+					!filter.match(decode(&got[j].Point)) {
+					t.Fatalf("%+v: filter %d result %d is wrong", opts, i, j)
+				}
+			}
+		}
+
+		// no point has tag 16, so the search stops at the root
+		tree.ResetStats()
+		_, err = tree.NearestTagged(NewPoint(3, 10), 5, TagFilter{Required: 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats := tree.AggregateStats(); stats.NodesVisited != 0 ||
+			stats.SubtreesPruned != 1 {
+			t.Fatalf("%+v: expected the root to be pruned, got %+v", opts,
+				stats)
+		}
+		tree.Close()
+	}
+}
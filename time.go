@@ -0,0 +1,89 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding/binary"
+)
+
+// TimeField locates a little-endian signed integer timestamp of Width bytes
+// (1, 2, 4 or 8) at byte Offset of each point's Data. The units are up to
+// the caller.
+type TimeField struct {
+	Offset int
+	Width  int
+}
+
+func (tf *TimeField) check(maxDataLen int) error {
+	switch tf.Width {
+	case 1, 2, 4, 8:
+	default:
+		return errClass.New("invalid time field width %d", tf.Width)
+	}
+	if tf.Offset < 0 || tf.Offset+tf.Width > maxDataLen {
+		return errClass.New("time field doesn't fit in max data length %d",
+			maxDataLen)
+	}
+	return nil
+}
+
+// decode returns the timestamp stored in data, and false if data is too
+// short to hold one.
+func (tf *TimeField) decode(data []byte) (int64, bool) {
+	if len(data) < tf.Offset+tf.Width {
+		return 0, false
+	}
+	b := data[tf.Offset : tf.Offset+tf.Width]
+	switch tf.Width {
+	case 1:
+		return int64(int8(b[0])), true
+	case 2:
+		return int64(int16(binary.LittleEndian.Uint16(b))), true
+	case 4:
+		return int64(int32(binary.LittleEndian.Uint32(b))), true
+	default:
+		return int64(binary.LittleEndian.Uint64(b)), true
+	}
+}
+
+// NearestInTimeRange returns the point nearest p whose timestamp is between
+// t0 and t1 inclusive, and false if there is none. The tree must have been
+// built with a TimeField. Points whose Data is too short to hold a timestamp
+// never match.
+func (t *Tree) NearestInTimeRange(p Point, t0, t1 int64) (Point, bool,
+	error) {
+	tf := t.footer.timeField
+	if tf == nil {
+		return Point{}, false, errClass.New("tree was built without a time field")
+	}
+	err := t.checkDims(p)
+	if err != nil {
+		return Point{}, false, err
+	}
+	q := nearestQuery{p: p, h: make(maxHeap, 0, 1), exclude: -1,
+		filter: func(n *Point) bool {
+			ts, ok := tf.decode(n.Data)
+			return ok && t0 <= ts && ts <= t1
+		}}
+	err = t.search(t.root, &q)
+	if err != nil {
+		return Point{}, false, err
+	}
+	t.searchPending(&q)
+	if q.h.Len() == 0 {
+		return Point{}, false, nil
+	}
+	return q.h.Max().Point, true, nil
+}
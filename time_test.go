@@ -0,0 +1,87 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+func TestNearestInTimeRange(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	// each point has a 4 byte tag followed by an 8 byte timestamp
+	points := make([]Point, 0, 500)
+	for i := 0; i < cap(points); i++ {
+		p := NewPoint(2, 1)
+		p.Data = make([]byte, 12)
+		binary.LittleEndian.PutUint64(p.Data[4:], uint64(rand.Int63n(1000)-500))
+		points = append(points, p)
+	}
+	tree := createTestTree(t, fs, 2, 12, points,
+		BuildOptions{TimeField: &TimeField{Offset: 4, Width: 8}})
+	tree.Close()
+	tree, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	timestamp := func(p *Point) int64 {
+		return int64(binary.LittleEndian.Uint64(p.Data[4:]))
+	}
+	for i := 0; i < 50; i++ {
+		q := NewPoint(2, 1)
+		t0 := rand.Int63n(1000) - 500
+		t1 := t0 + rand.Int63n(100)
+
+		var expected *Point
+		for j := range points {
+			ts := timestamp(&points[j])
+			if ts < t0 || ts > t1 {
+				continue
+			}
+			if expected == nil ||
+				q.distanceSquared(&points[j]) < q.distanceSquared(expected) {
+				expected = &points[j]
+			}
+		}
+
+		actual, found, err := tree.NearestInTimeRange(q, t0, t1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != (expected != nil) {
+			t.Fatalf("found %v, expected %v", found, expected != nil)
+		}
+		if found && !actual.equal(expected) {
+			t.Fatal("wrong point found")
+		}
+	}
+
+	_, _, err = tree.NearestInTimeRange(NewPoint(2, 1), 1000, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := createTestTree(t, fs, 2, 12, points, BuildOptions{})
+	defer plain.Close()
+	_, _, err = plain.NearestInTimeRange(NewPoint(2, 1), 0, 1)
+	if err == nil {
+		t.Fatal("expected an error without a time field")
+	}
+}
@@ -0,0 +1,472 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+// TimelineOptions configures a Timeline.
+type TimelineOptions struct {
+	// BucketWidth is the span of time each bucket covers. Defaults to an
+	// hour.
+	BucketWidth time.Duration
+	// Retention, if positive, is how long buckets are kept once their span
+	// is over. Older buckets are deleted, and points for them are refused.
+	Retention time.Duration
+	// MaxPending, if positive, is the most inserted points that may wait in
+	// a bucket's pending log, as with Tree.Insert, before the bucket is
+	// rebuilt to include them. Otherwise a bucket is only rebuilt once a
+	// point for a later bucket is inserted.
+	MaxPending int
+	// TmpDir is where builds keep their temporary files. Defaults to the
+	// Timeline's directory.
+	TmpDir string
+	// Build configures the build of each bucket. Its TimeField is set by
+	// the Timeline.
+	Build BuildOptions
+	// Open configures how each bucket is opened.
+	Open OpenOptions
+	// Now returns the current time, for expiring buckets. Defaults to
+	// time.Now.
+	Now func() time.Time
+}
+
+// Timeline keeps points with timestamps in a tree per bucket of time, in a
+// directory, for queries in space restricted to a window of time, and
+// expires buckets once they are older than a retention period.
+//
+// Points are inserted into their bucket's tree as with Tree.Insert, and
+// each bucket is rebuilt to include them once points start arriving for a
+// later bucket, or when MaxPending says. Each point's timestamp is stored
+// in the first 8 bytes of its Data in the bucket's tree, recorded as its
+// TimeField, so queries over only part of a bucket skip the points outside
+// the window. A Timeline is safe for concurrent use.
+type Timeline struct {
+	dir              string
+	dims, maxDataLen int
+	opts             TimelineOptions
+
+	mu      sync.RWMutex
+	buckets map[int64]*Tree
+	// latest is the latest bucket inserted into.
+	latest int64
+}
+
+// TimedPoint is a point found in a Timeline, with its timestamp and its
+// squared distance from the query point. Its ID only identifies it within
+// its bucket.
+type TimedPoint struct {
+	PointDistance
+	Time time.Time
+}
+
+// timelineField is where a Timeline stores each point's timestamp.
+var timelineField = TimeField{Offset: 0, Width: uint64Size}
+
+// OpenTimeline opens the Timeline kept in dir for points with dims
+// dimensions and Data up to maxDataLen bytes long, creating it if dir has
+// no buckets yet. Expired buckets are deleted.
+func OpenTimeline(dir string, dims, maxDataLen int, opts TimelineOptions) (
+	*Timeline, error) {
+	if opts.BucketWidth == 0 {
+		opts.BucketWidth = time.Hour
+	}
+	if opts.BucketWidth < 0 {
+		return nil, errClass.New("invalid bucket width %v", opts.BucketWidth)
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.TmpDir == "" {
+		opts.TmpDir = dir
+	}
+	err := checkNodeSize(int64(dims), int64(maxDataLen)+uint64Size)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Build.Normalize {
+		return nil, ErrUnsupported.New("a timeline's buckets can't each be " +
+			"normalized")
+	}
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	tl := &Timeline{dir: dir, dims: dims, maxDataLen: maxDataLen, opts: opts,
+		buckets: map[int64]*Tree{}, latest: math.MinInt64}
+	err = tl.load()
+	if err == nil {
+		err = tl.expire()
+	}
+	if err != nil {
+		tl.Close()
+		return nil, err
+	}
+	return tl, nil
+}
+
+// load opens the buckets in tl.dir.
+func (tl *Timeline) load() error {
+	entries, err := os.ReadDir(tl.dir)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	for _, entry := range entries {
+		var bucket int64
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".dkd") {
+			continue
+		}
+		_, err = fmt.Sscanf(name, "%d.dkd", &bucket)
+		if err != nil {
+			continue
+		}
+		t, err := OpenRWWithOptions(filepath.Join(tl.dir, name), tl.opts.Open)
+		if err != nil {
+			return err
+		}
+		tl.buckets[bucket] = t
+		switch {
+		case t.footer.dims != tl.dims:
+			return ErrDimensionMismatch.New("bucket %s has %d dimensions, "+
+				"expected %d", name, t.footer.dims, tl.dims)
+		case t.footer.maxDataLen != tl.maxDataLen+uint64Size:
+			return ErrDataLenMismatch.New("bucket %s has a max data length "+
+				"of %d, expected %d", name, t.footer.maxDataLen-uint64Size,
+				tl.maxDataLen)
+		case t.footer.timeField == nil || *t.footer.timeField != timelineField:
+			return errClass.New("%s is not a timeline bucket", name)
+		}
+		tl.latest = max(tl.latest, bucket)
+	}
+	return nil
+}
+
+// bucket returns the bucket holding time ns, in nanoseconds since the Unix
+// epoch.
+func (tl *Timeline) bucket(ns int64) int64 {
+	width := int64(tl.opts.BucketWidth)
+	b := ns / width
+	if ns%width < 0 {
+		b--
+	}
+	return b
+}
+
+// span returns the first and last nanosecond of bucket b.
+func (tl *Timeline) span(b int64) (start, end int64) {
+	width := int64(tl.opts.BucketWidth)
+	return b * width, b*width + width - 1
+}
+
+func (tl *Timeline) bucketPath(b int64) string {
+	return filepath.Join(tl.dir, fmt.Sprintf("%d.dkd", b))
+}
+
+// expired reports whether bucket b is past its retention.
+func (tl *Timeline) expired(b int64) bool {
+	if tl.opts.Retention <= 0 {
+		return false
+	}
+	_, end := tl.span(b)
+	return end < tl.opts.Now().Add(-tl.opts.Retention).UnixNano()
+}
+
+// Expire deletes the buckets past their retention. Insert does so too, so
+// this is only needed to free their space while no points are inserted.
+func (tl *Timeline) Expire() error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	return tl.expire()
+}
+
+func (tl *Timeline) expire() error {
+	for b, t := range tl.buckets {
+		if !tl.expired(b) {
+			continue
+		}
+		delete(tl.buckets, b)
+		err := t.Close()
+		if err != nil {
+			return err
+		}
+		err = os.Remove(t.path)
+		if err == nil {
+			err = os.Remove(t.path + pendingSuffix)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return errClass.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// Dims returns the number of dimensions of the Timeline's points.
+func (tl *Timeline) Dims() int { return tl.dims }
+
+// Buckets returns the start of each bucket, earliest first.
+func (tl *Timeline) Buckets() []time.Time {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	var rv []time.Time
+	for _, b := range tl.sortedBuckets() {
+		start, _ := tl.span(b)
+		rv = append(rv, time.Unix(0, start))
+	}
+	return rv
+}
+
+func (tl *Timeline) sortedBuckets() []int64 {
+	rv := make([]int64, 0, len(tl.buckets))
+	for b := range tl.buckets {
+		rv = append(rv, b)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i] < rv[j] })
+	return rv
+}
+
+// Count returns the number of points in every bucket.
+func (tl *Timeline) Count() (count int64) {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	for _, t := range tl.buckets {
+		count += t.Count()
+	}
+	return count
+}
+
+// checkPoint checks that p is a valid point for the Timeline.
+func (tl *Timeline) checkPoint(p Point) error {
+	if len(p.Pos) != tl.dims {
+		return ErrDimensionMismatch.New("point has wrong dimension: %d, "+
+			"expected %d", len(p.Pos), tl.dims)
+	}
+	return checkFinite(p.Pos)
+}
+
+// Insert adds p to the Timeline with timestamp at. The buckets before at's
+// are rebuilt to include their inserted points if at starts a new bucket.
+func (tl *Timeline) Insert(at time.Time, p Point) error {
+	err := tl.checkPoint(p)
+	if err != nil {
+		return err
+	}
+	if len(p.Data) > tl.maxDataLen {
+		return ErrDataTooLarge.New(
+			"data length (%d) greater than max data length (%d)",
+			len(p.Data), tl.maxDataLen)
+	}
+	ns := at.UnixNano()
+	data := make([]byte, uint64Size+len(p.Data))
+	binary.LittleEndian.PutUint64(data, uint64(ns))
+	copy(data[uint64Size:], p.Data)
+
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	err = tl.expire()
+	if err != nil {
+		return err
+	}
+	b := tl.bucket(ns)
+	if tl.expired(b) {
+		return errClass.New("point at %v is past the retention", at)
+	}
+	t := tl.buckets[b]
+	if t == nil {
+		t, err = tl.create(b)
+		if err != nil {
+			return err
+		}
+	}
+	err = t.Insert(Point{Pos: p.Pos, Data: data})
+	if err != nil {
+		return err
+	}
+	if tl.opts.MaxPending > 0 && t.Pending() >= tl.opts.MaxPending {
+		err = t.Merge(tl.opts.TmpDir)
+		if err != nil {
+			return err
+		}
+	}
+	if b <= tl.latest {
+		return nil
+	}
+	tl.latest = b
+	for other, t := range tl.buckets {
+		if other < b && t.Pending() > 0 {
+			err = t.Merge(tl.opts.TmpDir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// create builds an empty tree for bucket b and opens it for inserts.
+func (tl *Timeline) create(b int64) (*Tree, error) {
+	fs, err := newBaseFS(tempName(tl.opts.TmpDir))
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Delete()
+	set, err := newPointSet(fs.Temp(), tl.dims, tl.maxDataLen+uint64Size,
+		true)
+	if err != nil {
+		return nil, err
+	}
+	defer set.Close()
+	opts := tl.opts.Build
+	tf := timelineField
+	opts.TimeField = &tf
+	path := tl.bucketPath(b)
+	t, err := CreateTreeWithOptions(path, tl.opts.TmpDir, set, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = t.Close()
+	if err == nil {
+		t, err = OpenRWWithOptions(path, tl.opts.Open)
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	tl.buckets[b] = t
+	return t, nil
+}
+
+// query calls fn with the tree of each bucket overlapping the window from
+// from to to, in nanoseconds, and whether the window covers all of it.
+func (tl *Timeline) query(from, to time.Time,
+	fn func(t *Tree, whole bool) error) error {
+	t0, t1 := from.UnixNano(), to.UnixNano()
+	for _, b := range tl.sortedBuckets() {
+		start, end := tl.span(b)
+		if end < t0 || start > t1 {
+			continue
+		}
+		err := fn(tl.buckets[b], t0 <= start && end <= t1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timedPoint strips the timestamp from the Data of pd, a point stored in a
+// bucket.
+func timedPoint(pd PointDistance) TimedPoint {
+	ts, _ := timelineField.decode(pd.Data)
+	pd.Data = pd.Data[uint64Size:]
+	return TimedPoint{PointDistance: pd, Time: time.Unix(0, ts)}
+}
+
+// inWindow returns a filter for points stored in a bucket with timestamps
+// from from to to, inclusive.
+func inWindow(from, to time.Time) func(Point) bool {
+	t0, t1 := from.UnixNano(), to.UnixNano()
+	return func(p Point) bool {
+		ts, ok := timelineField.decode(p.Data)
+		return ok && t0 <= ts && ts <= t1
+	}
+}
+
+// Nearest returns the n nearest points to p with timestamps from from to
+// to, inclusive, closest first.
+func (tl *Timeline) Nearest(p Point, n int, from, to time.Time) (
+	[]TimedPoint, error) {
+	err := tl.checkPoint(p)
+	if err != nil || n <= 0 {
+		return nil, err
+	}
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	var trees []*Tree
+	partial := map[*Tree]bool{}
+	tl.query(from, to, func(t *Tree, whole bool) error {
+		trees = append(trees, t)
+		partial[t] = !whole
+		return nil
+	})
+	found, err := nearestAcross(trees, n,
+		func(t *Tree) ([]PointDistance, error) {
+			if partial[t] {
+				return t.NearestWhere(p, n, inWindow(from, to))
+			}
+			return t.Nearest(p, n)
+		})
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]TimedPoint, 0, len(found))
+	for _, pd := range found {
+		rv = append(rv, timedPoint(pd))
+	}
+	return rv, nil
+}
+
+// Within returns every point within radius of p with a timestamp from from
+// to to, inclusive, in no particular order. See Tree.Within.
+func (tl *Timeline) Within(p Point, radius float64, from, to time.Time) (
+	[]TimedPoint, error) {
+	if !(radius >= 0) {
+		return nil, errClass.New("invalid radius %v", radius)
+	}
+	err := tl.checkPoint(p)
+	if err != nil {
+		return nil, err
+	}
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	var rv []TimedPoint
+	in := inWindow(from, to)
+	err = tl.query(from, to, func(t *Tree, whole bool) error {
+		return t.WithinDistanceFunc(p, radius, func(pd PointDistance) error {
+			if whole || in(pd.Point) {
+				rv = append(rv, timedPoint(pd))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// Close closes every bucket. Points inserted but not yet built into their
+// bucket's tree are kept in its pending log for the next OpenTimeline.
+func (tl *Timeline) Close() error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	var errs errors.ErrorGroup
+	for b, t := range tl.buckets {
+		errs.Add(t.Close())
+		delete(tl.buckets, b)
+	}
+	return errs.Finalize()
+}
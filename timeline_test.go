@@ -0,0 +1,117 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTimeline(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+	dir := fs.Path("timeline")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(5 * time.Hour)
+	opts := TimelineOptions{Now: func() time.Time { return now }}
+
+	tl, err := OpenTimeline(dir, 2, 10, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := newTestPoints(300, 2, 10)
+	times := make([]time.Time, len(points))
+	for i, p := range points {
+		times[i] = start.Add(time.Duration(i) * time.Minute)
+		err = tl.Insert(times[i], p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(tl.Buckets()) != 5 || !tl.Buckets()[0].Equal(start) {
+		t.Fatalf("unexpected buckets %v", tl.Buckets())
+	}
+	for _, b := range tl.sortedBuckets()[:4] {
+		if tl.buckets[b].Pending() != 0 {
+			t.Fatalf("bucket %d wasn't rebuilt", b)
+		}
+	}
+	if tl.Count() != int64(len(points)) {
+		t.Fatalf("%d points, expected %d", tl.Count(), len(points))
+	}
+
+	q := NewPoint(2, 10)
+	from, to := start.Add(90*time.Minute), start.Add(150*time.Minute)
+	var expected []PointDistance
+	within := 0
+	for i, p := range points {
+		if times[i].Before(from) || times[i].After(to) {
+			continue
+		}
+		expected = append(expected, PointDistance{Point: p,
+			Distance: q.distanceSquared(&p)})
+		if q.distanceSquared(&p) <= 0.3*0.3 {
+			within++
+		}
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i].Distance < expected[j].Distance
+	})
+	nearest, err := tl.Nearest(q, 5, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 5 {
+		t.Fatalf("found %d points, expected 5", len(nearest))
+	}
+	for i, tp := range nearest {
+		if tp.Time.Before(from) || tp.Time.After(to) {
+			t.Fatalf("point at %v is outside the window", tp.Time)
+		}
+		AssertPointsEqual(tp.Point, expected[i].Point)
+	}
+	found, err := tl.Within(q, 0.3, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != within {
+		t.Fatalf("found %d points within range, expected %d", len(found),
+			within)
+	}
+	err = tl.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Retention = 2 * time.Hour
+	tl, err = OpenTimeline(dir, 2, 10, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	if len(tl.Buckets()) != 2 || tl.Count() != 120 {
+		t.Fatalf("%d buckets of %d points after expiry", len(tl.Buckets()),
+			tl.Count())
+	}
+	err = tl.Insert(start, points[0])
+	if err == nil {
+		t.Fatal("inserted a point past the retention")
+	}
+	_, err = OpenTimeline(dir, 3, 10, opts)
+	if !ErrDimensionMismatch.Contains(err) {
+		t.Fatalf("expected a dimension mismatch, got %v", err)
+	}
+}
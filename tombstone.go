@@ -0,0 +1,304 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+)
+
+// OpenRW opens an existing tree for reading, in-place tombstoning and
+// inserts. The structure of the tree is never changed in place: deleted
+// points still occupy space and inserted points sit in a pending log until
+// the tree is rebuilt with Compact or Merge.
+func OpenRW(path string) (*Tree, error) {
+	return OpenRWWithOptions(path, OpenOptions{})
+}
+
+// OpenRWWithOptions is OpenRW with options.
+func OpenRWWithOptions(path string, opts OpenOptions) (*Tree, error) {
+	fh, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return openTree(path, fh, true, opts)
+}
+
+// Delete tombstones a stored point equal to p. Queries skip tombstoned points
+// immediately, including concurrent queries on the same Tree, as a tombstone
+// is a single byte write. The subtree counts of the point's ancestors are
+// lowered afterwards, so concurrent counting queries may briefly see the
+// point. The writes are logged in the pending log first, so a crash partway
+// through can't leave the counts wrong. Use Sync to make deletions durable,
+// or OpenOptions.SyncWrites.
+func (t *Tree) Delete(p Point) error {
+	if !t.writable {
+		return errClass.New("tree not opened for writing")
+	}
+	err := t.checkDims(p)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	p.Pos = t.footer.coords().round(p.Pos)
+	type step struct {
+		offset int64
+		n      Node
+	}
+	var path []step
+	var find func(offset int64) (bool, error)
+	find = func(offset int64) (bool, error) {
+		if offset == -1 {
+			return false, nil
+		}
+		n, err := t.Node(offset)
+		if err != nil {
+			return false, err
+		}
+		path = append(path, step{offset: offset, n: n})
+		if !n.Deleted && n.Point.equal(&p) {
+			return true, nil
+		}
+		// coordinates rounded or encoded as they were stored can tie with a
+		// split from either side, so ties search both
+		split := n.Point.Pos[n.Dim]
+		if p.Pos[n.Dim] <= split {
+			found, err := find(n.Left)
+			if found || err != nil {
+				return found, err
+			}
+		}
+		if p.Pos[n.Dim] >= split {
+			found, err := find(n.Right)
+			if found || err != nil {
+				return found, err
+			}
+		}
+		path = path[:len(path)-1]
+		return false, nil
+	}
+	found, err := find(t.root)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errClass.New("point not found")
+	}
+	var b writeBatch
+	last := path[len(path)-1]
+	t.tombstone(&b, last.offset, last.n)
+	for i := len(path) - 1; i >= 0; i-- {
+		t.setCount(&b, path[i].offset, path[i].n.Count-1)
+	}
+	return t.commit(b)
+}
+
+// tombstone adds to b the write marking the node n at offset as deleted,
+// which rewrites the last byte of the node, the high byte of its dimension.
+func (t *Tree) tombstone(b *writeBatch, offset int64, n Node) {
+	n.Deleted = true
+	b.write(offset+t.nodelen-1, []byte{byte(n.serializedDim() >> 24)})
+}
+
+// setCount adds to b the write of the subtree count of the node at offset,
+// which sits just before its dimension.
+func (t *Tree) setCount(b *writeBatch, offset, count int64) {
+	buf := make([]byte, uint64Size)
+	binary.LittleEndian.PutUint64(buf, uint64(count))
+	b.write(offset+t.nodelen-uint32Size-uint64Size, buf)
+}
+
+// uncache drops the node at offset from the node cache after it changes,
+// and rereads it if it is pinned.
+func (t *Tree) uncache(offset int64) error {
+	if t.cache != nil {
+		t.cache.remove(offset, t.nodelen)
+	}
+	return t.refreshPinned(offset)
+}
+
+// Sync commits deletions and inserts to stable storage.
+func (t *Tree) Sync() error {
+	err := t.fh.Sync()
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	return t.pending.sync()
+}
+
+// syncWrites syncs the tree file and the pending log if
+// OpenOptions.SyncWrites is set.
+func (t *Tree) syncWrites() error {
+	if !t.opts.SyncWrites {
+		return nil
+	}
+	return t.Sync()
+}
+
+// DeleteFunc tombstones every point for which pred returns true in a single
+// pass over the tree, returning how many points were deleted. Like Delete,
+// its writes are logged first, and if the pass fails, none are made.
+func (t *Tree) DeleteFunc(pred func(Point) bool) (deleted int, err error) {
+	if !t.writable {
+		return 0, errClass.New("tree not opened for writing")
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	var b writeBatch
+	d, err := t.deleteFunc(&b, t.root, pred)
+	if err == nil {
+		err = t.commit(b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(d), nil
+}
+
+// deleteFunc adds to b the writes tombstoning matching points in the
+// subtree at offset, and fixing up subtree counts on the way back up.
+func (t *Tree) deleteFunc(b *writeBatch, offset int64,
+	pred func(Point) bool) (deleted int64, err error) {
+	if offset == -1 {
+		return 0, nil
+	}
+	n, err := t.Node(offset)
+	if err != nil {
+		return 0, err
+	}
+	if !n.Deleted && pred(n.Point) {
+		t.tombstone(b, offset, n)
+		deleted++
+	}
+	for _, child := range []int64{n.Left, n.Right} {
+		d, err := t.deleteFunc(b, child, pred)
+		deleted += d
+		if err != nil {
+			return deleted, err
+		}
+	}
+	if deleted > 0 {
+		t.setCount(b, offset, n.Count-deleted)
+	}
+	return deleted, nil
+}
+
+// DeleteRange tombstones every stored point inside the box with corners min
+// and max, inclusive, in a single traversal that skips subtrees outside the
+// box, returning how many points were deleted. Like Delete, it leaves
+// pending inserted points alone, and like DeleteFunc, its writes are logged
+// first and made all or not at all.
+func (t *Tree) DeleteRange(min, max []float64) (deleted int, err error) {
+	if !t.writable {
+		return 0, errClass.New("tree not opened for writing")
+	}
+	q, err := t.rangeBox(min, max)
+	if err != nil {
+		return 0, err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	b := t.bounds()
+	var writes writeBatch
+	d, err := t.deleteRange(&writes, t.root, &q, &b)
+	if err == nil {
+		err = t.commit(writes)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(d), nil
+}
+
+// deleteRange is deleteFunc restricted to points in q, pruning subtrees the
+// way countRange does.
+func (t *Tree) deleteRange(writes *writeBatch, offset int64, q, b *box) (
+	deleted int64, err error) {
+	if offset == -1 {
+		return 0, nil
+	}
+	restore, err := t.tightenBox(offset, b)
+	if err != nil {
+		return 0, err
+	}
+	defer restore()
+	if !q.intersects(b) {
+		return 0, nil
+	}
+	n, _, err := t.nodeShape(offset, true)
+	if err != nil {
+		return 0, err
+	}
+	if n.Count == 0 {
+		return 0, nil
+	}
+	if !n.Deleted && q.contains(n.Point.Pos) {
+		t.tombstone(writes, offset, n)
+		deleted++
+	}
+	split := n.Point.Pos[n.Dim]
+	oldMax := b.max[n.Dim]
+	b.max[n.Dim] = split
+	left, err := t.deleteRange(writes, n.Left, q, b)
+	b.max[n.Dim] = oldMax
+	deleted += left
+	if err != nil {
+		return deleted, err
+	}
+	oldMin := b.min[n.Dim]
+	b.min[n.Dim] = split
+	right, err := t.deleteRange(writes, n.Right, q, b)
+	b.min[n.Dim] = oldMin
+	deleted += right
+	if err != nil {
+		return deleted, err
+	}
+	if deleted > 0 {
+		t.setCount(writes, offset, n.Count-deleted)
+	}
+	return deleted, nil
+}
+
+// Compact rebuilds the tree without its deleted points, reclaiming their
+// space, and replaces the tree file with the result. Pending inserted points
+// are merged in along the way. Temporary files go in tmpdir. The build
+// options recorded in the tree are reused. Compact must not be called
+// concurrently with any other use of the tree.
+func (t *Tree) Compact(tmpdir string) error {
+	return t.CompactContext(context.Background(), tmpdir)
+}
+
+// CompactContext is Compact, but gives up and returns ctx's error if ctx is
+// canceled before the new tree is built, leaving the tree as it was.
+func (t *Tree) CompactContext(ctx context.Context, tmpdir string) error {
+	if !t.writable {
+		return errClass.New("tree not opened for writing")
+	}
+	return t.rebuild(ctx, tmpdir, nil)
+}
+
+// CompactWithOptions is CompactContext, with its disk use limited by opts so
+// that it doesn't starve the work it shares the disk with. It merges pending
+// points in as well, like Merge. Like Compact, it must not be called
+// concurrently with any other use of the tree.
+func (t *Tree) CompactWithOptions(ctx context.Context,
+	opts RebuildOptions) error {
+	if !t.writable {
+		return errClass.New("tree not opened for writing")
+	}
+	return t.rebuild(ctx, opts.TmpDir, opts.throttle())
+}
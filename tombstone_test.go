@@ -0,0 +1,493 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestDelete(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+
+	err := tree.Delete(points[0])
+	if err == nil {
+		t.Fatal("expected read-only tree to refuse deletes")
+	}
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	for _, p := range points[:20] {
+		err = rw.Delete(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = rw.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.Delete(points[0])
+	if err == nil {
+		t.Fatal("expected deleting a deleted point to fail")
+	}
+
+	reopened, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	for _, tr := range []*Tree{rw, reopened} {
+		for _, p := range points[:20] {
+			nearest, err := tr.Nearest(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nearest) != 1 || nearest[0].Point.equal(&p) {
+				t.Fatal("deleted point returned")
+			}
+			exhaustive, err := tr.NearestExhaustive(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exhaustive[0].Point.equal(&nearest[0].Point) {
+				t.Fatal("tree search disagrees with exhaustive search")
+			}
+		}
+		for _, p := range points[20:] {
+			nearest, err := tr.Nearest(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nearest) != 1 || !nearest[0].Point.equal(&p) {
+				t.Fatal("remaining point not found")
+			}
+		}
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(300, 2, 10)
+	for i := range points {
+		points[i].Data = []byte(fmt.Sprintf("keep-%d", i))
+		if i%3 == 0 {
+			points[i].Data = []byte(fmt.Sprintf("drop-%d", i))
+		}
+	}
+	tree := createTestTree(t, fs, 2, 10, points, BuildOptions{})
+	tree.Close()
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	deleted, err := rw.DeleteFunc(func(p Point) bool {
+		return bytes.HasPrefix(p.Data, []byte("drop-"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 100 {
+		t.Fatalf("deleted %d points, expected 100", deleted)
+	}
+
+	for _, p := range points {
+		nearest, err := rw.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasPrefix(nearest[0].Point.Data, []byte("drop-")) {
+			t.Fatal("query returned a deleted point")
+		}
+	}
+	remaining := 0
+	err = rw.Each(func(p Point) error {
+		remaining++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 200 {
+		t.Fatalf("%d points remain, expected 200", remaining)
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 2, 10)
+	tree := createTestTree(t, fs, 2, 10, points, BuildOptions{})
+	tree.Close()
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	min, max := []float64{0.2, 0.1}, []float64{0.6, 0.5}
+	inside, err := rw.CountRange(min, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inside == 0 || inside == int64(len(points)) {
+		t.Fatalf("%d points in the box, expected some but not all", inside)
+	}
+
+	deleted, err := rw.DeleteRange(min, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(deleted) != inside {
+		t.Fatalf("deleted %d points, expected %d", deleted, inside)
+	}
+	count, err := rw.CountRange(min, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("%d points left in the box", count)
+	}
+	remaining := int64(0)
+	err = rw.Each(func(p Point) error {
+		remaining++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != int64(len(points))-inside {
+		t.Fatalf("%d points remain, expected %d", remaining,
+			int64(len(points))-inside)
+	}
+	root, err := rw.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Count != remaining {
+		t.Fatalf("root count %d, expected %d", root.Count, remaining)
+	}
+
+	deleted, err = rw.DeleteRange(min, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 0 {
+		t.Fatalf("deleted %d points again", deleted)
+	}
+	_, err = rw.DeleteRange([]float64{0}, []float64{1})
+	if !ErrDimensionMismatch.Contains(err) {
+		t.Fatalf("expected a dimension mismatch, got %v", err)
+	}
+}
+
+func TestSubtreeCounts(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(300, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	// checkCounts verifies every stored subtree count by walking the tree.
+	var checkCounts func(offset int64) int64
+	checkCounts = func(offset int64) int64 {
+		if offset == -1 {
+			return 0
+		}
+		n, err := rw.Node(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := checkCounts(n.Left) + checkCounts(n.Right)
+		if !n.Deleted {
+			count++
+		}
+		if n.Count != count {
+			t.Fatalf("node at %d has count %d, expected %d", offset, n.Count,
+				count)
+		}
+		return count
+	}
+
+	root, err := rw.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Count != rw.Count() {
+		t.Fatalf("root count %d, expected %d", root.Count, rw.Count())
+	}
+	checkCounts(rw.root)
+
+	for _, p := range points[:10] {
+		err = rw.Delete(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted, err := rw.DeleteFunc(func(p Point) bool { return p.Pos[0] < 0.1 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkCounts(rw.root) != rw.Count()-10-int64(deleted) {
+		t.Fatal("root count doesn't reflect deletions")
+	}
+
+	for _, p := range points[50:60] {
+		count, err := rw.SubtreeCount(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count < 0 || count > rw.Count() {
+			t.Fatalf("unexpected subtree count %d", count)
+		}
+	}
+	count, err := rw.CountWithin(points[0], 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != rw.Count()-10-int64(deleted) {
+		t.Fatalf("counted %d points within range of everything, expected %d",
+			count, rw.Count()-10-int64(deleted))
+	}
+}
+
+func TestCompact(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(200, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points,
+		BuildOptions{GridResolution: 4})
+	tree.Close()
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	deleted, err := rw.DeleteFunc(func(p Point) bool { return p.Pos[0] < .5 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted == 0 {
+		t.Fatal("expected some points to be deleted")
+	}
+
+	err = rw.Compact(fs.Temp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw.Count() != int64(len(points)-deleted) {
+		t.Fatalf("expected %d points after compaction, got %d",
+			len(points)-deleted, rw.Count())
+	}
+	if rw.footer.grid == nil || rw.footer.grid.Resolution != 4 {
+		t.Fatal("build options not kept")
+	}
+	for _, p := range points {
+		nearest, err := rw.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nearest[0].Point.equal(&p) != (p.Pos[0] >= .5) {
+			t.Fatal("compacted tree has the wrong points")
+		}
+	}
+}
+
+func TestInterruptedDelete(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(300, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+
+	check := func(tree *Tree, expected int64) {
+		err := tree.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := tree.Root()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.Count != expected {
+			t.Fatalf("root count %d, expected %d", root.Count, expected)
+		}
+	}
+
+	// log a delete's writes, but make only some of them, as a crash partway
+	// through would
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b writeBatch
+	deleted, err := rw.deleteFunc(&b, rw.root,
+		func(p Point) bool { return p.Pos[0] < 0.3 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted == 0 {
+		t.Fatal("nothing to delete")
+	}
+	err = rw.pending.appendWrites(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.applyWrites(b[:len(b)/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.Close()
+	live := int64(len(points)) - deleted
+
+	// a reader sees the delete finished without changing the file
+	reader, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(reader, live)
+	reader.Close()
+
+	// a writer finishes it in the file
+	rw, err = OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.Close()
+	reader, err = OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reader.r.(*overlayReader); ok {
+		t.Fatal("delete wasn't finished in the file")
+	}
+	check(reader, live)
+	reader.Close()
+
+	// a torn record, as a crash while logging would leave, is ignored, and
+	// none of its writes were made
+	rw, err = OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = nil
+	_, err = rw.deleteFunc(&b, rw.root, func(p Point) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.pending.appendWrites(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := rw.pending.size
+	rw.Close()
+	err = os.Truncate(rw.pending.path, size-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, err = OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	check(rw, live)
+	err = rw.Insert(points[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw.Pending() != 1 {
+		t.Fatalf("got %d pending points, expected 1", rw.Pending())
+	}
+}
+
+func TestConcurrentDeletes(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(2000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	// each goroutine deletes its own points, so every delete finds its point
+	// and the counts along shared paths are lowered by each in turn
+	const workers = 8
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 1000; i += workers {
+				err := rw.Delete(points[i])
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	root, err := rw.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Count != 1000 {
+		t.Fatalf("root count %d with 1000 points live", root.Count)
+	}
+	err = rw.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
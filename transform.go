@@ -0,0 +1,216 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math"
+)
+
+// Transform maps query positions into the coordinates a tree's points are
+// stored in, such as a Normalization recorded in the tree by
+// BuildOptions.Normalize. See TransformedTree.
+type Transform interface {
+	// Apply returns pos in the tree's coordinates. It must not modify pos.
+	Apply(pos []float64) []float64
+}
+
+// InvertibleTransform is a Transform that can also map the tree's
+// coordinates back, which TransformedTree does to the positions it returns.
+type InvertibleTransform interface {
+	Transform
+	// Invert returns pos, in the tree's coordinates, in the coordinates
+	// Apply maps from. It must not modify pos.
+	Invert(pos []float64) []float64
+}
+
+// Normalization standardizes each dimension, subtracting its Mean and
+// dividing by its StdDev, so that dimensions in different units carry
+// similar weight in distances.
+type Normalization struct {
+	Mean, StdDev []float64
+}
+
+var _ InvertibleTransform = (*Normalization)(nil)
+
+// Apply returns pos normalized.
+func (n *Normalization) Apply(pos []float64) []float64 {
+	rv := make([]float64, len(pos))
+	for i, v := range pos {
+		rv[i] = (v - n.Mean[i]) / n.StdDev[i]
+	}
+	return rv
+}
+
+// Invert returns the position that normalizes to pos.
+func (n *Normalization) Invert(pos []float64) []float64 {
+	rv := make([]float64, len(pos))
+	for i, v := range pos {
+		rv[i] = v*n.StdDev[i] + n.Mean[i]
+	}
+	return rv
+}
+
+// check validates a Normalization for dims dimensions.
+func (n *Normalization) check(dims int) error {
+	if len(n.Mean) != dims || len(n.StdDev) != dims {
+		return ErrDimensionMismatch.New("normalization has %d means and %d "+
+			"standard deviations, expected %d", len(n.Mean), len(n.StdDev), dims)
+	}
+	for i := range n.Mean {
+		if math.IsInf(n.Mean[i], 0) || math.IsNaN(n.Mean[i]) ||
+			!(n.StdDev[i] > 0) || math.IsInf(n.StdDev[i], 1) {
+			return errClass.New("invalid normalization for dimension %d", i)
+		}
+	}
+	return nil
+}
+
+// Normalization returns the normalization the tree's points were stored
+// with, recorded by BuildOptions.Normalize or BuildOptions.Normalization, or
+// nil if there is none.
+func (t *Tree) Normalization() *Normalization {
+	if t.footer.normalization == nil {
+		return nil
+	}
+	return &Normalization{
+		Mean:   append([]float64(nil), t.footer.normalization.Mean...),
+		StdDev: append([]float64(nil), t.footer.normalization.StdDev...)}
+}
+
+// normalizeSet consumes points, returning a set in fs of the same points
+// normalized by the mean and standard deviation of each dimension, along
+// with that Normalization. A dimension every point has the same coordinate
+// in is only shifted.
+func normalizeSet(fs *baseFS, points *PointSet) (*PointSet,
+	*Normalization, error) {
+	defer points.Close()
+	err := points.closeNoDel()
+	if err != nil {
+		return nil, nil, errClass.Wrap(err)
+	}
+
+	// Welford's method, which doesn't lose precision to large means
+	norm := &Normalization{Mean: make([]float64, points.dims),
+		StdDev: make([]float64, points.dims)}
+	var count float64
+	err = points.each(func(p Point) error {
+		count++
+		for i, v := range p.Pos {
+			delta := v - norm.Mean[i]
+			norm.Mean[i] += delta / count
+			norm.StdDev[i] += delta * (v - norm.Mean[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, m2 := range norm.StdDev {
+		norm.StdDev[i] = 1
+		if m2 > 0 {
+			norm.StdDev[i] = math.Sqrt(m2 / count)
+		}
+	}
+
+	out, err := newPointSet(fs.Temp(), points.dims, points.maxDataLen, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = points.each(func(p Point) error {
+		p.Pos = norm.Apply(p.Pos)
+		return out.Add(p)
+	})
+	if err != nil {
+		out.Close()
+		return nil, nil, err
+	}
+	return out, norm, nil
+}
+
+// TransformedTree queries a tree with positions in coordinates of the
+// caller's, which a Transform maps into the tree's, so that query code
+// doesn't need to know how the tree's points were scaled. If the Transform
+// is an InvertibleTransform, the positions of returned points are mapped
+// back as well. Distances and radii are in the tree's coordinates.
+type TransformedTree struct {
+	t  *Tree
+	tr Transform
+}
+
+var _ Searcher = (*TransformedTree)(nil)
+
+// NewTransformedTree returns a TransformedTree querying t through tr, or
+// through t's own Normalization if tr is nil. It doesn't take ownership of
+// t.
+func NewTransformedTree(t *Tree, tr Transform) (*TransformedTree, error) {
+	if tr == nil {
+		norm := t.Normalization()
+		if norm == nil {
+			return nil, errClass.New("tree has no normalization")
+		}
+		tr = norm
+	}
+	return &TransformedTree{t: t, tr: tr}, nil
+}
+
+// Tree returns the tree being queried.
+func (tt *TransformedTree) Tree() *Tree { return tt.t }
+
+// Dims returns the number of dimensions of the tree's points.
+func (tt *TransformedTree) Dims() int { return tt.t.Dims() }
+
+// apply returns p with its position mapped into the tree's coordinates.
+func (tt *TransformedTree) apply(p Point) (Point, error) {
+	err := tt.t.checkDims(p)
+	if err != nil {
+		return p, err
+	}
+	p.Pos = tt.tr.Apply(p.Pos)
+	return p, nil
+}
+
+// invert maps the position of a returned point back, if the Transform can.
+func (tt *TransformedTree) invert(p *Point) {
+	if inv, ok := tt.tr.(InvertibleTransform); ok {
+		p.Pos = inv.Invert(p.Pos)
+	}
+}
+
+// Nearest is Tree.Nearest with p transformed.
+func (tt *TransformedTree) Nearest(p Point, n int) ([]PointDistance, error) {
+	p, err := tt.apply(p)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := tt.t.Nearest(p, n)
+	for i := range rv {
+		tt.invert(&rv[i].Point)
+	}
+	return rv, err
+}
+
+// Within is Tree.Within with p transformed. radius is in the tree's
+// coordinates.
+func (tt *TransformedTree) Within(p Point, radius float64) ([]Point, error) {
+	p, err := tt.apply(p)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := tt.t.Within(p, radius)
+	for i := range rv {
+		tt.invert(&rv[i])
+	}
+	return rv, err
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	// the second dimension is in much larger units
+	points := newTestPoints(500, 2, 10)
+	for i := range points {
+		points[i].Pos[1] = 1000 + points[i].Pos[1]*1e6
+	}
+	tree := createTestTree(t, fs, 2, 10, points,
+		BuildOptions{Normalize: true})
+	defer tree.Close()
+
+	norm := tree.Normalization()
+	if norm == nil {
+		t.Fatal("no normalization recorded")
+	}
+	var mean, variance float64
+	for _, p := range points {
+		mean += p.Pos[1]
+	}
+	mean /= float64(len(points))
+	for _, p := range points {
+		variance += (p.Pos[1] - mean) * (p.Pos[1] - mean)
+	}
+	std := math.Sqrt(variance / float64(len(points)))
+	if math.Abs(norm.Mean[1]-mean) > 1e-6 ||
+		math.Abs(norm.StdDev[1]-std)/std > 1e-9 {
+		t.Fatalf("got normalization %+v, expected mean %v and std dev %v",
+			norm, mean, std)
+	}
+
+	tt, err := NewTransformedTree(tree, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		q := points[i]
+		nearest, err := tt.Nearest(q, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nearest) != 1 || nearest[0].Distance > 1e-18 {
+			t.Fatalf("unexpected nearest points %v", nearest)
+		}
+		for j, v := range nearest[0].Pos {
+			if math.Abs(v-q.Pos[j]) > 1e-6*math.Max(1, math.Abs(v)) {
+				t.Fatalf("got position %v, expected %v", nearest[0].Pos, q.Pos)
+			}
+		}
+		// stored positions are normalized
+		raw, err := tree.Nearest(Point{Pos: norm.Apply(q.Pos)}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(raw[0].Pos[1]) > 10 {
+			t.Fatalf("stored position %v isn't normalized", raw[0].Pos)
+		}
+	}
+	within, err := tt.Within(points[0], 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(within) != len(points) {
+		t.Fatalf("found %d points", len(within))
+	}
+
+	// the normalization survives reopening and rebuilding
+	reopened, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if n := reopened.Normalization(); n == nil || n.Mean[1] != norm.Mean[1] {
+		t.Fatalf("got normalization %+v after reopening", n)
+	}
+	if n := reopened.Info().Options.Normalization; n == nil || n.StdDev[1] != norm.StdDev[1] {
+		t.Fatalf("got normalization %+v in build options", n)
+	}
+
+	plain := createTestTree(t, fs, 2, 10, points[:10], BuildOptions{})
+	defer plain.Close()
+	if plain.Normalization() != nil {
+		t.Fatal("unexpected normalization")
+	}
+	_, err = NewTransformedTree(plain, nil)
+	if err == nil {
+		t.Fatal("expected a tree without a normalization to fail")
+	}
+	_, err = NewTransformedTree(plain, norm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// readers that don't know of normalization refuse the tree rather than
+	// query it in the wrong coordinates
+	if v := reopened.Info().Version; v != FormatVersion || v == plain.Info().Version {
+		t.Fatalf("normalized tree has version %d", v)
+	}
+
+	// containers of several trees would normalize each differently
+	build := BuildOptions{Normalize: true}
+	_, err = OpenStore(fs.Path("store"), 2, 10, StoreOptions{Build: build})
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected store to refuse Normalize, got %v", err)
+	}
+	_, err = OpenCappedTree(fs.Path("capped"), 2, 10,
+		CappedOptions{MaxPoints: 100, Build: build})
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected capped tree to refuse Normalize, got %v", err)
+	}
+	_, err = OpenTimeline(fs.Path("timeline"), 2, 10,
+		TimelineOptions{Build: build})
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected timeline to refuse Normalize, got %v", err)
+	}
+	_, err = CreateTreeInMemory(2, 10, points, build)
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected in-memory tree to refuse Normalize, got %v", err)
+	}
+	mem, err := CreateTreeInMemory(2, 10, nil,
+		BuildOptions{Normalization: norm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.Normalization(); n == nil || n.Mean[1] != norm.Mean[1] {
+		t.Fatalf("got normalization %+v in memory", n)
+	}
+	mem.Close()
+}
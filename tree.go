@@ -19,238 +19,1714 @@ package dkdtree
 import (
 	"bufio"
 	"container/heap"
+	"context"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errClass = newErrorClass("dkdtree")
+
+	// ErrCorrupt is the class of errors returned when a tree file is
+	// malformed. Check for it with ErrCorrupt.Contains(err) or
+	// errors.Is(err, ErrCorrupt).
+	ErrCorrupt = errClass.NewClass("corrupt")
+
+	// ErrHole is the class of errors returned when a node in a tree file
+	// reads back as all zeroes, as happens when its region of a sparse file
+	// has been hole-punched. It is a subclass of ErrCorrupt. See
+	// OpenOptions.SkipHoles.
+	ErrHole = ErrCorrupt.NewClass("hole")
+
+	// ErrChecksum is the class of errors returned when a node or its Data
+	// doesn't match its checksum. It is a subclass of ErrCorrupt. See
+	// BuildOptions.Checksums.
+	ErrChecksum = ErrCorrupt.NewClass("checksum mismatch")
+
+	// ErrVersion is the class of errors returned for tree files written in a
+	// newer format version than this package understands. See FormatVersion.
+	ErrVersion = errClass.NewClass("unsupported version")
+
+	// ErrDimensionMismatch is the class of errors returned when a point,
+	// query or tree has a different number of dimensions than expected.
+	ErrDimensionMismatch = errClass.NewClass("dimension mismatch")
+
+	// ErrDataTooLarge is the class of errors returned when a point's Data is
+	// longer than the max data length it is stored with.
+	ErrDataTooLarge = errClass.NewClass("data too large")
+
+	// ErrDataLenMismatch is the class of errors returned when a tree has a
+	// different max data length than expected.
+	ErrDataLenMismatch = errClass.NewClass("max data length mismatch")
+
+	// ErrNonFinite is the class of errors returned for points with NaN or
+	// infinite coordinates. Such coordinates have no place in the order the
+	// tree splits points by, and the distances to them aren't meaningful,
+	// so they are refused by PointSet.Add, Tree.Insert and the queries.
+	ErrNonFinite = errClass.NewClass("non-finite coordinate")
+)
+
+const (
+	scanBatchSize = 256
+)
+
+// Searcher answers nearest neighbor queries over points with Dims
+// dimensions.
+type Searcher interface {
+	Dims() int
+	Nearest(p Point, n int) ([]PointDistance, error)
+}
+
+var _ Searcher = (*Tree)(nil)
+
+// Tree is a kd-tree stored in a file. A Tree is safe for concurrent use by
+// multiple goroutines: nodes are read with ReadAt, which keeps no shared file
+// offset, and the query statistics, node cache and pending log are
+// synchronized. Delete and Insert may run alongside queries and each other,
+// as deletes and updates, which read and rewrite subtree counts, are made
+// one at a time. Only Merge, Compact and Close, which replace or release the
+// file, must not.
+type Tree struct {
+	path     string
+	r        io.ReaderAt
+	fh       *os.File // nil unless the tree was opened from a file
+	writable bool
+	opts     OpenOptions
+	root     int64
+	count    int64
+	nodelen  int64
+	footer   footer
+	stats    *statsCounters
+	pending  *pendingLog
+	mapping  *mapping    // nil unless the tree file is memory-mapped
+	cache    *nodeCache  // nil unless OpenOptions.CacheBytes is set
+	closer   io.Closer   // set for trees opened from a Backend
+	prefetch *prefetcher // nil unless OpenOptions.Prefetch is set
+	pinned   pinnedNodes // nil unless OpenOptions.PinLevels is set
+	legacy   bool        // set if the file predates footers; see legacyReader
+	// writeMu serializes the changes Tree.commit makes in place, from
+	// reading the nodes they change to logging and making the writes.
+	writeMu sync.Mutex
+}
+
+func CreateTree(path, tmpdir string, points *PointSet) (*Tree, error) {
+	return CreateTreeWithOptions(path, tmpdir, points, BuildOptions{})
+}
+
+func CreateTreeWithOptions(path, tmpdir string, points *PointSet,
+	opts BuildOptions) (*Tree, error) {
+	return CreateTreeContext(context.Background(), path, tmpdir, points, opts)
+}
+
+// CreateTreeContext is CreateTreeWithOptions, but stops and returns ctx's
+// error if ctx is canceled while the tree is being built.
+//
+// Trees are built in a temporary file next to path, which is synced and
+// renamed to path once complete, so if the build fails or the process dies
+// there is never a partial tree at path, and an existing file at path is
+// replaced atomically.
+//
+// Points added to points in ascending order along the first dimension, as
+// from a sorted export, build faster: every level of the tree that splits on
+// the first dimension splits them in place, without a pass over them, unless
+// duplicates are being dropped or DirectIO is set.
+//
+// Builds are deterministic: the same points, added to points in the same
+// order, built with the same options, give a byte-identical tree file.
+// Points added to points from several goroutines at once are stored in no
+// particular order, so can give different files, as can a PaddingFill that
+// isn't deterministic, such as RandomPadding. A build resumed from a
+// checkpoint holds the same points as one that wasn't interrupted, but may
+// split them differently.
+func CreateTreeContext(ctx context.Context, path, tmpdir string,
+	points *PointSet, opts BuildOptions) (*Tree, error) {
+	blog := newBuildLog(opts.Logger, path, points)
+	t, err := createTree(ctx, path, tmpdir, points, opts, blog)
+	blog.finish(err)
+	return t, err
+}
+
+func createTree(ctx context.Context, path, tmpdir string, points *PointSet,
+	opts BuildOptions, blog *buildLog) (*Tree, error) {
+	norm := opts.Normalization
+	if opts.Normalize {
+		if norm != nil || opts.CheckpointDir != "" {
+			return nil, errClass.New("Normalize can't be combined with " +
+				"Normalization or CheckpointDir")
+		}
+		normalized, err := newBaseFS(tempName(tmpdir))
+		if err != nil {
+			return nil, err
+		}
+		defer normalized.Delete()
+		points, norm, err = normalizeSet(normalized, points)
+		if err != nil {
+			return nil, err
+		}
+		defer points.Close()
+	} else if norm != nil {
+		err := norm.check(points.dims)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f := footer{
+		dims:          points.dims,
+		maxDataLen:    points.maxDataLen,
+		count:         points.count,
+		root:          -1,
+		min:           points.min,
+		max:           points.max,
+		normalization: norm,
+		generation:    opts.generation}
+	if f.count > maxPoints {
+		return nil, ErrTooManyPoints.New("%d points, more than %d",
+			f.count, int64(maxPoints))
+	}
+	if f.count > 0 {
+		f.root = 0
+	} else {
+		f.min = make([]float64, f.dims)
+		f.max = make([]float64, f.dims)
+	}
+
+	var err error
+	if opts.TimeField != nil {
+		err = opts.TimeField.check(f.maxDataLen)
+		if err != nil {
+			return nil, err
+		}
+		tf := *opts.TimeField
+		f.timeField = &tf
+	}
+	if opts.TagField != nil {
+		err = opts.TagField.check(f.maxDataLen)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.LeafSize < 0 ||
+		(opts.LeafSize > 0 && opts.Layout != PreorderLayout) {
+		return nil, errClass.New("LeafSize must be positive, with the " +
+			"preorder layout")
+	}
+	f.leafSize = opts.LeafSize
+	err = opts.SplitStrategy.check()
+	if err != nil {
+		return nil, err
+	}
+	f.split = opts.SplitStrategy
+	err = opts.SplitDimension.check()
+	if err != nil {
+		return nil, err
+	}
+	f.dimensions = opts.SplitDimension
+	err = checkCodec(opts)
+	if err != nil {
+		return nil, err
+	}
+	fsync, err := newSyncer(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CheckpointDir != "" && opts.DirectIO {
+		return nil, errClass.New("CheckpointDir can't be used with DirectIO")
+	}
+	if opts.DataCompression < NoCompression ||
+		opts.DataCompression > FlateCompression {
+		return nil, errClass.New("unknown data compression %d",
+			opts.DataCompression)
+	}
+	if opts.GridResolution > 0 {
+		f.grid, err = newGrid(f.min, f.max, opts.GridResolution,
+			opts.MaxGridCells)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	scratch := opts.CheckpointDir
+	if scratch == "" {
+		scratch = tempName(tmpdir)
+	}
+	fs, err := newBaseFS(scratch)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CheckpointDir == "" {
+		// with checkpoints, scratch files are kept until the build succeeds
+		defer fs.Delete()
+	}
+	fs.direct = opts.DirectIO
+	fs.metrics = opts.Metrics
+	// written reports the size of a file the build wrote to Metrics
+	written := func(path string) {
+		if opts.Metrics == nil {
+			return
+		}
+		if fi, err := os.Stat(path); err == nil {
+			opts.Metrics.BuildWrite(fi.Size())
+		}
+	}
+
+	// copies holds the intermediate copies of the whole tree, which move next
+	// to the destination if they don't fit in the scratch budget.
+	copies := fs
+	if opts.MaxScratchBytes > 0 {
+		splits, copiesLen := scratchEstimate(points)
+		if splits > opts.MaxScratchBytes {
+			return nil, errClass.New("build needs about %d bytes of scratch "+
+				"space, more than MaxScratchBytes", splits)
+		}
+		if splits+copiesLen > opts.MaxScratchBytes {
+			copies, err = newBaseFS(tempName(filepath.Dir(path)))
+			if err != nil {
+				return nil, err
+			}
+			defer copies.Delete()
+		}
+	}
+
+	building := tempName(filepath.Dir(path))
+	defer os.Remove(building)
+
+	reversed := copies.Temp()
+	// only the tree file itself is synced
+	syncFor := func(path string) *syncer {
+		if path == building {
+			return fsync
+		}
+		return nil
+	}
+
+	dups := opts.Duplicates
+	if opts.Dedup && dups == KeepDuplicates {
+		dups = DropExactDuplicates
+	}
+	prog := newProgress(opts.Progress, 2*points.count)
+
+	var checkpoints *checkpointer
+	var cp *checkpoint
+	if opts.CheckpointDir != "" {
+		checkpoints, err = newCheckpointer(fs, points, opts, dups)
+		if err != nil {
+			return nil, err
+		}
+		reversed = checkpoints.nodesPath()
+		cp, err = checkpoints.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cp != nil {
+		// the split point files hold everything still to be built
+		points.Close()
+		err = replayNodes(reversed, cp, f.grid, prog)
+		if err != nil {
+			return nil, err
+		}
+		f.count = cp.Built
+	}
+
+	if cp == nil || !cp.Done {
+		blog.phase("split")
+		var nlog *nodeLog
+		if cp != nil {
+			nlog, err = resumeNodeLog(reversed, cp)
+		} else {
+			nlog, err = newNodeLog(reversed, points.dims, points.maxDataLen,
+				opts.DirectIO)
+		}
+		if err != nil {
+			return nil, err
+		}
+		nlog.grid = f.grid
+		nlog.dups = dups
+		nlog.split = f.split
+		nlog.dimensions = f.dimensions
+		nlog.ctx = ctx
+		nlog.progress = prog
+		nlog.checkpoints = checkpoints
+
+		if cp != nil {
+			_, f.count, err = nlog.resume(fs, cp)
+		} else {
+			_, f.count, err = nlog.Build(fs, points, 0)
+		}
+		if err == nil {
+			err = nlog.finishCheckpoints(f.count)
+		}
+		if err != nil {
+			nlog.Close()
+			return nil, err
+		}
+
+		err = nlog.Close()
+		if err != nil {
+			return nil, err
+		}
+		written(reversed)
+	}
+	// removeReversed removes the node log once it is consumed, unless a
+	// resumed build would need it.
+	removeReversed := func() {
+		if checkpoints == nil {
+			os.Remove(reversed)
+		}
+	}
+
+	variableData := opts.VariableData || opts.DataCompression != NoCompression
+	repacked := variableData || opts.Float32 || opts.CoordinateCodec != nil
+	target := building
+	if repacked {
+		target = copies.Temp()
+	}
+	// each intermediate copy is removed as soon as it is consumed, so no
+	// more than two exist at once.
+	blog.phase("write")
+	if opts.Layout == PreorderLayout {
+		err = reverseTree(reversed, target, opts.PaddingFill, prog,
+			syncFor(target), opts.DirectIO)
+		if err != nil {
+			return nil, err
+		}
+		if repacked {
+			written(target)
+		}
+		removeReversed()
+	} else {
+		preorder := copies.Temp()
+		err = reverseTree(reversed, preorder, nil, prog, nil, opts.DirectIO)
+		if err != nil {
+			return nil, err
+		}
+		written(preorder)
+		removeReversed()
+		f.layout = opts.Layout
+		blog.phase("layout")
+		err = relayout(preorder, target, &f, opts.Layout, opts.PaddingFill,
+			syncFor(target))
+		if err != nil {
+			return nil, err
+		}
+		if repacked {
+			written(target)
+		}
+		os.Remove(preorder)
+	}
+	if repacked {
+		out := f
+		out.variableData = variableData
+		out.compression = opts.DataCompression
+		out.float32 = opts.Float32
+		out.codec = opts.CoordinateCodec
+		blog.phase("repack")
+		err = repack(target, building, &f, out, opts.PaddingFill, fsync)
+		if err != nil {
+			return nil, err
+		}
+		os.Remove(target)
+	}
+	if opts.Checksums {
+		blog.phase("checksums")
+		err = addChecksums(building, &f, fsync)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Boxes {
+		blog.phase("boxes")
+		err = addBoxes(building, &f, fsync)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.TagField != nil {
+		blog.phase("tags")
+		err = addTags(building, &f, *opts.TagField, fsync)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = appendFooter(building, &f, fsync)
+	if err != nil {
+		return nil, err
+	}
+	written(building)
+	if len(opts.Mirrors) > 0 {
+		blog.phase("mirrors")
+		err = writeMirrors(building, opts.Mirrors, f.dims, f.maxDataLen)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = os.Rename(building, path)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	fsync.finishDir(path)
+	if opts.PositionIndex != "" {
+		blog.phase("position index")
+		err = writePositionIndex(path, opts.PositionIndex, fsync)
+		if err != nil {
+			return nil, err
+		}
+	}
+	prog.finish()
+	if opts.CheckpointDir != "" {
+		fs.Delete()
+	}
+
+	return OpenTree(path)
+}
+
+// scratchEstimate bounds the scratch space a build of points uses: for the
+// point files it splits the points into, at most two copies of the points
+// at once, and for intermediate copies of the tree, at most two at once.
+func scratchEstimate(points *PointSet) (splits, copies int64) {
+	return 2 * points.count * int64(pointSize(points.dims, points.maxDataLen)),
+		2 * points.count * int64(nodeSize(points.dims, points.maxDataLen))
+}
+
+// CreateTreeFromChan builds a tree out of every point received from points
+// until it is closed. As with BuildTree, points are held in memory up to
+// opts.MaxMemoryBytes, and past it, or without it, are spooled to a
+// temporary file in tmpdir as they arrive, so memory use doesn't grow with
+// the number of points. If a point can't be added, the rest of the channel
+// is drained and discarded so the sender isn't left blocked.
+func CreateTreeFromChan(path, tmpdir string, dims, maxDataLen int,
+	points <-chan Point, opts BuildOptions) (*Tree, error) {
+	tree, err := BuildTree(context.Background(), path, tmpdir, dims,
+		maxDataLen, chanIterator(points), opts)
+	if err != nil {
+		for range points {
+		}
+	}
+	return tree, err
+}
+
+// chanIterator is a PointIterator over the points received from a channel.
+type chanIterator <-chan Point
+
+func (it chanIterator) Next() (p Point, ok bool, err error) {
+	p, ok = <-it
+	return p, ok, nil
+}
+
+// PointIterator yields a sequence of points. Next returns ok false once the
+// sequence is exhausted.
+type PointIterator interface {
+	Next() (p Point, ok bool, err error)
+}
+
+// BuildTree builds a tree out of every point iter yields. Points are held in
+// memory up to opts.MaxMemoryBytes, and past it, or without one, are spooled
+// to a temporary file in tmpdir as they are read, like CreateTreeFromChan, so
+// there is no need to fill a PointSet first and memory use doesn't grow with
+// the number of points. BuildTree stops reading and returns ctx's error if
+// ctx is canceled.
+func BuildTree(ctx context.Context, path, tmpdir string, dims, maxDataLen int,
+	iter PointIterator, opts BuildOptions) (*Tree, error) {
+	var fs *baseFS
+	var set *PointSet
+	defer func() {
+		if set != nil {
+			set.Close()
+			fs.Delete()
+		}
+	}()
+	// spill moves the points held in memory to a temporary file, which
+	// takes every point after them.
+	var held []Point
+	spill := func() error {
+		var err error
+		fs, err = newBaseFS(tempName(tmpdir))
+		if err != nil {
+			return err
+		}
+		set, err = newPointSet(fs.Temp(), dims, maxDataLen, true)
+		if err != nil {
+			fs.Delete()
+			return err
+		}
+		for _, p := range held {
+			err = set.Add(p)
+			if err != nil {
+				return err
+			}
+		}
+		held = nil
+		return nil
+	}
+	if opts.MaxMemoryBytes <= 0 {
+		err := spill()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	size := int64(pointSize(dims, maxDataLen))
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+		p, ok, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if set == nil && int64(len(held)+1)*size <= opts.MaxMemoryBytes {
+			// the iterator may reuse p's slices for the next point
+			held = append(held, Point{
+				Pos:  append([]float64(nil), p.Pos...),
+				Data: append([]byte(nil), p.Data...)})
+			continue
+		}
+		if set == nil {
+			err = spill()
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = set.Add(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if set == nil {
+		tree, err := buildInMemory(path, dims, maxDataLen, held, opts)
+		if !ErrUnsupported.Contains(err) {
+			return tree, err
+		}
+		err = spill()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return CreateTreeContext(ctx, path, tmpdir, set, opts)
+}
+
+// buildInMemory builds a tree of points with CreateTreeInMemory and writes
+// it to path.
+func buildInMemory(path string, dims, maxDataLen int, points []Point,
+	opts BuildOptions) (*Tree, error) {
+	fsync, err := newSyncer(opts)
+	if err != nil {
+		return nil, err
+	}
+	mem, err := CreateTreeInMemory(dims, maxDataLen, points, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer mem.Close()
+
+	building := tempName(filepath.Dir(path))
+	defer os.Remove(building)
+	fh, err := os.Create(building)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	_, err = mem.WriteTo(fh)
+	if err == nil {
+		err = fsync.finish(fh)
+	}
+	if cerr := fh.Close(); err == nil {
+		err = errClass.Wrap(cerr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(building, path)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	fsync.finishDir(path)
+	return OpenTree(path)
+}
+
+// MergeTrees builds a tree at path out of the live points of every tree in
+// trees, including their pending inserted points. The trees must have the
+// same number of dimensions. The merged tree's max data length is the
+// largest of theirs. Temporary files go in tmpdir.
+func MergeTrees(path, tmpdir string, opts BuildOptions, trees ...*Tree) (
+	*Tree, error) {
+	if len(trees) == 0 {
+		return nil, errClass.New("no trees to merge")
+	}
+	dims, maxDataLen := trees[0].footer.dims, 0
+	for _, t := range trees {
+		if t.footer.dims != dims {
+			return nil, ErrDimensionMismatch.New("tree has %d dimensions, expected %d",
+				t.footer.dims, dims)
+		}
+		if t.footer.maxDataLen > maxDataLen {
+			maxDataLen = t.footer.maxDataLen
+		}
+	}
+
+	fs, err := newBaseFS(tempName(tmpdir))
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Delete()
+
+	set, err := newPointSet(fs.Temp(), dims, maxDataLen, true)
+	if err != nil {
+		return nil, err
+	}
+	defer set.Close()
+	for _, t := range trees {
+		err = t.Each(set.Add)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return CreateTreeWithOptions(path, tmpdir, set, opts)
+}
+
+func appendFooter(path string, f *footer, fsync *syncer) error {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	err = f.serialize(fh)
+	if err == nil {
+		err = fsync.finish(fh)
+	}
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// OpenTree opens the tree at path for reading. Tree files written before
+// footers were added to the format can still be opened, but opening one reads
+// the whole file.
+func OpenTree(path string) (*Tree, error) {
+	return OpenTreeWithOptions(path, OpenOptions{})
+}
+
+func OpenTreeWithOptions(path string, opts OpenOptions) (*Tree, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return openTree(path, fh, false, opts)
+}
+
+func openTree(path string, fh *os.File, writable bool, opts OpenOptions) (
+	*Tree, error) {
+	filelen, err := fh.Seek(0, 2)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	var r io.ReaderAt = fh
+	var m *mapping
+	if opts.Mmap {
+		m, err = mmapFile(fh, filelen)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		if m != nil {
+			r = m
+		}
+	}
+
+	t, err := openReaderAt(r, filelen, opts)
+	if err == nil && writable && t.legacy {
+		t.prefetch.stop()
+		err = ErrUnsupported.New("tree files written before footers were " +
+			"added can only be opened for reading; write them out again " +
+			"with WriteTo to update them")
+	}
+	if err == nil {
+		t.pending, err = openPendingLog(path+pendingSuffix, t.footer.dims,
+			t.footer.generation)
+		if err != nil {
+			t.prefetch.stop()
+		}
+	}
+	if err != nil {
+		m.unmap()
+		fh.Close()
+		return nil, err
+	}
+	t.path = path
+	t.fh = fh
+	t.writable = writable
+	t.mapping = m
+	err = t.replay()
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// openReaderAt opens the tree held in the first size bytes of r. The tree
+// has no pending log.
+func openReaderAt(r io.ReaderAt, size int64, opts OpenOptions) (*Tree,
+	error) {
+	legacy, err := openLegacy(r, size, opts.Dims)
+	if err != nil {
+		return nil, err
+	}
+	if legacy != nil {
+		r, size = legacy, legacy.size()
+	}
+	f, nodesLen, err := readFooter(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Dims > 0 && f.dims != opts.Dims {
+		return nil, ErrDimensionMismatch.New("tree was built with %s, "+
+			"expected %d dimensions", f.describe(), opts.Dims)
+	}
+	if opts.MaxDataLen > 0 && f.maxDataLen != opts.MaxDataLen {
+		return nil, ErrDataLenMismatch.New("tree was built with %s, "+
+			"expected a max data length of %d", f.describe(), opts.MaxDataLen)
+	}
+
+	nodelen := f.nodeSize()
+	// a corrupt count or data length could overflow the sum below
+	if f.count < 0 || f.count > nodesLen/nodelen || f.dataLen < 0 ||
+		f.dataLen > nodesLen ||
+		nodesLen != f.count*nodelen+f.dataLen+f.checksumsLen()+f.boxesLen()+
+			f.tagsLen() {
+		return nil, ErrCorrupt.New("Invalid tree file")
+	}
+
+	var cache *nodeCache
+	if opts.CacheBytes > 0 {
+		cache = newNodeCache(opts.CacheBytes)
+		cache.logger = opts.Logger
+	}
+
+	if opts.Metrics != nil {
+		r = &meteredReader{r: r, metrics: opts.Metrics}
+	}
+	t := &Tree{
+		r:       r,
+		opts:    opts,
+		root:    f.root,
+		count:   f.count,
+		nodelen: nodelen,
+		footer:  f,
+		stats:   new(statsCounters),
+		pending: new(pendingLog),
+		cache:   cache,
+		legacy:  legacy != nil,
+	}
+	if opts.PinLevels > 0 {
+		t.pinned, err = t.pinLevels(opts.PinLevels)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Prefetch > 0 {
+		t.prefetch = newPrefetcher(t, opts.Prefetch)
+	}
+	return t, nil
+}
+
+func (t *Tree) Close() error {
+	t.prefetch.stop()
+	err := t.pending.close()
+	if merr := t.mapping.unmap(); err == nil {
+		err = merr
+	}
+	if t.closer != nil {
+		if cerr := t.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if t.fh == nil {
+		return err
+	}
+	if cerr := t.fh.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Count returns the number of points stored in the tree, including any that
+// have since been deleted and any inserted but not yet merged.
+func (t *Tree) Count() int64 { return t.count + int64(t.pending.len()) }
+
+func (t *Tree) Dims() int { return t.footer.dims }
+
+// Root returns the root node of the tree. See Cursor for walking the tree
+// from it.
+func (t *Tree) Root() (Node, error) { return t.Node(t.root) }
+
+// Node returns the node at offset id of the tree file, such as a Node's Left
+// or Right, through the node cache if the tree has one.
+func (t *Tree) Node(id int64) (Node, error) {
+	if n, ok := t.pinned.get(id); ok {
+		return n, nil
+	}
+	if t.cache == nil {
+		return t.readNode(id)
+	}
+	n, ok := t.cache.get(id)
+	if t.opts.Metrics != nil {
+		t.opts.Metrics.CacheLookup(ok)
+	}
+	if ok {
+		return n, nil
+	}
+	n, err := t.readNode(id)
+	if err != nil {
+		return Node{}, err
+	}
+	t.cache.add(id, n, t.nodelen)
+	return n, nil
+}
+
+// readNode reads the node at id from the file, bypassing the node cache.
+func (t *Tree) readNode(id int64) (Node, error) {
+	data := make([]byte, t.nodelen)
+	_, err := t.r.ReadAt(data, id)
+	if err != nil {
+		return Node{}, err
+	}
+	return t.parseNode(id, data)
+}
+
+// parseNode parses the node at offset of the tree, handling holes as
+// configured. The Data of trees with variable-length data is read from the
+// data region. Checksums, if the tree has them, are verified.
+func (t *Tree) parseNode(offset int64, data []byte) (Node, error) {
+	n, ref, err := t.parseNodeShape(offset, data)
+	if err == nil && ref {
+		n.Point.Data, err = t.readData(offset, n.Point.Data)
+	}
+	return n, err
+}
+
+// parseNodeShape is parseNode, but leaves the Data of trees with
+// variable-length data as the reference to it in the data region, and
+// reports whether it did.
+func (t *Tree) parseNodeShape(offset int64, data []byte) (n Node, ref bool,
+	err error) {
+	if t.footer.checksums && !isHole(data) {
+		err := t.verifyNode(offset, data)
+		if err != nil {
+			return Node{}, false, err
+		}
+	}
+	n, err = parseNode(data, t.footer.dims, t.footer.coords())
+	if err != nil {
+		if t.opts.SkipHoles && ErrHole.Contains(err) {
+			return Node{
+				Point:   Point{Pos: make([]float64, t.footer.dims)},
+				Left:    -1,
+				Right:   -1,
+				Deleted: true}, false, nil
+		}
+		return n, false, err
+	}
+	return n, t.footer.variableData, nil
+}
+
+// SubtreeCount descends the tree toward p and returns the number of
+// undeleted points in the subtree rooted at the last node the descent
+// reaches.
+func (t *Tree) SubtreeCount(p Point) (int64, error) {
+	err := t.checkDims(p)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	offset := t.root
+	for offset != -1 {
+		n, err := t.Node(offset)
+		if err != nil {
+			return 0, err
+		}
+		count = n.Count
+		if p.Pos[n.Dim] <= n.Point.Pos[n.Dim] {
+			offset = n.Left
+		} else {
+			offset = n.Right
+		}
+	}
+	return count, nil
+}
 
-	"github.com/spacemonkeygo/errors"
-)
+// PointDistance is a point found by a query along with its distance from
+// the query point. Distance is squared Euclidean distance unless the query
+// takes a PointMetric, in which case it is by that metric.
+//
+// Queries order their results by distance. Points at the same distance are
+// ordered lexicographically by Pos and then by Data, and when there are more
+// of them than a query wants, the first in that order are kept, so the
+// results don't depend on how the tree happens to be laid out.
+type PointDistance struct {
+	Point
+	Distance float64
+	// ID identifies the point to Tree.Get.
+	ID uint64
+}
 
-var (
-	errClass = errors.NewClass("dkdtree")
-)
+// before reports whether pd comes ahead of o in query results.
+func (pd *PointDistance) before(o *PointDistance) bool {
+	if pd.Distance != o.Distance {
+		return pd.Distance < o.Distance
+	}
+	return comparePoints(&pd.Point, &o.Point) < 0
+}
 
-type Tree struct {
-	path    string
-	fh      *os.File
-	root    int64
-	count   int64
-	nodelen int64
+// sortResults sorts rv into query result order.
+func sortResults(rv []PointDistance) {
+	sort.Slice(rv, func(i, j int) bool { return rv[i].before(&rv[j]) })
 }
 
-func CreateTree(path, tmpdir string, points *PointSet) (*Tree, error) {
-	fs, err := newBaseFS(tempName(tmpdir))
-	if err != nil {
-		return nil, err
+// Dist returns the plain Euclidean distance, the square root of Distance,
+// for results of queries by squared Euclidean distance.
+func (pd PointDistance) Dist() float64 { return math.Sqrt(pd.Distance) }
+
+// neighbor is a found point along with the offset of its node.
+type neighbor struct {
+	PointDistance
+	offset int64
+	// dataRef is set if Data is still the reference to it in the data region.
+	// See Tree.nodeShape.
+	dataRef bool
+}
+
+type maxHeap []neighbor
+
+func (h *maxHeap) Max() neighbor { return (*h)[0] }
+func (h *maxHeap) Len() int      { return len(*h) }
+func (h *maxHeap) Cap() int      { return cap(*h) }
+
+func (h *maxHeap) Less(i, j int) bool {
+	return (*h)[j].before(&(*h)[i].PointDistance)
+}
+
+func (h *maxHeap) Swap(i, j int) {
+	(*h)[i], (*h)[j] = (*h)[j], (*h)[i]
+}
+
+func (h *maxHeap) Push(x interface{}) {
+	(*h) = append(*h, x.(neighbor))
+}
+
+func (h *maxHeap) Pop() (i interface{}) {
+	i, *h = (*h)[len(*h)-1], (*h)[:len(*h)-1]
+	return i
+}
+
+// Add keeps n if it comes before the last point so far, or if the heap
+// isn't full yet. It reports whether it had to choose between points at the
+// same distance and position whose Data is still a reference, so that the
+// choice may not follow the result order. See nodeShape.
+func (h *maxHeap) Add(n neighbor) (unsure bool) {
+	if h.Len() < h.Cap() {
+		heap.Push(h, n)
+		return false
 	}
-	defer fs.Delete()
+	unsure = refTie(&n, &(*h)[0])
+	if !n.before(&(*h)[0].PointDistance) {
+		return unsure
+	}
+	for h.Len() >= h.Cap() {
+		last := heap.Pop(h).(neighbor)
+		if h.Len() > 0 && refTie(&last, &(*h)[0]) {
+			unsure = true
+		}
+	}
+	heap.Push(h, n)
+	return unsure
+}
 
-	reversed := fs.Temp()
+// refTie reports whether a and b are at the same distance and position but
+// can't be ordered by Data because one of them hasn't been read.
+func refTie(a, b *neighbor) bool {
+	return (a.dataRef || b.dataRef) && a.Distance == b.Distance &&
+		a.samePos(&b.Point)
+}
 
-	nlog, err := newNodeLog(reversed, points.dims, points.maxDataLen)
-	if err != nil {
-		return nil, err
+// Points empties the heap, returning its points closest first.
+func (h *maxHeap) Points() []PointDistance {
+	sort.Sort(sort.Reverse(h))
+	rv := make([]PointDistance, 0, h.Len())
+	for _, n := range *h {
+		rv = append(rv, n.PointDistance)
 	}
+	*h = (*h)[:0]
+	return rv
+}
 
-	_, err = nlog.Build(fs, points, 0)
+// NearestExhaustive just scans every point. This might be faster if your data
+// has high dimensionality.
+func (t *Tree) NearestExhaustive(p Point, n int) ([]PointDistance, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	start := time.Now()
+	err := t.checkDims(p)
+	if err == nil {
+		err = t.checkResults(int64(n))
+	}
 	if err != nil {
 		return nil, err
 	}
-
-	err = nlog.Close()
+	h := make(maxHeap, 0, n)
+	batch := make([]Point, 0, scanBatchSize)
+	offsets := make([]int64, 0, scanBatchSize)
+	flush := func() error {
+		dists, err := t.distances(p, batch)
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			h.Add(neighbor{
+				PointDistance: PointDistance{Point: batch[i], Distance: dists[i],
+					ID: t.pointID(offsets[i])},
+				offset: offsets[i]})
+		}
+		batch = batch[:0]
+		offsets = offsets[:0]
+		return nil
+	}
+	err = t.scan(func(offset int64, n Node) error {
+		if n.Deleted {
+			return nil
+		}
+		batch = append(batch, n.Point)
+		offsets = append(offsets, offset)
+		if len(batch) == cap(batch) {
+			return flush()
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	err = reverseTree(reversed, path)
+	for i, p := range t.pending.snapshot() {
+		batch = append(batch, p)
+		offsets = append(offsets, pendingOffset(i))
+		if len(batch) == cap(batch) {
+			err = flush()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = flush()
 	if err != nil {
 		return nil, err
 	}
+	t.recordQuery(QueryStats{NodesVisited: t.count,
+		BytesRead: t.count * t.nodelen}, start)
+	return h.Points(), nil
+}
 
-	return OpenTree(path)
+// scan calls fn with every node in the tree, in file order.
+func (t *Tree) scan(fn func(offset int64, n Node) error) error {
+	return t.scanRange(t.count*t.nodelen, fn)
 }
 
-func OpenTree(path string) (*Tree, error) {
-	fh, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// scanRange calls fn with every node in the first limit bytes of the tree.
+func (t *Tree) scanRange(limit int64, fn func(offset int64, n Node) error) error {
+	buf := bufio.NewReader(io.NewSectionReader(t.r, 0, limit))
+	for offset := int64(0); offset < limit; offset += t.nodelen {
+		data := make([]byte, t.nodelen)
+		_, err := io.ReadFull(buf, data)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+		n, err := t.parseNode(offset, data)
+		if err != nil {
+			return err
+		}
+		err = fn(offset, n)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	filelen, err := fh.Seek(0, 2)
+// Each calls fn with every point in the tree, in file order, skipping
+// deleted points, and then with every pending inserted point. It stops at
+// and returns the first error fn returns.
+func (t *Tree) Each(fn func(Point) error) error {
+	return t.eachID(func(p Point, id uint64) error { return fn(p) })
+}
+
+// eachID is Each, but also passes each point's ID. See Tree.Get.
+func (t *Tree) eachID(fn func(p Point, id uint64) error) error {
+	err := t.scan(func(offset int64, n Node) error {
+		if n.Deleted {
+			return nil
+		}
+		return fn(n.Point, t.pointID(offset))
+	})
 	if err != nil {
-		fh.Close()
-		return nil, err
+		return err
 	}
-	if filelen == 0 {
-		return &Tree{path: path, fh: fh, root: -1, count: 0}, nil
+	for i, p := range t.pending.snapshot() {
+		err = fn(p, t.pointID(pendingOffset(i)))
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	_, err = fh.Seek(0, 0)
+// Export writes every point Each visits to a new PointSet at path, e.g. to
+// rebuild the tree with different options without the original points.
+func (t *Tree) Export(path string) (*PointSet, error) {
+	set, err := NewPointSet(path, t.footer.dims, t.footer.maxDataLen)
 	if err != nil {
-		fh.Close()
 		return nil, err
 	}
-
-	_, _, err = parseNodeFromReader(fh)
+	err = t.Each(set.Add)
 	if err != nil {
-		fh.Close()
+		set.Close()
 		return nil, err
 	}
+	return set, nil
+}
 
-	nodelen, err := fh.Seek(0, 1)
+// WriteTo writes a complete copy of the tree file to w.
+func (t *Tree) WriteTo(w io.Writer) (n int64, err error) {
+	meter := newWriteMeter(w)
+	_, err = io.Copy(meter, io.NewSectionReader(t.r, 0,
+		t.tagsOffset()+t.footer.tagsLen()))
 	if err != nil {
-		fh.Close()
-		return nil, err
+		return meter.Amount, errClass.Wrap(err)
 	}
+	err = t.footer.serialize(meter)
+	return meter.Amount, err
+}
 
-	if filelen%nodelen != 0 {
-		fh.Close()
-		return nil, errClass.New("Invalid tree file")
+// checkDims returns an error if the query point p has the wrong number of
+// dimensions for the tree, or a coordinate that isn't finite.
+func (t *Tree) checkDims(p Point) error {
+	if len(p.Pos) != t.footer.dims {
+		return ErrDimensionMismatch.New("point has wrong dimension: %d, expected %d",
+			len(p.Pos), t.footer.dims)
 	}
+	return checkFinite(p.Pos)
+}
 
-	return &Tree{
-		path:    path,
-		fh:      fh,
-		root:    0,
-		count:   filelen / nodelen,
-		nodelen: nodelen,
-	}, nil
+// distances returns the squared distance from p to each of points, using
+// the BatchDistance option if there is one.
+func (t *Tree) distances(p Point, points []Point) ([]float64, error) {
+	if t.opts.BatchDistance == nil {
+		rv := make([]float64, 0, len(points))
+		for i := range points {
+			rv = append(rv, p.distanceSquared(&points[i]))
+		}
+		return rv, nil
+	}
+	positions := make([][]float64, 0, len(points))
+	for _, point := range points {
+		positions = append(positions, point.Pos)
+	}
+	rv := t.opts.BatchDistance(p.Pos, positions)
+	if len(rv) != len(points) {
+		return nil, errClass.New("batch distance returned %d distances for %d "+
+			"points", len(rv), len(points))
+	}
+	return rv, nil
 }
 
-func (t *Tree) Close() error {
-	return t.fh.Close()
+// Nearest returns the n points closest to p, closest first, along with their
+// squared distances. The search keeps a bounded max-heap of the best n points
+// so far and prunes any subtree that can't beat the furthest of them, so the
+// tree is walked once no matter how large n is. Fewer than n points are
+// returned if the tree holds fewer.
+func (t *Tree) Nearest(p Point, n int) ([]PointDistance, error) {
+	rv, _, err := t.NearestWithStats(p, n)
+	return rv, err
 }
 
-func (t *Tree) Count() int64        { return t.count }
-func (t *Tree) Root() (Node, error) { return t.Node(t.root) }
+// NearestWithStats is Nearest, but also returns how much work the query did.
+func (t *Tree) NearestWithStats(p Point, n int) ([]PointDistance, QueryStats,
+	error) {
+	return t.nearest(n, &nearestQuery{p: p})
+}
 
-func (t *Tree) Node(id int64) (Node, error) {
-	_, err := t.fh.Seek(id, 0)
+// NearestContext is Nearest, but gives up and returns ctx's error if ctx is
+// canceled before the search is done.
+func (t *Tree) NearestContext(ctx context.Context, p Point, n int) (
+	[]PointDistance, error) {
+	rv, _, err := t.nearest(n, &nearestQuery{p: p, ctx: ctx})
+	return rv, err
+}
+
+// NearestApprox is Nearest, but may return points up to 1+eps times further
+// away than the true nearest points, in exchange for visiting fewer nodes.
+// Subtrees are pruned unless they could hold a point more than 1+eps times
+// closer than the furthest point found so far, so eps of 0 is an exact
+// search, and each returned point is within 1+eps of the distance of the
+// true point of the same rank. Distances are squared as usual.
+func (t *Tree) NearestApprox(p Point, n int, eps float64) ([]PointDistance,
+	error) {
+	if !(eps >= 0) {
+		return nil, errClass.New("invalid approximation factor: %v", eps)
+	}
+	rv, _, err := t.nearest(n,
+		&nearestQuery{p: p, slack: (1 + eps) * (1 + eps)})
+	return rv, err
+}
+
+// NearestWithin is Nearest, but only returns points within radius of p, so
+// it returns fewer than n points if fewer are in range. Subtrees beyond
+// radius are pruned from the start, so a query whose nearest points are far
+// away reads little of the tree. radius is a plain Euclidean distance, not
+// squared, and includes points exactly radius away.
+func (t *Tree) NearestWithin(p Point, n int, radius float64) ([]PointDistance,
+	error) {
+	err := t.checkRange(p, radius)
 	if err != nil {
-		return Node{}, err
+		return nil, err
 	}
-	data := make([]byte, t.nodelen)
-	_, err = io.ReadFull(t.fh, data)
+	rv, _, err := t.nearest(n, &nearestQuery{p: p, limited: true,
+		maxDist: radius * radius})
+	return rv, err
+}
+
+// NearestWhere is Nearest, but only returns points for which pred returns
+// true. The search carries on past rejected points until it has n accepted
+// ones, so it reads more of the tree the more points pred rejects.
+func (t *Tree) NearestWhere(p Point, n int, pred func(Point) bool) (
+	[]PointDistance, error) {
+	rv, _, err := t.nearest(n, &nearestQuery{p: p,
+		filter: func(p *Point) bool { return pred(*p) }})
+	return rv, err
+}
+
+// NearestDistances is Nearest, but only returns the squared distances to the
+// n nearest points, closest first. Trees built with VariableData keep Data
+// apart from the coordinates, so this never reads it there, where Nearest
+// would read the Data of every point it returns.
+func (t *Tree) NearestDistances(p Point, n int) ([]float64, error) {
+	pds, _, err := t.nearest(n, &nearestQuery{p: p, noData: true})
 	if err != nil {
-		return Node{}, err
+		return nil, err
+	}
+	rv := make([]float64, 0, len(pds))
+	for _, pd := range pds {
+		rv = append(rv, pd.Distance)
 	}
-	return parseNode(data)
+	return rv, nil
 }
 
-type PointDistance struct {
-	Point
-	Distance float64
+// nearest finds the n points nearest q.p, searching as the metric, filter,
+// ctx, slack and maxDist fields of q say. The other fields are filled in.
+func (t *Tree) nearest(n int, q *nearestQuery) ([]PointDistance, QueryStats,
+	error) {
+	if n <= 0 {
+		return nil, QueryStats{}, nil
+	}
+	err := t.searchNearest(n, q)
+	if err != nil {
+		return nil, q.stats, err
+	}
+	return q.h.Points(), q.stats, nil
 }
 
-type maxHeap []PointDistance
+// searchNearest is nearest, leaving the results in q.h.
+func (t *Tree) searchNearest(n int, q *nearestQuery) error {
+	start := time.Now()
+	err := t.checkDims(q.p)
+	if err == nil {
+		err = t.checkResults(int64(n))
+	}
+	if err != nil {
+		return err
+	}
+	q.exclude = -1
+	q.lazyData = q.filter == nil && q.metric == nil && q.key == nil
+	for {
+		q.h = make(maxHeap, 0, n)
+		if q.key != nil {
+			q.keys = make(map[string]struct{}, n)
+		}
+		if t.opts.QueryConcurrency > 0 {
+			q.shared = true
+			err = t.searchConcurrent(t.root, q, t.opts.QueryConcurrency)
+		} else {
+			err = t.search(t.root, q)
+		}
+		if err != nil {
+			return err
+		}
+		t.searchPending(q)
+		if !q.unsure || q.noData {
+			break
+		}
+		// points tied down to their positions were told apart by where
+		// their Data is stored, so search again, reading it
+		q.lazyData = false
+		q.unsure = false
+	}
+	if !q.noData && !q.lazyResults {
+		err = t.resolveData(q.h)
+		if err != nil {
+			return err
+		}
+	}
+	t.recordQuery(q.stats, start)
+	return nil
+}
 
-func (h *maxHeap) Max() PointDistance { return (*h)[0] }
-func (h *maxHeap) Len() int           { return len(*h) }
-func (h *maxHeap) Cap() int           { return cap(*h) }
+// nearestQuery is the state of a search for the points nearest p.
+type nearestQuery struct {
+	p Point
+	// h holds the closest points found so far, and is as large as the number
+	// of points wanted.
+	h maxHeap
+	// exclude is the offset of a node to leave out of the results, or -1.
+	exclude int64
+	// metric measures distances from p, or is nil for squared Euclidean
+	// distance.
+	metric PreparedMetric
+	// filter, if set, must accept a point for it to be a result. Rejected
+	// points don't tighten the search bound.
+	filter func(*Point) bool
+	// key, if set, picks a key out of a point's Data, and h keeps only the
+	// nearest point with each key, whose keys are in keys. See
+	// Tree.NearestDistinct.
+	key  func(data []byte) string
+	keys map[string]struct{}
+	// ctx, if set, cancels the search.
+	ctx context.Context
+	// limited is set if results can be no further than maxDist from p.
+	limited bool
+	maxDist float64
+	// slack, if above 1, scales up the squared distance to the far side of a
+	// split before comparing it with the furthest result, for approximate
+	// search.
+	slack float64
+	// bucket, if set, holds the nodes of the subtree being searched, read at
+	// once. See BuildOptions.LeafSize.
+	bucket *bucket
+	// lazyData is set if the search may leave the Data of the points it
+	// finds unread until they are resolved, as it doesn't look at Data.
+	lazyData bool
+	// unsure is set if h may have kept the wrong one of points tied on
+	// distance and position, as their Data wasn't read. See maxHeap.Add.
+	unsure bool
+	// noData is set if only the distances of the results are wanted, so
+	// their Data is left unread, and ties on it don't matter.
+	noData bool
+	// lazyResults is set if the Data of the results is left for the caller
+	// to read. See Tree.NearestLazy.
+	lazyResults bool
+	// tags, if set, prunes subtrees whose points can't match it, going by
+	// the tag table. filter must also check points against it.
+	tags *TagFilter
+	// across, if set, is shared with searches of other trees for the same
+	// points, and the query prunes against the nearest points they've found
+	// as well as its own. See Forest.Nearest.
+	across *sharedBound
+	// shared is set when the query is searched by multiple goroutines, which
+	// then must hold mu to use h.
+	shared bool
+	mu     sync.Mutex
+	stats  QueryStats
+}
 
-func (h *maxHeap) Less(i, j int) bool {
-	return (*h)[i].Distance > (*h)[j].Distance
+// visit counts a node visited by the query and the nodelen bytes read for
+// it, and reports whether the query has been canceled.
+func (q *nearestQuery) visit(nodelen int64) error {
+	q.count(&q.stats.NodesVisited, 1)
+	q.count(&q.stats.BytesRead, nodelen)
+	if q.ctx == nil {
+		return nil
+	}
+	return q.ctx.Err()
 }
 
-func (h *maxHeap) Swap(i, j int) {
-	(*h)[i], (*h)[j] = (*h)[j], (*h)[i]
+// count adds n to the stats counter c. Shared queries lock mu rather than
+// adding atomically, as a nearestQuery inside a ResultBuffer needn't be
+// 64-bit aligned, which atomic adds require on 32-bit platforms.
+func (q *nearestQuery) count(c *int64, n int64) {
+	if q.shared {
+		q.mu.Lock()
+		*c += n
+		q.mu.Unlock()
+	} else {
+		*c += n
+	}
 }
 
-func (h *maxHeap) Push(x interface{}) {
-	(*h) = append(*h, x.(PointDistance))
+// prune counts the subtree at offset as pruned, if there is one.
+func (q *nearestQuery) prune(offset int64) {
+	if offset != -1 {
+		q.count(&q.stats.SubtreesPruned, 1)
+	}
 }
 
-func (h *maxHeap) Pop() (i interface{}) {
-	i, *h = (*h)[len(*h)-1], (*h)[:len(*h)-1]
-	return i
+func (q *nearestQuery) distance(b *Point) float64 {
+	q.count(&q.stats.PointsCompared, 1)
+	if q.metric == nil {
+		return q.p.distanceSquared(b)
+	}
+	return q.metric.Distance(b)
 }
 
-// NearestExhaustive just scans every point. This might be faster if your data
-// has high dimensionality.
-func (t *Tree) NearestExhaustive(p Point, n int) ([]PointDistance, error) {
-	h := make(maxHeap, 0, n)
-	_, err := t.fh.Seek(0, 0)
-	if err != nil {
-		return nil, err
+// add offers a found point to the query.
+func (q *nearestQuery) add(n neighbor) {
+	if q.limited && n.Distance > q.maxDist {
+		return
 	}
-	buf := bufio.NewReader(t.fh)
-	for {
-		n, _, err := parseNodeFromReader(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-		dist := p.distanceSquared(&n.Point)
-		if h.Len() < h.Cap() || dist < h.Max().Distance {
-			for h.Len() >= h.Cap() {
-				heap.Pop(&h)
-			}
-			heap.Push(&h, PointDistance{
-				Point:    n.Point,
-				Distance: dist})
+	if q.across != nil && n.Distance > q.across.get() {
+		return
+	}
+	if q.shared {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+	}
+	if q.key != nil {
+		q.addDistinct(n)
+	} else if q.h.Add(n) {
+		q.unsure = true
+	}
+	if q.across != nil && q.h.Len() >= q.h.Cap() {
+		q.across.lower(q.h.Max().Distance)
+	}
+}
+
+// bound returns the furthest a point can be and still be one of the nearest
+// points. It must be called with mu held if the query is shared.
+func (q *nearestQuery) bound() float64 {
+	bound := math.Inf(1)
+	if q.h.Len() >= q.h.Cap() {
+		bound = q.h.Max().Distance
+	}
+	if q.limited && q.maxDist < bound {
+		bound = q.maxDist
+	}
+	if q.across != nil {
+		if across := q.across.get(); across < bound {
+			bound = across
 		}
 	}
-	sort.Sort(sort.Reverse(&h))
-	return h, nil
+	return bound
 }
 
-func (t *Tree) Nearest(p Point, n int) ([]PointDistance, error) {
-	h := make(maxHeap, 0, n)
-	err := t.search(t.root, p, &h)
-	if err != nil {
-		return nil, err
+// explore reports whether the far side of a split on dimension dim, delta
+// away from p, could still hold any of the nearest points.
+func (q *nearestQuery) explore(dim uint32, delta float64) bool {
+	if q.shared {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+	}
+	bound := q.bound()
+	if math.IsInf(bound, 1) {
+		return true
 	}
-	sort.Sort(sort.Reverse(&h))
-	return h, nil
+	if q.metric == nil {
+		if q.slack > 1 {
+			return delta*delta*q.slack <= bound
+		}
+		return delta*delta <= bound
+	}
+	return q.metric.AxisBound(dim, delta) <= bound
 }
 
-func (t *Tree) search(node_offset int64, p Point, h *maxHeap) error {
-	if node_offset == -1 {
-		return nil
+// outOfReach reports whether b, with squared Euclidean distances, is too far
+// from p to hold any of the nearest points.
+func (q *nearestQuery) outOfReach(b *box) bool {
+	if q.shared {
+		q.mu.Lock()
+		defer q.mu.Unlock()
 	}
+	bound := q.bound()
+	if math.IsInf(bound, 1) {
+		return false
+	}
+	dist := b.minDistance(&q.p)
+	if q.slack > 1 {
+		dist *= q.slack
+	}
+	return dist > bound
+}
 
-	n, err := t.Node(node_offset)
+// NearestFunc finds the same points as Nearest, but once the search is done
+// it hands them to fn in order of increasing distance instead of returning
+// them, releasing each point after fn sees it. It stops at and returns the
+// first error fn returns.
+func (t *Tree) NearestFunc(p Point, n int, fn func(PointDistance) error) error {
+	nearest, err := t.Nearest(p, n)
 	if err != nil {
 		return err
 	}
+	for i := range nearest {
+		err = fn(nearest[i])
+		if err != nil {
+			return err
+		}
+		nearest[i] = PointDistance{}
+	}
+	return nil
+}
 
-	c := p.Pos[n.Dim] - n.Point.Pos[n.Dim]
-	dist := p.distanceSquared(&n.Point)
-
-	if h.Len() < h.Cap() || dist < h.Max().Distance {
-		for h.Len() >= h.Cap() {
-			heap.Pop(h)
+// searchPending offers every pending point to q.
+func (t *Tree) searchPending(q *nearestQuery) {
+	for i, p := range t.pending.snapshot() {
+		offset := pendingOffset(i)
+		if offset == q.exclude || (q.filter != nil && !q.filter(&p)) {
+			continue
 		}
-		heap.Push(h, PointDistance{
-			Point:    n.Point,
-			Distance: dist})
+		q.add(neighbor{
+			PointDistance: PointDistance{Point: p, Distance: q.distance(&p),
+				ID: t.pointID(offset)},
+			offset: offset})
 	}
+}
 
-	if c <= 0 {
-		err = t.search(n.Left, p, h)
+func (t *Tree) search(node_offset int64, q *nearestQuery) error {
+	if node_offset == -1 {
+		return nil
+	}
+	if t.footer.boxes && q.metric == nil {
+		b, err := t.nodeBox(node_offset)
 		if err != nil {
 			return err
 		}
-		if c*c <= h.Max().Distance {
-			err = t.search(n.Right, p, h)
-			if err != nil {
-				return err
-			}
+		if q.outOfReach(&b) {
+			q.prune(node_offset)
+			return nil
+		}
+	}
+	if q.tags != nil {
+		pruned, err := t.tagsPruned(node_offset, q.tags)
+		if err != nil {
+			return err
+		}
+		if pruned {
+			q.prune(node_offset)
+			return nil
 		}
-		return nil
 	}
 
-	err = t.search(n.Right, p, h)
+	read := t.nodelen
+	if q.bucket.holds(node_offset, t.nodelen) {
+		read = 0
+	}
+	n, ref, err := t.searchNode(node_offset, q)
+	if err != nil {
+		return err
+	}
+	err = q.visit(read)
 	if err != nil {
 		return err
 	}
-	if c*c <= h.Max().Distance {
-		err = t.search(n.Left, p, h)
+	if q.bucket == nil && !q.shared && n.Count > 1 &&
+		n.Count <= int64(t.footer.leafSize) {
+		err = t.readBucket(node_offset, n.Count, q)
 		if err != nil {
 			return err
 		}
+		defer func() { q.bucket = nil }()
 	}
+
+	c := q.p.Pos[n.Dim] - n.Point.Pos[n.Dim]
+	dist := q.distance(&n.Point)
+
+	if !n.Deleted && node_offset != q.exclude &&
+		(q.filter == nil || q.filter(&n.Point)) {
+		q.add(neighbor{
+			PointDistance: PointDistance{Point: n.Point, Distance: dist,
+				ID: t.pointID(node_offset)},
+			offset:  node_offset,
+			dataRef: ref})
+	}
+
+	near, far := n.Left, n.Right
+	if c > 0 {
+		near, far = far, near
+	}
+	t.prefetch.fetch(far)
+	err = t.search(near, q)
+	if err != nil {
+		return err
+	}
+	if q.explore(n.Dim, c) {
+		return t.search(far, q)
+	}
+	q.prune(far)
 	return nil
 }
+
+// searchConcurrent is search, but explores both children of the top levels
+// of the tree at once. The far child is only pruned by the bound at the time
+// it is started, so this can visit more nodes than search in exchange for
+// finishing sooner.
+func (t *Tree) searchConcurrent(node_offset int64, q *nearestQuery,
+	levels int) error {
+	if levels <= 0 {
+		return t.search(node_offset, q)
+	}
+	if node_offset == -1 {
+		return nil
+	}
+
+	n, err := t.Node(node_offset)
+	if err != nil {
+		return err
+	}
+	err = q.visit(t.nodelen)
+	if err != nil {
+		return err
+	}
+
+	c := q.p.Pos[n.Dim] - n.Point.Pos[n.Dim]
+	dist := q.distance(&n.Point)
+
+	if !n.Deleted && node_offset != q.exclude &&
+		(q.filter == nil || q.filter(&n.Point)) {
+		q.add(neighbor{
+			PointDistance: PointDistance{Point: n.Point, Distance: dist,
+				ID: t.pointID(node_offset)},
+			offset: node_offset})
+	}
+
+	near, far := n.Left, n.Right
+	if c > 0 {
+		near, far = far, near
+	}
+	var wg sync.WaitGroup
+	var farErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if q.explore(n.Dim, c) {
+			farErr = t.searchConcurrent(far, q, levels-1)
+		} else {
+			q.prune(far)
+		}
+	}()
+	err = t.searchConcurrent(near, q, levels-1)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return farErr
+}
@@ -15,8 +15,18 @@
 package dkdtree
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -93,3 +103,1599 @@ func TestTree(t *testing.T) {
 		}
 	}
 }
+
+func newTestFS(t testing.TB) *baseFS {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func newTestPoints(n, dims, maxData int) []Point {
+	points := make([]Point, 0, n)
+	for i := 0; i < n; i++ {
+		points = append(points, NewPoint(dims, maxData))
+	}
+	return points
+}
+
+// withoutIDs clears the IDs of rv, for comparing results of trees built
+// separately, whose points may be numbered differently.
+func withoutIDs(rv []PointDistance) []PointDistance {
+	for i := range rv {
+		rv[i].ID = 0
+	}
+	return rv
+}
+
+func createTestTree(t testing.TB, fs *baseFS, dims, maxData int,
+	points []Point, opts BuildOptions) *Tree {
+	log, err := NewPointSet(fs.Temp(), dims, maxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points {
+		err = log.Add(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree, err := CreateTreeWithOptions(fs.Path(tempName("")), fs.Temp(), log,
+		opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestNearestFunc(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	tree := createTestTree(t, fs, 4, 10, newTestPoints(200, 4, 10),
+		BuildOptions{})
+	defer tree.Close()
+
+	q := NewPoint(4, 10)
+	nearest, err := tree.Nearest(q, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []PointDistance
+	err = tree.NearestFunc(q, 10, func(pd PointDistance) error {
+		seen = append(seen, pd)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(nearest) {
+		t.Fatalf("got %d callbacks, expected %d", len(seen), len(nearest))
+	}
+	for i := range seen {
+		if i > 0 && seen[i].Distance < seen[i-1].Distance {
+			t.Fatal("callbacks out of order")
+		}
+		if !seen[i].Point.equal(&nearest[i].Point) {
+			t.Fatal("callback disagrees with Nearest")
+		}
+	}
+
+	stop := errClass.New("stop")
+	calls := 0
+	err = tree.NearestFunc(q, 10, func(pd PointDistance) error {
+		calls++
+		if calls == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || calls != 3 {
+		t.Fatalf("expected early stop after 3 calls, got %d calls, err %v",
+			calls, err)
+	}
+}
+
+func TestBatchDistance(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	tree := createTestTree(t, fs, 5, 10, newTestPoints(1000, 5, 10),
+		BuildOptions{})
+	defer tree.Close()
+
+	batches := 0
+	batched, err := OpenTreeWithOptions(tree.path, OpenOptions{
+		BatchDistance: func(q []float64, positions [][]float64) []float64 {
+			batches++
+			rv := make([]float64, 0, len(positions))
+			for _, pos := range positions {
+				sum := float64(0)
+				for i := range pos {
+					sum += (q[i] - pos[i]) * (q[i] - pos[i])
+				}
+				rv = append(rv, sum)
+			}
+			return rv
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batched.Close()
+
+	for i := 0; i < 10; i++ {
+		q := NewPoint(5, 10)
+		expected, err := tree.NearestExhaustive(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := batched.NearestExhaustive(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != len(expected) {
+			t.Fatal("result count mismatch")
+		}
+		for j := range actual {
+			if !actual[j].Point.equal(&expected[j].Point) ||
+				actual[j].Distance != expected[j].Distance {
+				t.Fatal("batched results differ")
+			}
+		}
+	}
+	if batches == 0 {
+		t.Fatal("batch distance function never called")
+	}
+}
+
+func TestDimsMismatch(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	tree := createTestTree(t, fs, 3, 10, newTestPoints(50, 3, 10),
+		BuildOptions{})
+	tree.Close()
+
+	// claim the root point only has two dimensions
+	fh, err := os.OpenFile(tree.path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dims [uint32Size]byte
+	binary.LittleEndian.PutUint32(dims[:], 2)
+	_, err = fh.WriteAt(dims[:], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+
+	tree, err = OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	_, err = tree.Nearest(NewPoint(3, 10), 1)
+	if !ErrCorrupt.Contains(err) {
+		t.Fatalf("expected corruption error, got %v", err)
+	}
+	_, err = tree.NearestExhaustive(NewPoint(3, 10), 1)
+	if !ErrCorrupt.Contains(err) {
+		t.Fatalf("expected corruption error, got %v", err)
+	}
+}
+
+func TestQueryDims(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	var searcher Searcher = createTestTree(t, fs, 3, 10,
+		newTestPoints(50, 3, 10), BuildOptions{})
+	defer searcher.(*Tree).Close()
+
+	set, err := NewPointSet(fs.Temp(), 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	err = set.Add(Point{Pos: []float64{0, 0}})
+	if !ErrDimensionMismatch.Contains(err) {
+		t.Fatalf("expected a dimension mismatch, got %v", err)
+	}
+	err = set.Add(Point{Pos: []float64{0, 0, 0}, Data: make([]byte, 5)})
+	if !ErrDataTooLarge.Contains(err) {
+		t.Fatalf("expected data too large, got %v", err)
+	}
+
+	_, _, err = searcher.(*Tree).NearestIter(NewPoint(2, 10)).Next()
+	if !ErrDimensionMismatch.Contains(err) {
+		t.Fatalf("expected a dimension mismatch, got %v", err)
+	}
+	_, err = OpenTreeWithOptions(searcher.(*Tree).path, OpenOptions{Dims: 4})
+	if !ErrDimensionMismatch.Contains(err) {
+		t.Fatalf("expected a dimension mismatch, got %v", err)
+	}
+	_, err = OpenTreeWithOptions(searcher.(*Tree).path,
+		OpenOptions{Dims: 3, MaxDataLen: 5})
+	if !ErrDataLenMismatch.Contains(err) {
+		t.Fatalf("expected a max data length mismatch, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "3 dimensions") {
+		t.Fatalf("expected the build parameters in %q", err)
+	}
+	reopened, err := OpenTreeWithOptions(searcher.(*Tree).path,
+		OpenOptions{Dims: 3, MaxDataLen: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+
+	if searcher.Dims() != 3 {
+		t.Fatalf("got %d dims, expected 3", searcher.Dims())
+	}
+	for _, dims := range []int{2, 4} {
+		_, err := searcher.Nearest(NewPoint(dims, 10), 1)
+		if !ErrDimensionMismatch.Contains(err) {
+			t.Fatalf("expected a dimension mismatch querying with %d dims, "+
+				"got %v", dims, err)
+		}
+		_, err = searcher.(*Tree).NearestExhaustive(NewPoint(dims, 10), 1)
+		if err == nil {
+			t.Fatalf("expected an error querying with %d dims", dims)
+		}
+	}
+}
+
+func TestNonFinite(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(50, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+
+	set, err := NewPointSet(fs.Temp(), 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		err = set.Add(Point{Pos: []float64{0, v, 0}})
+		if !ErrNonFinite.Contains(err) {
+			t.Fatalf("expected a non-finite error adding %v, got %v", v, err)
+		}
+	}
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	err = rw.Insert(Point{Pos: []float64{math.NaN(), 0, 0}})
+	if !ErrNonFinite.Contains(err) {
+		t.Fatalf("expected a non-finite error inserting, got %v", err)
+	}
+	_, err = rw.Nearest(Point{Pos: []float64{0, 0, math.Inf(1)}}, 1)
+	if !ErrNonFinite.Contains(err) {
+		t.Fatalf("expected a non-finite error querying, got %v", err)
+	}
+
+	inf := math.Inf(1)
+	found := 0
+	err = rw.Range([]float64{-inf, -inf, -inf}, []float64{inf, inf, inf},
+		func(Point) error {
+			found++
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != len(points) {
+		t.Fatalf("open range found %d points, expected %d", found, len(points))
+	}
+}
+
+func TestTieBreak(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	// a grid of points, each position three times over with different Data,
+	// so that a query at the origin has ties at every distance
+	var points []Point
+	for x := -2; x <= 2; x++ {
+		for y := -2; y <= 2; y++ {
+			for _, data := range []string{"c", "a", "bb"} {
+				points = append(points, Point{
+					Pos:  []float64{float64(x), float64(y)},
+					Data: []byte(data)})
+			}
+		}
+	}
+	q := Point{Pos: []float64{0, 0}}
+	var expected []PointDistance
+	for _, p := range points {
+		expected = append(expected,
+			PointDistance{Point: p, Distance: q.distanceSquared(&p)})
+	}
+	sortResults(expected)
+
+	rng := rand.New(rand.NewSource(0))
+	for _, opts := range []BuildOptions{{}, {VariableData: true}} {
+		for trial := 0; trial < 3; trial++ {
+			rng.Shuffle(len(points), func(i, j int) {
+				points[i], points[j] = points[j], points[i]
+			})
+			tree := createTestTree(t, fs, 2, 2, points, opts)
+			var buf ResultBuffer
+			for _, n := range []int{1, 4, 8, 16, 40, len(points)} {
+				nearest, err := tree.Nearest(q, n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				into, err := tree.NearestInto(q, n, &buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				it := tree.NearestIter(q)
+				for i := 0; i < n; i++ {
+					next, _, err := it.Next()
+					if err != nil {
+						t.Fatal(err)
+					}
+					for name, got := range map[string]PointDistance{
+						"Nearest": nearest[i], "NearestInto": into[i],
+						"NearestIter": next} {
+						if got.Distance != expected[i].Distance ||
+							!got.samePos(&expected[i].Point) ||
+							!bytes.Equal(got.Data, expected[i].Data) {
+							t.Fatalf("%+v: %s result %d of %d is %v, expected %v",
+								opts, name, i, n, got, expected[i])
+						}
+					}
+				}
+			}
+			tree.Close()
+		}
+	}
+}
+
+func TestNearestIter(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(300, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	q := NewPoint(3, 10)
+	nearest, err := tree.Nearest(q, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it := tree.NearestIter(q)
+	last := float64(0)
+	count := 0
+	for {
+		pd, ok, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		if pd.Distance < last {
+			t.Fatal("distances decreased")
+		}
+		last = pd.Distance
+		if count < len(nearest) && pd.Distance != nearest[count].Distance {
+			t.Fatal("iterator disagrees with Nearest")
+		}
+		count++
+	}
+	if count != len(points) {
+		t.Fatalf("iterated %d points, expected %d", count, len(points))
+	}
+}
+
+func TestQueryConcurrency(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	tree := createTestTree(t, fs, 3, 10, newTestPoints(1000, 3, 10),
+		BuildOptions{})
+	defer tree.Close()
+
+	concurrent, err := OpenTreeWithOptions(tree.path,
+		OpenOptions{QueryConcurrency: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer concurrent.Close()
+
+	for i := 0; i < 50; i++ {
+		q := NewPoint(3, 10)
+		expected, err := tree.Nearest(q, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := concurrent.Nearest(q, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != len(expected) {
+			t.Fatalf("got %d results, expected %d", len(actual), len(expected))
+		}
+		for j := range expected {
+			if actual[j].Distance != expected[j].Distance ||
+				!actual[j].Point.equal(&expected[j].Point) {
+				t.Fatalf("result %d differs", j)
+			}
+		}
+	}
+}
+
+func TestHoles(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(100, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	// punch out a leaf
+	var hole Node
+	holeOffset := int64(-1)
+	err := tree.scan(func(offset int64, n Node) error {
+		if n.Left == -1 && n.Right == -1 {
+			hole, holeOffset = n, offset
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err := os.OpenFile(tree.path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.WriteAt(make([]byte, tree.nodelen), holeOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+
+	strict, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer strict.Close()
+	_, err = strict.Nearest(hole.Point, 1)
+	if !ErrHole.Contains(err) {
+		t.Fatalf("expected a hole error, got %v", err)
+	}
+	_, err = strict.NearestExhaustive(hole.Point, 1)
+	if !ErrHole.Contains(err) {
+		t.Fatalf("expected a hole error, got %v", err)
+	}
+
+	skipping, err := OpenTreeWithOptions(tree.path, OpenOptions{SkipHoles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skipping.Close()
+	nearest, err := skipping.Nearest(hole.Point, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 1 || nearest[0].Point.equal(&hole.Point) {
+		t.Fatal("expected the punched point to be skipped")
+	}
+	seen := 0
+	err = skipping.Each(func(p Point) error {
+		if p.equal(&hole.Point) {
+			t.Fatal("punched point returned")
+		}
+		seen++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != len(points)-1 {
+		t.Fatalf("saw %d points, expected %d", seen, len(points)-1)
+	}
+}
+
+func TestCreateTreeFromChan(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(2000, 3, 10)
+	ch := make(chan Point)
+	go func() {
+		for _, p := range points {
+			ch <- p
+		}
+		close(ch)
+	}()
+	tree, err := CreateTreeFromChan(fs.Path("tree"), fs.Temp(), 3, 10, ch,
+		BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.Count() != int64(len(points)) {
+		t.Fatalf("got %d points, expected %d", tree.Count(), len(points))
+	}
+	for _, p := range points[:50] {
+		nearest, err := tree.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+	}
+
+	ch = make(chan Point)
+	go func() {
+		ch <- NewPoint(4, 10)
+		for _, p := range points[:100] {
+			ch <- p
+		}
+		close(ch)
+	}()
+	_, err = CreateTreeFromChan(fs.Path("bad"), fs.Temp(), 3, 10, ch,
+		BuildOptions{})
+	if err == nil {
+		t.Fatal("expected a dimension mismatch error")
+	}
+
+	// points past MaxMemoryBytes spill to tmpdir, and those within it are
+	// built without creating it
+	size := int64(pointSize(3, 10))
+	for _, max := range []int64{100 * size, 2000 * size} {
+		tmpdir := fs.Temp()
+		ch = make(chan Point)
+		go func() {
+			for _, p := range points {
+				ch <- p
+			}
+			close(ch)
+		}()
+		tree, err := CreateTreeFromChan(fs.Path("bounded"), tmpdir, 3, 10, ch,
+			BuildOptions{MaxMemoryBytes: max})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Stat(tmpdir)
+		if spilled := err == nil; spilled != (max < 2000*size) {
+			t.Fatalf("MaxMemoryBytes %d: spilled %v, stat error %v", max,
+				spilled, err)
+		}
+		if tree.Count() != int64(len(points)) {
+			t.Fatalf("got %d points, expected %d", tree.Count(), len(points))
+		}
+		err = tree.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.Close()
+	}
+}
+
+type slicePointIterator []Point
+
+func (it *slicePointIterator) Next() (p Point, ok bool, err error) {
+	if len(*it) == 0 {
+		return Point{}, false, nil
+	}
+	p, *it = (*it)[0], (*it)[1:]
+	return p, true, nil
+}
+
+func TestBuildTree(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(2000, 3, 10)
+	iter := slicePointIterator(points)
+	tree, err := BuildTree(context.Background(), fs.Path("tree"), fs.Temp(),
+		3, 10, &iter, BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.Count() != int64(len(points)) {
+		t.Fatalf("got %d points, expected %d", tree.Count(), len(points))
+	}
+	for _, p := range points[:50] {
+		nearest, err := tree.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+	}
+
+	// points within the memory budget are built without temporary files,
+	// so tmpdir is never created
+	tmpdir := fs.Temp()
+	iter = slicePointIterator(points)
+	inMemory, err := BuildTree(context.Background(), fs.Path("in-memory"),
+		tmpdir, 3, 10, &iter, BuildOptions{MaxMemoryBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(tmpdir); !os.IsNotExist(err) {
+		t.Fatalf("tmpdir used: %v", err)
+	}
+	defer inMemory.Close()
+	if inMemory.Count() != int64(len(points)) {
+		t.Fatalf("got %d points, expected %d", inMemory.Count(), len(points))
+	}
+	err = inMemory.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// but past it, or with options only a build on disk supports, they
+	// spill
+	for _, opts := range []BuildOptions{
+		{MaxMemoryBytes: 1 << 10},
+		{MaxMemoryBytes: 1 << 20, Checksums: true},
+	} {
+		tmpdir := fs.Temp()
+		iter = slicePointIterator(points)
+		spilled, err := BuildTree(context.Background(), fs.Path("spilled"),
+			tmpdir, 3, 10, &iter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(tmpdir); err != nil {
+			t.Fatalf("%+v: tmpdir not used: %v", opts, err)
+		}
+		if spilled.Count() != int64(len(points)) {
+			t.Fatalf("got %d points, expected %d", spilled.Count(),
+				len(points))
+		}
+		spilled.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	iter = slicePointIterator(points)
+	_, err = BuildTree(ctx, fs.Path("canceled"), fs.Temp(), 3, 10, &iter,
+		BuildOptions{})
+	if err != context.Canceled {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+}
+
+func TestPresorted(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	// in order along the first dimension, with runs of ties
+	points := make([]Point, 0, 2000)
+	for i := 0; i < cap(points); i++ {
+		p := NewPoint(2, 2)
+		p.Pos[0] = float64(i / 4)
+		p.Data = []byte{byte(i), byte(i >> 8)}
+		points = append(points, p)
+	}
+	shuffled := append([]Point(nil), points...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	var sortedMetrics, shuffledMetrics testMetrics
+	createTestTree(t, fs, 2, 2, shuffled,
+		BuildOptions{Metrics: &shuffledMetrics}).Close()
+	tree := createTestTree(t, fs, 2, 2, points,
+		BuildOptions{Metrics: &sortedMetrics})
+	tree.Close()
+	if sortedMetrics.buildBytes >= shuffledMetrics.buildBytes {
+		t.Fatalf("presorted build wrote %d bytes, shuffled wrote %d",
+			sortedMetrics.buildBytes, shuffledMetrics.buildBytes)
+	}
+
+	tree, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	err = tree.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points {
+		nearest, err := tree.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nearest[0].Distance != 0 {
+			t.Fatalf("point %v not found", p.Pos)
+		}
+	}
+	for _, p := range points[:100] {
+		err = tree.Delete(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := tree.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Count != int64(len(points)-100) {
+		t.Fatalf("got %d points after deletes, expected %d", root.Count,
+			len(points)-100)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	unique := newTestPoints(300, 2, 10)
+	points := append([]Point(nil), unique...)
+	for i := 0; i < 500; i++ {
+		points = append(points, unique[rand.Intn(len(unique))])
+	}
+	// same position, different data
+	variant := Point{Pos: unique[0].Pos, Data: append(unique[0].Data, 1)}
+	points = append(points, variant)
+	unique = append(unique, variant)
+	rand.Shuffle(len(points), func(i, j int) {
+		points[i], points[j] = points[j], points[i]
+	})
+
+	tree := createTestTree(t, fs, 2, 11, points, BuildOptions{Dedup: true})
+	defer tree.Close()
+	if tree.Count() != int64(len(unique)) {
+		t.Fatalf("got %d points, expected %d", tree.Count(), len(unique))
+	}
+	seen := map[string]int{}
+	err := tree.Each(func(p Point) error {
+		seen[fmt.Sprint(p)]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range unique {
+		if seen[fmt.Sprint(p)] != 1 {
+			t.Fatalf("point stored %d times", seen[fmt.Sprint(p)])
+		}
+	}
+	root, err := tree.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Count != tree.Count() {
+		t.Fatalf("root count %d, expected %d", root.Count, tree.Count())
+	}
+
+	kept := createTestTree(t, fs, 2, 11, points, BuildOptions{})
+	defer kept.Close()
+	if kept.Count() != int64(len(points)) {
+		t.Fatalf("got %d points, expected %d", kept.Count(), len(points))
+	}
+}
+
+func TestReplaceByData(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	unique := newTestPoints(300, 2, 10)
+	var points []Point
+	latest := map[string][]byte{}
+	for round := byte(0); round < 3; round++ {
+		for _, p := range unique {
+			if rand.Intn(2) == 0 {
+				continue
+			}
+			p.Data = append(append([]byte(nil), p.Data...), round)
+			points = append(points, p)
+			latest[fmt.Sprint(p.Pos)] = p.Data
+		}
+	}
+
+	tree := createTestTree(t, fs, 2, 11, points,
+		BuildOptions{Duplicates: ReplaceByData})
+	defer tree.Close()
+	if tree.Count() != int64(len(latest)) {
+		t.Fatalf("got %d points, expected %d", tree.Count(), len(latest))
+	}
+	err := tree.Each(func(p Point) error {
+		if !bytes.Equal(p.Data, latest[fmt.Sprint(p.Pos)]) {
+			t.Fatalf("got data %x, expected %x", p.Data,
+				latest[fmt.Sprint(p.Pos)])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNearestK(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(400, 4, 10)
+	tree := createTestTree(t, fs, 4, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	for _, k := range []int{1, 2, 10, 100, 400, 1000} {
+		q := NewPoint(4, 10)
+		expected, err := tree.NearestExhaustive(q, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := tree.Nearest(q, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := k
+		if want > len(points) {
+			want = len(points)
+		}
+		if len(actual) != want || len(expected) != want {
+			t.Fatalf("k=%d: got %d results, expected %d", k, len(actual), want)
+		}
+		for i := range expected {
+			if actual[i].Distance != expected[i].Distance ||
+				!actual[i].Point.equal(&expected[i].Point) {
+				t.Fatalf("k=%d: result %d differs from exhaustive search", k, i)
+			}
+		}
+	}
+}
+
+func TestCreateTreeAtomic(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points[:100], BuildOptions{})
+	tree.Close()
+	before, err := os.ReadDir(filepath.Dir(tree.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := NewPointSet(fs.Temp(), 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points {
+		err = set.Add(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	failed := errors.New("padding failed")
+	_, err = CreateTreeWithOptions(tree.path, fs.Temp(), set, BuildOptions{
+		PaddingFill: func(pad []byte) error { return failed }})
+	if err == nil {
+		t.Fatal("expected build to fail")
+	}
+
+	after, err := os.ReadDir(filepath.Dir(tree.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("build left %d files behind", len(after)-len(before))
+	}
+	tree, err = OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.Count() != 100 {
+		t.Fatalf("got %d points, expected the original 100", tree.Count())
+	}
+}
+
+func TestDeterministicBuild(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(2000, 3, 10)
+	for _, opts := range []BuildOptions{
+		{},
+		{Boxes: true, LeafSize: 8, VariableData: true},
+		{SplitStrategy: SlidingMidpointSplit, SplitDimension: VarianceDimension,
+			Layout: CacheObliviousLayout},
+	} {
+		var files [][]byte
+		for i := 0; i < 2; i++ {
+			tree := createTestTree(t, fs, 3, 10, points, opts)
+			tree.Close()
+			data, err := os.ReadFile(tree.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, data)
+		}
+		if !bytes.Equal(files[0], files[1]) {
+			t.Fatalf("%+v: builds of the same points differ", opts)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	for _, layout := range []Layout{PreorderLayout, CacheObliviousLayout} {
+		var calls [][2]int64
+		tree := createTestTree(t, fs, 3, 10, newTestPoints(3000, 3, 10),
+			BuildOptions{Layout: layout, Progress: func(done, total int64) {
+				calls = append(calls, [2]int64{done, total})
+			}})
+		tree.Close()
+		if len(calls) < 100 || len(calls) > 1001 {
+			t.Fatalf("got %d progress calls", len(calls))
+		}
+		for i, call := range calls {
+			if call[1] != 6000 || call[0] > call[1] ||
+				(i > 0 && call[0] <= calls[i-1][0]) {
+				t.Fatalf("unexpected progress call %v after %v", call, calls[:i])
+			}
+		}
+		if calls[len(calls)-1][0] != 6000 {
+			t.Fatalf("last progress call %v, expected completion",
+				calls[len(calls)-1])
+		}
+	}
+}
+
+func TestMaxScratchBytes(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(2000, 3, 10)
+	newSet := func() *PointSet {
+		set, err := NewPointSet(fs.Temp(), 3, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range points {
+			err = set.Add(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return set
+	}
+	scratch, dest := fs.Path("scratch"), fs.Path("dest")
+	err := os.MkdirAll(dest, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	du := func(dir string) (size int64) {
+		filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+		return size
+	}
+
+	set := newSet()
+	splits, copies := scratchEstimate(set)
+	budget := splits + copies/2
+	var peak int64
+	tree, err := CreateTreeWithOptions(filepath.Join(dest, "tree"), scratch,
+		set, BuildOptions{
+			Layout:          CacheObliviousLayout,
+			MaxScratchBytes: budget,
+			Progress: func(done, total int64) {
+				if size := du(scratch); size > peak {
+					peak = size
+				}
+			}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if peak == 0 || peak > budget {
+		t.Fatalf("used %d bytes of scratch space, budget %d", peak, budget)
+	}
+	if tree.Count() != int64(len(points)) {
+		t.Fatalf("got %d points, expected %d", tree.Count(), len(points))
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("build left %d files next to the tree", len(entries)-1)
+	}
+
+	_, err = CreateTreeWithOptions(filepath.Join(dest, "small"), scratch,
+		newSet(), BuildOptions{MaxScratchBytes: splits / 2})
+	if err == nil {
+		t.Fatal("expected build over budget to fail")
+	}
+}
+
+func TestContext(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	set, err := NewPointSet(fs.Temp(), 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points {
+		err = set.Add(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = CreateTreeContext(ctx, fs.Path("canceled"), fs.Temp(), set,
+		BuildOptions{})
+	if err != context.Canceled {
+		t.Fatalf("expected canceled build, got %v", err)
+	}
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	_, err = rw.NearestContext(ctx, points[0], 1)
+	if err != context.Canceled {
+		t.Fatalf("expected canceled query, got %v", err)
+	}
+	nearest, err := rw.NearestContext(context.Background(), points[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertPointsEqual(nearest[0].Point, points[0])
+
+	err = rw.Delete(points[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.CompactContext(ctx, fs.Temp())
+	if err != context.Canceled {
+		t.Fatalf("expected canceled compaction, got %v", err)
+	}
+	if rw.Count() != int64(len(points)) {
+		t.Fatal("canceled compaction changed the tree")
+	}
+	nearest, err = rw.Nearest(points[1], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertPointsEqual(nearest[0].Point, points[1])
+}
+
+func TestMmap(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	mapped, err := OpenTreeWithOptions(tree.path, OpenOptions{Mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results [][]PointDistance
+	for _, p := range points[:50] {
+		expected, err := tree.Nearest(p, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := mapped.Nearest(p, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != len(expected) {
+			t.Fatal("mapped tree returned a different number of points")
+		}
+		for i := range expected {
+			AssertPointsEqual(actual[i].Point, expected[i].Point)
+		}
+		results = append(results, actual)
+	}
+	err = mapped.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// results must not refer to the mapping
+	for i, p := range points[:50] {
+		AssertPointsEqual(results[i][0].Point, p)
+	}
+}
+
+func TestNearestApprox(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(2000, 8, 10)
+	tree := createTestTree(t, fs, 8, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	_, err := tree.NearestApprox(points[0], 5, -1)
+	if err == nil {
+		t.Fatal("expected an error for negative eps")
+	}
+
+	queries := newTestPoints(50, 8, 1)
+	var exactVisits int64
+	for _, q := range queries {
+		_, stats, err := tree.NearestWithStats(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exactVisits += stats.NodesVisited
+	}
+	for _, eps := range []float64{0, .5, 2} {
+		tree.ResetStats()
+		var results [][]PointDistance
+		for _, q := range queries {
+			approx, err := tree.NearestApprox(q, 5, eps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, approx)
+		}
+		visits := tree.AggregateStats().NodesVisited
+		if (eps == 0) != (visits == exactVisits) || visits > exactVisits {
+			t.Fatalf("eps %v visited %d nodes, exact search visited %d", eps,
+				visits, exactVisits)
+		}
+		for j, q := range queries {
+			exact, err := tree.Nearest(q, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			approx := results[j]
+			if len(approx) != len(exact) {
+				t.Fatal("wrong number of results")
+			}
+			for i := range exact {
+				if approx[i].Distance > exact[i].Distance*(1+eps)*(1+eps) {
+					t.Fatalf("result %d too far for eps %v: %v vs %v", i, eps,
+						approx[i].Distance, exact[i].Distance)
+				}
+			}
+		}
+	}
+}
+
+func TestNearestWhere(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	for i := range points {
+		points[i].Data = []byte{byte(i % 7)}
+	}
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	pred := func(p Point) bool { return p.Data[0] == 3 }
+	for _, q := range newTestPoints(20, 3, 1) {
+		nearest, err := tree.NearestWhere(q, 10, pred)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := tree.NearestExhaustive(q, len(points))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected []PointDistance
+		for _, pd := range all {
+			if pred(pd.Point) && len(expected) < 10 {
+				expected = append(expected, pd)
+			}
+		}
+		if len(nearest) != len(expected) {
+			t.Fatalf("got %d points, expected %d", len(nearest), len(expected))
+		}
+		for i := range expected {
+			AssertPointsEqual(nearest[i].Point, expected[i].Point)
+		}
+	}
+}
+
+func TestNearestDistances(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	for i := range points {
+		points[i].Data = make([]byte, i%10)
+	}
+	for _, opts := range []BuildOptions{{}, {VariableData: true}} {
+		tree := createTestTree(t, fs, 3, 10, points, opts)
+		for _, q := range newTestPoints(20, 3, 1) {
+			distances, err := tree.NearestDistances(q, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nearest, err := tree.Nearest(q, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(distances) != len(nearest) {
+				t.Fatalf("got %d distances, expected %d", len(distances),
+					len(nearest))
+			}
+			for i := range nearest {
+				if distances[i] != nearest[i].Distance {
+					t.Fatalf("distance %d is %v, expected %v", i, distances[i],
+						nearest[i].Distance)
+				}
+			}
+		}
+		tree.Close()
+	}
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(2000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	for round, opts := range []OpenOptions{{},
+		{CacheBytes: 1 << 16, Mmap: true}} {
+		shared, err := OpenTreeWithOptions(tree.path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs := make(chan error, 9)
+		queries := newTestPoints(50, 3, 1)
+		for _, tr := range []*Tree{shared, rw} {
+			tr := tr
+			go func() {
+				for _, q := range queries {
+					_, err := tr.Nearest(q, 5)
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+				errs <- nil
+			}()
+			go func() {
+				for _, q := range queries {
+					_, err := tr.CountWithin(q, .2)
+					if err != nil {
+						errs <- err
+						return
+					}
+					it := tr.NearestIter(q)
+					for i := 0; i < 5; i++ {
+						_, _, err = it.Next()
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}
+				errs <- nil
+			}()
+			go func() {
+				errs <- tr.Range([]float64{0, 0, 0}, []float64{.5, .5, .5},
+					func(Point) error { return nil })
+			}()
+			go func() {
+				_, err := tr.NearestExhaustive(queries[0], 5)
+				errs <- err
+			}()
+		}
+		go func() {
+			for _, p := range points[round*50 : round*50+50] {
+				err := rw.Delete(p)
+				if err == nil {
+					err = rw.Insert(p)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+		for i := 0; i < cap(errs); i++ {
+			err := <-errs
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		shared.Close()
+	}
+}
+
+func TestMergeTrees(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(900, 3, 10)
+	a := createTestTree(t, fs, 3, 10, points[:300], BuildOptions{})
+	defer a.Close()
+	b := createTestTree(t, fs, 3, 20, points[300:600],
+		BuildOptions{Layout: CacheObliviousLayout})
+	defer b.Close()
+	c := createTestTree(t, fs, 3, 5, nil, BuildOptions{})
+	c.Close()
+	rw, err := OpenRW(c.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	for _, p := range points[600:] {
+		p.Data = p.Data[:len(p.Data)/2]
+		err = rw.Insert(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	merged, err := MergeTrees(fs.Path("merged"), fs.Temp(), BuildOptions{},
+		a, b, rw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merged.Close()
+	if merged.Count() != int64(len(points)) {
+		t.Fatalf("got %d points, expected %d", merged.Count(), len(points))
+	}
+	if merged.footer.maxDataLen != 20 {
+		t.Fatalf("got max data length %d, expected 20",
+			merged.footer.maxDataLen)
+	}
+	for _, p := range points[:600] {
+		nearest, err := merged.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+	}
+
+	other := createTestTree(t, fs, 2, 10, newTestPoints(10, 2, 10),
+		BuildOptions{})
+	defer other.Close()
+	_, err = MergeTrees(fs.Path("bad"), fs.Temp(), BuildOptions{}, a, other)
+	if err == nil {
+		t.Fatal("expected a dimension mismatch error")
+	}
+}
+
+func TestExport(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(300, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	set, err := tree.Export(fs.Path("export"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := CreateTreeWithOptions(fs.Path("rebuilt"), fs.Temp(), set,
+		BuildOptions{Layout: CacheObliviousLayout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rebuilt.Close()
+	if rebuilt.Count() != int64(len(points)) {
+		t.Fatalf("got %d points, expected %d", rebuilt.Count(), len(points))
+	}
+	for _, p := range points {
+		nearest, err := rebuilt.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+	}
+}
+
+func TestConcurrentAdd(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	const producers, each = 8, 200
+	set, err := NewPointSet(fs.Temp(), 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := newTestPoints(producers*each, 3, 10)
+	errs := make(chan error, producers)
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func(points []Point) {
+			defer wg.Done()
+			for _, p := range points {
+				err := set.Add(p)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(points[i*each : (i+1)*each])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	tree, err := CreateTree(fs.Path(tempName("")), fs.Temp(), set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.Count() != int64(len(points)) {
+		t.Fatalf("got %d points, expected %d", tree.Count(), len(points))
+	}
+	for _, p := range points {
+		nearest, err := tree.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nearest[0].Point.equal(&p) {
+			t.Fatal("added point missing from tree")
+		}
+	}
+}
+
+func TestNearestWithin(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	for _, radius := range []float64{0, 0.05, 0.1, 0.3, 2} {
+		for i := 0; i < 10; i++ {
+			q := NewPoint(3, 10)
+			expected, err := tree.NearestExhaustive(q, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for len(expected) > 0 &&
+				expected[len(expected)-1].Distance > radius*radius {
+				expected = expected[:len(expected)-1]
+			}
+
+			nearest, err := tree.NearestWithin(q, 10, radius)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nearest) != len(expected) {
+				t.Fatalf("radius %v: got %d points, expected %d", radius,
+					len(nearest), len(expected))
+			}
+			for j := range expected {
+				if nearest[j].Distance != expected[j].Distance {
+					t.Fatalf("radius %v: result %d differs from brute force",
+						radius, j)
+				}
+			}
+		}
+	}
+
+	_, err := tree.NearestWithin(points[0], 1, -1)
+	if err == nil {
+		t.Fatal("expected a negative radius to be rejected")
+	}
+}
+
+// sparseTree is a tree file of count all-zero nodes, which read as holes,
+// followed by its footer, without storing the nodes.
+type sparseTree struct {
+	nodes  int64
+	footer []byte
+}
+
+func (s *sparseTree) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		pos := off + int64(n)
+		switch {
+		case pos < s.nodes:
+			p[n] = 0
+		case pos < s.nodes+int64(len(s.footer)):
+			p[n] = s.footer[pos-s.nodes]
+		default:
+			return n, io.EOF
+		}
+		n++
+	}
+	return n, nil
+}
+
+func TestLargeCounts(t *testing.T) {
+	// counts, offsets and the data region are all 64-bit
+	const count = 5 << 30
+	f := footer{dims: 2, maxDataLen: dataRefSize, count: count,
+		root: (count - 1) * 100, min: []float64{0, 0}, max: []float64{1, 1},
+		variableData: true, dataLen: 6 << 30}
+	var buf bytes.Buffer
+	err := f.serialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := readFooter(bytes.NewReader(buf.Bytes()),
+		int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.count != f.count || parsed.root != f.root ||
+		parsed.dataLen != f.dataLen {
+		t.Fatalf("footer didn't round trip: %d %d %d", parsed.count,
+			parsed.root, parsed.dataLen)
+	}
+
+	n := Node{Point: Point{Pos: []float64{1, 2}, Data: []byte("x")},
+		Left: 1 << 40, Right: 3 << 40, Count: count}
+	buf.Reset()
+	err = n.serialize(&buf, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := parseNode(buf.Bytes(), 2, coords{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n2.Left != n.Left || n2.Right != n.Right || n2.Count != n.Count {
+		t.Fatal("node didn't round trip")
+	}
+
+	// a tree of more than 4 billion holes opens, and its points are
+	// addressed past 4 billion
+	f = footer{dims: 2, maxDataLen: 1, count: count, root: 0,
+		min: []float64{0, 0}, max: []float64{1, 1}}
+	buf.Reset()
+	err = f.serialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sparse := &sparseTree{nodes: count * f.nodeSize(), footer: buf.Bytes()}
+	tree, err := openReaderAt(sparse, sparse.nodes+int64(buf.Len()),
+		OpenOptions{SkipHoles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Count() != count {
+		t.Fatalf("expected %d points, got %d", int64(count), tree.Count())
+	}
+	_, err = tree.Get(count - 1)
+	if err == nil || !strings.Contains(err.Error(), "deleted") {
+		t.Fatalf("expected the last point to be a deleted hole, got %v", err)
+	}
+	if tree.pointID((count-1)*tree.nodelen) != count-1 {
+		t.Fatal("point ID overflowed")
+	}
+}
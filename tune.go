@@ -0,0 +1,257 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+// TuneOptions configures Tree.Tune. The zero value tries every layout,
+// a few leaf sizes and a few cache sizes.
+type TuneOptions struct {
+	// TmpDir is where the candidate trees are built, one at a time. It
+	// needs room for a copy of the tree along with the build's scratch
+	// files, and should be on the same kind of storage the tree will be
+	// served from, or the measurements won't mean much.
+	TmpDir string
+	// Queries is how many points are sampled from the tree to query each
+	// candidate with. Defaults to 200.
+	Queries int
+	// K is how many nearest points each query asks for. Defaults to 10.
+	K int
+	// Layouts are the layouts to try. Defaults to all of them.
+	Layouts []Layout
+	// LeafSizes are the BuildOptions.LeafSize values to try with the
+	// preorder layout, which is the only one they apply to. Defaults to 0,
+	// 16 and 64.
+	LeafSizes []int
+	// CacheBytes are the OpenOptions.CacheBytes values to try with each
+	// candidate tree. Defaults to no cache and caches of a sixteenth and a
+	// quarter of the tree's nodes.
+	CacheBytes []int64
+	// Seed seeds the choice of query points, so runs can be compared.
+	Seed int64
+}
+
+// TuneResult is how one candidate configuration performed.
+type TuneResult struct {
+	// Build is the tree's own BuildOptions with Layout and LeafSize
+	// replaced by the candidate's.
+	Build BuildOptions
+	// CacheBytes is the node cache the candidate was opened with.
+	CacheBytes int64
+	// BuildTime is how long building the candidate took, and Size is the
+	// size of its file.
+	BuildTime time.Duration
+	Size      int64
+	// Latency is the mean latency of the queries, measured after one pass
+	// over them to warm the cache.
+	Latency time.Duration
+	// NodesVisited and BytesRead are the mean work per query.
+	NodesVisited, BytesRead float64
+}
+
+// Tune measures how queries for the nearest points to points sampled from
+// the tree perform when the tree's points are rebuilt with each candidate
+// layout and leaf size and opened with each candidate cache size, on this
+// machine, and returns the results fastest first. The first result's Build
+// and CacheBytes are the ones to use. Every build is a full build of the
+// tree's points, so tuning takes a while for a large tree; a tree of a
+// representative sample of the points tunes much the same.
+func (t *Tree) Tune(ctx context.Context, opts TuneOptions) (
+	[]TuneResult, error) {
+	if opts.Queries <= 0 {
+		opts.Queries = 200
+	}
+	if opts.K <= 0 {
+		opts.K = 10
+	}
+	if len(opts.Layouts) == 0 {
+		opts.Layouts = []Layout{PreorderLayout, CacheObliviousLayout,
+			BlockedLayout}
+	}
+	if len(opts.LeafSizes) == 0 {
+		opts.LeafSizes = []int{0, 16, 64}
+	}
+	if len(opts.CacheBytes) == 0 {
+		nodes := t.count * t.nodelen
+		opts.CacheBytes = []int64{0, nodes / 16, nodes / 4}
+	}
+	queries, err := t.Sample(opts.Queries, rand.New(rand.NewSource(opts.Seed)))
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []TuneResult
+	base := t.footer.buildOptions()
+	for _, layout := range opts.Layouts {
+		for _, leafSize := range opts.LeafSizes {
+			if leafSize > 0 && layout != PreorderLayout {
+				continue
+			}
+			build := base
+			build.Layout = layout
+			build.LeafSize = leafSize
+			results, err := t.tuneBuild(ctx, opts, build, queries)
+			if err != nil {
+				return nil, err
+			}
+			rv = append(rv, results...)
+		}
+	}
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].Latency < rv[j].Latency
+	})
+	return rv, nil
+}
+
+// TuneLeafSize picks a BuildOptions.LeafSize for trees of points like
+// sample before any is built. It builds a tree of the sample in opts.TmpDir
+// with each of opts.LeafSizes, which default to 0, 8, 16, 32, 64 and 128,
+// times queries for the nearest points to points drawn from the sample the
+// way Tune does, and returns the leaf size whose queries were fastest. Only
+// the preorder layout is tried, as leaf sizes only apply to it, and
+// opts.Layouts is ignored. opts.CacheBytes defaults to no cache.
+//
+// It is a heuristic: the answer is only as good as the sample is
+// representative of the points the real tree will hold and the queries it
+// will get, and as TmpDir is of the storage it will be served from. A
+// sample too small to fill more than a few leaves tells little.
+func TuneLeafSize(sample []Point, opts TuneOptions) (int, error) {
+	if len(sample) == 0 {
+		return 0, errClass.New("no sample points to tune with")
+	}
+	dims, maxDataLen := len(sample[0].Pos), 0
+	for _, p := range sample {
+		maxDataLen = max(maxDataLen, len(p.Data))
+	}
+	if len(opts.LeafSizes) == 0 {
+		opts.LeafSizes = []int{0, 8, 16, 32, 64, 128}
+	}
+	if len(opts.CacheBytes) == 0 {
+		opts.CacheBytes = []int64{0}
+	}
+	opts.Layouts = []Layout{PreorderLayout}
+
+	fs, err := newBaseFS(tempName(opts.TmpDir))
+	if err != nil {
+		return 0, err
+	}
+	defer fs.Delete()
+	set, err := newPointSet(fs.Temp(), dims, maxDataLen, true)
+	if err != nil {
+		return 0, err
+	}
+	defer set.Close()
+	for _, p := range sample {
+		err = set.Add(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+	tree, err := CreateTreeWithOptions(fs.Path(tempName("")), fs.Temp(), set,
+		BuildOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer tree.Close()
+	opts.TmpDir = fs.base
+	results, err := tree.Tune(context.Background(), opts)
+	if err != nil {
+		return 0, err
+	}
+	return results[0].Build.LeafSize, nil
+}
+
+// tuneBuild builds t's points with build and measures queries against the
+// result with each of the cache sizes opts lists.
+func (t *Tree) tuneBuild(ctx context.Context, opts TuneOptions,
+	build BuildOptions, queries []Point) ([]TuneResult, error) {
+	path := tempName(opts.TmpDir)
+	defer os.Remove(path)
+	set, err := newPointSet(tempName(opts.TmpDir), t.footer.dims,
+		t.footer.maxDataLen, true)
+	if err != nil {
+		return nil, err
+	}
+	err = t.Each(set.Add)
+	if err != nil {
+		set.Close()
+		return nil, err
+	}
+	start := time.Now()
+	built, err := CreateTreeContext(ctx, path, opts.TmpDir, set, build)
+	set.Close()
+	if err != nil {
+		return nil, err
+	}
+	buildTime := time.Since(start)
+	err = built.Close()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+
+	var rv []TuneResult
+	for _, cacheBytes := range opts.CacheBytes {
+		candidate, err := OpenTreeWithOptions(path,
+			OpenOptions{CacheBytes: cacheBytes})
+		if err != nil {
+			return nil, err
+		}
+		result := TuneResult{Build: build, CacheBytes: cacheBytes,
+			BuildTime: buildTime, Size: fi.Size()}
+		err = candidate.tuneQueries(ctx, opts.K, queries, &result)
+		candidate.Close()
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, result)
+	}
+	return rv, nil
+}
+
+// tuneQueries runs the queries against t twice, filling in result from the
+// second pass.
+func (t *Tree) tuneQueries(ctx context.Context, k int, queries []Point,
+	result *TuneResult) error {
+	for pass := 0; pass < 2; pass++ {
+		var nodes, bytes int64
+		start := time.Now()
+		for _, q := range queries {
+			_, stats, err := t.nearest(k, &nearestQuery{p: q, ctx: ctx})
+			if err != nil {
+				return err
+			}
+			nodes += stats.NodesVisited
+			bytes += stats.BytesRead
+		}
+		if len(queries) == 0 {
+			return nil
+		}
+		n := float64(len(queries))
+		result.Latency = time.Since(start) / time.Duration(len(queries))
+		result.NodesVisited = float64(nodes) / n
+		result.BytesRead = float64(bytes) / n
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTune(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points,
+		BuildOptions{Checksums: true})
+	defer tree.Close()
+
+	tmp := filepath.Join(fs.base, "tune")
+	err := os.Mkdir(tmp, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := tree.Tune(context.Background(), TuneOptions{
+		TmpDir: tmp, Queries: 20, LeafSizes: []int{0, 8},
+		CacheBytes: []int64{0, 1 << 16}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two leaf sizes with the preorder layout, and one with each other
+	if len(results) != 8 {
+		t.Fatalf("expected 8 results, got %d", len(results))
+	}
+	layouts := map[Layout]bool{}
+	for i, r := range results {
+		if i > 0 && r.Latency < results[i-1].Latency {
+			t.Fatal("results aren't fastest first")
+		}
+		if r.Latency <= 0 || r.NodesVisited <= 0 || r.Size <= 0 {
+			t.Fatalf("result %d wasn't measured: %+v", i, r)
+		}
+		if !r.Build.Checksums {
+			t.Fatal("candidates dropped the tree's options")
+		}
+		if r.Build.LeafSize > 0 && r.Build.Layout != PreorderLayout {
+			t.Fatal("leaf size tried with the wrong layout")
+		}
+		layouts[r.Build.Layout] = true
+	}
+	if len(layouts) != 3 {
+		t.Fatalf("expected all 3 layouts tried, got %d", len(layouts))
+	}
+	left, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Fatalf("tuning left %d files behind", len(left))
+	}
+}
+
+func TestTuneLeafSize(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	tmp := filepath.Join(fs.base, "tune")
+	err := os.Mkdir(tmp, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafSize, err := TuneLeafSize(newTestPoints(500, 3, 10),
+		TuneOptions{TmpDir: tmp, Queries: 20, LeafSizes: []int{0, 8, 32}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leafSize != 0 && leafSize != 8 && leafSize != 32 {
+		t.Fatalf("got leaf size %d, which wasn't a candidate", leafSize)
+	}
+	left, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Fatalf("tuning left %d files behind", len(left))
+	}
+
+	_, err = TuneLeafSize(nil, TuneOptions{TmpDir: tmp})
+	if err == nil {
+		t.Fatal("expected an error tuning without a sample")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding"
+)
+
+// Codec converts between values of type D and the bytes stored as a Point's
+// Data.
+type Codec[D any] interface {
+	Marshal(D) ([]byte, error)
+	Unmarshal([]byte) (D, error)
+}
+
+// BinaryCodec returns a Codec for a type D that encodes itself with
+// MarshalBinary and decodes with an UnmarshalBinary method on *D, e.g.
+// BinaryCodec[T, *T]().
+func BinaryCodec[D encoding.BinaryMarshaler, PD interface {
+	*D
+	encoding.BinaryUnmarshaler
+}]() Codec[D] {
+	return binaryMarshalerCodec[D, PD]{}
+}
+
+type binaryMarshalerCodec[D encoding.BinaryMarshaler, PD interface {
+	*D
+	encoding.BinaryUnmarshaler
+}] struct{}
+
+func (binaryMarshalerCodec[D, PD]) Marshal(d D) ([]byte, error) {
+	return d.MarshalBinary()
+}
+
+func (binaryMarshalerCodec[D, PD]) Unmarshal(data []byte) (d D, err error) {
+	return d, PD(&d).UnmarshalBinary(data)
+}
+
+// TypedPoint is a Point whose Data is a D instead of raw bytes.
+type TypedPoint[D any] struct {
+	Pos  []float64
+	Data D
+}
+
+type TypedPointDistance[D any] struct {
+	TypedPoint[D]
+	Distance float64
+}
+
+// TypedBuilder collects TypedPoints into a PointSet, encoding their Data with
+// a Codec. Encoded Data must fit in the builder's maxDataLen.
+type TypedBuilder[D any] struct {
+	codec  Codec[D]
+	points *PointSet
+}
+
+func NewTypedBuilder[D any](path string, dims, maxDataLen int,
+	codec Codec[D]) (*TypedBuilder[D], error) {
+	points, err := NewPointSet(path, dims, maxDataLen)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedBuilder[D]{codec: codec, points: points}, nil
+}
+
+func (b *TypedBuilder[D]) Add(p TypedPoint[D]) error {
+	data, err := b.codec.Marshal(p.Data)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	return b.points.Add(Point{Pos: p.Pos, Data: data})
+}
+
+func (b *TypedBuilder[D]) Close() error {
+	return b.points.Close()
+}
+
+// CreateTree builds a tree out of the added points. Like CreateTree, it
+// consumes the builder.
+func (b *TypedBuilder[D]) CreateTree(path, tmpdir string,
+	opts BuildOptions) (*TypedTree[D], error) {
+	tree, err := CreateTreeWithOptions(path, tmpdir, b.points, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedTree[D]{tree: tree, codec: b.codec}, nil
+}
+
+// TypedTree wraps a Tree, decoding the Data of query results with a Codec.
+// The on-disk format is the same as any other tree.
+type TypedTree[D any] struct {
+	tree  *Tree
+	codec Codec[D]
+}
+
+func OpenTypedTree[D any](path string, codec Codec[D]) (*TypedTree[D],
+	error) {
+	tree, err := OpenTree(path)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedTree[D]{tree: tree, codec: codec}, nil
+}
+
+// Tree returns the underlying untyped tree.
+func (t *TypedTree[D]) Tree() *Tree  { return t.tree }
+func (t *TypedTree[D]) Count() int64 { return t.tree.Count() }
+func (t *TypedTree[D]) Close() error { return t.tree.Close() }
+
+func (t *TypedTree[D]) decode(p Point) (rv TypedPoint[D], err error) {
+	rv.Pos = p.Pos
+	rv.Data, err = t.codec.Unmarshal(p.Data)
+	return rv, errClass.Wrap(err)
+}
+
+func (t *TypedTree[D]) Nearest(pos []float64, n int) (
+	[]TypedPointDistance[D], error) {
+	nearest, err := t.tree.Nearest(Point{Pos: pos}, n)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]TypedPointDistance[D], 0, len(nearest))
+	for _, pd := range nearest {
+		p, err := t.decode(pd.Point)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, TypedPointDistance[D]{TypedPoint: p, Distance: pd.Distance})
+	}
+	return rv, nil
+}
+
+// WithinFunc calls fn with every point within radius of pos, decoded.
+func (t *TypedTree[D]) WithinFunc(pos []float64, radius float64,
+	fn func(TypedPoint[D]) error) error {
+	return t.tree.WithinFunc(Point{Pos: pos}, radius, func(p Point) error {
+		tp, err := t.decode(p)
+		if err != nil {
+			return err
+		}
+		return fn(tp)
+	})
+}
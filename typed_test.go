@@ -0,0 +1,134 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+type testRecord struct {
+	Name  string
+	Score uint32
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(r testRecord) ([]byte, error) { return json.Marshal(r) }
+func (jsonCodec) Unmarshal(data []byte) (r testRecord, err error) {
+	return r, json.Unmarshal(data, &r)
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Marshal(r testRecord) ([]byte, error) {
+	data := make([]byte, uint32Size, uint32Size+len(r.Name))
+	binary.LittleEndian.PutUint32(data, r.Score)
+	return append(data, r.Name...), nil
+}
+
+func (binaryCodec) Unmarshal(data []byte) (r testRecord, err error) {
+	if len(data) < uint32Size {
+		return r, fmt.Errorf("short record")
+	}
+	r.Score = binary.LittleEndian.Uint32(data)
+	r.Name = string(data[uint32Size:])
+	return r, nil
+}
+
+func (r testRecord) MarshalBinary() ([]byte, error) {
+	return binaryCodec{}.Marshal(r)
+}
+
+func (r *testRecord) UnmarshalBinary(data []byte) (err error) {
+	*r, err = binaryCodec{}.Unmarshal(data)
+	return err
+}
+
+func testTypedTree(t *testing.T, codec Codec[testRecord]) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	builder, err := NewTypedBuilder[testRecord](fs.Temp(), 2, 64, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Close()
+
+	records := map[string]testRecord{}
+	for i := 0; i < 100; i++ {
+		p := TypedPoint[testRecord]{
+			Pos:  []float64{rand.Float64(), rand.Float64()},
+			Data: testRecord{Name: fmt.Sprint("point-", i), Score: uint32(i)}}
+		records[fmt.Sprint(p.Pos)] = p.Data
+		err = builder.Add(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree, err := builder.CreateTree(fs.Path("tree"), fs.Temp(), BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Close()
+
+	tree, err = OpenTypedTree[testRecord](fs.Path("tree"), codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	nearest, err := tree.Nearest([]float64{0.5, 0.5}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 10 {
+		t.Fatalf("got %d results, expected 10", len(nearest))
+	}
+	for _, pd := range nearest {
+		if records[fmt.Sprint(pd.Pos)] != pd.Data {
+			t.Fatalf("decoded %v, expected %v", pd.Data,
+				records[fmt.Sprint(pd.Pos)])
+		}
+	}
+
+	found := 0
+	err = tree.WithinFunc([]float64{0.5, 0.5}, 2,
+		func(p TypedPoint[testRecord]) error {
+			found++
+			if records[fmt.Sprint(p.Pos)] != p.Data {
+				t.Fatalf("decoded %v, expected %v", p.Data,
+					records[fmt.Sprint(p.Pos)])
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != len(records) {
+		t.Fatalf("found %d points within range, expected %d", found,
+			len(records))
+	}
+}
+
+func TestTypedTreeJSON(t *testing.T)   { testTypedTree(t, jsonCodec{}) }
+func TestTypedTreeBinary(t *testing.T) { testTypedTree(t, binaryCodec{}) }
+func TestTypedTreeBinaryMarshaler(t *testing.T) {
+	testTypedTree(t, BinaryCodec[testRecord, *testRecord]())
+}
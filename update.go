@@ -0,0 +1,152 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// UpdateData replaces the Data of the stored point with the given ID, as
+// reported in the ID of query results, rewriting just its Data in place.
+// The tree's structure and the point's position and ID are unchanged. In a
+// tree with fixed-size Data, data may be up to the max data length. In a
+// tree with variable-length data, the new Data, once compressed if the tree
+// compresses Data, must fit in the space the old Data took up, or
+// ErrDataTooLarge is returned; build with room to spare, or rebuild the tree
+// to make more. Checksums are updated along with the Data. In a tree with a
+// TagField, the point's tags can't be changed.
+//
+// Unlike Delete, UpdateData isn't safe to call concurrently with queries
+// that might read the point, which could see the Data half written. Pending
+// inserted points and deleted points can't be updated. Like Delete, the
+// writes are logged in the pending log first, so that a crash can't leave
+// the Data half written. Use Sync to make updates durable, or
+// OpenOptions.SyncWrites.
+func (t *Tree) UpdateData(id uint64, data []byte) error {
+	if !t.writable {
+		return errClass.New("tree not opened for writing")
+	}
+	index, err := t.idIndex(id)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if index >= uint64(t.count) {
+		if index-uint64(t.count) < uint64(t.pending.len()) {
+			return errClass.New("point %d is pending and can't be updated",
+				id)
+		}
+		return ErrNotFound.New("no point with id %d", id)
+	}
+	if len(data) > t.footer.maxDataLen {
+		return ErrDataTooLarge.New(
+			"data length (%d) greater than max data length (%d)",
+			len(data), t.footer.maxDataLen)
+	}
+	offset := int64(index) * t.nodelen
+	n, err := t.Node(offset)
+	if err != nil {
+		return err
+	}
+	if n.Deleted {
+		return ErrNotFound.New("point %d is deleted", id)
+	}
+	if tf := t.footer.tagField; tf != nil &&
+		tf.decode(n.Point.Data) != tf.decode(data) {
+		return ErrUnsupported.New("can't change the tags of point %d", id)
+	}
+
+	raw := make([]byte, t.nodelen)
+	_, err = t.r.ReadAt(raw, offset)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	h, _, err := parsePointHeader(raw, t.footer.coords())
+	if err != nil {
+		return err
+	}
+	start := pointHeaderSize + h.posBytes
+	var end int
+	var b writeBatch
+	if t.footer.variableData {
+		end = start + dataRefSize
+		err = t.updateStoredData(&b, offset, raw[start:end], data)
+		if err != nil {
+			return err
+		}
+	} else {
+		end = start + t.footer.maxDataLen
+		binary.LittleEndian.PutUint32(raw[1+uint32Size:], uint32(len(data)))
+		binary.LittleEndian.PutUint32(raw[1+2*uint32Size:],
+			uint32(t.footer.maxDataLen-len(data)))
+		copy(raw[start:end], data)
+		clear(raw[start+len(data) : end])
+	}
+	// the subtree count and tombstone after the point are left alone, as
+	// Delete rewrites them in place
+	b.write(offset, raw[:end])
+	if t.footer.checksums {
+		sum := make([]byte, checksumSize)
+		binary.LittleEndian.PutUint32(sum, nodeChecksum(raw))
+		b.write(t.checksumsOffset()+
+			offset/t.nodelen*t.footer.checksumEntrySize(), sum)
+	}
+	return t.commit(b)
+}
+
+// updateStoredData adds to b the writes of data over the stored Data of the
+// node at offset in a tree with variable-length data, and of the Data's
+// checksum, and updates ref, the node's reference to it.
+func (t *Tree) updateStoredData(b *writeBatch, offset int64, ref,
+	data []byte) error {
+	if t.footer.compression == FlateCompression {
+		var compressed bytes.Buffer
+		fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+		_, err = fw.Write(data)
+		if err == nil {
+			err = fw.Close()
+		}
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+		data = compressed.Bytes()
+	}
+	at := int64(binary.LittleEndian.Uint64(ref))
+	length := int64(binary.LittleEndian.Uint32(ref[uint64Size:]))
+	if at < 0 || at+length > t.footer.dataLen {
+		return ErrCorrupt.New("invalid data reference")
+	}
+	if int64(len(data)) > length {
+		return ErrDataTooLarge.New("stored data length (%d) greater than "+
+			"the space of the old data (%d)", len(data), length)
+	}
+	b.write(t.count*t.nodelen+at, data)
+	binary.LittleEndian.PutUint32(ref[uint64Size:], uint32(len(data)))
+	if !t.footer.checksums {
+		return nil
+	}
+	sum := make([]byte, checksumSize)
+	binary.LittleEndian.PutUint32(sum, crc32.Checksum(data, crcTable))
+	b.write(t.checksumsOffset()+
+		offset/t.nodelen*t.footer.checksumEntrySize()+checksumSize, sum)
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestUpdateData(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(100, 2, 10)
+	for i := range points {
+		points[i].Data = []byte(fmt.Sprintf("old-%03d", i))
+	}
+	for _, opts := range []BuildOptions{
+		{},
+		{Checksums: true},
+		{VariableData: true, Checksums: true},
+		{VariableData: true, DataCompression: FlateCompression, Checksums: true},
+	} {
+		tree := createTestTree(t, fs, 2, 10, points, opts)
+		tree.Close()
+		rw, err := OpenRW(tree.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]uint64, len(points))
+		for i, p := range points {
+			nearest, err := rw.Nearest(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[i] = nearest[0].ID
+			err = rw.UpdateData(ids[i], []byte(fmt.Sprintf("new-%03d", i)))
+			if err != nil {
+				t.Fatalf("%+v: %v", opts, err)
+			}
+		}
+		err = rw.UpdateData(ids[0], make([]byte, 11))
+		if !ErrDataTooLarge.Contains(err) {
+			t.Fatalf("%+v: expected data too large, got %v", opts, err)
+		}
+		if opts.VariableData {
+			err = rw.UpdateData(ids[0], []byte("0123456789"))
+			if !ErrDataTooLarge.Contains(err) {
+				t.Fatalf("%+v: expected growth to fail, got %v", opts, err)
+			}
+		}
+		err = rw.UpdateData(uint64(len(points)), nil)
+		if err == nil {
+			t.Fatalf("%+v: updated an unknown id", opts)
+		}
+		err = rw.Delete(Point{Pos: points[1].Pos, Data: []byte("new-001")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rw.UpdateData(ids[1], nil)
+		if err == nil {
+			t.Fatalf("%+v: updated a deleted point", opts)
+		}
+		err = rw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tree, err = OpenTree(tree.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tree.Verify()
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		for i, p := range points[2:] {
+			nearest, err := tree.Nearest(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []byte(fmt.Sprintf("new-%03d", i+2))
+			if nearest[0].ID != ids[i+2] ||
+				!bytes.Equal(nearest[0].Data, expected) {
+				t.Fatalf("%+v: got id %d data %q, expected id %d data %q", opts,
+					nearest[0].ID, nearest[0].Data, ids[i+2], expected)
+			}
+		}
+		tree.Close()
+	}
+}
+
+func TestUpdateDataTags(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(50, 2, 4)
+	for i := range points {
+		points[i].Data = []byte{byte(i % 4), 0}
+	}
+	tree := createTestTree(t, fs, 2, 4, points,
+		BuildOptions{TagField: &TagField{Offset: 0, Width: 1}})
+	tree.Close()
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	nearest, err := rw.Nearest(points[1], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.UpdateData(nearest[0].ID, []byte{1, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.UpdateData(nearest[0].ID, []byte{2, 7})
+	if !ErrUnsupported.Contains(err) {
+		t.Fatalf("expected changing tags to be unsupported, got %v", err)
+	}
+}
@@ -43,3 +43,40 @@ func (w *wrappedReader) Read(p []byte) (n int, err error) {
 	w.pos += int64(n)
 	return n, err
 }
+
+// progress reports build progress to a BuildOptions.Progress callback, at
+// most about once per thousandth of total. A nil *progress reports nothing.
+type progress struct {
+	fn          func(done, total int64)
+	done, total int64
+	next        int64
+}
+
+func newProgress(fn func(done, total int64), total int64) *progress {
+	if fn == nil {
+		return nil
+	}
+	return &progress{fn: fn, total: total}
+}
+
+func (p *progress) add(n int64) {
+	if p == nil {
+		return
+	}
+	p.done += n
+	if p.done >= p.next && p.done < p.total {
+		p.fn(p.done, p.total)
+		step := p.total / 1000
+		if step < 1 {
+			step = 1
+		}
+		p.next = p.done + step
+	}
+}
+
+// finish reports that all the work is done.
+func (p *progress) finish() {
+	if p != nil {
+		p.fn(p.total, p.total)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// dataRefSize is the size of the Data stored in each node of a tree with
+// variable-length data: the offset of the real Data in the data region and
+// its length.
+const dataRefSize = uint64Size + uint32Size
+
+// repack copies the tree at src, described by f, to dst in the node format
+// that out describes, updating f to describe dst. If out has variable-length
+// data, the Data of every node is moved, unpadded and compressed as out
+// says, to a data region after the nodes. Nodes keep a fixed size, so they
+// are still addressed by offset. If out has float32 coordinates, they are
+// rounded, and if it has a coordinate codec, they are encoded. fill fills
+// any padding.
+func repack(src, dst string, f *footer, out footer, fill PaddingFill,
+	fsync *syncer) error {
+	fh, err := os.Open(src)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer fh.Close()
+	t := &Tree{r: fh, root: f.root, count: f.count, nodelen: f.nodeSize(),
+		footer: *f}
+
+	if out.float32 {
+		// rounding is monotonic, so the rounded bounds bound the rounded
+		// points and every split still holds
+		out.min = roundFloat32s(f.min)
+		out.max = roundFloat32s(f.max)
+	}
+	out.dataLen = 0
+	nodelen := out.nodeSize()
+	relocate := func(offset int64) int64 {
+		if offset == -1 {
+			return -1
+		}
+		return offset / t.nodelen * nodelen
+	}
+	out.root = relocate(f.root)
+
+	dh, err := os.Create(dst)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer dh.Close()
+	w := bufio.NewWriter(fsync.writer(dh))
+
+	var ref [dataRefSize]byte
+	var compressed bytes.Buffer
+	var fw *flate.Writer
+	if out.compression == FlateCompression {
+		fw, err = flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	compress := func(data []byte) ([]byte, error) {
+		if fw == nil {
+			return data, nil
+		}
+		compressed.Reset()
+		fw.Reset(&compressed)
+		_, err := fw.Write(data)
+		if err == nil {
+			err = fw.Close()
+		}
+		return compressed.Bytes(), errClass.Wrap(err)
+	}
+
+	err = t.scan(func(offset int64, n Node) error {
+		n.Left = relocate(n.Left)
+		n.Right = relocate(n.Right)
+		if !out.variableData {
+			return n.serializeCoords(w, out.coords(), out.maxDataLen,
+				fill)
+		}
+		data, err := compress(n.Point.Data)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(ref[:], uint64(out.dataLen))
+		binary.LittleEndian.PutUint32(ref[uint64Size:], uint32(len(data)))
+		out.dataLen += int64(len(data))
+		n.Point.Data = ref[:]
+		return n.serializeCoords(w, out.coords(), dataRefSize, nil)
+	})
+	if err != nil {
+		return err
+	}
+	if !out.variableData {
+		return finishRepack(w, dh, f, out)
+	}
+	err = t.scan(func(offset int64, n Node) error {
+		data, err := compress(n.Point.Data)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return errClass.Wrap(err)
+	})
+	if err != nil {
+		return err
+	}
+	return finishRepack(w, dh, f, out)
+}
+
+func finishRepack(w *bufio.Writer, dh *os.File, f *footer, out footer) error {
+	err := w.Flush()
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	*f = out
+	return errClass.Wrap(dh.Close())
+}
+
+// roundFloat32s returns a copy of vals rounded to float32 precision.
+func roundFloat32s(vals []float64) []float64 {
+	rv := make([]float64, len(vals))
+	for i, v := range vals {
+		rv[i] = float64(float32(v))
+	}
+	return rv
+}
+
+// readData reads the Data that ref, the Data of the node at node in a tree
+// with variable-length data, refers to.
+func (t *Tree) readData(node int64, ref []byte) ([]byte, error) {
+	data, err := t.readStoredData(ref)
+	if err != nil {
+		return nil, err
+	}
+	if t.footer.checksums {
+		err = t.verifyData(node, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.footer.compression == NoCompression {
+		return data, nil
+	}
+	// read one byte past the max data length to catch overlong Data
+	fr := flate.NewReader(bytes.NewReader(data))
+	defer fr.Close()
+	data, err = io.ReadAll(io.LimitReader(fr, int64(t.footer.maxDataLen)+1))
+	if err != nil {
+		return nil, ErrCorrupt.New("invalid compressed data: %v", err)
+	}
+	if len(data) > t.footer.maxDataLen {
+		return nil, ErrCorrupt.New("compressed data too long")
+	}
+	return data, nil
+}
+
+// readStoredData reads the Data that ref refers to as it is stored, before
+// any decompression.
+func (t *Tree) readStoredData(ref []byte) ([]byte, error) {
+	if len(ref) != dataRefSize {
+		return nil, ErrCorrupt.New("invalid data reference")
+	}
+	offset := int64(binary.LittleEndian.Uint64(ref))
+	length := int64(binary.LittleEndian.Uint32(ref[uint64Size:]))
+	compressed := t.footer.compression != NoCompression
+	if offset < 0 || offset+length > t.footer.dataLen ||
+		(!compressed && length > int64(t.footer.maxDataLen)) {
+		return nil, ErrCorrupt.New("invalid data reference")
+	}
+	data := make([]byte, length)
+	_, err := t.r.ReadAt(data, t.count*t.nodelen+offset)
+	return data, errClass.Wrap(err)
+}
+
+// nodeShape returns the node at offset. If lazy is set and the tree has
+// variable-length data and no node cache, the node's Data is left as the
+// reference to it in the data region, saving a read for searches that only
+// need positions, and ref reports so. See resolveData.
+func (t *Tree) nodeShape(offset int64, lazy bool) (n Node, ref bool,
+	err error) {
+	if n, ok := t.pinned.get(offset); ok {
+		return n, false, nil
+	}
+	if !lazy || !t.footer.variableData || t.cache != nil {
+		n, err = t.Node(offset)
+		return n, false, err
+	}
+	data := make([]byte, t.nodelen)
+	_, err = t.r.ReadAt(data, offset)
+	if err != nil {
+		return Node{}, false, err
+	}
+	return t.parseNodeShape(offset, data)
+}
+
+// resolveData reads the Data of the neighbors in h that nodeShape left
+// unread.
+func (t *Tree) resolveData(h maxHeap) (err error) {
+	for i := range h {
+		if !h[i].dataRef {
+			continue
+		}
+		h[i].Data, err = t.readData(h[i].offset, h[i].Data)
+		if err != nil {
+			return err
+		}
+		h[i].dataRef = false
+	}
+	return nil
+}
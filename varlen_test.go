@@ -0,0 +1,335 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestVariableData(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 2, 1)
+	for i := range points {
+		// mostly short Data, with the occasional long one
+		n := rand.Intn(8)
+		if i%50 == 0 {
+			n = 4096
+		}
+		points[i].Data = make([]byte, n)
+		rand.Read(points[i].Data)
+	}
+	padded := createTestTree(t, fs, 2, 4096, points, BuildOptions{})
+	defer padded.Close()
+	tree := createTestTree(t, fs, 2, 4096, points,
+		BuildOptions{VariableData: true, Layout: CacheObliviousLayout})
+	defer tree.Close()
+
+	paddedInfo, err := os.Stat(padded.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size()*10 > paddedInfo.Size() {
+		t.Fatalf("unpadded tree is %d bytes, padded tree is %d", info.Size(),
+			paddedInfo.Size())
+	}
+
+	check := func(tr *Tree) {
+		for _, p := range points {
+			nearest, err := tr.Nearest(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			AssertPointsEqual(nearest[0].Point, p)
+		}
+		expected, err := padded.ContentHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := tr.ContentHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != expected {
+			t.Fatal("unpadded tree holds different points")
+		}
+	}
+	check(tree)
+
+	var copy bytes.Buffer
+	_, err = tree.WriteTo(&copy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(copy.Len()) != info.Size() {
+		t.Fatalf("copy is %d bytes, expected %d", copy.Len(), info.Size())
+	}
+
+	_, err = Shrink(&bytes.Buffer{}, tree)
+	if err == nil {
+		t.Fatal("expected Shrink to refuse an unpadded tree")
+	}
+
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	err = rw.Delete(points[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.Compact(fs.Temp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rw.footer.variableData {
+		t.Fatal("compaction padded the tree")
+	}
+	nearest, err := rw.Nearest(points[1], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertPointsEqual(nearest[0].Point, points[1])
+}
+
+// dataReadCounter counts reads of a tree file past the nodes.
+type dataReadCounter struct {
+	r     io.ReaderAt
+	nodes int64
+	reads int
+}
+
+func (c *dataReadCounter) ReadAt(p []byte, off int64) (int, error) {
+	if off >= c.nodes {
+		c.reads++
+	}
+	return c.r.ReadAt(p, off)
+}
+
+func TestLazyData(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 100)
+	tree := createTestTree(t, fs, 3, 100, points,
+		BuildOptions{VariableData: true})
+	defer tree.Close()
+	counter := &dataReadCounter{r: tree.r, nodes: tree.count * tree.nodelen}
+	tree.r = counter
+
+	for _, p := range points[:50] {
+		counter.reads = 0
+		nearest, err := tree.Nearest(p, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+		if counter.reads != 3 {
+			t.Fatalf("read %d Data, expected 3", counter.reads)
+		}
+	}
+
+	var expected int64
+	for _, p := range points {
+		if p.distanceSquared(&points[0]) <= 0.25 {
+			expected++
+		}
+	}
+	counter.reads = 0
+	count, err := tree.CountWithin(points[0], 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != expected || counter.reads != 0 {
+		t.Fatalf("counted %d points, expected %d, reading %d Data", count,
+			expected, counter.reads)
+	}
+}
+
+func TestNearestLazy(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 3, 100)
+	tree := createTestTree(t, fs, 3, 100, points,
+		BuildOptions{VariableData: true})
+	defer tree.Close()
+	counter := &dataReadCounter{r: tree.r, nodes: tree.count * tree.nodelen}
+	tree.r = counter
+
+	for _, p := range points[:50] {
+		nearest, err := tree.Nearest(p, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counter.reads = 0
+		lazy, err := tree.NearestLazy(p, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counter.reads != 0 {
+			t.Fatalf("read %d Data before any was asked for", counter.reads)
+		}
+		if len(lazy) != len(nearest) {
+			t.Fatalf("expected %d results, got %d", len(nearest), len(lazy))
+		}
+		for i, r := range lazy {
+			if r.Distance != nearest[i].Distance || r.ID != nearest[i].ID {
+				t.Fatalf("result %d differs from Nearest", i)
+			}
+		}
+		got, err := lazy[0].Point()
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(got, nearest[0].Point)
+		_, err = lazy[0].Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counter.reads != 1 {
+			t.Fatalf("read %d Data for one result", counter.reads)
+		}
+	}
+
+	// exact duplicates differing only by Data must still be ordered by it
+	dups := newTestPoints(100, 3, 10)
+	for i := 0; i < 4; i++ {
+		dup := dups[0]
+		dup.Data = []byte{byte(4 - i)}
+		dups = append(dups, dup)
+	}
+	dupTree := createTestTree(t, fs, 3, 10, dups,
+		BuildOptions{VariableData: true})
+	defer dupTree.Close()
+	nearest, err := dupTree.Nearest(dups[0], 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lazy, err := dupTree.NearestLazy(dups[0], 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range lazy {
+		got, err := r.Point()
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(got, nearest[i].Point)
+	}
+}
+
+func TestDataCompression(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(300, 2, 1)
+	for i := range points {
+		points[i].Data = bytes.Repeat([]byte{'{', '"', 'a', '"', '}'},
+			rand.Intn(200))
+	}
+	plain := createTestTree(t, fs, 2, 1000, points,
+		BuildOptions{VariableData: true})
+	defer plain.Close()
+	tree := createTestTree(t, fs, 2, 1000, points,
+		BuildOptions{DataCompression: FlateCompression})
+	defer tree.Close()
+
+	if tree.footer.dataLen*5 > plain.footer.dataLen {
+		t.Fatalf("compressed data is %d bytes, uncompressed is %d",
+			tree.footer.dataLen, plain.footer.dataLen)
+	}
+	for _, p := range points {
+		nearest, err := tree.Nearest(p, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertPointsEqual(nearest[0].Point, p)
+	}
+	if tree.footer.buildOptions().DataCompression != FlateCompression {
+		t.Fatal("compression not recorded")
+	}
+
+	set, err := NewPointSet(fs.Temp(), 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateTreeWithOptions(fs.Path("bad"), fs.Temp(), set,
+		BuildOptions{DataCompression: 99})
+	if err == nil {
+		t.Fatal("expected an error for unknown compression")
+	}
+}
+
+func TestFloat32(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 4, 10)
+	wide := createTestTree(t, fs, 4, 10, points, BuildOptions{})
+	defer wide.Close()
+	for _, opts := range []BuildOptions{
+		{Float32: true},
+		{Float32: true, VariableData: true, Checksums: true}} {
+		tree := createTestTree(t, fs, 4, 10, points, opts)
+		if !opts.VariableData && tree.nodelen != wide.nodelen-4*float32Size {
+			t.Fatalf("expected nodes of %d bytes, got %d",
+				wide.nodelen-4*float32Size, tree.nodelen)
+		}
+		for _, p := range points {
+			nearest, err := tree.Nearest(p, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := nearest[0].Point
+			if !bytes.Equal(got.Data, p.Data) {
+				t.Fatal("wrong point found")
+			}
+			for i, v := range p.Pos {
+				if got.Pos[i] != float64(float32(v)) {
+					t.Fatalf("expected %v rounded, got %v", v, got.Pos[i])
+				}
+			}
+		}
+		tree.Close()
+
+		rw, err := OpenRW(tree.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rw.Delete(points[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rw.Compact(fs.Temp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rw.Count() != int64(len(points)-1) || !rw.footer.float32 {
+			t.Fatal("compaction lost a point or the float32 option")
+		}
+		rw.Close()
+	}
+}
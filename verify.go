@@ -0,0 +1,118 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+// VerifyTree opens the tree file at path and checks it with Tree.Verify.
+func VerifyTree(path string) error {
+	t, err := OpenTree(path)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	return t.Verify()
+}
+
+// Verify reads the whole tree and checks its structure: that every node and
+// its Data parse and match their checksums, if the tree has them, that child
+// offsets are in range and every node is reachable from the root exactly
+// once, that every point is on the correct side of each of its ancestors'
+// splits and within the tree's bounds, and that subtree counts match the
+// points that aren't deleted. Problems are reported with ErrCorrupt.
+func (t *Tree) Verify() error {
+	limit := t.count * t.nodelen
+	valid := func(child int64) bool {
+		return child == -1 || (child >= 0 && child < limit && child%t.nodelen == 0)
+	}
+	if t.count > 0 && (t.root == -1 || !valid(t.root)) ||
+		t.count == 0 && t.root != -1 {
+		return ErrCorrupt.New("root %d out of range", t.root)
+	}
+	err := t.scan(func(offset int64, n Node) error {
+		if !valid(n.Left) || !valid(n.Right) {
+			return ErrCorrupt.New("node at %d has children out of range", offset)
+		}
+		if int(n.Dim) >= t.footer.dims {
+			return ErrCorrupt.New("node at %d splits on dimension %d", offset,
+				n.Dim)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if t.root == -1 {
+		return nil
+	}
+
+	seen := make([]bool, t.count)
+	lo := append([]float64(nil), t.footer.min...)
+	hi := append([]float64(nil), t.footer.max...)
+	var reached int64
+	var walk func(offset int64) (count int64, err error)
+	walk = func(offset int64) (count int64, err error) {
+		if offset == -1 {
+			return 0, nil
+		}
+		if seen[offset/t.nodelen] {
+			return 0, ErrCorrupt.New("node at %d reached twice", offset)
+		}
+		seen[offset/t.nodelen] = true
+		reached++
+		n, err := t.Node(offset)
+		if err != nil {
+			return 0, err
+		}
+		for i, v := range n.Point.Pos {
+			if v < lo[i] || v > hi[i] {
+				return 0, ErrCorrupt.New("node at %d is out of place", offset)
+			}
+		}
+
+		split := n.Point.Pos[n.Dim]
+		saved := hi[n.Dim]
+		hi[n.Dim] = split
+		left, err := walk(n.Left)
+		hi[n.Dim] = saved
+		if err != nil {
+			return 0, err
+		}
+		saved = lo[n.Dim]
+		lo[n.Dim] = split
+		right, err := walk(n.Right)
+		lo[n.Dim] = saved
+		if err != nil {
+			return 0, err
+		}
+
+		count = left + right
+		if !n.Deleted {
+			count++
+		}
+		if n.Count != count {
+			return 0, ErrCorrupt.New("node at %d counts %d points, found %d",
+				offset, n.Count, count)
+		}
+		return count, nil
+	}
+	_, err = walk(t.root)
+	if err != nil {
+		return err
+	}
+	if reached != t.count {
+		return ErrCorrupt.New("%d of %d nodes are unreachable",
+			t.count-reached, t.count)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestVerifyTree(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(300, 3, 10)
+	for _, opts := range []BuildOptions{
+		{},
+		{Layout: CacheObliviousLayout, Checksums: true},
+		{VariableData: true, Float32: true},
+	} {
+		tree := createTestTree(t, fs, 3, 10, points, opts)
+		err := tree.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.Close()
+	}
+
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	tree.Close()
+	rw, err := OpenRW(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points[:30] {
+		err = rw.Delete(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rw.Close()
+	err = VerifyTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := os.ReadFile(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err = OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := tree.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodelen := tree.nodelen
+	rootOffset := tree.root
+	tree.Close()
+
+	corrupt := func(name string, offset int64, value uint64) {
+		data := append([]byte(nil), original...)
+		binary.LittleEndian.PutUint64(data[offset:], value)
+		path := fs.Path(name)
+		err := os.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = VerifyTree(path)
+		if !ErrCorrupt.Contains(err) {
+			t.Fatalf("%s: expected corruption, got %v", name, err)
+		}
+	}
+	// the last three int64s of a node before its dimension are its left and
+	// right children and count
+	fields := rootOffset + nodelen - uint32Size - 3*uint64Size
+	corrupt("child-range", fields, uint64(nodelen*int64(len(points))))
+	corrupt("child-cycle", fields, uint64(rootOffset))
+	corrupt("children-swapped", fields, uint64(root.Right))
+	corrupt("count", fields+2*uint64Size, uint64(root.Count+1))
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"sort"
+)
+
+// warmChunk is how much of the file Warm reads at a time when reading all of
+// it.
+const warmChunk = 1 << 20
+
+// Warm reads the top levels of the tree, breadth first from the root, so
+// that the queries that follow find them in memory rather than on disk: in
+// the node cache if OpenOptions.CacheBytes is set, and in the operating
+// system's page cache either way. Each level is read in file order. If
+// levels is negative, Warm instead reads the whole file from start to end,
+// which warms the page cache alone, but as fast as the disk reads. Warm is
+// safe to run in the background alongside queries, and stops and returns
+// ctx's error if ctx is canceled.
+func (t *Tree) Warm(ctx context.Context, levels int) error {
+	if levels < 0 {
+		return t.warmFile(ctx)
+	}
+	level := []int64{t.root}
+	for i := 0; i < levels && len(level) > 0; i++ {
+		sort.Slice(level, func(i, j int) bool { return level[i] < level[j] })
+		var next []int64
+		for _, offset := range level {
+			if offset == -1 {
+				continue
+			}
+			err := ctx.Err()
+			if err != nil {
+				return err
+			}
+			n, err := t.Node(offset)
+			if err != nil {
+				return err
+			}
+			next = append(next, n.Left, n.Right)
+		}
+		level = next
+	}
+	return nil
+}
+
+// warmFile reads the tree file from start to end.
+func (t *Tree) warmFile(ctx context.Context) error {
+	end := t.tagsOffset() + t.footer.tagsLen()
+	buf := make([]byte, warmChunk)
+	for offset := int64(0); offset < end; offset += warmChunk {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		chunk := buf
+		if end-offset < warmChunk {
+			chunk = buf[:end-offset]
+		}
+		_, err = t.r.ReadAt(chunk, offset)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,519 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// rangeQuery describes a search for every point within some distance of p.
+type rangeQuery struct {
+	p Point
+	// distance measures how far a point is from p.
+	distance func(*Point) float64
+	// axisBound is a lower bound on the distance of any point on the other
+	// side of a split on dimension dim, delta away from p.
+	axisBound func(dim uint32, delta float64) float64
+	// bound is the largest distance of interest. It may shrink as the search
+	// progresses.
+	bound func() float64
+}
+
+// euclideanQuery is a rangeQuery for squared Euclidean distances of at most
+// bound() from p.
+func euclideanQuery(p Point, bound func() float64) rangeQuery {
+	return rangeQuery{
+		p:        p,
+		distance: p.distanceSquared,
+		axisBound: func(dim uint32, delta float64) float64 {
+			return delta * delta
+		},
+		bound: bound}
+}
+
+// within calls fn with every undeleted point within range of q, along with
+// the point's node offset.
+func (t *Tree) within(q rangeQuery,
+	fn func(offset int64, n *Node, dist float64) error) error {
+	err := t.withinNode(t.root, &q, fn)
+	if err != nil {
+		return err
+	}
+	for i, p := range t.pending.snapshot() {
+		dist := q.distance(&p)
+		if dist <= q.bound() {
+			err = fn(pendingOffset(i), &Node{Point: p}, dist)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Tree) withinNode(offset int64, q *rangeQuery,
+	fn func(offset int64, n *Node, dist float64) error) error {
+	if offset == -1 {
+		return nil
+	}
+	n, err := t.Node(offset)
+	if err != nil {
+		return err
+	}
+	if !n.Deleted {
+		dist := q.distance(&n.Point)
+		if dist <= q.bound() {
+			err = fn(offset, &n, dist)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	c := q.p.Pos[n.Dim] - n.Point.Pos[n.Dim]
+	near, far := n.Left, n.Right
+	if c > 0 {
+		near, far = far, near
+	}
+	err = t.withinNode(near, q, fn)
+	if err != nil {
+		return err
+	}
+	if q.axisBound(n.Dim, c) <= q.bound() {
+		return t.withinNode(far, q, fn)
+	}
+	return nil
+}
+
+// Within returns every point within radius of p, in no particular order.
+// radius is a plain Euclidean distance, not squared, and includes points
+// exactly radius away.
+func (t *Tree) Within(p Point, radius float64) ([]Point, error) {
+	var rv []Point
+	budget := t.newBudget()
+	err := t.WithinFunc(p, radius, func(p Point) error {
+		rv = append(rv, p)
+		return budget.charge(resultBytes(&p))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// WithinFunc calls fn with every point within radius of p, in no particular
+// order. It stops at and returns the first error fn returns.
+func (t *Tree) WithinFunc(p Point, radius float64, fn func(Point) error) error {
+	return t.WithinDistanceFunc(p, radius, func(pd PointDistance) error {
+		return fn(pd.Point)
+	})
+}
+
+// WithinDistances is Within, but returns each point's squared distance from
+// p along with it.
+func (t *Tree) WithinDistances(p Point, radius float64) ([]PointDistance,
+	error) {
+	var rv []PointDistance
+	budget := t.newBudget()
+	err := t.WithinDistanceFunc(p, radius, func(pd PointDistance) error {
+		rv = append(rv, pd)
+		return budget.charge(resultBytes(&pd.Point))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// WithinDistanceFunc is WithinFunc, but calls fn with each point's squared
+// distance from p along with it.
+func (t *Tree) WithinDistanceFunc(p Point, radius float64,
+	fn func(PointDistance) error) error {
+	err := t.checkRange(p, radius)
+	if err != nil {
+		return err
+	}
+	radius2 := radius * radius
+	b := t.bounds()
+	err = t.withinBox(t.root, p, radius2, &b,
+		func(offset int64, n *Node) error {
+			return fn(PointDistance{Point: n.Point,
+				Distance: p.distanceSquared(&n.Point), ID: t.pointID(offset)})
+		})
+	if err != nil {
+		return err
+	}
+	for i, pending := range t.pending.snapshot() {
+		dist := p.distanceSquared(&pending)
+		if dist <= radius2 {
+			err = fn(PointDistance{Point: pending, Distance: dist,
+				ID: t.pointID(pendingOffset(i))})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CountWithin returns the number of points within radius of p. Subtrees
+// entirely within range are counted from their stored subtree counts
+// without being descended into.
+func (t *Tree) CountWithin(p Point, radius float64) (count int64, err error) {
+	err = t.checkRange(p, radius)
+	if err != nil {
+		return 0, err
+	}
+	radius2 := radius * radius
+	b := t.bounds()
+	count, err = t.countBox(t.root, p, radius2, &b)
+	if err != nil {
+		return 0, err
+	}
+	for _, pending := range t.pending.snapshot() {
+		if p.distanceSquared(&pending) <= radius2 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// checkRange validates the arguments of a radius query.
+func (t *Tree) checkRange(p Point, radius float64) error {
+	if !(radius >= 0) {
+		return errClass.New("invalid radius %v", radius)
+	}
+	return t.checkDims(p)
+}
+
+// box is an axis-aligned bounding box.
+type box struct {
+	min, max []float64
+}
+
+// bounds returns a box around every point in the tree.
+func (t *Tree) bounds() box {
+	return box{
+		min: append([]float64(nil), t.footer.min...),
+		max: append([]float64(nil), t.footer.max...)}
+}
+
+// minDistance returns the squared distance from p to the closest point in b.
+func (b *box) minDistance(p *Point) (sum float64) {
+	for i, v := range p.Pos {
+		var delta float64
+		if v < b.min[i] {
+			delta = b.min[i] - v
+		} else if v > b.max[i] {
+			delta = v - b.max[i]
+		}
+		sum += delta * delta
+	}
+	return sum
+}
+
+// maxDistance returns the squared distance from p to the furthest point in
+// b.
+func (b *box) maxDistance(p *Point) (sum float64) {
+	for i, v := range p.Pos {
+		delta := math.Max(math.Abs(v-b.min[i]), math.Abs(v-b.max[i]))
+		sum += delta * delta
+	}
+	return sum
+}
+
+// withinBox calls fn with every undeleted point in the subtree at offset
+// within squared distance radius2 of p, where b bounds the subtree. Subtrees
+// entirely within range are emitted without testing each point. b is
+// narrowed in place while descending and restored before returning.
+func (t *Tree) withinBox(offset int64, p Point, radius2 float64, b *box,
+	fn func(offset int64, n *Node) error) error {
+	if offset == -1 {
+		return nil
+	}
+	restore, err := t.tightenBox(offset, b)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	if b.minDistance(&p) > radius2 {
+		return nil
+	}
+	if b.maxDistance(&p) <= radius2 {
+		return t.walk(offset, fn)
+	}
+	n, err := t.Node(offset)
+	if err != nil {
+		return err
+	}
+	if !n.Deleted && p.distanceSquared(&n.Point) <= radius2 {
+		err = fn(offset, &n)
+		if err != nil {
+			return err
+		}
+	}
+	split := n.Point.Pos[n.Dim]
+	oldMax := b.max[n.Dim]
+	b.max[n.Dim] = split
+	err = t.withinBox(n.Left, p, radius2, b, fn)
+	b.max[n.Dim] = oldMax
+	if err != nil {
+		return err
+	}
+	oldMin := b.min[n.Dim]
+	b.min[n.Dim] = split
+	err = t.withinBox(n.Right, p, radius2, b, fn)
+	b.min[n.Dim] = oldMin
+	return err
+}
+
+// countBox is withinBox, but counts points instead of visiting them.
+func (t *Tree) countBox(offset int64, p Point, radius2 float64, b *box) (
+	count int64, err error) {
+	if offset == -1 {
+		return 0, nil
+	}
+	restore, err := t.tightenBox(offset, b)
+	if err != nil {
+		return 0, err
+	}
+	defer restore()
+	if b.minDistance(&p) > radius2 {
+		return 0, nil
+	}
+	n, _, err := t.nodeShape(offset, true)
+	if err != nil {
+		return 0, err
+	}
+	if b.maxDistance(&p) <= radius2 {
+		return n.Count, nil
+	}
+	if !n.Deleted && p.distanceSquared(&n.Point) <= radius2 {
+		count++
+	}
+	split := n.Point.Pos[n.Dim]
+	oldMax := b.max[n.Dim]
+	b.max[n.Dim] = split
+	left, err := t.countBox(n.Left, p, radius2, b)
+	b.max[n.Dim] = oldMax
+	if err != nil {
+		return 0, err
+	}
+	oldMin := b.min[n.Dim]
+	b.min[n.Dim] = split
+	right, err := t.countBox(n.Right, p, radius2, b)
+	b.min[n.Dim] = oldMin
+	return count + left + right, err
+}
+
+// walk calls fn with every undeleted point in the subtree at offset.
+func (t *Tree) walk(offset int64, fn func(offset int64, n *Node) error) error {
+	if offset == -1 {
+		return nil
+	}
+	n, err := t.Node(offset)
+	if err != nil {
+		return err
+	}
+	if !n.Deleted {
+		err = fn(offset, &n)
+		if err != nil {
+			return err
+		}
+	}
+	err = t.walk(n.Left, fn)
+	if err != nil {
+		return err
+	}
+	return t.walk(n.Right, fn)
+}
+
+// Cursor marks a position in the results of WithinPage. The zero Cursor
+// starts at the beginning.
+type Cursor struct {
+	distance float64
+	offset   int64
+	started  bool
+	done     bool
+}
+
+// Done reports whether there are no more results after the cursor.
+func (c Cursor) Done() bool { return c.done }
+
+func (c Cursor) before(distance float64, offset int64) bool {
+	if !c.started {
+		return true
+	}
+	if c.distance != distance {
+		return c.distance < distance
+	}
+	return c.offset < offset
+}
+
+// MarshalBinary encodes the cursor so it can be handed to clients.
+func (c Cursor) MarshalBinary() ([]byte, error) {
+	var buf [1 + float64Size + uint64Size]byte
+	if c.started {
+		buf[0] |= 1
+	}
+	if c.done {
+		buf[0] |= 2
+	}
+	binary.LittleEndian.PutUint64(buf[1:], math.Float64bits(c.distance))
+	binary.LittleEndian.PutUint64(buf[1+float64Size:], uint64(c.offset))
+	return buf[:], nil
+}
+
+func (c *Cursor) UnmarshalBinary(data []byte) error {
+	if len(data) != 1+float64Size+uint64Size {
+		return errClass.New("invalid cursor")
+	}
+	c.started = data[0]&1 != 0
+	c.done = data[0]&2 != 0
+	c.distance = math.Float64frombits(binary.LittleEndian.Uint64(data[1:]))
+	c.offset = int64(binary.LittleEndian.Uint64(data[1+float64Size:]))
+	return nil
+}
+
+// pageHeap keeps the first entries in (distance, offset) order, with the
+// last of them on top.
+type pageHeap []neighbor
+
+func (h *pageHeap) Len() int { return len(*h) }
+func (h *pageHeap) Less(i, j int) bool {
+	a, b := (*h)[i], (*h)[j]
+	if a.Distance != b.Distance {
+		return a.Distance > b.Distance
+	}
+	return a.offset > b.offset
+}
+func (h *pageHeap) Swap(i, j int)      { (*h)[i], (*h)[j] = (*h)[j], (*h)[i] }
+func (h *pageHeap) Push(x interface{}) { *h = append(*h, x.(neighbor)) }
+func (h *pageHeap) Pop() (i interface{}) {
+	i, *h = (*h)[len(*h)-1], (*h)[:len(*h)-1]
+	return i
+}
+
+// WithinPage returns up to limit of the points within radius of p, ordered
+// by distance and then by their position in the tree file, starting after
+// cursor. The returned Cursor resumes where this page left off, so long as
+// the tree isn't rebuilt in between. Points on earlier pages are skipped
+// without being copied. Distances are squared.
+func (t *Tree) WithinPage(p Point, radius float64, cursor Cursor,
+	limit int) ([]PointDistance, Cursor, error) {
+	if cursor.done || limit <= 0 {
+		return nil, cursor, nil
+	}
+	err := t.checkRange(p, radius)
+	if err == nil {
+		err = t.checkResults(int64(limit))
+	}
+	if err != nil {
+		return nil, cursor, err
+	}
+	radius2 := radius * radius
+	h := make(pageHeap, 0, limit)
+	bound := func() float64 {
+		if len(h) < limit {
+			return radius2
+		}
+		return h[0].Distance
+	}
+	err = t.within(euclideanQuery(p, bound), func(offset int64, n *Node,
+		dist float64) error {
+		if !cursor.before(dist, offset) {
+			return nil
+		}
+		if len(h) == limit {
+			top := h[0]
+			if dist > top.Distance ||
+				(dist == top.Distance && offset > top.offset) {
+				return nil
+			}
+			heap.Pop(&h)
+		}
+		heap.Push(&h, neighbor{
+			PointDistance: PointDistance{Point: n.Point, Distance: dist,
+				ID: t.pointID(offset)},
+			offset: offset})
+		return nil
+	})
+	if err != nil {
+		return nil, cursor, err
+	}
+
+	sort.Sort(sort.Reverse(&h))
+	rv := make([]PointDistance, 0, len(h))
+	for _, entry := range h {
+		rv = append(rv, entry.PointDistance)
+	}
+	next := Cursor{done: len(h) < limit}
+	if len(h) > 0 {
+		last := h[len(h)-1]
+		next.started = true
+		next.distance = last.Distance
+		next.offset = last.offset
+	} else {
+		next = cursor
+		next.done = true
+	}
+	return rv, next, nil
+}
+
+// WithinEllipsoid returns every point inside the axis-aligned ellipsoid
+// centered on p with the given radius along each dimension, that is, every
+// point a where the sum of ((a[i] - p[i]) / radii[i])^2 is at most 1. Results
+// are ordered by that sum, which is returned as their Distance.
+func (t *Tree) WithinEllipsoid(p Point, radii []float64) (
+	[]PointDistance, error) {
+	if len(p.Pos) != t.footer.dims || len(radii) != t.footer.dims {
+		return nil, ErrDimensionMismatch.New(
+			"point and radii must have %d dimensions",
+			t.footer.dims)
+	}
+	for _, r := range radii {
+		if !(r > 0) {
+			return nil, errClass.New("radii must be positive")
+		}
+	}
+	q := rangeQuery{
+		p: p,
+		distance: func(a *Point) (sum float64) {
+			for i, v := range a.Pos {
+				delta := (v - p.Pos[i]) / radii[i]
+				sum += delta * delta
+			}
+			return sum
+		},
+		axisBound: func(dim uint32, delta float64) float64 {
+			delta /= radii[dim]
+			return delta * delta
+		},
+		bound: func() float64 { return 1 }}
+	var rv []PointDistance
+	budget := t.newBudget()
+	err := t.within(q, func(offset int64, n *Node, dist float64) error {
+		rv = append(rv, PointDistance{Point: n.Point, Distance: dist,
+			ID: t.pointID(offset)})
+		return budget.charge(resultBytes(&n.Point))
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortResults(rv)
+	return rv, nil
+}
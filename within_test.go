@@ -0,0 +1,248 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestWithinPage(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(500, 2, 10)
+	// add exact duplicates so the tie-break matters
+	points = append(points, points[:50]...)
+	tree := createTestTree(t, fs, 2, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	q := Point{Pos: []float64{0.5, 0.5}}
+	radius := 0.3
+	expected := 0
+	for _, p := range points {
+		if q.distanceSquared(&p) <= radius*radius {
+			expected++
+		}
+	}
+
+	seen := map[string]int{}
+	var cursor Cursor
+	last := float64(0)
+	total := 0
+	for !cursor.Done() {
+		page, next, err := tree.WithinPage(q, radius, cursor, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 7 {
+			t.Fatalf("page too large: %d", len(page))
+		}
+		for _, pd := range page {
+			if pd.Distance < last {
+				t.Fatal("results out of order")
+			}
+			last = pd.Distance
+			seen[fmt.Sprint(pd.Point)]++
+			total++
+		}
+
+		data, err := next.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor = Cursor{}
+		err = cursor.UnmarshalBinary(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if total != expected {
+		t.Fatalf("paged through %d points, expected %d", total, expected)
+	}
+	for _, p := range points {
+		if q.distanceSquared(&p) > radius*radius {
+			continue
+		}
+		copies := 1
+		for _, other := range points[:50] {
+			if p.equal(&other) {
+				copies = 2
+			}
+		}
+		if seen[fmt.Sprint(p)] != copies {
+			t.Fatalf("point seen %d times, expected %d", seen[fmt.Sprint(p)],
+				copies)
+		}
+	}
+}
+
+func TestWithinEllipsoid(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	_, err := tree.WithinEllipsoid(Point{Pos: []float64{0, 0, 0}},
+		[]float64{1, 0, 1})
+	if err == nil {
+		t.Fatal("expected error for a zero radius")
+	}
+	_, err = tree.WithinEllipsoid(Point{Pos: []float64{0, 0, 0}},
+		[]float64{1, 1})
+	if err == nil {
+		t.Fatal("expected error for missing radii")
+	}
+
+	for i := 0; i < 10; i++ {
+		q := NewPoint(3, 10)
+		radii := []float64{0.05, 0.4, 0.2}
+		inside := map[string]bool{}
+		for _, p := range points {
+			sum := float64(0)
+			for j := range p.Pos {
+				d := (p.Pos[j] - q.Pos[j]) / radii[j]
+				sum += d * d
+			}
+			if sum <= 1 {
+				inside[fmt.Sprint(p)] = true
+			}
+		}
+		found, err := tree.WithinEllipsoid(q, radii)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != len(inside) {
+			t.Fatalf("found %d points, expected %d", len(found), len(inside))
+		}
+		for j, pd := range found {
+			if !inside[fmt.Sprint(pd.Point)] {
+				t.Fatal("found a point outside the ellipsoid")
+			}
+			if j > 0 && pd.Distance < found[j-1].Distance {
+				t.Fatal("results out of order")
+			}
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(1000, 3, 10)
+	tree := createTestTree(t, fs, 3, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	for _, radius := range []float64{0, 0.05, 0.2, 0.5, 1, 2} {
+		for i := 0; i < 10; i++ {
+			q := NewPoint(3, 10)
+			expected := map[string]bool{}
+			for _, p := range points {
+				if q.distanceSquared(&p) <= radius*radius {
+					expected[fmt.Sprint(p)] = true
+				}
+			}
+
+			within, err := tree.Within(q, radius)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(within) != len(expected) {
+				t.Fatalf("radius %v: got %d points, expected %d", radius,
+					len(within), len(expected))
+			}
+			for _, p := range within {
+				if !expected[fmt.Sprint(p)] {
+					t.Fatalf("radius %v: unexpected point", radius)
+				}
+			}
+
+			count, err := tree.CountWithin(q, radius)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != int64(len(expected)) {
+				t.Fatalf("radius %v: counted %d points, expected %d", radius,
+					count, len(expected))
+			}
+
+			distances, err := tree.WithinDistances(q, radius)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(distances) != len(expected) {
+				t.Fatalf("radius %v: got %d distances, expected %d", radius,
+					len(distances), len(expected))
+			}
+			for _, pd := range distances {
+				if pd.Distance != q.distanceSquared(&pd.Point) ||
+					pd.Dist() > radius {
+					t.Fatalf("radius %v: wrong distance %v", radius, pd.Distance)
+				}
+			}
+		}
+	}
+}
+
+func TestWithinRadius(t *testing.T) {
+	fs := newTestFS(t)
+	defer fs.Delete()
+
+	points := newTestPoints(100, 2, 10)
+	tree := createTestTree(t, fs, 2, 10, points, BuildOptions{})
+	defer tree.Close()
+
+	within, err := tree.Within(points[0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(within) != 1 || !within[0].equal(&points[0]) {
+		t.Fatal("expected a zero radius to find exactly the point itself")
+	}
+
+	var streamed int
+	err = tree.WithinFunc(points[0], 0.25, func(p Point) error {
+		if points[0].distanceSquared(&p) > 0.25*0.25 {
+			t.Fatal("point out of range")
+		}
+		streamed++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := tree.CountWithin(points[0], 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(streamed) != count {
+		t.Fatalf("streamed %d points, counted %d", streamed, count)
+	}
+
+	for _, radius := range []float64{-1, math.NaN()} {
+		_, err = tree.Within(points[0], radius)
+		if err == nil {
+			t.Fatalf("expected radius %v to be rejected", radius)
+		}
+		_, _, err = tree.WithinPage(points[0], radius, Cursor{}, 10)
+		if err == nil {
+			t.Fatalf("expected radius %v to be rejected", radius)
+		}
+	}
+}